@@ -5,16 +5,10 @@
 package main
 
 import (
-	"code.google.com/p/go.crypto/bcrypt"
-	"crypto/sha256"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
-	"strconv"
-	"strings"
 	"time"
 )
 
@@ -23,6 +17,21 @@ type SessionInfo struct {
 	Uid         string
 	AccessToken string
 	Expire      string
+
+	Origin       string
+	Client       string
+	Created      string
+	LastSeen     string
+	Impersonator string
+
+	Admin   bool
+	Current bool
+	TTL     int64
+}
+
+type SessionInfoList struct {
+	Id    int64
+	Entry []SessionInfo
 }
 
 type UserInfo struct {
@@ -34,6 +43,8 @@ type UserInfo struct {
 	Status     string
 	Registered string
 	FirstLogin string
+	Verified   string
+	Locale     string
 
 	RegDate int64
 	Idx     int64
@@ -41,17 +52,35 @@ type UserInfo struct {
 }
 
 type UserInfoList struct {
+	Id     int64
+	Entry  []UserInfo
+	Cursor string
+}
+
+type UserData struct {
+	Profile  UserInfo
+	Roles    []string
+	Sessions []SessionInfo
+	ApiKeys  []ApiKeyInfo
+	Activity []string
+	Login    []string
+
+	ErrNo int
+}
+
+type UserDataList struct {
 	Id    int64
-	Entry []UserInfo
+	Entry []UserData
 }
 
-func resolveUser(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqResolveUser++
+func resolveUser(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqResolveUser)
 
 	var m *NameList
 
 	if m, err = getNameList(d.Data, d.Command); err != nil {
-		stat.ReqErrResolveUser++
+		incStat(&stat.ReqErrResolveUser)
 		return
 	}
 
@@ -60,7 +89,7 @@ func resolveUser(w http.ResponseWriter, d *RequestMsg) (err error) {
 	for i := range m.Entry {
 		e := m.Entry[i]
 
-		if uid, err := getRedisUserIdFromLogin(e.Name); err != nil {
+		if uid, err := users.GetUserIdFromLogin(e.Name); err != nil {
 			event(logwarn, li, err.Error())
 			si[i] = Id{ErrNo: ENOENT, Opt: e.Name}
 		} else {
@@ -69,17 +98,18 @@ func resolveUser(w http.ResponseWriter, d *RequestMsg) (err error) {
 	}
 
 	buf, _ := json.Marshal(&IdList{Entry: si})
-	sendResponse(w, &Msg{Data: string(buf)})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
-func resolveUserId(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqResolveUserId++
+func resolveUserId(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqResolveUserId)
 
 	var m *IdList
 
 	if m, err = getIdList(d.Data, d.Command); err != nil {
-		stat.ReqErrResolveUserId++
+		incStat(&stat.ReqErrResolveUserId)
 		return
 	}
 
@@ -88,7 +118,7 @@ func resolveUserId(w http.ResponseWriter, d *RequestMsg) (err error) {
 	for i := range m.Entry {
 		e := m.Entry[i]
 
-		if s, err := getRedisUserInfo(e.Id); err != nil {
+		if s, err := users.GetUserInfo(e.Id); err != nil {
 			event(logwarn, li, err.Error())
 			si[i] = Id{Id: e.Id, ErrNo: ENOENT}
 		} else {
@@ -97,17 +127,18 @@ func resolveUserId(w http.ResponseWriter, d *RequestMsg) (err error) {
 	}
 
 	buf, _ := json.Marshal(&IdList{Entry: si})
-	sendResponse(w, &Msg{Data: string(buf)})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
-func resetUserPw(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqResetUserPw++
+func resetUserPw(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqResetUserPw)
 
 	var m *IdList
 
 	if m, err = getIdList(d.Data, d.Command); err != nil {
-		stat.ReqErrResetUserPw++
+		incStat(&stat.ReqErrResetUserPw)
 		return
 	}
 
@@ -116,54 +147,30 @@ func resetUserPw(w http.ResponseWriter, d *RequestMsg) (err error) {
 	for i := range m.Entry {
 		e := m.Entry[i]
 
-		if s, err := getRedisUserInfo(e.Id); err != nil {
+		if s, err := users.GetUserInfo(e.Id); err != nil {
 			event(logwarn, li, err.Error())
-			si[i] = Id{ErrNo: ENOENT}
+			si[i] = Id{Id: e.Id, ErrNo: ENOENT}
+		} else if err = setUserResetToken(li, s, d.Origin,
+			true); err != nil {
+			event(logwarn, li, err.Error())
+			si[i] = Id{Id: e.Id, ErrNo: EINVAL}
 		} else {
-			pw := generateTempPassword()
-			h := sha256.New()
-			io.WriteString(h, pw)
-
-			tpw := base64.StdEncoding.EncodeToString(h.Sum(nil))
-
-			if err = setRedisUserAttr(s.Id, "password",
-				tpw, d.Origin); err != nil {
-				event(logwarn, li, err.Error())
-				si[i] = Id{ErrNo: EINVAL}
-			} else {
-				si[i] = Id{}
-
-				var rcpt = []string{s.Login}
-				var subj = "Rebung.IO User Password Reset"
-				var body = fmt.Sprintf("Greetings %v,\n\n"+
-					"Your Rebung.IO account password has "+
-					"been reset by the administrator.\n\n"+
-					"Your new password is: %v\n\n"+
-					"You may change your password in your "+
-					"user page.\n\n"+
-					"Regards,\nRebung.IO service robot",
-					s.Name, pw)
-
-				if err = sendMail(rcpt, subj, body,
-					false); err != nil {
-					event(logwarn, li, err.Error())
-				}
-			}
+			si[i] = Id{Id: e.Id}
 		}
 	}
 
 	buf, _ := json.Marshal(&IdList{Entry: si})
-	sendResponse(w, &Msg{Data: string(buf)})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
-func addUser(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqAddUser++
+func addUser(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqAddUser)
 
 	var m *NameList
 
 	if m, err = getNameList(d.Data, d.Command); err != nil {
-		stat.ReqErrAddUser++
+		incStat(&stat.ReqErrAddUser)
 		return
 	}
 
@@ -191,6 +198,13 @@ func addUser(w http.ResponseWriter, d *RequestMsg) (err error) {
 
 			name = e.Opt
 			c--
+		} else if field = e.Name; field == "locale" {
+			if _, ok := getMailTemplates()[e.Opt]; !ok {
+				err = errors.New(field)
+				break
+			}
+
+			s.Locale = e.Opt
 		} else {
 			err = errors.New(field)
 			break
@@ -198,12 +212,12 @@ func addUser(w http.ResponseWriter, d *RequestMsg) (err error) {
 	}
 
 	if err != nil {
-		stat.ReqErrAddUser++
+		incStat(&stat.ReqErrAddUser)
 		return errors.New("Invalid user parameter: " + field)
 	}
 
 	if c != 0 {
-		stat.ReqErrAddUser++
+		incStat(&stat.ReqErrAddUser)
 		return errors.New("Insufficient user parameters")
 	}
 
@@ -214,68 +228,43 @@ func addUser(w http.ResponseWriter, d *RequestMsg) (err error) {
 	var uid int64
 	var passwd string
 
-	if uid, passwd, err = setRedisUserNew(s, d.Origin); err != nil {
-		stat.ReqErrAddUser++
+	if uid, passwd, err = users.NewUser(li, s, d.Origin); err != nil {
+		incStat(&stat.ReqErrAddUser)
 		return
 	} else {
 		si[0] = Id{Id: uid, Opt: email}
 
-		var subj, body string
-		var rcpt []string
+		md := &MailData{Name: name, Login: email, Origin: d.Origin,
+			Time: time.Now().Format(time.RFC1123)}
 
-		var t = time.Now().Format(time.RFC1123)
-
-		rcpt = []string{app.AdminEmail}
-		subj = fmt.Sprintf("Rebung.IO new user registration: %v", name)
-		body = fmt.Sprintf("New user registration\n\n"+
-			"Registered on %v\n"+
-			"Registered from [%v]\n\n"+
-			"Login name: %v\n"+
-			"Name: %v", t, d.Origin, email, name)
-
-		if err = sendMail([]string{}, subj, body, true); err != nil {
+		if err = sendTemplateMail(li, []string{}, "user-registered",
+			app.MailLocale, md, true); err != nil {
 			event(logwarn, li, err.Error())
 		}
 
-		rcpt = []string{email}
-		subj = "Rebung.IO user registration information"
-		body = fmt.Sprintf("Greetings %v,\n\n"+
-			"Thank you for registering for a Rebung.IO "+
-			"account.\n\n"+
-			"You may now login into your account using the "+
-			"following information:\n\n"+
-			"Login name: %v\n"+
-			"Password: %v\n\n"+
-			"You may change your password in your user "+
-			"page.\n\n"+
-			"Be sure to read and understand our AUP.\n\n"+
-			"As a reminder, you will need to login into your "+
-			"account within 48 hours for activation or the "+
-			"account will be disabled.\n\n"+
-			"Regards,\nRebung.IO service robot", name, email, passwd)
-
-		if err = sendMail(rcpt, subj, body, false); err != nil {
+		if err = sendUserWelcome(li, uid, s, passwd); err != nil {
 			event(logwarn, li, err.Error())
 		}
 	}
 
 	buf, _ := json.Marshal(&IdList{Id: m.Id, Entry: si})
-	sendResponse(w, &Msg{Data: string(buf)})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
-func setUserAttr(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqSetUserAttr++
+func setUserAttr(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqSetUserAttr)
 
 	var m *NameList
 
 	if m, err = getNameList(d.Data, d.Command); err != nil {
-		stat.ReqErrSetUserAttr++
+		incStat(&stat.ReqErrSetUserAttr)
 		return
 	}
 
-	if err = checkRedisUserStatus(m.Id); err != nil {
-		stat.ReqErrSetUserAttr++
+	if err = users.CheckUserStatus(m.Id); err != nil {
+		incStat(&stat.ReqErrSetUserAttr)
 		return
 	}
 
@@ -284,20 +273,32 @@ func setUserAttr(w http.ResponseWriter, d *RequestMsg) (err error) {
 	for i := range m.Entry {
 		e := m.Entry[i]
 
+		// the whole request fails when the password breaks the policy
 		if e.Name == "password" {
-			var pw []byte
+			if err = checkUserTarget(d.UserId, m.Id); err != nil {
+				incStat(&stat.ReqErrSetUserAttr)
+				return
+			}
 
-			if pw, err = bcrypt.GenerateFromPassword([]byte(e.Opt),
-				10); err != nil {
-				stat.ReqErrSetUserAttr++
-				return errors.New("Error generating password")
+			if err = setUserPassword(li, m.Id, e.Opt,
+				d.Origin); err != nil {
+				incStat(&stat.ReqErrSetUserAttr)
+				return
 			}
 
-			e.Opt = string(pw)
+			si[i] = Name{Name: e.Name}
+			continue
 		}
 
-		if e.Name == "name" || e.Name == "password" {
-			if err = setRedisUserAttr(m.Id, e.Name,
+		if e.Name == "locale" {
+			if _, ok := getMailTemplates()[e.Opt]; !ok {
+				si[i] = Name{Name: e.Name, ErrNo: EINVAL}
+				continue
+			}
+		}
+
+		if e.Name == "name" || e.Name == "locale" {
+			if err = users.SetUserAttr(li, m.Id, e.Name,
 				e.Opt, d.Origin); err != nil {
 				event(logwarn, li, err.Error())
 				si[i] = Name{Name: e.Name, ErrNo: ENOENT}
@@ -305,23 +306,23 @@ func setUserAttr(w http.ResponseWriter, d *RequestMsg) (err error) {
 				si[i] = Name{Name: e.Name, Opt: e.Opt}
 			}
 		} else {
-			stat.ReqErrSetUserAttr++
+			incStat(&stat.ReqErrSetUserAttr)
 			return errors.New("Attribute not permitted: " + e.Name)
 		}
 	}
 
 	buf, _ := json.Marshal(&NameList{Id: m.Id, Entry: si})
-	sendResponse(w, &Msg{Data: string(buf)})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
-func enableUser(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqEnableUser++
+func enableUser(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqEnableUser)
 
 	var m *IdList
 
 	if m, err = getIdList(d.Data, d.Command); err != nil {
-		stat.ReqErrEnableUser++
+		incStat(&stat.ReqErrEnableUser)
 		return
 	}
 
@@ -330,7 +331,7 @@ func enableUser(w http.ResponseWriter, d *RequestMsg) (err error) {
 	for i := range m.Entry {
 		e := m.Entry[i]
 
-		if err = setRedisUserAdminStatus(e.Id, true,
+		if err = users.SetUserAdminStatus(li, e.Id, true,
 			d.Origin); err != nil {
 			event(logwarn, li, err.Error())
 			si[i] = Id{Id: e.Id, ErrNo: ENOENT}
@@ -340,17 +341,18 @@ func enableUser(w http.ResponseWriter, d *RequestMsg) (err error) {
 	}
 
 	buf, _ := json.Marshal(&IdList{Entry: si})
-	sendResponse(w, &Msg{Data: string(buf)})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
-func disableUser(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqDisableUser++
+func disableUser(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqDisableUser)
 
 	var m *IdList
 
 	if m, err = getIdList(d.Data, d.Command); err != nil {
-		stat.ReqErrDisableUser++
+		incStat(&stat.ReqErrDisableUser)
 		return
 	}
 
@@ -359,7 +361,7 @@ func disableUser(w http.ResponseWriter, d *RequestMsg) (err error) {
 	for i := range m.Entry {
 		e := m.Entry[i]
 
-		if err = setRedisUserAdminStatus(e.Id, false,
+		if err = users.SetUserAdminStatus(li, e.Id, false,
 			d.Origin); err != nil {
 			event(logwarn, li, err.Error())
 			si[i] = Id{Id: e.Id, ErrNo: ENOENT}
@@ -369,17 +371,18 @@ func disableUser(w http.ResponseWriter, d *RequestMsg) (err error) {
 	}
 
 	buf, _ := json.Marshal(&IdList{Entry: si})
-	sendResponse(w, &Msg{Data: string(buf)})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
-func activateUser(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqActivateUser++
+func activateUser(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqActivateUser)
 
 	var m *IdList
 
 	if m, err = getIdList(d.Data, d.Command); err != nil {
-		stat.ReqErrActivateUser++
+		incStat(&stat.ReqErrActivateUser)
 		return
 	}
 
@@ -388,7 +391,10 @@ func activateUser(w http.ResponseWriter, d *RequestMsg) (err error) {
 	for i := range m.Entry {
 		e := m.Entry[i]
 
-		if err = setRedisUserStatus(e.Id, true,
+		if err := checkUserTarget(d.UserId, e.Id); err != nil {
+			event(logwarn, li, err.Error())
+			si[i] = Id{Id: e.Id, ErrNo: EPERM}
+		} else if err = users.SetUserStatus(li, e.Id, true,
 			d.Origin); err != nil {
 			event(logwarn, li, err.Error())
 			si[i] = Id{Id: e.Id, ErrNo: ENOENT}
@@ -398,17 +404,18 @@ func activateUser(w http.ResponseWriter, d *RequestMsg) (err error) {
 	}
 
 	buf, _ := json.Marshal(&IdList{Entry: si})
-	sendResponse(w, &Msg{Data: string(buf)})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
-func deactivateUser(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqDeactivateUser++
+func deactivateUser(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqDeactivateUser)
 
 	var m *IdList
 
 	if m, err = getIdList(d.Data, d.Command); err != nil {
-		stat.ReqErrDeactivateUser++
+		incStat(&stat.ReqErrDeactivateUser)
 		return
 	}
 
@@ -417,7 +424,10 @@ func deactivateUser(w http.ResponseWriter, d *RequestMsg) (err error) {
 	for i := range m.Entry {
 		e := m.Entry[i]
 
-		if err = setRedisUserStatus(e.Id, false,
+		if err := checkUserTarget(d.UserId, e.Id); err != nil {
+			event(logwarn, li, err.Error())
+			si[i] = Id{Id: e.Id, ErrNo: EPERM}
+		} else if err = users.SetUserStatus(li, e.Id, false,
 			d.Origin); err != nil {
 			event(logwarn, li, err.Error())
 			si[i] = Id{Id: e.Id, ErrNo: ENOENT}
@@ -427,281 +437,354 @@ func deactivateUser(w http.ResponseWriter, d *RequestMsg) (err error) {
 	}
 
 	buf, _ := json.Marshal(&IdList{Entry: si})
-	sendResponse(w, &Msg{Data: string(buf)})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
-func listUser(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqListUser++
+func listUser(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqListUser)
 
 	var m *IdList
 
 	if m, err = getIdList(d.Data, d.Command); err != nil {
-		stat.ReqErrListUser++
+		incStat(&stat.ReqErrListUser)
 		return
 	}
 
 	var si []UserInfo
 	var uil *UserInfoList
 
+	// a 0 entry carries a UserQuery in its Opt
 	if m.Entry[0].Id == 0 {
-		args := strings.Split(m.Entry[0].Opt, ":")
+		var q *UserQuery
 
-		if c := len(args); c != 4 {
-			stat.ReqErrListUser++
-			return errors.New("Invalid server list parameter count")
+		if q, err = getUserQuery(m.Entry[0].Opt, map[string]bool{
+			"all": true, "enabled": true, "disabled": true, "active": true,
+			"inactive": true, "new": true, "admin": true}); err != nil {
+			incStat(&stat.ReqErrListUser)
+			return
 		}
 
-                list := args[0]
+		var next string
 
-		if list == "all" || list == "enabled" || list == "disabled" ||
-			list == "active" || list == "inactive" ||
-			list == "new" || list == "admin" {
-		} else {
-			stat.ReqErrListUser++
-			return errors.New("Invalid server list: " + list)
+		if si, next, err = queryUsers(li, q); err != nil {
+			incStat(&stat.ReqErrListUser)
+			return
 		}
 
-                page, _ := strconv.ParseInt(args[1], 0, 32)
-                npage, _ := strconv.ParseInt(args[2], 0, 32)
-
-		if page == 0 || npage < 10 {
-			stat.ReqErrListUser++
-			return errors.New("Invalid list page count")
-		}
+		uil = &UserInfoList{Id: int64(len(si)), Entry: si, Cursor: next}
+	} else {
+		si = make([]UserInfo, len(m.Entry))
 
-		// init sort closures
-		var sfn UserSortBy
+		for i := range m.Entry {
+			e := m.Entry[i]
 
-                if sby := args[3]; sby == "id" {
-			sfn = func(s1, s2 *UserInfo) bool {
-				return s1.Id < s2.Id
-			}
-		} else if sby == "id-r" {
-			sfn = func(s1, s2 *UserInfo) bool {
-				return s1.Id > s2.Id
-			}
-		} else if sby == "name" {
-			sfn = func(s1, s2 *UserInfo) bool {
-				return s1.Name < s2.Name
-			}
-		} else if sby == "name-r" {
-			sfn = func(s1, s2 *UserInfo) bool {
-				return s1.Name > s2.Name
-			}
-		} else if sby == "rdate" {
-			sfn = func(s1, s2 *UserInfo) bool {
-				return s1.RegDate < s2.RegDate
-			}
-		} else if sby == "rdate-r" {
-			sfn = func(s1, s2 *UserInfo) bool {
-				return s1.RegDate > s2.RegDate
+			if s, err := users.GetUserInfo(e.Id); err != nil {
+				event(logwarn, li, err.Error())
+				si[i] = UserInfo{Idx: e.Id, ErrNo: ENOENT}
+			} else {
+				si[i] = *s
+				si[i].Idx = e.Id
 			}
-		} else {
-			stat.ReqErrListUser++
-			return errors.New("Invalid sort field: " + sby)
 		}
 
-		var v []string
+		uil = &UserInfoList{Id: int64(len(si)), Entry: si}
+	}
 
-		if v, err = getRedisUserList(list); err != nil {
-			stat.ReqErrListUser++
-			return
-		}
+	buf, _ := json.Marshal(uil)
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
 
-		si = make([]UserInfo, len(v))
+func getUserList(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqGetUserList)
 
-		for i := range v {
-			uid, _ := strconv.ParseInt(v[i], 0, 32)
+	var m *IdList
 
-			if s, err := getRedisUserInfo(uid); err != nil {
-				event(logwarn, li, err.Error())
-				si[i] = UserInfo{Idx: uid, ErrNo: ENOENT}
-			} else {
-				si[i] = *s
-				si[i].Idx = uid
-			}
-		}
+	if m, err = getIdList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrGetUserList)
+		return
+	}
 
-		// sort data
-		UserSortBy(sfn).Sort(si)
+	var q *UserQuery
 
-		// get page entries
-                c := len(si)
+	if q, err = getUserQuery(m.Entry[0].Opt, map[string]bool{
+		"activity": true, "login": true}); err != nil {
+		incStat(&stat.ReqErrGetUserList)
+		return
+	}
 
-		if int(npage) < c {
-			var st []UserInfo
+	var si []Name
+	var next string
 
-			pofs := int(page - 1)
-			sofs := int(pofs * int(npage))
-			eofs := int(pofs*int(npage) + (int(npage) - 1))
+	if si, next, err = queryUserEvents(m.Entry[0].Id, q); err != nil {
+		incStat(&stat.ReqErrGetUserList)
+		return
+	}
 
-			if sofs >= c {
-				stat.ReqErrListUser++
-				return errors.New("Invalid page offset")
-			}
+	buf, _ := json.Marshal(&UserEventList{Id: int64(len(si)), Entry: si,
+		Cursor: next})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
 
-			if eofs < c {
-				st = make([]UserInfo, npage)
-				copy(st, si[sofs:])
-			} else {
-				eofs = c
-				st = make([]UserInfo, len(si[sofs:eofs]))
-				copy(st, si[sofs:eofs])
-			}
+func listLoginSessions(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqListLoginSessions)
 
-			uil = &UserInfoList{Id: int64(c), Entry: st}
+	var m *IdList
+
+	if m, err = getIdList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrListLoginSessions)
+		return
+	}
+
+	var si []SessionInfo
+
+	for i := range m.Entry {
+		e := m.Entry[i]
+
+		if l, err := getRedisUserSessions(e.Id); err != nil {
+			event(logwarn, li, err.Error())
 		} else {
-			uil = &UserInfoList{Id: int64(c), Entry: si}
+			si = append(si, l...)
 		}
-	} else {
-		si = make([]UserInfo, len(m.Entry))
+	}
 
-		for i := range m.Entry {
-			e := m.Entry[i]
+	buf, _ := json.Marshal(&SessionInfoList{Id: int64(len(si)), Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+func revokeLoginSessions(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqRevokeLoginSessions)
+
+	var m *IdList
+
+	if m, err = getIdList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrRevokeLoginSessions)
+		return
+	}
 
-			if s, err := getRedisUserInfo(e.Id); err != nil {
+	si := make([]Id, len(m.Entry))
+
+	for i := range m.Entry {
+		e := m.Entry[i]
+
+		if err := checkUserTarget(d.UserId, e.Id); err != nil {
+			event(logwarn, li, err.Error())
+			si[i] = Id{Id: e.Id, ErrNo: EPERM, Opt: e.Opt}
+		} else if e.Opt == "" {
+			// an empty session ID revokes all of the user sessions
+			if _, err = deleteRedisUserSessions(li, e.Id, "",
+				d.Origin); err != nil {
 				event(logwarn, li, err.Error())
-				si[i] = UserInfo{Idx: e.Id, ErrNo: ENOENT}
+				si[i] = Id{Id: e.Id, ErrNo: ENOENT}
 			} else {
-				si[i] = *s
-				si[i].Idx = e.Id
+				si[i] = Id{Id: e.Id}
 			}
+		} else if s, err := getRedisSession(e.Opt); err != nil ||
+			s.Uid != fmt.Sprintf("%v", e.Id) {
+			si[i] = Id{Id: e.Id, ErrNo: ENOENT, Opt: e.Opt}
+		} else if err = deleteRedisUserSession(li, e.Id, e.Opt,
+			"revoked", d.Origin); err != nil {
+			event(logwarn, li, err.Error())
+			si[i] = Id{Id: e.Id, ErrNo: ENOENT, Opt: e.Opt}
+		} else {
+			si[i] = Id{Id: e.Id, Opt: e.Opt}
 		}
-
-		uil = &UserInfoList{Id: int64(len(si)), Entry: si}
 	}
 
-	buf, _ := json.Marshal(uil)
-	sendResponse(w, &Msg{Data: string(buf)})
+	buf, _ := json.Marshal(&IdList{Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
-func getUserList(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqGetUserList++
+func unlockUser(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqUnlockUser)
 
 	var m *IdList
 
 	if m, err = getIdList(d.Data, d.Command); err != nil {
-		stat.ReqErrGetUserList++
+		incStat(&stat.ReqErrUnlockUser)
 		return
 	}
 
-	args := strings.Split(m.Entry[0].Opt, ":")
+	si := make([]Id, len(m.Entry))
 
-	if c := len(args); c != 4 {
-		stat.ReqErrGetUserList++
-		return errors.New("Invalid server list parameter count")
-	}
+	for i := range m.Entry {
+		e := m.Entry[i]
 
-	list := args[0]
+		if err := checkUserTarget(d.UserId, e.Id); err != nil {
+			event(logwarn, li, err.Error())
+			si[i] = Id{Id: e.Id, ErrNo: EPERM}
+		} else if s, err := users.GetUserInfo(e.Id); err != nil {
+			event(logwarn, li, err.Error())
+			si[i] = Id{Id: e.Id, ErrNo: ENOENT}
+		} else if err = deleteRedisLoginFail(s.Login); err != nil {
+			event(logwarn, li, err.Error())
+			si[i] = Id{Id: e.Id, ErrNo: EINVAL}
+		} else {
+			if err = users.SetUserActivity(e.Id, "unlocked",
+				d.Origin); err != nil {
+				event(logwarn, li, err.Error())
+			}
 
-	if list == "activity" || list == "login" {
-	} else {
-		stat.ReqErrGetUserList++
-		return errors.New("Invalid user list: " + list)
+			si[i] = Id{Id: e.Id}
+		}
 	}
 
-	page, _ := strconv.ParseInt(args[1], 0, 32)
-	npage, _ := strconv.ParseInt(args[2], 0, 32)
+	buf, _ := json.Marshal(&IdList{Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
 
-	if page == 0 || npage < 10 {
-		stat.ReqErrListUser++
-		return errors.New("Invalid list page count")
-	}
+func deleteUser(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqDeleteUser)
 
-	var v []string
+	var m *IdList
 
-	if v, err = getRedisUserUidList(m.Entry[0].Id, list); err != nil {
-		stat.ReqErrGetUserList++
+	if m, err = getIdList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrDeleteUser)
 		return
 	}
 
-	si := make([]Name, len(v))
+	si := make([]Id, len(m.Entry))
 
-	for i := range v {
-		si[i] = Name{Name: v[i]}
+	for i := range m.Entry {
+		e := m.Entry[i]
+		si[i] = Id{Id: e.Id, Opt: e.Opt}
+
+		if err := users.CheckUserId(e.Id); err != nil {
+			si[i].ErrNo = ENOENT
+			continue
+		}
+
+		if e.Id == d.UserId {
+			si[i].ErrNo = EPERM
+			continue
+		}
+
+		// tunnel sessions must be reassigned in rebana first, unless forced
+		if n, err := checkRedisUserTunnel(e.Id); err != nil {
+			event(logwarn, li, err.Error())
+			si[i].ErrNo = EINVAL
+			continue
+		} else if n > 0 && e.Opt != "force" {
+			event(logwarn, li, "User [%v] owns %v tunnel sessions",
+				e.Id, n)
+			si[i].ErrNo = EAGAIN
+			continue
+		} else if n > 0 {
+			event(lognotice, li, "User [%v] deleted with %v tunnel "+
+				"sessions assigned", e.Id, n)
+		}
+
+		if err := deleteRedisUser(li, e.Id, d.Origin); err != nil {
+			event(logwarn, li, err.Error())
+			si[i].ErrNo = EPERM
+		}
 	}
 
-	var nl *NameList
+	buf, _ := json.Marshal(&IdList{Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
 
-	// get page entries
-	c := len(si)
+func exportUserData(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqExportUserData)
 
-	if int(npage) < c {
-		var st []Name
+	var m *IdList
 
-		pofs := int(page - 1)
-		sofs := int(pofs * int(npage))
-		eofs := int(pofs*int(npage) + (int(npage) - 1))
+	if m, err = getIdList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrExportUserData)
+		return
+	}
 
-		if sofs >= c {
-			stat.ReqErrGetUserList++
-			return errors.New("Invalid page offset")
-		}
+	si := make([]UserData, len(m.Entry))
 
-		if eofs < c {
-			st = make([]Name, npage)
-			copy(st, si[sofs:])
-		} else {
-			eofs = c
-			st = make([]Name, len(si[sofs:eofs]))
-			copy(st, si[sofs:eofs])
+	for i := range m.Entry {
+		e := m.Entry[i]
+
+		s, err := users.GetUserInfo(e.Id)
+
+		if err != nil {
+			event(logwarn, li, err.Error())
+			si[i] = UserData{Profile: UserInfo{Idx: e.Id}, ErrNo: ENOENT}
+			continue
 		}
 
-		nl = &NameList{Id: int64(c), Entry: st}
-	} else {
-		nl = &NameList{Id: int64(c), Entry: si}
+		// the password digest is not personal data worth exporting
+		s.Password = ""
+		s.Idx = e.Id
+
+		si[i] = UserData{Profile: *s}
+
+		si[i].Roles, _ = getRedisUserRoles(e.Id)
+		si[i].Sessions, _ = getRedisUserSessions(e.Id)
+		si[i].ApiKeys, _ = getRedisUserApiKeys(e.Id)
+		si[i].Activity, _ = users.GetUserUidList(e.Id, "activity")
+		si[i].Login, _ = users.GetUserUidList(e.Id, "login")
+
+		if err = users.SetUserActivity(e.Id, "personal data exported",
+			d.Origin); err != nil {
+			event(logwarn, li, err.Error())
+		}
 	}
 
-	buf, _ := json.Marshal(nl)
-	sendResponse(w, &Msg{Data: string(buf)})
+	buf, _ := json.Marshal(&UserDataList{Id: int64(len(si)), Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
 func defaultAdminUserHandler(w http.ResponseWriter, r *http.Request) {
-	stat.ReqAll++
-	li.Msgid = 0
+	incStat(&stat.ReqAll)
+
+	li := &LogInfo{}
 
 	var err error
 
 	str := "Invalid request"
 
-	if err = checkUrl(r); err != nil {
-		stat.ReqErrUrl++
-		sendError(w, EINVAL, str, err)
+	if err = checkUrl(li, r); err != nil {
+		incStat(&stat.ReqErrUrl)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
 	if err = checkHeader(r); err != nil {
-		stat.ReqErrHeader++
-		sendError(w, EINVAL, str, err)
+		incStat(&stat.ReqErrHeader)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
 	if err = checkRedis(); err != nil {
-		stat.ReqErrRedis++
-		sendError(w, EINVAL, str, err)
+		incStat(&stat.ReqErrRedis)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
 	var d *RequestMsg
 
-	if d, err = checkData(r); err != nil {
-		stat.ReqErrPayload++
-		sendError(w, EINVAL, str, err)
+	if d, err = checkData(li, r); err != nil {
+		incStat(&stat.ReqErrPayload)
+		sendError(w, li, getDataErrNo(err), str, err)
 		return
 	}
 
 	if li.Msgid, err = getRedisMsgId(d.Command); err != nil {
-		stat.ReqErrMsgId++
-		sendError(w, EINVAL, str, err)
+		incStat(&stat.ReqErrMsgId)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
-	if err = checkUserAdmin(d.UserId); err != nil {
-		stat.ReqErrUserId++
-		sendError(w, EPERM, str, err)
+	if err = checkUserPermission(d.UserId,
+		adminPermission[d.Command]); err != nil {
+		incStat(&stat.ReqErrUserId)
+		sendError(w, li, EPERM, str, err)
 		return
 	}
 
@@ -709,42 +792,125 @@ func defaultAdminUserHandler(w http.ResponseWriter, r *http.Request) {
 
 	switch d.Command {
 	case "resolve-user":
-		err = resolveUser(w, d)
+		err = resolveUser(w, li, d)
 
 	case "resolve-user-id":
-		err = resolveUserId(w, d)
+		err = resolveUserId(w, li, d)
 
 	case "reset-user-pw":
-		err = resetUserPw(w, d)
+		err = resetUserPw(w, li, d)
 
 	case "add-user":
-		err = addUser(w, d)
+		err = addUser(w, li, d)
 
 	case "set-user-attr":
-		err = setUserAttr(w, d)
+		err = setUserAttr(w, li, d)
 
 	case "enable-user":
-		err = enableUser(w, d)
+		err = enableUser(w, li, d)
 
 	case "disable-user":
-		err = disableUser(w, d)
+		err = disableUser(w, li, d)
 
 	case "activate-user":
-		err = activateUser(w, d)
+		err = activateUser(w, li, d)
 
 	case "deactivate-user":
-		err = deactivateUser(w, d)
+		err = deactivateUser(w, li, d)
 
 	case "list-user":
-		err = listUser(w, d)
+		err = listUser(w, li, d)
 
 	case "get-user-list":
-		err = getUserList(w, d)
+		err = getUserList(w, li, d)
+
+	case "list-login-sessions":
+		err = listLoginSessions(w, li, d)
+
+	case "revoke-login-sessions":
+		err = revokeLoginSessions(w, li, d)
+
+	case "impersonate-user":
+		err = impersonateUser(w, li, d)
+
+	case "unlock-user":
+		err = unlockUser(w, li, d)
+
+	case "list-role":
+		err = listRole(w, li, d)
+
+	case "create-role":
+		err = createRole(w, li, d)
+
+	case "delete-role":
+		err = deleteRole(w, li, d)
+
+	case "grant-role", "revoke-role":
+		err = setUserRole(w, li, d)
+
+	case "delete-user":
+		err = deleteUser(w, li, d)
+
+	case "export-user-data":
+		err = exportUserData(w, li, d)
+
+	case "search-user":
+		err = searchUser(w, li, d)
+
+	case "import-users":
+		err = importUsers(w, li, d)
+
+	case "export-users":
+		err = exportUsers(w, li, d)
+
+	case "render-template":
+		err = renderTemplate(w, li, d)
+
+	case "list-mail":
+		err = listMail(w, li, d)
+
+	case "retry-mail":
+		err = retryMail(w, li, d)
+
+	case "purge-mail":
+		err = purgeMail(w, li, d)
+
+	case "create-oidc-client":
+		err = createOIDCClient(w, li, d)
+
+	case "list-oidc-client":
+		err = listOIDCClient(w, li, d)
+
+	case "delete-oidc-client":
+		err = deleteOIDCClient(w, li, d)
+
+	case "publish-aup":
+		err = publishAUP(w, li, d)
+
+	case "list-aup":
+		err = listAUP(w, li, d)
+
+	case "report-aup":
+		err = reportAUP(w, li, d)
+
+	case "add-signing-key":
+		err = addSigningKey(w, li, d)
+
+	case "list-signing-keys":
+		err = listSigningKeys(w, li, d)
+
+	case "retire-signing-key":
+		err = retireSigningKey(w, li, d)
+	}
+
+	if pe, ok := err.(*PolicyError); ok {
+		sendError(w, li, EPOLICY, pe.Data(), err)
+		return
 	}
 
 	if err != nil {
 		str += ": " + d.Command
-		sendError(w, EINVAL, str, err)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
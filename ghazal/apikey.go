@@ -0,0 +1,286 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ApiKeyInfo struct {
+	Id       string
+	Uid      string
+	Name     string
+	Scope    string
+	Created  string
+	Expire   string
+	LastUsed string
+}
+
+type ApiKeyInfoList struct {
+	Id    int64
+	Entry []ApiKeyInfo
+}
+
+// scopes an API key may be restricted to, tunnel-control only applies to
+// rebana session commands and user to the commands of the user interface
+var apiKeyScopes = []string{"read-only", "tunnel-control", "user", "admin"}
+
+// userScope lists the user interface commands an API key may issue, those
+// set to true may also be issued with a read-only key. Logging in, password
+// and TOTP changes and creating keys still need the password.
+var userScope = map[string]bool{
+	"validate-session":    true,
+	"list-sessions":       true,
+	"list-api-keys":       true,
+	"show-aup":            true,
+	"logout":              false,
+	"revoke-session":      false,
+	"revoke-all-sessions": false,
+	"revoke-api-key":      false,
+	"accept-aup":          false,
+}
+
+func checkApiKeyScope(scope, cmd string) (err error) {
+	if ro, ok := userScope[cmd]; ok && (scope == "user" ||
+		scope == "admin" || (scope == "read-only" && ro)) {
+		return
+	}
+
+	p, ok := adminPermission[cmd]
+
+	if ok && (scope == "admin" ||
+		(scope == "read-only" && strings.HasSuffix(p, ".read"))) {
+		return
+	}
+
+	return errors.New(fmt.Sprintf("API key scope %v does not allow %v",
+		scope, cmd))
+}
+
+// getApiKey derives the key of a key ID from the API key secret, which
+// rebana shares to check the same keys. Only the digest of the key is
+// stored and it cannot sign a request, a key therefore cannot be recovered
+// from the database without the secret.
+func getApiKey(kid string) (key string, err error) {
+	if app.ApiKeySecret == "" {
+		return key, errors.New("API keys are not enabled")
+	}
+
+	dgst := hmac.New(sha256.New, []byte(app.ApiKeySecret))
+	dgst.Write([]byte("apikey:" + kid))
+
+	return base64.URLEncoding.EncodeToString(dgst.Sum(nil)), nil
+}
+
+// checkApiKey verifies a request signed with an API key instead of the
+// service secret. The stored digest has to match the derived key, keys
+// issued under a previous API key secret are no longer accepted.
+func checkApiKey(li *LogInfo, r *http.Request, kid, sig string, m []byte,
+	d *RequestMsg) (err error) {
+	var k *ApiKeyInfo
+	var key, dgst string
+
+	if k, dgst, err = getRedisApiKey(kid); err != nil {
+		return errors.New("Invalid API key: " + kid)
+	}
+
+	if key, err = getApiKey(kid); err != nil {
+		return
+	}
+
+	if !hmac.Equal([]byte(hashToken(key)), []byte(dgst)) {
+		return errors.New("Invalid API key: " + kid)
+	}
+
+	if err = checkRequestSignature(r, sig, m, key); err != nil {
+		return
+	}
+
+	if k.Uid != fmt.Sprintf("%v", d.UserId) {
+		return errors.New(fmt.Sprintf("API key %v does not belong to "+
+			"user [%v]", kid, d.UserId))
+	}
+
+	if err = checkApiKeyScope(k.Scope, d.Command); err != nil {
+		return
+	}
+
+	if err = users.CheckUserStatus(d.UserId); err != nil {
+		return
+	}
+
+	if err = setRedisApiKeyUsed(kid); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	li.Key = key
+	return nil
+}
+
+func createApiKey(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqCreateApiKey)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrCreateApiKey)
+		return
+	}
+
+	var tok, name, scope string
+	var days int64
+
+	c := 3
+
+	for i := range m.Entry {
+		e := m.Entry[i]
+
+		if e.Name == "session-key" {
+			tok = e.Opt
+			c--
+		} else if e.Name == "name" {
+			name = e.Opt
+			c--
+		} else if e.Name == "scope" {
+			scope = e.Opt
+			c--
+		} else if e.Name == "expire" {
+			days, _ = strconv.ParseInt(e.Opt, 0, 64)
+		}
+	}
+
+	if c != 0 || name == "" {
+		incStat(&stat.ReqErrCreateApiKey)
+		return errors.New("Insufficient API key parameters")
+	}
+
+	if _, err = checkUserSession(li, m.Id, tok); err != nil {
+		incStat(&stat.ReqErrCreateApiKey)
+		return
+	}
+
+	if err = checkUserImpersonation(li); err != nil {
+		incStat(&stat.ReqErrCreateApiKey)
+		return
+	}
+
+	var ok bool
+
+	for i := range apiKeyScopes {
+		if scope == apiKeyScopes[i] {
+			ok = true
+		}
+	}
+
+	if !ok {
+		incStat(&stat.ReqErrCreateApiKey)
+		return errors.New("Invalid API key scope: " + scope)
+	}
+
+	var kid, key string
+
+	if kid, err = generateToken(9); err != nil {
+		incStat(&stat.ReqErrCreateApiKey)
+		return
+	}
+
+	if key, err = getApiKey(kid); err != nil {
+		incStat(&stat.ReqErrCreateApiKey)
+		return
+	}
+
+	now := time.Now()
+
+	k := &ApiKeyInfo{Id: kid, Uid: fmt.Sprintf("%v", m.Id), Name: name,
+		Scope: scope, Created: now.Format(time.RFC1123)}
+
+	ttl := days * 86400
+
+	if ttl > 0 {
+		k.Expire = now.Add(time.Duration(ttl) *
+			time.Second).Format(time.RFC1123)
+	}
+
+	if err = setRedisApiKey(li, m.Id, k, hashToken(key), ttl,
+		d.Origin); err != nil {
+		incStat(&stat.ReqErrCreateApiKey)
+		return
+	}
+
+	// the key is only ever shown here
+	si := []Name{Name{Name: kid, Opt: key}}
+
+	buf, _ := json.Marshal(&NameList{Id: m.Id, Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+func listApiKeys(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqListApiKeys)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrListApiKeys)
+		return
+	}
+
+	if _, err = checkUserSession(li, m.Id, m.Entry[0].Name); err != nil {
+		incStat(&stat.ReqErrListApiKeys)
+		return
+	}
+
+	var l []ApiKeyInfo
+
+	if l, err = getRedisUserApiKeys(m.Id); err != nil {
+		incStat(&stat.ReqErrListApiKeys)
+		return
+	}
+
+	buf, _ := json.Marshal(&ApiKeyInfoList{Id: m.Id, Entry: l})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+func revokeApiKey(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqRevokeApiKey)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrRevokeApiKey)
+		return
+	}
+
+	e := m.Entry[0]
+
+	if _, err = checkUserSession(li, m.Id, e.Name); err != nil {
+		incStat(&stat.ReqErrRevokeApiKey)
+		return
+	}
+
+	if err = deleteRedisApiKey(li, m.Id, e.Opt, d.Origin); err != nil {
+		incStat(&stat.ReqErrRevokeApiKey)
+		return
+	}
+
+	si := []Name{Name{Name: e.Opt}}
+
+	buf, _ := json.Marshal(&NameList{Id: m.Id, Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
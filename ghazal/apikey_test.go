@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetApiKey(t *testing.T) {
+	app = &AppConfig{}
+
+	if _, err := getApiKey("kid"); err == nil {
+		t.Fatalf("key derived without an API key secret")
+	}
+
+	tests := []struct {
+		secret string
+		kid    string
+	}{
+		{"secret", "kid"},
+		{"secret", "kid2"},
+		{"secret2", "kid"},
+	}
+
+	seen := make(map[string]bool)
+
+	for _, v := range tests {
+		app.ApiKeySecret = v.secret
+
+		k1, err := getApiKey(v.kid)
+
+		if err != nil {
+			t.Fatalf("%v/%v: %v", v.secret, v.kid, err)
+		}
+
+		k2, _ := getApiKey(v.kid)
+
+		if k1 != k2 {
+			t.Errorf("%v/%v: key derivation is not stable",
+				v.secret, v.kid)
+		}
+
+		if seen[k1] {
+			t.Errorf("%v/%v: key shared with another key ID "+
+				"or secret", v.secret, v.kid)
+		}
+
+		seen[k1] = true
+
+		// only the digest is stored, it must not sign for the key
+		if hashToken(k1) == k1 {
+			t.Errorf("%v/%v: stored digest equals the key",
+				v.secret, v.kid)
+		}
+	}
+}
+
+func TestCheckApiKeyScope(t *testing.T) {
+	tests := []struct {
+		scope string
+		cmd   string
+		ok    bool
+	}{
+		{"user", "list-sessions", true},
+		{"user", "logout", true},
+		{"user", "list-user", false},
+		{"read-only", "list-sessions", true},
+		{"read-only", "logout", false},
+		{"read-only", "list-user", true},
+		{"read-only", "set-user-attr", false},
+		{"admin", "logout", true},
+		{"admin", "set-user-attr", true},
+		{"tunnel-control", "list-sessions", false},
+		{"tunnel-control", "list-user", false},
+		{"user", "change-password", false},
+		{"admin", "create-api-key", false},
+		{"", "list-sessions", false},
+	}
+
+	for _, v := range tests {
+		err := checkApiKeyScope(v.scope, v.cmd)
+
+		if v.ok && err != nil {
+			t.Errorf("%v/%v: %v", v.scope, v.cmd, err)
+		} else if !v.ok && err == nil {
+			t.Errorf("%v/%v: command allowed", v.scope, v.cmd)
+		}
+	}
+}
+
+func TestApiKeyExpiry(t *testing.T) {
+	defer setupTestStore(t)()
+
+	li := &LogInfo{}
+
+	tests := []struct {
+		kid  string
+		ttl  int64
+		live bool
+	}{
+		{"expiring", 1, false},
+		{"lasting", 0, true},
+	}
+
+	for _, v := range tests {
+		k := &ApiKeyInfo{Id: v.kid, Name: v.kid, Scope: "user"}
+
+		if err := setRedisApiKey(li, 1, k, hashToken(v.kid), v.ttl,
+			"127.0.0.1"); err != nil {
+			t.Fatalf("%v: %v", v.kid, err)
+		}
+
+		if _, dgst, err := getRedisApiKey(v.kid); err != nil {
+			t.Fatalf("%v: %v", v.kid, err)
+		} else if dgst != hashToken(v.kid) {
+			t.Errorf("%v: got digest %v", v.kid, dgst)
+		}
+	}
+
+	k := &ApiKeyInfo{Id: "lasting", Name: "again", Scope: "admin"}
+
+	if err := setRedisApiKey(li, 1, k, "", 0, "127.0.0.1"); err == nil {
+		t.Errorf("existing API key replaced")
+	}
+
+	time.Sleep(2 * time.Second)
+
+	for _, v := range tests {
+		if _, _, err := getRedisApiKey(v.kid); v.live && err != nil {
+			t.Errorf("%v: %v", v.kid, err)
+		} else if !v.live && err == nil {
+			t.Errorf("%v: expired key still found", v.kid)
+		}
+	}
+
+	l, err := getRedisUserApiKeys(1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(l) != 1 || l[0].Id != "lasting" {
+		t.Errorf("got keys %v, want only lasting", l)
+	}
+}
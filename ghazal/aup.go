@@ -0,0 +1,326 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type AUPInfo struct {
+	Version   int64
+	Title     string
+	Text      string
+	Published string
+	Accepted  string
+
+	ErrNo int
+}
+
+type AUPInfoList struct {
+	Id    int64
+	Entry []AUPInfo
+}
+
+type AUPAcceptInfo struct {
+	Version  int64
+	Uid      int64
+	Login    string
+	Accepted string
+	Ip       string
+
+	ErrNo int
+}
+
+type AUPAcceptInfoList struct {
+	Id    int64
+	Entry []AUPAcceptInfo
+}
+
+// getUserAUPPending returns the latest AUP version if the user has not
+// accepted it yet, 0 when there is nothing to accept
+func getUserAUPPending(uid int64) (ver int64, err error) {
+	if ver, err = getRedisAUPLatest(); err != nil || ver == 0 {
+		return
+	}
+
+	var t string
+
+	if t, _, err = getRedisUserAUP(uid, ver); err != nil || t != "" {
+		return 0, err
+	}
+
+	return
+}
+
+// setLoginAUPPending appends an aup entry to a login response when the
+// user still has to accept the latest AUP version
+func setLoginAUPPending(li *LogInfo, uid int64, si []Id) []Id {
+	ver, err := getUserAUPPending(uid)
+
+	if err != nil {
+		event(logwarn, li, err.Error())
+		return si
+	}
+
+	if ver != 0 {
+		si = append(si, Id{Id: ver, ErrNo: ENOENT, Opt: "aup"})
+	}
+
+	return si
+}
+
+func publishAUP(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqPublishAUP)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrPublishAUP)
+		return
+	}
+
+	a := &AUPInfo{Published: time.Now().Format(time.RFC1123)}
+
+	for i := range m.Entry {
+		e := m.Entry[i]
+
+		if e.Name == "title" {
+			a.Title = e.Opt
+		} else if e.Name == "text" {
+			a.Text = e.Opt
+		}
+	}
+
+	if a.Title == "" || a.Text == "" {
+		incStat(&stat.ReqErrPublishAUP)
+		return errors.New("Insufficient AUP parameters")
+	}
+
+	if a.Version, err = setRedisAUPNew(a); err != nil {
+		incStat(&stat.ReqErrPublishAUP)
+		return
+	}
+
+	event(lognotice, li, "AUP version %v published: %v", a.Version,
+		a.Title)
+
+	si := []Id{Id{Id: a.Version, Opt: a.Title}}
+
+	buf, _ := json.Marshal(&IdList{Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+func listAUP(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqListAUP)
+
+	var m *IdList
+
+	if m, err = getIdList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrListAUP)
+		return
+	}
+
+	var l []int64
+
+	// a single 0 entry lists every version without its text
+	all := len(m.Entry) == 1 && m.Entry[0].Id == 0
+
+	if all {
+		if l, err = getRedisAUPList(); err != nil {
+			incStat(&stat.ReqErrListAUP)
+			return
+		}
+	} else {
+		for i := range m.Entry {
+			l = append(l, m.Entry[i].Id)
+		}
+	}
+
+	si := make([]AUPInfo, len(l))
+
+	for i := range l {
+		if a, err := getRedisAUP(l[i]); err != nil {
+			si[i] = AUPInfo{Version: l[i], ErrNo: ENOENT}
+		} else {
+			if all {
+				a.Text = ""
+			}
+
+			si[i] = *a
+		}
+	}
+
+	buf, _ := json.Marshal(&AUPInfoList{Id: int64(len(si)), Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+func reportAUP(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqReportAUP)
+
+	var m *IdList
+
+	if m, err = getIdList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrReportAUP)
+		return
+	}
+
+	var l []int64
+
+	// a single 0 entry reports on every version
+	if len(m.Entry) == 1 && m.Entry[0].Id == 0 {
+		if l, err = getRedisAUPList(); err != nil {
+			incStat(&stat.ReqErrReportAUP)
+			return
+		}
+	} else {
+		for i := range m.Entry {
+			l = append(l, m.Entry[i].Id)
+		}
+	}
+
+	var si []AUPAcceptInfo
+
+	for i := range l {
+		if _, err := getRedisAUP(l[i]); err != nil {
+			si = append(si, AUPAcceptInfo{Version: l[i], ErrNo: ENOENT})
+			continue
+		}
+
+		r, err := getRedisAUPAccepted(l[i])
+
+		if err != nil {
+			event(logwarn, li, err.Error())
+			si = append(si, AUPAcceptInfo{Version: l[i], ErrNo: EAGAIN})
+			continue
+		}
+
+		for j := range r {
+			if s, err := users.GetUserInfo(r[j].Uid); err == nil {
+				r[j].Login = s.Login
+			}
+		}
+
+		si = append(si, r...)
+	}
+
+	buf, _ := json.Marshal(&AUPAcceptInfoList{Id: int64(len(si)),
+		Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+func showAUP(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqShowAUP)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrShowAUP)
+		return
+	}
+
+	e := m.Entry[0]
+
+	if _, err = checkUserSession(li, m.Id, e.Name); err != nil {
+		incStat(&stat.ReqErrShowAUP)
+		return
+	}
+
+	var ver int64
+
+	// without a version the latest one is shown
+	if e.Opt == "" {
+		if ver, err = getRedisAUPLatest(); err != nil {
+			incStat(&stat.ReqErrShowAUP)
+			return
+		}
+	} else if ver, err = strconv.ParseInt(e.Opt, 0, 64); err != nil {
+		incStat(&stat.ReqErrShowAUP)
+		return errors.New("Invalid AUP version: " + e.Opt)
+	}
+
+	if ver == 0 {
+		incStat(&stat.ReqErrShowAUP)
+		return errors.New("No AUP has been published")
+	}
+
+	var a *AUPInfo
+
+	if a, err = getRedisAUP(ver); err != nil {
+		incStat(&stat.ReqErrShowAUP)
+		return
+	}
+
+	if a.Accepted, _, err = getRedisUserAUP(m.Id, ver); err != nil {
+		incStat(&stat.ReqErrShowAUP)
+		return
+	}
+
+	buf, _ := json.Marshal(&AUPInfoList{Id: m.Id, Entry: []AUPInfo{*a}})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+func acceptAUP(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqAcceptAUP)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrAcceptAUP)
+		return
+	}
+
+	e := m.Entry[0]
+
+	if _, err = checkUserSession(li, m.Id, e.Name); err != nil {
+		incStat(&stat.ReqErrAcceptAUP)
+		return
+	}
+
+	// only the user can accept on their own behalf
+	if err = checkUserImpersonation(li); err != nil {
+		incStat(&stat.ReqErrAcceptAUP)
+		return
+	}
+
+	// the version is required so a user only accepts the text they read
+	var ver int64
+
+	if ver, err = strconv.ParseInt(e.Opt, 0, 64); err != nil || ver < 1 {
+		incStat(&stat.ReqErrAcceptAUP)
+		return errors.New("Invalid AUP version: " + e.Opt)
+	}
+
+	if _, err = getRedisAUP(ver); err != nil {
+		incStat(&stat.ReqErrAcceptAUP)
+		return errors.New(fmt.Sprintf("AUP version %v not found", ver))
+	}
+
+	if err = setRedisUserAUP(li, m.Id, ver, d.Origin); err != nil {
+		incStat(&stat.ReqErrAcceptAUP)
+		return
+	}
+
+	var t string
+
+	if t, _, err = getRedisUserAUP(m.Id, ver); err != nil {
+		incStat(&stat.ReqErrAcceptAUP)
+		return
+	}
+
+	si := []Id{Id{Id: ver, Opt: t}}
+
+	buf, _ := json.Marshal(&IdList{Id: m.Id, Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+// rebana reads the latest version with lrange -1 -1 of the list ghazal
+// rpushes each published version to
+func TestAUPLatest(t *testing.T) {
+	defer setupTestStore(t)()
+
+	li := &LogInfo{}
+
+	// each step publishes a number of versions, then the user accepts one
+	tests := []struct {
+		publish int
+		accept  int64
+		latest  int64
+		pending int64
+	}{
+		{0, 0, 0, 0},
+		{1, 0, 1, 1},
+		{0, 1, 1, 0},
+		{2, 0, 3, 3},
+		{0, 2, 3, 3},
+		{0, 3, 3, 0},
+	}
+
+	for i, v := range tests {
+		for n := 0; n < v.publish; n++ {
+			a := &AUPInfo{Title: "Acceptable use", Text: "Text"}
+
+			if _, err := setRedisAUPNew(a); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if v.accept != 0 {
+			if err := setRedisUserAUP(li, 1, v.accept,
+				"127.0.0.1"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if ver, err := getRedisAUPLatest(); err != nil {
+			t.Fatal(err)
+		} else if ver != v.latest {
+			t.Errorf("step %v: got latest %v, want %v", i, ver,
+				v.latest)
+		}
+
+		if ver, err := getUserAUPPending(1); err != nil {
+			t.Fatal(err)
+		} else if ver != v.pending {
+			t.Errorf("step %v: got pending %v, want %v", i, ver,
+				v.pending)
+		}
+	}
+
+	if ver, err := getUserAUPPending(2); err != nil || ver != 3 {
+		t.Errorf("got pending %v, %v for another user", ver, err)
+	}
+}
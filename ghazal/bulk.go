@@ -0,0 +1,332 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ImportInfo struct {
+	Line  int
+	Id    int64
+	Login string
+	Name  string
+
+	ErrNo int
+	Error string
+}
+
+type ImportInfoList struct {
+	Id    int64
+	Entry []ImportInfo
+}
+
+type ExportInfo struct {
+	Id         int64  `json:"id"`
+	Login      string `json:"login"`
+	Name       string `json:"name"`
+	Admin      string `json:"admin"`
+	Status     string `json:"status"`
+	Registered string `json:"registered"`
+	FirstLogin string `json:"first-login"`
+	Verified   string `json:"verified"`
+	Roles      string `json:"roles"`
+}
+
+var exportHeader = []string{"id", "login", "name", "admin", "status",
+	"registered", "first-login", "verified", "roles"}
+
+// getImportRows parses CSV rows of login and name, with an optional header,
+// or JSON lines carrying the same two fields
+func getImportRows(format, data string) (si []ImportInfo, err error) {
+	switch format {
+	case "csv":
+		r := csv.NewReader(strings.NewReader(data))
+		r.FieldsPerRecord = -1
+		r.TrimLeadingSpace = true
+
+		for n := 1; ; n++ {
+			var v []string
+
+			if v, err = r.Read(); err == io.EOF {
+				return si, nil
+			} else if err != nil {
+				return
+			}
+
+			// skip the header
+			if n == 1 && len(v) > 0 &&
+				strings.ToLower(v[0]) == "login" {
+				continue
+			}
+
+			e := ImportInfo{Line: n}
+
+			if len(v) != 2 {
+				e.ErrNo = EINVAL
+				e.Error = "expected login and name columns"
+			} else {
+				e.Login, e.Name = v[0], v[1]
+			}
+
+			si = append(si, e)
+		}
+
+	case "jsonl":
+		sc := bufio.NewScanner(strings.NewReader(data))
+
+		for n := 1; sc.Scan(); n++ {
+			if strings.TrimSpace(sc.Text()) == "" {
+				continue
+			}
+
+			var v struct {
+				Login string `json:"login"`
+				Name  string `json:"name"`
+			}
+
+			e := ImportInfo{Line: n}
+
+			if err := json.Unmarshal(sc.Bytes(), &v); err != nil {
+				e.ErrNo = EINVAL
+				e.Error = "invalid JSON"
+			} else {
+				e.Login, e.Name = v.Login, v.Name
+			}
+
+			si = append(si, e)
+		}
+
+		return si, sc.Err()
+	}
+
+	return si, errors.New("Invalid import format: " + format)
+}
+
+// checkImportRow validates a row without touching the user keys, seen holds
+// the logins of the rows before it
+func checkImportRow(e *ImportInfo, seen map[string]bool) {
+	if e.ErrNo != EOK {
+		return
+	}
+
+	e.Login = strings.TrimSpace(e.Login)
+	e.Name = strings.TrimSpace(e.Name)
+
+	if e.Login == "" || e.Name == "" {
+		e.ErrNo, e.Error = EINVAL, "login and name are required"
+	} else if a, err := mail.ParseAddress(e.Login); err != nil ||
+		a.Address != e.Login {
+		e.ErrNo, e.Error = EINVAL, "login is not an email address"
+	} else if seen[e.Login] {
+		e.ErrNo, e.Error = EAGAIN, "duplicate login in import"
+	} else if uid, err := users.GetUserIdFromLogin(e.Login); err == nil {
+		e.ErrNo, e.Error = EAGAIN, "user exists"
+		e.Id = uid
+	}
+
+	seen[e.Login] = true
+}
+
+func importUsers(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqImportUsers)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrImportUsers)
+		return
+	}
+
+	var format, data string
+	var dry, welcome bool
+
+	for i := range m.Entry {
+		e := m.Entry[i]
+
+		switch e.Name {
+		case "format":
+			format = e.Opt
+		case "data":
+			data = e.Opt
+		case "dry-run":
+			dry = e.Opt == "true"
+		case "welcome":
+			welcome = e.Opt == "true"
+		default:
+			incStat(&stat.ReqErrImportUsers)
+			return errors.New("Invalid import parameter: " + e.Name)
+		}
+	}
+
+	var si []ImportInfo
+
+	if si, err = getImportRows(format, data); err != nil {
+		incStat(&stat.ReqErrImportUsers)
+		return
+	}
+
+	seen := make(map[string]bool)
+
+	var n int64
+
+	for i := range si {
+		e := &si[i]
+
+		checkImportRow(e, seen)
+
+		if e.ErrNo != EOK || dry {
+			continue
+		}
+
+		s := &UserInfo{Login: e.Login, Name: e.Name,
+			Registered: time.Now().Format(time.RFC1123)}
+
+		var pw string
+
+		if e.Id, pw, err = users.NewUser(li, s, d.Origin); err != nil {
+			event(logwarn, li, err.Error())
+			e.ErrNo, e.Error = EINVAL, err.Error()
+			continue
+		}
+
+		n++
+
+		// without the welcome mail the user never gets a verification
+		// link, left on the new list the sweeper would disable them.
+		// They sign in after a password reset instead.
+		if !welcome {
+			if err = users.SetUserVerified(li, e.Id,
+				d.Origin); err != nil {
+				event(logwarn, li, err.Error())
+			}
+
+			continue
+		}
+
+		if err = sendUserWelcome(li, e.Id, s, pw); err != nil {
+			event(logwarn, li, err.Error())
+		}
+	}
+
+	err = nil
+
+	if n > 0 {
+		md := &MailData{Origin: d.Origin, Uid: d.UserId,
+			Time: time.Now().Format(time.RFC1123), Rows: int64(len(si)),
+			Count: n, Welcome: welcome}
+
+		if err = sendTemplateMail(li, []string{}, "import-digest",
+			app.MailLocale, md, true); err != nil {
+			event(logwarn, li, err.Error())
+		}
+
+		err = nil
+	}
+
+	event(lognotice, li, "Bulk import by user [%v]: %v of %v rows "+
+		"created, dry run %v", d.UserId, n, len(si), dry)
+
+	buf, _ := json.Marshal(&ImportInfoList{Id: n, Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+func exportUsers(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqExportUsers)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrExportUsers)
+		return
+	}
+
+	list, format := "all", "csv"
+
+	for i := range m.Entry {
+		e := m.Entry[i]
+
+		if e.Name == "list" {
+			list = e.Opt
+		} else if e.Name == "format" {
+			format = e.Opt
+		}
+	}
+
+	if list == "all" || list == "enabled" || list == "disabled" ||
+		list == "active" || list == "inactive" ||
+		list == "new" || list == "admin" {
+	} else {
+		incStat(&stat.ReqErrExportUsers)
+		return errors.New("Invalid user list: " + list)
+	}
+
+	if format != "csv" && format != "jsonl" {
+		incStat(&stat.ReqErrExportUsers)
+		return errors.New("Invalid export format: " + format)
+	}
+
+	var v []string
+
+	// an empty list exports nothing
+	if v, err = users.GetUserList(list); err != nil {
+		v = []string{}
+		err = nil
+	}
+
+	b := &bytes.Buffer{}
+	cw := csv.NewWriter(b)
+	je := json.NewEncoder(b)
+
+	if format == "csv" {
+		cw.Write(exportHeader)
+	}
+
+	for i := range v {
+		uid, _ := strconv.ParseInt(v[i], 0, 64)
+
+		s, err := users.GetUserInfo(uid)
+
+		if err != nil {
+			event(logwarn, li, err.Error())
+			continue
+		}
+
+		r, _ := getRedisUserRoles(uid)
+
+		e := ExportInfo{Id: uid, Login: s.Login, Name: s.Name,
+			Admin: s.Admin, Status: s.Status, Registered: s.Registered,
+			FirstLogin: s.FirstLogin, Verified: s.Verified,
+			Roles: strings.Join(r, " ")}
+
+		if format == "csv" {
+			cw.Write([]string{v[i], e.Login, e.Name, e.Admin, e.Status,
+				e.Registered, e.FirstLogin, e.Verified, e.Roles})
+		} else {
+			je.Encode(&e)
+		}
+	}
+
+	cw.Flush()
+
+	si := []Name{Name{Name: format, Opt: b.String()}}
+
+	buf, _ := json.Marshal(&NameList{Id: int64(len(v)), Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// impersonation session keys carry a prefix so they stand out in logs and
+// client storage
+const impersonationPrefix = "imp."
+
+func impersonateUser(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqImpersonateUser)
+
+	var m *IdList
+
+	if m, err = getIdList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrImpersonateUser)
+		return
+	}
+
+	if len(m.Entry) != 1 {
+		incStat(&stat.ReqErrImpersonateUser)
+		return errors.New("Only one user may be impersonated at a time")
+	}
+
+	e := m.Entry[0]
+
+	// the reason goes into the audit trail and the notice to the user
+	if e.Opt == "" {
+		incStat(&stat.ReqErrImpersonateUser)
+		return errors.New("Impersonation reason is empty")
+	}
+
+	if e.Id == d.UserId {
+		incStat(&stat.ReqErrImpersonateUser)
+		return errors.New("Users cannot impersonate themselves")
+	}
+
+	if err = users.CheckUserStatus(e.Id); err != nil {
+		incStat(&stat.ReqErrImpersonateUser)
+		return
+	}
+
+	// a role holder's session would lend out the role
+	if checkUserStaff(e.Id) == nil {
+		incStat(&stat.ReqErrImpersonateUser)
+		return errors.New(fmt.Sprintf("User [%v] holds a role and cannot "+
+			"be impersonated", e.Id))
+	}
+
+	var s *UserInfo
+
+	if s, err = users.GetUserInfo(e.Id); err != nil {
+		incStat(&stat.ReqErrImpersonateUser)
+		return
+	}
+
+	var tok string
+
+	if tok, err = generateToken(24); err != nil {
+		incStat(&stat.ReqErrImpersonateUser)
+		return
+	}
+
+	tok = impersonationPrefix + tok
+
+	if err = setRedisUserImpersonation(li, e.Id, d.UserId, tok, d.Origin,
+		fmt.Sprintf("impersonation by [%v]", d.UserId)); err != nil {
+		incStat(&stat.ReqErrImpersonateUser)
+		return
+	}
+
+	if err = users.SetUserActivity(e.Id, fmt.Sprintf("impersonation by "+
+		"[%v] started: %v", d.UserId, e.Opt), d.Origin); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	if err = users.SetUserActivity(d.UserId, fmt.Sprintf("impersonation "+
+		"of [%v] started: %v", e.Id, e.Opt), d.Origin); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	event(lognotice, li, "User [%v] impersonating %v [%v]: %v", d.UserId,
+		s.Login, e.Id, e.Opt)
+
+	now := time.Now().Format(time.RFC1123)
+
+	md := &MailData{Name: s.Name, Origin: d.Origin, Reason: e.Opt,
+		Time: now, Minutes: app.ImpersonateTTL / 60}
+
+	if err = sendTemplateMail(li, []string{s.Login}, "user-impersonated",
+		s.Locale, md, false); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	si := []Id{Id{Id: e.Id, Opt: tok}}
+
+	buf, _ := json.Marshal(&IdList{Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return nil
+}
+
+// setImpersonationActivity records a user request made with an
+// impersonation session in the activity lists of both the user and the
+// impersonating admin
+func setImpersonationActivity(li *LogInfo, cmd, ip string, failed bool) {
+	uid, _ := strconv.ParseInt(li.Session.Uid, 0, 64)
+	auid, _ := strconv.ParseInt(li.Session.Impersonator, 0, 64)
+
+	res := "completed"
+
+	if failed {
+		res = "failed"
+	}
+
+	if err := users.SetUserActivity(uid, fmt.Sprintf("%v %v, "+
+		"impersonated by [%v]", cmd, res, auid), ip); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	if err := users.SetUserActivity(auid, fmt.Sprintf("%v %v, "+
+		"impersonating [%v]", cmd, res, uid), ip); err != nil {
+		event(logwarn, li, err.Error())
+	}
+}
@@ -0,0 +1,282 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SigningKey is a named request signing key of a service keyring. It is
+// valid from NotBefore until NotAfter, which is 0 for a key that does not
+// expire, and only for the listed callers, or any caller when none are
+// listed.
+type SigningKey struct {
+	Id        string
+	Service   string
+	Callers   []string
+	NotBefore int64
+	NotAfter  int64
+	Created   string
+
+	ErrNo int
+}
+
+type SigningKeyList struct {
+	Id    int64
+	Entry []SigningKey
+}
+
+// keyServices are the services a signing key may be issued for
+var keyServices = []string{"ghazal", "rebana", "rebanats"}
+
+// checkSigningKey checks a key may sign a request from caller to the
+// service at this time
+func checkSigningKey(k *SigningKey, svc, caller string) (err error) {
+	now := time.Now().Unix()
+
+	if k.Service != svc {
+		return errors.New(fmt.Sprintf("Signing key %v is not valid "+
+			"for %v", k.Id, svc))
+	}
+
+	if now < k.NotBefore {
+		return errors.New("Signing key " + k.Id + " is not yet valid")
+	}
+
+	if k.NotAfter != 0 && now >= k.NotAfter {
+		return errors.New("Signing key " + k.Id + " has expired")
+	}
+
+	if len(k.Callers) == 0 {
+		return
+	}
+
+	for i := range k.Callers {
+		if caller == k.Callers[i] {
+			return
+		}
+	}
+
+	return errors.New(fmt.Sprintf("Signing key %v is not valid for "+
+		"caller %v", k.Id, caller))
+}
+
+// checkKeyId verifies a request signed with a keyring key instead of the
+// service secret, the response is signed with the same key
+func checkKeyId(li *LogInfo, r *http.Request, kid, sig string,
+	m []byte) (err error) {
+	var k *SigningKey
+	var secret string
+
+	if k, secret, err = getRedisSigningKey(kid); err != nil {
+		return errors.New("Invalid signing key: " + kid)
+	}
+
+	caller := r.Header.Get("X-N3-Caller")
+
+	// a mutual TLS client is held to the name on its certificate. Without
+	// one the caller header is only trusted under a canonical signature, a
+	// legacy signature covers the body alone.
+	if cn := getClientName(r); cn != "" {
+		caller = cn
+	} else if len(k.Callers) != 0 && !strings.HasPrefix(sig, SIGALG+" ") {
+		return errors.New("Signing key " + kid + " is restricted to " +
+			"callers and needs a canonical signature")
+	}
+
+	if err = checkSigningKey(k, "ghazal", caller); err != nil {
+		return
+	}
+
+	if err = checkRequestSignature(r, sig, m, secret); err != nil {
+		return
+	}
+
+	li.Key = secret
+	return
+}
+
+func addSigningKey(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqAddSigningKey)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrAddSigningKey)
+		return
+	}
+
+	now := time.Now()
+
+	k := &SigningKey{NotBefore: now.Unix(),
+		Created: now.Format(time.RFC1123)}
+
+	var secret string
+	var days int64
+
+	for i := range m.Entry {
+		e := m.Entry[i]
+
+		switch e.Name {
+		case "id":
+			k.Id = e.Opt
+		case "service":
+			k.Service = e.Opt
+		case "caller":
+			k.Callers = append(k.Callers, e.Opt)
+		case "secret":
+			secret = e.Opt
+		case "delay":
+			n, _ := strconv.ParseInt(e.Opt, 0, 64)
+			k.NotBefore += n
+		case "expire":
+			days, _ = strconv.ParseInt(e.Opt, 0, 64)
+		default:
+			incStat(&stat.ReqErrAddSigningKey)
+			return errors.New("Invalid key parameter: " + e.Name)
+		}
+	}
+
+	var ok bool
+
+	for i := range keyServices {
+		if k.Service == keyServices[i] {
+			ok = true
+		}
+	}
+
+	if !ok {
+		incStat(&stat.ReqErrAddSigningKey)
+		return errors.New("Invalid signing key service: " + k.Service)
+	}
+
+	if days > 0 {
+		k.NotAfter = k.NotBefore + days*86400
+	}
+
+	if k.Id == "" {
+		if k.Id, err = generateToken(9); err != nil {
+			incStat(&stat.ReqErrAddSigningKey)
+			return
+		}
+	}
+
+	// an existing secret may be imported, such as a service Secret being
+	// moved into the keyring
+	if secret == "" {
+		if secret, err = generateToken(32); err != nil {
+			incStat(&stat.ReqErrAddSigningKey)
+			return
+		}
+	}
+
+	if err = setRedisSigningKey(li, k, secret); err != nil {
+		incStat(&stat.ReqErrAddSigningKey)
+		return
+	}
+
+	event(lognotice, li, "Signing key %v for %v added by user [%v]", k.Id,
+		k.Service, d.UserId)
+
+	// the secret is only ever shown here
+	si := []Name{Name{Name: k.Id, Opt: secret}}
+
+	buf, _ := json.Marshal(&NameList{Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+func listSigningKeys(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqListSigningKeys)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrListSigningKeys)
+		return
+	}
+
+	var ids []string
+
+	// a single empty entry lists the whole keyring
+	if len(m.Entry) == 1 && m.Entry[0].Name == "" {
+		if ids, err = getRedisSigningKeyList(); err != nil {
+			incStat(&stat.ReqErrListSigningKeys)
+			return
+		}
+	} else {
+		for i := range m.Entry {
+			ids = append(ids, m.Entry[i].Name)
+		}
+	}
+
+	si := make([]SigningKey, len(ids))
+
+	for i := range ids {
+		if k, _, err := getRedisSigningKey(ids[i]); err != nil {
+			si[i] = SigningKey{Id: ids[i], ErrNo: ENOENT}
+		} else {
+			si[i] = *k
+		}
+	}
+
+	buf, _ := json.Marshal(&SigningKeyList{Id: int64(len(si)), Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+// retireSigningKey ends the validity of keys after a grace period, during
+// which callers still holding the key can move to its replacement
+func retireSigningKey(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqRetireSigningKey)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrRetireSigningKey)
+		return
+	}
+
+	si := make([]Name, len(m.Entry))
+
+	for i := range m.Entry {
+		e := m.Entry[i]
+		si[i] = Name{Name: e.Name}
+
+		grace := app.KeyGraceTTL
+
+		if e.Opt != "" {
+			grace, _ = strconv.ParseInt(e.Opt, 0, 64)
+		}
+
+		t := time.Now().Unix() + grace
+
+		if t, err = setRedisSigningKeyExpiry(li, e.Name,
+			t); err != nil {
+			event(logwarn, li, err.Error())
+			si[i].ErrNo = ENOENT
+			err = nil
+			continue
+		}
+
+		event(lognotice, li, "Signing key %v retired by user [%v]",
+			e.Name, d.UserId)
+
+		si[i].Opt = fmt.Sprintf("%v", t)
+	}
+
+	buf, _ := json.Marshal(&NameList{Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
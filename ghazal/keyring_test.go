@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckSigningKey(t *testing.T) {
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name   string
+		key    SigningKey
+		svc    string
+		caller string
+		ok     bool
+	}{
+		{"no limits", SigningKey{Service: "ghazal"}, "ghazal", "rctl",
+			true},
+		{"other service", SigningKey{Service: "rebana"}, "ghazal",
+			"rctl", false},
+		{"not yet valid", SigningKey{Service: "ghazal",
+			NotBefore: now + 60}, "ghazal", "rctl", false},
+		{"valid from now", SigningKey{Service: "ghazal",
+			NotBefore: now}, "ghazal", "rctl", true},
+		{"within window", SigningKey{Service: "ghazal",
+			NotBefore: now - 60, NotAfter: now + 60}, "ghazal",
+			"rctl", true},
+		{"expired", SigningKey{Service: "ghazal", NotBefore: now - 60,
+			NotAfter: now - 1}, "ghazal", "rctl", false},
+		{"expires now", SigningKey{Service: "ghazal", NotAfter: now},
+			"ghazal", "rctl", false},
+		{"listed caller", SigningKey{Service: "ghazal",
+			Callers: []string{"rebana", "rctl"}}, "ghazal", "rctl",
+			true},
+		{"unlisted caller", SigningKey{Service: "ghazal",
+			Callers: []string{"rebana"}}, "ghazal", "rctl", false},
+		{"no caller", SigningKey{Service: "ghazal",
+			Callers: []string{"rebana"}}, "ghazal", "", false},
+	}
+
+	for _, v := range tests {
+		v.key.Id = v.name
+
+		err := checkSigningKey(&v.key, v.svc, v.caller)
+
+		if v.ok && err != nil {
+			t.Errorf("%v: %v", v.name, err)
+		} else if !v.ok && err == nil {
+			t.Errorf("%v: key accepted", v.name)
+		}
+	}
+}
+
+// retiring a key brings its expiry forward, never back
+func TestSigningKeyExpiry(t *testing.T) {
+	defer setupTestStore(t)()
+
+	li := &LogInfo{}
+	now := time.Now().Unix()
+
+	k := &SigningKey{Id: "k1", Service: "ghazal", NotBefore: now}
+
+	if err := setRedisSigningKey(li, k, "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		retire int64
+		expiry int64
+	}{
+		{now + 3600, now + 3600},
+		{now + 7200, now + 3600},
+		{now + 60, now + 60},
+		{now + 600, now + 60},
+	}
+
+	for _, v := range tests {
+		n, err := setRedisSigningKeyExpiry(li, k.Id, v.retire)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != v.expiry {
+			t.Errorf("retired to %v: got expiry %v, want %v",
+				v.retire, n, v.expiry)
+		}
+
+		if r, _, err := getRedisSigningKey(k.Id); err != nil {
+			t.Fatal(err)
+		} else if r.NotAfter != v.expiry {
+			t.Errorf("retired to %v: stored expiry %v, want %v",
+				v.retire, r.NotAfter, v.expiry)
+		}
+	}
+
+	// a key retired without grace is gone along with its record
+	if _, err := setRedisSigningKeyExpiry(li, k.Id, now-1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := getRedisSigningKey(k.Id); err == nil {
+		t.Errorf("retired key still found")
+	}
+
+	if l, err := getRedisSigningKeyList(); err != nil || len(l) != 0 {
+		t.Errorf("got keyring %v, %v, want it empty", l, err)
+	}
+}
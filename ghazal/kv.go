@@ -0,0 +1,1660 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+/*
+ * State tables
+ * ------------
+ * kv_keys (one row per Redis key with its type and expiry)
+ * kv_items (the contents of each key: the value of a string, hash fields,
+ *           set and sorted set members, list entries ordered by position)
+ *
+ * Without a Redis server a SQLite user store also keeps the sessions, roles,
+ * keys, nonces and the rest of the state described in redis.go. The Redis
+ * helpers are unchanged, they are handed connections that run the commands
+ * they use against these tables.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var kvSchema = []string{
+	`create table if not exists kv_keys (
+		name text primary key,
+		type text not null,
+		expire integer not null default 0)`,
+	`create index if not exists kv_keys_expire on kv_keys (expire)`,
+	`create table if not exists kv_items (
+		name text not null,
+		field text not null,
+		score real not null default 0,
+		value text not null default '',
+		primary key (name, field))`,
+	`create index if not exists kv_items_score on kv_items (name, score)`,
+}
+
+type kvCommand struct {
+	// the type of key the command works on, commands without one accept
+	// any key and set creates a string
+	typ string
+	fn  func(t *kvTx, a []string) (interface{}, error)
+}
+
+// kvCommands are the Redis commands the helpers in redis.go use
+var kvCommands = map[string]kvCommand{
+	"get":              {"string", kvGet},
+	"set":              {"", kvSet},
+	"setex":            {"", kvSetex},
+	"del":              {"", kvDel},
+	"exists":           {"", kvExists},
+	"expire":           {"", kvExpire},
+	"expireat":         {"", kvExpireat},
+	"ttl":              {"", kvTTL},
+	"incr":             {"string", kvIncr},
+	"type":             {"", kvType},
+	"keys":             {"", kvKeys},
+	"hset":             {"hash", kvHset},
+	"hsetnx":           {"hash", kvHsetnx},
+	"hmset":            {"hash", kvHmset},
+	"hget":             {"hash", kvHget},
+	"hmget":            {"hash", kvHmget},
+	"hgetall":          {"hash", kvHgetall},
+	"hdel":             {"hash", kvDelItems},
+	"hincrby":          {"hash", kvHincrby},
+	"sadd":             {"set", kvSadd},
+	"srem":             {"set", kvDelItems},
+	"smembers":         {"set", kvSmembers},
+	"sismember":        {"set", kvSismember},
+	"scard":            {"set", kvCard},
+	"sinter":           {"set", kvSinter},
+	"zadd":             {"zset", kvZadd},
+	"zrem":             {"zset", kvDelItems},
+	"zcard":            {"zset", kvCard},
+	"zcount":           {"zset", kvZcount},
+	"zrank":            {"zset", kvZrank},
+	"zrevrank":         {"zset", kvZrank},
+	"zrange":           {"zset", kvZrange},
+	"zrevrange":        {"zset", kvZrange},
+	"zrangebyscore":    {"zset", kvZrangeByScore},
+	"zrevrangebyscore": {"zset", kvZrangeByScore},
+	"zremrangebyscore": {"zset", kvZremRangeByScore},
+	"zrangebylex":      {"zset", kvZrangeByLex},
+	"zrevrangebylex":   {"zset", kvZrangeByLex},
+	"lpush":            {"list", kvPush},
+	"rpush":            {"list", kvPush},
+	"rpop":             {"list", kvRpop},
+	"llen":             {"list", kvCard},
+	"lrange":           {"list", kvLrange},
+	"ltrim":            {"list", kvLtrim},
+	"lrem":             {"list", kvLrem},
+}
+
+// newKVPool returns a pool whose connections keep the Redis state in the
+// SQLite user store database
+func newKVPool() (p *redis.Pool, err error) {
+	var db *sql.DB
+
+	if db, err = openSQLite(); err != nil {
+		return
+	}
+
+	for i := range kvSchema {
+		if _, err = db.Exec(kvSchema[i]); err != nil {
+			return nil, errors.New("Unable to create state " +
+				"schema: " + err.Error())
+		}
+	}
+
+	p = &redis.Pool{MaxIdle: 5, IdleTimeout: 300 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return &kvConn{db: db}, nil
+		}}
+
+	c := p.Get()
+	defer c.Close()
+
+	// rdbtool seeds the message ID counter of a Redis database
+	if _, err = c.Do("set", "msgid:next", 1, "nx"); err != nil {
+		return nil, errors.New("Unable to seed state: " + err.Error())
+	}
+
+	return
+}
+
+// kvConn runs each command in its own transaction, which makes single
+// commands such as set with nx as atomic as they are on Redis
+type kvConn struct {
+	db *sql.DB
+}
+
+type kvTx struct {
+	tx  *sql.Tx
+	cmd string
+	typ string
+	now int64
+}
+
+func (c *kvConn) Close() error {
+	return nil
+}
+
+func (c *kvConn) Err() error {
+	return nil
+}
+
+func (c *kvConn) Send(cmd string, args ...interface{}) error {
+	return errors.New("Pipelining is not supported without Redis")
+}
+
+func (c *kvConn) Flush() error {
+	return nil
+}
+
+func (c *kvConn) Receive() (interface{}, error) {
+	return nil, errors.New("Pipelining is not supported without Redis")
+}
+
+func (c *kvConn) Do(cmd string, args ...interface{}) (reply interface{},
+	err error) {
+	// the pool flushes a connection it takes back with an empty command
+	if cmd == "" {
+		return
+	}
+
+	cmd = strings.ToLower(cmd)
+	kc, ok := kvCommands[cmd]
+
+	if !ok {
+		return nil, redis.Error("ERR unknown command " + cmd)
+	}
+
+	a := make([]string, len(args))
+
+	for i := range args {
+		a[i] = kvArg(args[i])
+	}
+
+	var tx *sql.Tx
+
+	if tx, err = c.db.Begin(); err != nil {
+		return
+	}
+
+	t := &kvTx{tx: tx, cmd: cmd, typ: kc.typ, now: time.Now().Unix()}
+
+	if err = t.expire(); err == nil {
+		reply, err = kc.fn(t, a)
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// kvArg formats a command argument the way redigo writes it to Redis
+func kvArg(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		if v {
+			return "1"
+		}
+
+		return "0"
+	case nil:
+		return ""
+	}
+
+	return fmt.Sprint(v)
+}
+
+// expire drops the keys whose time is up before a command sees them
+func (t *kvTx) expire() (err error) {
+	if _, err = t.tx.Exec(`delete from kv_items where name in (select name
+		from kv_keys where expire > 0 and expire <= ?)`,
+		t.now); err != nil {
+		return
+	}
+
+	_, err = t.tx.Exec(`delete from kv_keys where expire > 0 and
+		expire <= ?`, t.now)
+	return
+}
+
+// check returns whether the key exists, a key of another type than the
+// command works on is an error as it is on Redis
+func (t *kvTx) check(key string) (ok bool, err error) {
+	var typ string
+
+	err = t.tx.QueryRow(`select type from kv_keys where name = ?`,
+		key).Scan(&typ)
+
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	if err != nil {
+		return
+	}
+
+	if t.typ != "" && t.typ != typ {
+		return false, redis.Error("WRONGTYPE Operation against a " +
+			"key holding the wrong kind of value")
+	}
+
+	return true, nil
+}
+
+// create adds the key for a command that writes to it
+func (t *kvTx) create(key string) (err error) {
+	typ := t.typ
+
+	if typ == "" {
+		typ = "string"
+	}
+
+	_, err = t.tx.Exec(`insert or ignore into kv_keys (name, type) values
+		(?, ?)`, key, typ)
+	return
+}
+
+func (t *kvTx) drop(key string) (n int64, err error) {
+	if _, err = t.tx.Exec(`delete from kv_items where name = ?`,
+		key); err != nil {
+		return
+	}
+
+	var res sql.Result
+
+	if res, err = t.tx.Exec(`delete from kv_keys where name = ?`,
+		key); err != nil {
+		return
+	}
+
+	return res.RowsAffected()
+}
+
+// prune drops a hash, set or list once its last item is gone
+func (t *kvTx) prune(key string) (err error) {
+	var n int64
+
+	if n, err = t.count(key); err != nil || n != 0 {
+		return
+	}
+
+	_, err = t.drop(key)
+	return
+}
+
+func (t *kvTx) count(key string) (n int64, err error) {
+	err = t.tx.QueryRow(`select count(*) from kv_items where name = ?`,
+		key).Scan(&n)
+	return
+}
+
+func (t *kvTx) strings(query string, args ...interface{}) (l []interface{},
+	err error) {
+	var rows *sql.Rows
+
+	if rows, err = t.tx.Query(query, args...); err != nil {
+		return
+	}
+	defer rows.Close()
+
+	l = []interface{}{}
+
+	for rows.Next() {
+		var v string
+
+		if err = rows.Scan(&v); err != nil {
+			return
+		}
+
+		l = append(l, []byte(v))
+	}
+
+	return l, rows.Err()
+}
+
+// items returns the fields and scores or values of a key in order
+func (t *kvTx) items(query string, args ...interface{}) (f []string,
+	v []string, err error) {
+	var rows *sql.Rows
+
+	if rows, err = t.tx.Query(query, args...); err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a, b string
+
+		if err = rows.Scan(&a, &b); err != nil {
+			return
+		}
+
+		f = append(f, a)
+		v = append(v, b)
+	}
+
+	err = rows.Err()
+	return
+}
+
+func (t *kvTx) value(key, field string) (v interface{}, err error) {
+	var s string
+
+	err = t.tx.QueryRow(`select value from kv_items where name = ? and
+		field = ?`, key, field).Scan(&s)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return
+	}
+
+	return []byte(s), nil
+}
+
+// setField stores a field, returning 1 when it is new
+func (t *kvTx) setField(key, field, value string, score float64) (n int64,
+	err error) {
+	if err = t.create(key); err != nil {
+		return
+	}
+
+	var res sql.Result
+
+	if res, err = t.tx.Exec(`update kv_items set value = ?, score = ? where
+		name = ? and field = ?`, value, score, key,
+		field); err != nil {
+		return
+	}
+
+	if n, _ = res.RowsAffected(); n != 0 {
+		return 0, nil
+	}
+
+	if _, err = t.tx.Exec(`insert into kv_items (name, field, score, value)
+		values (?, ?, ?, ?)`, key, field, score, value); err != nil {
+		return
+	}
+
+	return 1, nil
+}
+
+func (t *kvTx) setExpire(key string, at int64) (n int64, err error) {
+	var res sql.Result
+
+	if res, err = t.tx.Exec(`update kv_keys set expire = ? where name = ?`,
+		at, key); err != nil {
+		return
+	}
+
+	return res.RowsAffected()
+}
+
+func kvArgs(a []string, n int, even bool) error {
+	if len(a) < n || (even && (len(a)-n)%2 != 0) {
+		return redis.Error("ERR wrong number of arguments")
+	}
+
+	return nil
+}
+
+func kvInt(s string) (int64, error) {
+	n, err := strconv.ParseInt(s, 10, 64)
+
+	if err != nil {
+		return n, redis.Error("ERR value is not an integer or " +
+			"out of range")
+	}
+
+	return n, nil
+}
+
+func kvGet(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 1, false); err != nil {
+		return nil, err
+	}
+
+	if ok, err := t.check(a[0]); err != nil || !ok {
+		return nil, err
+	}
+
+	return t.value(a[0], "")
+}
+
+// kvSet handles set key value [ex ttl] [nx]
+func kvSet(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 2, false); err != nil {
+		return nil, err
+	}
+
+	var ttl int64
+	var nx bool
+
+	for i := 2; i < len(a); i++ {
+		switch strings.ToLower(a[i]) {
+		case "nx":
+			nx = true
+		case "ex":
+			if i++; i == len(a) {
+				return nil, redis.Error("ERR syntax error")
+			}
+
+			n, err := kvInt(a[i])
+
+			if err != nil || n <= 0 {
+				return nil, redis.Error("ERR invalid expire " +
+					"time")
+			}
+
+			ttl = n
+		default:
+			return nil, redis.Error("ERR syntax error")
+		}
+	}
+
+	ok, err := t.check(a[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	if ok && nx {
+		return nil, nil
+	}
+
+	if _, err = t.drop(a[0]); err != nil {
+		return nil, err
+	}
+
+	if _, err = t.setField(a[0], "", a[1], 0); err != nil {
+		return nil, err
+	}
+
+	if ttl > 0 {
+		if _, err = t.setExpire(a[0], t.now+ttl); err != nil {
+			return nil, err
+		}
+	}
+
+	return "OK", nil
+}
+
+func kvSetex(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 3, false); err != nil {
+		return nil, err
+	}
+
+	return kvSet(t, []string{a[0], a[2], "ex", a[1]})
+}
+
+func kvDel(t *kvTx, a []string) (interface{}, error) {
+	var c int64
+
+	for i := range a {
+		n, err := t.drop(a[i])
+
+		if err != nil {
+			return nil, err
+		}
+
+		c += n
+	}
+
+	return c, nil
+}
+
+func kvExists(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 1, false); err != nil {
+		return nil, err
+	}
+
+	if ok, err := t.check(a[0]); err != nil || !ok {
+		return int64(0), err
+	}
+
+	return int64(1), nil
+}
+
+func kvExpire(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 2, false); err != nil {
+		return nil, err
+	}
+
+	n, err := kvInt(a[1])
+
+	if err != nil {
+		return nil, err
+	}
+
+	return kvExpireat(t, []string{a[0], strconv.FormatInt(t.now+n, 10)})
+}
+
+func kvExpireat(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 2, false); err != nil {
+		return nil, err
+	}
+
+	at, err := kvInt(a[1])
+
+	if err != nil {
+		return nil, err
+	}
+
+	// a time in the past removes the key straight away
+	if at <= t.now {
+		return t.drop(a[0])
+	}
+
+	return t.setExpire(a[0], at)
+}
+
+func kvTTL(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 1, false); err != nil {
+		return nil, err
+	}
+
+	var at int64
+
+	err := t.tx.QueryRow(`select expire from kv_keys where name = ?`,
+		a[0]).Scan(&at)
+
+	if err == sql.ErrNoRows {
+		return int64(-2), nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if at == 0 {
+		return int64(-1), nil
+	}
+
+	return at - t.now, nil
+}
+
+func kvIncr(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 1, false); err != nil {
+		return nil, err
+	}
+
+	v, err := kvGet(t, a)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var n int64
+
+	if v != nil {
+		if n, err = kvInt(string(v.([]byte))); err != nil {
+			return nil, err
+		}
+	}
+
+	n++
+
+	if _, err = t.setField(a[0], "", strconv.FormatInt(n, 10),
+		0); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+func kvType(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 1, false); err != nil {
+		return nil, err
+	}
+
+	var typ string
+
+	err := t.tx.QueryRow(`select type from kv_keys where name = ?`,
+		a[0]).Scan(&typ)
+
+	if err == sql.ErrNoRows {
+		return "none", nil
+	}
+
+	return typ, err
+}
+
+// kvKeys matches with SQLite's glob, which reads * ? and [] as Redis does
+func kvKeys(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 1, false); err != nil {
+		return nil, err
+	}
+
+	return t.strings(`select name from kv_keys where name glob ? order by
+		name`, a[0])
+}
+
+func kvHset(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 3, false); err != nil {
+		return nil, err
+	}
+
+	if _, err := t.check(a[0]); err != nil {
+		return nil, err
+	}
+
+	return t.setField(a[0], a[1], a[2], 0)
+}
+
+func kvHsetnx(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 3, false); err != nil {
+		return nil, err
+	}
+
+	v, err := kvHget(t, a[:2])
+
+	if err != nil || v != nil {
+		return int64(0), err
+	}
+
+	return t.setField(a[0], a[1], a[2], 0)
+}
+
+func kvHmset(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 3, true); err != nil {
+		return nil, err
+	}
+
+	if _, err := t.check(a[0]); err != nil {
+		return nil, err
+	}
+
+	for i := 1; i+1 < len(a); i += 2 {
+		if _, err := t.setField(a[0], a[i], a[i+1], 0); err != nil {
+			return nil, err
+		}
+	}
+
+	return "OK", nil
+}
+
+func kvHget(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 2, false); err != nil {
+		return nil, err
+	}
+
+	if ok, err := t.check(a[0]); err != nil || !ok {
+		return nil, err
+	}
+
+	return t.value(a[0], a[1])
+}
+
+func kvHmget(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 2, false); err != nil {
+		return nil, err
+	}
+
+	ok, err := t.check(a[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	l := make([]interface{}, len(a)-1)
+
+	for i := 1; ok && i < len(a); i++ {
+		if l[i-1], err = t.value(a[0], a[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+func kvHgetall(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 1, false); err != nil {
+		return nil, err
+	}
+
+	if _, err := t.check(a[0]); err != nil {
+		return nil, err
+	}
+
+	f, v, err := t.items(`select field, value from kv_items where name = ?
+		order by field`, a[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	l := []interface{}{}
+
+	for i := range f {
+		l = append(l, []byte(f[i]), []byte(v[i]))
+	}
+
+	return l, nil
+}
+
+// kvDelItems removes hash fields, set members or sorted set members
+func kvDelItems(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 2, false); err != nil {
+		return nil, err
+	}
+
+	if ok, err := t.check(a[0]); err != nil || !ok {
+		return int64(0), err
+	}
+
+	var c int64
+
+	for i := 1; i < len(a); i++ {
+		res, err := t.tx.Exec(`delete from kv_items where name = ? and
+			field = ?`, a[0], a[i])
+
+		if err != nil {
+			return nil, err
+		}
+
+		n, _ := res.RowsAffected()
+		c += n
+	}
+
+	return c, t.prune(a[0])
+}
+
+func kvHincrby(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 3, false); err != nil {
+		return nil, err
+	}
+
+	by, err := kvInt(a[2])
+
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := kvHget(t, a[:2])
+
+	if err != nil {
+		return nil, err
+	}
+
+	var n int64
+
+	if v != nil {
+		if n, err = kvInt(string(v.([]byte))); err != nil {
+			return nil, redis.Error("ERR hash value is not an " +
+				"integer")
+		}
+	}
+
+	n += by
+
+	if _, err = t.setField(a[0], a[1], strconv.FormatInt(n, 10),
+		0); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+func kvSadd(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 2, false); err != nil {
+		return nil, err
+	}
+
+	if _, err := t.check(a[0]); err != nil {
+		return nil, err
+	}
+
+	var c int64
+
+	for i := 1; i < len(a); i++ {
+		if v, err := kvSismember(t, []string{a[0], a[i]}); err != nil {
+			return nil, err
+		} else if v.(int64) == 1 {
+			continue
+		}
+
+		n, err := t.setField(a[0], a[i], "", 0)
+
+		if err != nil {
+			return nil, err
+		}
+
+		c += n
+	}
+
+	return c, nil
+}
+
+func kvSmembers(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 1, false); err != nil {
+		return nil, err
+	}
+
+	if _, err := t.check(a[0]); err != nil {
+		return nil, err
+	}
+
+	return t.strings(`select field from kv_items where name = ? order by
+		field`, a[0])
+}
+
+func kvSismember(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 2, false); err != nil {
+		return nil, err
+	}
+
+	if _, err := t.check(a[0]); err != nil {
+		return nil, err
+	}
+
+	v, err := t.value(a[0], a[1])
+
+	if err != nil || v == nil {
+		return int64(0), err
+	}
+
+	return int64(1), nil
+}
+
+// kvCard counts the items of a set, sorted set or list
+func kvCard(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 1, false); err != nil {
+		return nil, err
+	}
+
+	if ok, err := t.check(a[0]); err != nil || !ok {
+		return int64(0), err
+	}
+
+	return t.count(a[0])
+}
+
+func kvSinter(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 1, false); err != nil {
+		return nil, err
+	}
+
+	for i := range a {
+		if _, err := t.check(a[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	q := `select field from kv_items where name = ?`
+	args := []interface{}{a[0]}
+
+	for i := 1; i < len(a); i++ {
+		q += ` and field in (select field from kv_items where
+			name = ?)`
+		args = append(args, a[i])
+	}
+
+	return t.strings(q+` order by field`, args...)
+}
+
+func kvZadd(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 3, true); err != nil {
+		return nil, err
+	}
+
+	if _, err := t.check(a[0]); err != nil {
+		return nil, err
+	}
+
+	var c int64
+
+	for i := 1; i+1 < len(a); i += 2 {
+		score, err := strconv.ParseFloat(a[i], 64)
+
+		if err != nil {
+			return nil, redis.Error("ERR value is not a valid " +
+				"float")
+		}
+
+		n, err := t.setField(a[0], a[i+1], "", score)
+
+		if err != nil {
+			return nil, err
+		}
+
+		c += n
+	}
+
+	return c, nil
+}
+
+// kvScore parses a score range bound, ( makes it exclusive
+func kvScore(s string) (f float64, op string, err error) {
+	op = "="
+
+	if strings.HasPrefix(s, "(") {
+		s, op = s[1:], ""
+	}
+
+	switch strings.ToLower(s) {
+	case "-inf":
+		return math.Inf(-1), op, nil
+	case "+inf", "inf":
+		return math.Inf(1), op, nil
+	}
+
+	if f, err = strconv.ParseFloat(s, 64); err != nil {
+		return f, op, redis.Error("ERR min or max is not a float")
+	}
+
+	return
+}
+
+// kvScoreRange returns the condition for scores between min and max
+func kvScoreRange(min, max string) (q string, args []interface{},
+	err error) {
+	var lo, hi float64
+	var lop, hop string
+
+	if lo, lop, err = kvScore(min); err != nil {
+		return
+	}
+
+	if hi, hop, err = kvScore(max); err != nil {
+		return
+	}
+
+	q = " and score >" + lop + " ? and score <" + hop + " ?"
+	args = []interface{}{lo, hi}
+
+	return
+}
+
+// kvLimit reads the optional withscores and limit offset count arguments
+func kvLimit(a []string) (scores bool, ofs, n int64, err error) {
+	n = -1
+
+	for i := 0; i < len(a); i++ {
+		switch strings.ToLower(a[i]) {
+		case "withscores":
+			scores = true
+		case "limit":
+			if i+2 >= len(a) {
+				err = redis.Error("ERR syntax error")
+				return
+			}
+
+			if ofs, err = kvInt(a[i+1]); err != nil {
+				return
+			}
+
+			if n, err = kvInt(a[i+2]); err != nil {
+				return
+			}
+
+			i += 2
+		default:
+			return scores, ofs, n, redis.Error("ERR syntax error")
+		}
+	}
+
+	return
+}
+
+func kvScores(f, v []string, scores bool) []interface{} {
+	l := []interface{}{}
+
+	for i := range f {
+		l = append(l, []byte(f[i]))
+
+		if scores {
+			s, _ := strconv.ParseFloat(v[i], 64)
+			v := strconv.FormatFloat(s, 'f', -1, 64)
+			l = append(l, []byte(v))
+		}
+	}
+
+	return l
+}
+
+func kvZcount(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 3, false); err != nil {
+		return nil, err
+	}
+
+	if _, err := t.check(a[0]); err != nil {
+		return nil, err
+	}
+
+	q, args, err := kvScoreRange(a[1], a[2])
+
+	if err != nil {
+		return nil, err
+	}
+
+	var n int64
+
+	err = t.tx.QueryRow(`select count(*) from kv_items where name = ?`+q,
+		append([]interface{}{a[0]}, args...)...).Scan(&n)
+
+	return n, err
+}
+
+func kvZrank(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 2, false); err != nil {
+		return nil, err
+	}
+
+	if ok, err := t.check(a[0]); err != nil || !ok {
+		return nil, err
+	}
+
+	var score float64
+
+	err := t.tx.QueryRow(`select score from kv_items where name = ? and
+		field = ?`, a[0], a[1]).Scan(&score)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// members sharing a score are ranked by the member itself
+	q := `select count(*) from kv_items where name = ? and (score < ? or
+		(score = ? and field < ?))`
+
+	if t.cmd == "zrevrank" {
+		q = `select count(*) from kv_items where name = ? and
+			(score > ? or (score = ? and field > ?))`
+	}
+
+	var n int64
+
+	err = t.tx.QueryRow(q, a[0], score, score, a[1]).Scan(&n)
+
+	return n, err
+}
+
+// kvIndex turns Redis start and stop indexes, which may count from the
+// end, into an offset and a count
+func kvIndex(start, stop, size int64) (ofs, n int64) {
+	if start < 0 {
+		start += size
+	}
+
+	if stop < 0 {
+		stop += size
+	}
+
+	if start < 0 {
+		start = 0
+	}
+
+	if stop >= size {
+		stop = size - 1
+	}
+
+	if start > stop || start >= size {
+		return 0, 0
+	}
+
+	return start, stop - start + 1
+}
+
+func kvZrange(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 3, false); err != nil {
+		return nil, err
+	}
+
+	if _, err := t.check(a[0]); err != nil {
+		return nil, err
+	}
+
+	start, err := kvInt(a[1])
+
+	if err != nil {
+		return nil, err
+	}
+
+	stop, err := kvInt(a[2])
+
+	if err != nil {
+		return nil, err
+	}
+
+	scores, _, _, err := kvLimit(a[3:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := t.count(a[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	ofs, n := kvIndex(start, stop, size)
+
+	order := "score, field"
+
+	if t.cmd == "zrevrange" {
+		order = "score desc, field desc"
+	}
+
+	f, v, err := t.items(`select field, score from kv_items where name = ?
+		order by `+order+` limit ? offset ?`, a[0], n, ofs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return kvScores(f, v, scores), nil
+}
+
+func kvZrangeByScore(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 3, false); err != nil {
+		return nil, err
+	}
+
+	if _, err := t.check(a[0]); err != nil {
+		return nil, err
+	}
+
+	min, max, order := a[1], a[2], "score, field"
+
+	if t.cmd == "zrevrangebyscore" {
+		min, max, order = a[2], a[1], "score desc, field desc"
+	}
+
+	q, args, err := kvScoreRange(min, max)
+
+	if err != nil {
+		return nil, err
+	}
+
+	scores, ofs, n, err := kvLimit(a[3:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	args = append([]interface{}{a[0]}, args...)
+	args = append(args, n, ofs)
+
+	f, v, err := t.items(`select field, score from kv_items where
+		name = ?`+q+` order by `+order+` limit ? offset ?`, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return kvScores(f, v, scores), nil
+}
+
+func kvZremRangeByScore(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 3, false); err != nil {
+		return nil, err
+	}
+
+	if ok, err := t.check(a[0]); err != nil || !ok {
+		return int64(0), err
+	}
+
+	q, args, err := kvScoreRange(a[1], a[2])
+
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := t.tx.Exec(`delete from kv_items where name = ?`+q,
+		append([]interface{}{a[0]}, args...)...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	n, _ := res.RowsAffected()
+
+	return n, t.prune(a[0])
+}
+
+// kvLex returns the condition for a lexical range bound, [ includes the
+// value, ( excludes it and - or + leave that side open
+func kvLex(s string, lower bool) (q string, args []interface{},
+	err error) {
+	if (lower && s == "-") || (!lower && s == "+") {
+		return
+	}
+
+	op := "<"
+
+	if lower {
+		op = ">"
+	}
+
+	switch {
+	case s == "-" || s == "+":
+		// a range from + or to - holds nothing
+		return " and 0", nil, nil
+	case strings.HasPrefix(s, "["):
+		op += "="
+	case strings.HasPrefix(s, "("):
+	default:
+		err = redis.Error("ERR min or max not valid string range item")
+		return
+	}
+
+	return " and field " + op + " ?", []interface{}{s[1:]}, nil
+}
+
+func kvZrangeByLex(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 3, false); err != nil {
+		return nil, err
+	}
+
+	if _, err := t.check(a[0]); err != nil {
+		return nil, err
+	}
+
+	min, max, order := a[1], a[2], "field"
+
+	if t.cmd == "zrevrangebylex" {
+		min, max, order = a[2], a[1], "field desc"
+	}
+
+	lq, largs, err := kvLex(min, true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	hq, hargs, err := kvLex(max, false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, ofs, n, err := kvLimit(a[3:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	args := append([]interface{}{a[0]}, largs...)
+	args = append(append(args, hargs...), n, ofs)
+
+	return t.strings(`select field from kv_items where name = ?`+lq+hq+
+		` order by `+order+` limit ? offset ?`, args...)
+}
+
+// list entries are ordered by their score, pushing to the head takes a
+// score below the lowest and pushing to the tail one above the highest
+func kvPush(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 2, false); err != nil {
+		return nil, err
+	}
+
+	if _, err := t.check(a[0]); err != nil {
+		return nil, err
+	}
+
+	q := `select coalesce(max(score), 0) from kv_items where name = ?`
+	step := 1.0
+
+	if t.cmd == "lpush" {
+		q = `select coalesce(min(score), 0) from kv_items where
+			name = ?`
+		step = -1
+	}
+
+	var pos float64
+
+	if err := t.tx.QueryRow(q, a[0]).Scan(&pos); err != nil {
+		return nil, err
+	}
+
+	for i := 1; i < len(a); i++ {
+		pos += step
+
+		if _, err := t.setField(a[0], strconv.FormatFloat(pos, 'f', -1,
+			64), a[i], pos); err != nil {
+			return nil, err
+		}
+	}
+
+	return t.count(a[0])
+}
+
+func kvRpop(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 1, false); err != nil {
+		return nil, err
+	}
+
+	if ok, err := t.check(a[0]); err != nil || !ok {
+		return nil, err
+	}
+
+	f, v, err := t.items(`select field, value from kv_items where name = ?
+		order by score desc limit 1`, a[0])
+
+	if err != nil || len(f) == 0 {
+		return nil, err
+	}
+
+	if _, err = t.tx.Exec(`delete from kv_items where name = ? and
+		field = ?`, a[0], f[0]); err != nil {
+		return nil, err
+	}
+
+	return []byte(v[0]), t.prune(a[0])
+}
+
+// kvListRange returns the positions and values of a list between the start
+// and stop indexes
+func kvListRange(t *kvTx, key, start, stop string) (f, v []string,
+	err error) {
+	var b, e, size int64
+
+	if b, err = kvInt(start); err != nil {
+		return
+	}
+
+	if e, err = kvInt(stop); err != nil {
+		return
+	}
+
+	if size, err = t.count(key); err != nil {
+		return
+	}
+
+	ofs, n := kvIndex(b, e, size)
+
+	return t.items(`select field, value from kv_items where name = ?
+		order by score limit ? offset ?`, key, n, ofs)
+}
+
+func kvLrange(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 3, false); err != nil {
+		return nil, err
+	}
+
+	if _, err := t.check(a[0]); err != nil {
+		return nil, err
+	}
+
+	_, v, err := kvListRange(t, a[0], a[1], a[2])
+
+	if err != nil {
+		return nil, err
+	}
+
+	l := []interface{}{}
+
+	for i := range v {
+		l = append(l, []byte(v[i]))
+	}
+
+	return l, nil
+}
+
+func kvLtrim(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 3, false); err != nil {
+		return nil, err
+	}
+
+	if ok, err := t.check(a[0]); err != nil || !ok {
+		return "OK", err
+	}
+
+	f, _, err := kvListRange(t, a[0], a[1], a[2])
+
+	if err != nil {
+		return nil, err
+	}
+
+	keep := make(map[string]bool)
+
+	for i := range f {
+		keep[f[i]] = true
+	}
+
+	all, _, err := t.items(`select field, value from kv_items where
+		name = ?`, a[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range all {
+		if keep[all[i]] {
+			continue
+		}
+
+		if _, err = t.tx.Exec(`delete from kv_items where name = ? and
+			field = ?`, a[0], all[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return "OK", t.prune(a[0])
+}
+
+// kvLrem removes entries equal to the value, from the head for a positive
+// count, from the tail for a negative one and all of them for 0
+func kvLrem(t *kvTx, a []string) (interface{}, error) {
+	if err := kvArgs(a, 3, false); err != nil {
+		return nil, err
+	}
+
+	c, err := kvInt(a[1])
+
+	if err != nil {
+		return nil, err
+	}
+
+	if ok, err := t.check(a[0]); err != nil || !ok {
+		return int64(0), err
+	}
+
+	order := "score"
+
+	if c < 0 {
+		order, c = "score desc", -c
+	}
+
+	if c == 0 {
+		c = -1
+	}
+
+	f, _, err := t.items(`select field, value from kv_items where name = ?
+		and value = ? order by `+order+` limit ?`, a[0], a[2], c)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range f {
+		if _, err = t.tx.Exec(`delete from kv_items where name = ? and
+			field = ?`, a[0], f[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return int64(len(f)), t.prune(a[0])
+}
+
+// userStoreKey tells the keys of the Redis user store from the rest of the
+// state, users are carried over by ImportUser
+func userStoreKey(k string) bool {
+	if strings.HasPrefix(k, "user:") || strings.HasPrefix(k, "index:") ||
+		k == "uid:next" {
+		return true
+	}
+
+	p := strings.Split(k, ":")
+
+	if len(p) < 2 || p[0] != "uid" {
+		return false
+	}
+
+	if _, err := strconv.ParseInt(p[1], 10, 64); err != nil {
+		return false
+	}
+
+	return len(p) == 2 || (len(p) == 3 && (p[2] == "activity-list" ||
+		p[2] == "login-list"))
+}
+
+// copyState copies the state keys of one backend to another with their
+// expiry, keys the target already holds are left alone
+func copyState(src, dst redis.Conn) (n int, err error) {
+	var l []string
+
+	if l, err = redis.Strings(src.Do("keys", "*")); err != nil {
+		return n, errors.New("Error listing state keys")
+	}
+
+	for i := range l {
+		k := l[i]
+
+		if userStoreKey(k) {
+			continue
+		}
+
+		if ok, _ := redis.Bool(dst.Do("exists", k)); ok {
+			continue
+		}
+
+		var typ string
+
+		if typ, err = redis.String(src.Do("type", k)); err != nil {
+			return n, errors.New("Error retrieving state key " + k)
+		}
+
+		var v []string
+
+		args := []interface{}{k}
+
+		switch typ {
+		case "string":
+			var s string
+
+			if s, err = redis.String(src.Do("get",
+				k)); err == nil {
+				_, err = dst.Do("set", k, s)
+			}
+		case "hash":
+			if v, err = redis.Strings(src.Do("hgetall",
+				k)); err == nil {
+				for j := range v {
+					args = append(args, v[j])
+				}
+
+				_, err = dst.Do("hmset", args...)
+			}
+		case "set":
+			if v, err = redis.Strings(src.Do("smembers",
+				k)); err == nil {
+				for j := range v {
+					args = append(args, v[j])
+				}
+
+				_, err = dst.Do("sadd", args...)
+			}
+		case "zset":
+			// withscores pairs each member with its score, zadd
+			// takes them the other way round
+			if v, err = redis.Strings(src.Do("zrange", k, 0, -1,
+				"withscores")); err == nil {
+				for j := 0; j+1 < len(v); j += 2 {
+					args = append(args, v[j+1], v[j])
+				}
+
+				_, err = dst.Do("zadd", args...)
+			}
+		case "list":
+			if v, err = redis.Strings(src.Do("lrange", k, 0,
+				-1)); err == nil {
+				for j := range v {
+					args = append(args, v[j])
+				}
+
+				_, err = dst.Do("rpush", args...)
+			}
+		default:
+			continue
+		}
+
+		if err != nil {
+			return n, errors.New("Error copying state key " + k)
+		}
+
+		if ttl, _ := redis.Int64(src.Do("ttl", k)); ttl > 0 {
+			dst.Do("expire", k, ttl)
+		}
+
+		n++
+	}
+
+	return
+}
+
+// migrateState carries the state over with the users, into the SQLite
+// database when Redis is to be dropped and back out of it into Redis
+func migrateState(target string) (err error) {
+	var kv *redis.Pool
+
+	if kv, err = newKVPool(); err != nil {
+		return
+	}
+
+	src := rdp.Get()
+	defer src.Close()
+
+	dst := kv.Get()
+	defer dst.Close()
+
+	if target == "redis" {
+		src, dst = dst, src
+	}
+
+	var n int
+
+	if n, err = copyState(src, dst); err != nil {
+		return
+	}
+
+	event(lognotice, sli, "%v state keys copied to %v", n, target)
+	return
+}
@@ -19,10 +19,20 @@ const (
 	logcrit   string = "critical"
 )
 
+// LogInfo follows a request from its handler down to the store and Redis
+// helpers. Besides what is logged it carries the key the response is signed
+// with and the session the request was made with.
 type LogInfo struct {
 	Src   string
 	Uid   int64
 	Msgid int64
+
+	// key the response is signed with, set when the request was signed
+	// with an API or keyring key instead of the service secret
+	Key string
+
+	// session a user request was made with, nil without a session key
+	Session *SessionInfo
 }
 
 type GhazalLog struct {
@@ -40,14 +50,15 @@ type GhazalLog struct {
 var (
 	debug bool
 	logfp *os.File
-	li    *LogInfo
 )
 
+// sli logs the mail queue, the new user sweeper, signals and the other work
+// ghazal does outside of a request
+var sli = &LogInfo{Src: "::1"}
+
 func setupLog(d bool) (err error) {
 	debug = d
 
-        li = &LogInfo{"::1", 0, 0}
-
 	if debug {
 		logfp = os.Stderr
 		fmt.Fprintf(logfp, "Debugging enabled - redirect to stderr\n")
@@ -0,0 +1,295 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htemplate "html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	ttemplate "text/template"
+	"time"
+)
+
+// MailData carries the fields a notification template may use, each
+// template only picks the ones relevant to it
+type MailData struct {
+	Brand    string
+	Name     string
+	Login    string
+	Password string
+	Token    string
+	Link     string
+	Origin   string
+	Time     string
+	Reason   string
+	List     []string
+
+	Admin   bool
+	Welcome bool
+
+	Uid     int64
+	Hours   int64
+	Minutes int64
+	Rows    int64
+	Count   int64
+}
+
+// MailTemplate holds the plain text part of a notification, which also
+// defines the "subject" template, and the optional HTML part
+type MailTemplate struct {
+	Text *ttemplate.Template
+	Html *htemplate.Template
+}
+
+// notifications that every install must provide in the default locale
+var mailTemplates = []string{
+	"user-welcome",
+	"user-registered",
+	"password-reset",
+	"expired-digest",
+	"import-digest",
+	"user-impersonated",
+}
+
+// mailTpl maps a locale to its notification templates, render-template may
+// replace it while other requests are sending mail
+var mailTpl map[string]map[string]*MailTemplate
+
+var mailTplLock sync.RWMutex
+
+func getMailTemplates() map[string]map[string]*MailTemplate {
+	mailTplLock.RLock()
+	defer mailTplLock.RUnlock()
+
+	return mailTpl
+}
+
+// loadMailTemplates parses [dir]/[locale]/[name].txt and the matching
+// [name].html if present
+func loadMailTemplates(dir string) (t map[string]map[string]*MailTemplate,
+	err error) {
+	var locales []os.FileInfo
+
+	if locales, err = ioutil.ReadDir(dir); err != nil {
+		return t, errors.New("Unable to read template directory: " + dir)
+	}
+
+	t = make(map[string]map[string]*MailTemplate)
+
+	for i := range locales {
+		if !locales[i].IsDir() {
+			continue
+		}
+
+		locale := locales[i].Name()
+		path := filepath.Join(dir, locale)
+
+		var files []string
+
+		if files, err = filepath.Glob(path + "/*.txt"); err != nil {
+			return
+		}
+
+		t[locale] = make(map[string]*MailTemplate)
+
+		for j := range files {
+			name := strings.TrimSuffix(filepath.Base(files[j]), ".txt")
+			mt := &MailTemplate{}
+
+			if mt.Text, err = ttemplate.ParseFiles(files[j]); err != nil {
+				return
+			}
+
+			if mt.Text.Lookup("subject") == nil {
+				return t, errors.New("Template has no subject: " +
+					files[j])
+			}
+
+			h := filepath.Join(path, name+".html")
+
+			if _, err := os.Stat(h); err == nil {
+				if mt.Html, err = htemplate.ParseFiles(h); err != nil {
+					return t, err
+				}
+			}
+
+			t[locale][name] = mt
+		}
+	}
+
+	for i := range mailTemplates {
+		if _, ok := t[app.MailLocale][mailTemplates[i]]; !ok {
+			return t, errors.New(fmt.Sprintf("Template %v missing for "+
+				"locale %v", mailTemplates[i], app.MailLocale))
+		}
+	}
+
+	return t, nil
+}
+
+// getMailMsg renders a notification in the given locale, falling back to
+// the default locale when the user has none or it lacks the template
+func getMailMsg(t map[string]map[string]*MailTemplate, name, locale string,
+	m *MailData) (subj, text, html string, err error) {
+	mt, ok := t[locale][name]
+
+	if !ok {
+		if mt, ok = t[app.MailLocale][name]; !ok {
+			return subj, text, html, errors.New("Invalid template: " +
+				name)
+		}
+	}
+
+	m.Brand = app.BrandName
+
+	b := &bytes.Buffer{}
+
+	if err = mt.Text.ExecuteTemplate(b, "subject", m); err != nil {
+		return
+	}
+
+	subj = strings.TrimSpace(b.String())
+	b.Reset()
+
+	if err = mt.Text.Execute(b, m); err != nil {
+		return
+	}
+
+	text = strings.TrimSpace(b.String())
+
+	if mt.Html == nil {
+		return
+	}
+
+	b.Reset()
+
+	if err = mt.Html.Execute(b, m); err != nil {
+		return
+	}
+
+	html = b.String()
+	return
+}
+
+// sendTemplateMail renders a notification and sends it, f has the same
+// meaning as in sendMail
+func sendTemplateMail(li *LogInfo, r []string, name, locale string, m *MailData,
+	f bool) (err error) {
+	var subj, text, html string
+
+	if subj, text, html, err = getMailMsg(getMailTemplates(), name, locale,
+		m); err != nil {
+		return
+	}
+
+	return sendMail(li, r, subj, text, html, f)
+}
+
+// renderTemplate previews a notification from the templates on disk, which
+// only replace the loaded ones when reload is requested
+func renderTemplate(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqRenderTemplate)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrRenderTemplate)
+		return
+	}
+
+	var name, locale string
+	var uid int64
+	var reload bool
+
+	for i := range m.Entry {
+		e := m.Entry[i]
+
+		switch e.Name {
+		case "template":
+			name = e.Opt
+		case "locale":
+			locale = e.Opt
+		case "uid":
+			uid, _ = strconv.ParseInt(e.Opt, 0, 64)
+		case "reload":
+			reload = e.Opt == "true"
+		default:
+			incStat(&stat.ReqErrRenderTemplate)
+			return errors.New("Invalid template parameter: " + e.Name)
+		}
+	}
+
+	var t map[string]map[string]*MailTemplate
+
+	if t, err = loadMailTemplates(app.MailTemplateDir); err != nil {
+		incStat(&stat.ReqErrRenderTemplate)
+		return
+	}
+
+	now := time.Now().Format(time.RFC1123)
+	pw, _ := generateTempPassword()
+
+	md := &MailData{Name: "Sample User", Login: "user@domain",
+		Password: pw, Token: "sample-token",
+		Link: app.VerifyUrl + "?token=sample-token", Origin: d.Origin,
+		Time: now, List: []string{"user@domain [1], registered on " + now},
+		Uid: d.UserId, Hours: app.VerifyTTL / 3600,
+		Minutes: app.ResetTokenTTL / 60, Rows: 1, Count: 1,
+		Reason: "sample support request"}
+
+	if uid != 0 {
+		var s *UserInfo
+
+		if s, err = users.GetUserInfo(uid); err != nil {
+			incStat(&stat.ReqErrRenderTemplate)
+			return
+		}
+
+		md.Name, md.Login = s.Name, s.Login
+
+		if locale == "" {
+			locale = s.Locale
+		}
+	}
+
+	var si []Name
+
+	if name != "" {
+		var subj, text, html string
+
+		if subj, text, html, err = getMailMsg(t, name, locale,
+			md); err != nil {
+			incStat(&stat.ReqErrRenderTemplate)
+			return
+		}
+
+		si = []Name{Name{Name: "subject", Opt: subj},
+			Name{Name: "text", Opt: text},
+			Name{Name: "html", Opt: html}}
+	}
+
+	if reload {
+		mailTplLock.Lock()
+		mailTpl = t
+		mailTplLock.Unlock()
+
+		event(lognotice, li, "Mail templates reloaded from %v",
+			app.MailTemplateDir)
+	}
+
+	buf, _ := json.Marshal(&NameList{Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
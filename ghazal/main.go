@@ -12,6 +12,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 )
 
@@ -42,6 +43,7 @@ type RequestMsg struct {
 	Origin  string
 	Command string
 	Data    string
+	Nonce   string
 }
 
 type Msg struct {
@@ -52,9 +54,30 @@ type Msg struct {
 	Data     string
 }
 
+// BindInfo is a listening address, served over TLS when TLSCert and TLSKey
+// are set. With TLSClientCA only clients holding a certificate issued by
+// that CA are accepted.
 type BindInfo struct {
 	Host string
 	Port string
+
+	TLSCert     string
+	TLSKey      string
+	TLSClientCA string
+
+	// names the client certificates have to be issued to, any client
+	// the CA issued a certificate to may connect when empty
+	TLSClientNames []string
+}
+
+// PasswordPolicy applies to every password a user or an administrator
+// chooses, generated temporary passwords are exempt
+type PasswordPolicy struct {
+	MinLength   int
+	Classes     []string
+	BannedWords []string
+	History     int
+	BreachedDir string
 }
 
 type AppConfig struct {
@@ -70,60 +93,227 @@ type AppConfig struct {
 	SMTPHost   string
 	SMTPUser   string
 	SMTPPw     string
+	SMTPPort   string
+
+	MailTransport     string
+	SendmailPath      string
+	MailSinkDir       string
+	MailRetryLimit    int64
+	MailRetryDelay    int64
+	MailQueueInterval int64
+
+	BrandName       string
+	MailTemplateDir string
+	MailLocale      string
+
+	ResetTokenTTL  int64
+	SessionTTL     int64
+	SessionIdleTTL int64
+	ImpersonateTTL int64
+
+	TOTPAdminRequired bool
+
+	LoginFailWindow  int64
+	LoginFailDelay   int64
+	LoginFailLimit   int64
+	LoginIPFailLimit int64
+	LoginLockTTL     int64
+
+	PasswordPolicy PasswordPolicy
+
+	VerifyUrl           string
+	VerifyTTL           int64
+	VerifySweepInterval int64
 
 	Secret    string
 	TLSCACert []string `json:"TLSCACert"`
 
+	// seconds a request Date may lie either side of the local clock, also
+	// how long request nonces are remembered for
+	ClockSkew int64
+
+	// canonical only accepts canonical request signatures, transition also
+	// accepts the legacy body signature while clients are upgraded. The
+	// default becomes canonical on 2027-04-01, set transition explicitly
+	// to keep legacy clients working past it.
+	SignatureMode string
+
+	// seconds a retired signing key stays valid by default
+	KeyGraceTTL int64
+
+	// API keys are derived from their key ID with this secret, rebana has
+	// to be configured with the same one. API keys are disabled without it.
+	ApiKeySecret string
+
 	RedisUrl string
 	RedisPw  string
 	RedisDb  string
+
+	TunnelRedisDb string
+
+	// redis or sqlite. A sqlite store without RedisUrl also keeps the
+	// sessions, roles, keys and the rest of the state in its database,
+	// rebana cannot share them then and needs a Redis deployment.
+	UserStore     string
+	UserStorePath string
+
+	OIDCIssuer   string
+	OIDCKeyFile  string
+	OIDCCodeTTL  int64
+	OIDCTokenTTL int64
 }
 
 type AppStat struct {
-	HostName             string
-	ReqAll               int64
-	ReqResolveUser       int64
-	ReqResolveUserId     int64
-	ReqResetUserPw       int64
-	ReqGetAccessToken    int64
-	ReqAddUser           int64
-	ReqSetUserAttr       int64
-	ReqEnableUser        int64
-	ReqDisableUser       int64
-	ReqActivateUser      int64
-	ReqDeactivateUser    int64
-	ReqListUser          int64
-	ReqGetUserList       int64
-	ReqUserLogin         int64
-	ReqUserLogout        int64
-	ReqStatus            int64
-	ReqError             int64
-	ReqErrUrl            int64
-	ReqErrHeader         int64
-	ReqErrRedis          int64
-	ReqErrPayload        int64
-	ReqErrSignature      int64
-	ReqErrPassword       int64
-	ReqErrAccessToken    int64
-	ReqErrUserId         int64
-	ReqErrMsgId          int64
-	ReqErrCommand        int64
-	ReqErrData           int64
-	ReqErrResolveUser    int64
-	ReqErrResolveUserId  int64
-	ReqErrResetUserPw    int64
-	ReqErrGetAccessToken int64
-	ReqErrAddUser        int64
-	ReqErrSetUserAttr    int64
-	ReqErrEnableUser     int64
-	ReqErrDisableUser    int64
-	ReqErrActivateUser   int64
-	ReqErrDeactivateUser int64
-	ReqErrListUser       int64
-	ReqErrGetUserList    int64
-	ReqErrUserLogin      int64
-	ReqErrUserLogout     int64
-	ReqErrStatus         int64
+	HostName                  string
+	ReqAll                    int64
+	ReqResolveUser            int64
+	ReqResolveUserId          int64
+	ReqResetUserPw            int64
+	ReqGetAccessToken         int64
+	ReqAddUser                int64
+	ReqSetUserAttr            int64
+	ReqEnableUser             int64
+	ReqDisableUser            int64
+	ReqActivateUser           int64
+	ReqDeactivateUser         int64
+	ReqListUser               int64
+	ReqGetUserList            int64
+	ReqUserLogin              int64
+	ReqUserLogout             int64
+	ReqChangePassword         int64
+	ReqRequestPwReset         int64
+	ReqCompletePwReset        int64
+	ReqValidateSession        int64
+	ReqListSessions           int64
+	ReqRevokeSession          int64
+	ReqRevokeAllSessions      int64
+	ReqListLoginSessions      int64
+	ReqRevokeLoginSessions    int64
+	ReqImpersonateUser        int64
+	ReqUserLoginTOTP          int64
+	ReqEnrollTOTP             int64
+	ReqConfirmTOTP            int64
+	ReqDisableTOTP            int64
+	ReqUnlockUser             int64
+	ReqBlockedLogin           int64
+	ReqLockedLogin            int64
+	ReqVerifyEmail            int64
+	ReqListRole               int64
+	ReqCreateRole             int64
+	ReqDeleteRole             int64
+	ReqGrantRole              int64
+	ReqRevokeRole             int64
+	ReqCreateApiKey           int64
+	ReqListApiKeys            int64
+	ReqRevokeApiKey           int64
+	ReqDeleteUser             int64
+	ReqExportUserData         int64
+	ReqSearchUser             int64
+	ReqImportUsers            int64
+	ReqExportUsers            int64
+	ReqRenderTemplate         int64
+	ReqListMail               int64
+	ReqRetryMail              int64
+	ReqPurgeMail              int64
+	ReqCreateOIDCClient       int64
+	ReqListOIDCClient         int64
+	ReqDeleteOIDCClient       int64
+	ReqOIDCAuthorize          int64
+	ReqOIDCToken              int64
+	ReqOIDCUserInfo           int64
+	ReqPublishAUP             int64
+	ReqListAUP                int64
+	ReqReportAUP              int64
+	ReqShowAUP                int64
+	ReqAcceptAUP              int64
+	ReqAddSigningKey          int64
+	ReqListSigningKeys        int64
+	ReqRetireSigningKey       int64
+	ReqStatus                 int64
+	ReqLegacySignature        int64
+	ReqError                  int64
+	ReqErrUrl                 int64
+	ReqErrHeader              int64
+	ReqErrRedis               int64
+	ReqErrPayload             int64
+	ReqErrSignature           int64
+	ReqErrApiKey              int64
+	ReqErrKeyId               int64
+	ReqErrReplay              int64
+	ReqErrExpired             int64
+	ReqErrFuture              int64
+	ReqErrPassword            int64
+	ReqErrPasswordPolicy      int64
+	ReqErrAccessToken         int64
+	ReqErrUserId              int64
+	ReqErrMsgId               int64
+	ReqErrCommand             int64
+	ReqErrData                int64
+	ReqErrResolveUser         int64
+	ReqErrResolveUserId       int64
+	ReqErrResetUserPw         int64
+	ReqErrGetAccessToken      int64
+	ReqErrAddUser             int64
+	ReqErrSetUserAttr         int64
+	ReqErrEnableUser          int64
+	ReqErrDisableUser         int64
+	ReqErrActivateUser        int64
+	ReqErrDeactivateUser      int64
+	ReqErrListUser            int64
+	ReqErrGetUserList         int64
+	ReqErrUserLogin           int64
+	ReqErrUserLogout          int64
+	ReqErrChangePassword      int64
+	ReqErrRequestPwReset      int64
+	ReqErrCompletePwReset     int64
+	ReqErrValidateSession     int64
+	ReqErrListSessions        int64
+	ReqErrRevokeSession       int64
+	ReqErrRevokeAllSessions   int64
+	ReqErrListLoginSessions   int64
+	ReqErrRevokeLoginSessions int64
+	ReqErrImpersonateUser     int64
+	ReqErrUserLoginTOTP       int64
+	ReqErrEnrollTOTP          int64
+	ReqErrConfirmTOTP         int64
+	ReqErrDisableTOTP         int64
+	ReqErrUnlockUser          int64
+	ReqErrVerifyEmail         int64
+	ReqErrListRole            int64
+	ReqErrCreateRole          int64
+	ReqErrDeleteRole          int64
+	ReqErrGrantRole           int64
+	ReqErrRevokeRole          int64
+	ReqErrCreateApiKey        int64
+	ReqErrListApiKeys         int64
+	ReqErrRevokeApiKey        int64
+	ReqErrDeleteUser          int64
+	ReqErrExportUserData      int64
+	ReqErrSearchUser          int64
+	ReqErrImportUsers         int64
+	ReqErrExportUsers         int64
+	ReqErrRenderTemplate      int64
+	ReqErrListMail            int64
+	ReqErrRetryMail           int64
+	ReqErrPurgeMail           int64
+	ReqErrCreateOIDCClient    int64
+	ReqErrListOIDCClient      int64
+	ReqErrDeleteOIDCClient    int64
+	ReqErrOIDCAuthorize       int64
+	ReqErrOIDCToken           int64
+	ReqErrOIDCUserInfo        int64
+	ReqErrPublishAUP          int64
+	ReqErrListAUP             int64
+	ReqErrReportAUP           int64
+	ReqErrShowAUP             int64
+	ReqErrAcceptAUP           int64
+	ReqErrAddSigningKey       int64
+	ReqErrListSigningKeys     int64
+	ReqErrRetireSigningKey    int64
+	ReqErrStatus              int64
+	MailSent                  int64
+	MailRetry                 int64
+	MailDead                  int64
 }
 
 const (
@@ -131,64 +321,88 @@ const (
 	APPVER   = "1.0.0"
 	PIDFILE  = "/var/run/rebung/ghazal.pid"
 	CONFFILE = "/usr/local/etc/rebung/ghazal.json"
+	TPLDIR   = "/usr/local/etc/rebung/ghazal/templates"
+
+	// canonical request signature scheme
+	SIGALG = "N3-HMAC-SHA256"
 
 	// result codes
-	EOK    = 0
-	EINVAL = 1
-	EAGAIN = 2
-	ENOENT = 3
-	EPERM  = 4
+	EOK     = 0
+	EINVAL  = 1
+	EAGAIN  = 2
+	ENOENT  = 3
+	EPERM   = 4
+	EPOLICY = 5
+	EREPLAY = 6
 )
 
 var (
 	app  *AppConfig
 	stat *AppStat
+
+	// statLock guards the counters of stat, which concurrent handlers
+	// bump through incStat
+	statLock sync.Mutex
 )
 
-func serverStatus(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqStatus++
+func incStat(c *int64) {
+	statLock.Lock()
+	*c++
+	statLock.Unlock()
+}
+
+func serverStatus(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqStatus)
+
+	// copied under the lock so the counters are from a single moment
+	statLock.Lock()
+	s := *stat
+	statLock.Unlock()
 
-	buf, _ := json.Marshal(&stat)
-	sendResponse(w, &Msg{Data: string(buf)})
+	buf, _ := json.Marshal(&s)
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
 func defaultHandler(w http.ResponseWriter, r *http.Request) {
-	stat.ReqAll++
+	incStat(&stat.ReqAll)
+
+	li := &LogInfo{}
 
 	var err error
 
 	str := "Invalid request"
 
-	if err = checkUrl(r); err != nil {
-		stat.ReqErrUrl++
-		sendError(w, EINVAL, str, err)
+	if err = checkUrl(li, r); err != nil {
+		incStat(&stat.ReqErrUrl)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
 	if err = checkHeader(r); err != nil {
-		stat.ReqErrHeader++
-		sendError(w, EINVAL, str, err)
+		incStat(&stat.ReqErrHeader)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
 	if err = checkRedis(); err != nil {
-		stat.ReqErrRedis++
-		sendError(w, EINVAL, str, err)
+		incStat(&stat.ReqErrRedis)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
 	var d *RequestMsg
 
-	if d, err = checkData(r); err != nil {
-		stat.ReqErrPayload++
-		sendError(w, EINVAL, str, err)
+	if d, err = checkData(li, r); err != nil {
+		incStat(&stat.ReqErrPayload)
+		sendError(w, li, getDataErrNo(err), str, err)
 		return
 	}
 
 	if li.Msgid, err = getRedisMsgId(d.Command); err != nil {
-		stat.ReqErrMsgId++
-		sendError(w, EINVAL, str, err)
+		incStat(&stat.ReqErrMsgId)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
@@ -196,12 +410,12 @@ func defaultHandler(w http.ResponseWriter, r *http.Request) {
 
 	switch d.Command {
 	case "server-status":
-		err = serverStatus(w, d)
+		err = serverStatus(w, li, d)
 	}
 
 	if err != nil {
 		str += ": " + d.Command
-		sendError(w, EINVAL, str, err)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
@@ -210,11 +424,12 @@ func defaultHandler(w http.ResponseWriter, r *http.Request) {
 
 func main() {
 	var help, debug bool
-	var conf string
+	var conf, migrate string
 
 	flag.BoolVar(&debug, "d", false, "Debug mode")
 	flag.BoolVar(&help, "h", false, "Display usage")
 	flag.StringVar(&conf, "c", CONFFILE, "Configuration file")
+	flag.StringVar(&migrate, "m", "", "Copy users to another user store")
 
 	flag.Parse()
 
@@ -233,10 +448,37 @@ func main() {
 		fatal(err.Error())
 	}
 
+	if err := checkRedis(); err != nil {
+		fatal(err.Error())
+	}
+
+	if err := setupUserStore(); err != nil {
+		fatal(err.Error())
+	}
+
+	if migrate != "" {
+		if err := migrateUserStore(migrate); err != nil {
+			fatal(err.Error())
+		}
+
+		os.Exit(0)
+	}
+
+	var err error
+
+	if mailTpl, err = loadMailTemplates(app.MailTemplateDir); err != nil {
+		fatal(err.Error())
+	}
+
 	go sigHandler()
 
-	event(loginfo, li, "%v-%v server started: %v", app.ProgName, app.Version,
-		app.HostName)
+	event(loginfo, sli, "%v-%v server started: %v", app.ProgName,
+		app.Version, app.HostName)
+
+	// roles are in place before the first admin request comes in
+	if err := setupRoles(); err != nil {
+		fatal(err.Error())
+	}
 
 	if err := setupServer(); err != nil {
 		fatal(err.Error())
@@ -244,33 +486,38 @@ func main() {
 
 	pid := fmt.Sprintf("%v", app.Pid)
 
-        if err := ioutil.WriteFile(PIDFILE, []byte(pid), 0644); err != nil {
+	if err := ioutil.WriteFile(PIDFILE, []byte(pid), 0644); err != nil {
 		fatal(err.Error())
 	}
 
+	go sweepNewUsers()
+	go processMailQueue()
+
 	select {}
 }
 
 func sigHandler() {
 	c := make(chan os.Signal, 1)
 
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-	signal := <-c
+	for signal := range c {
+		event(lognotice, sli, "Signal received: "+signal.String())
 
-	event(lognotice, li, "Signal received: "+signal.String())
-
-	switch signal {
-	case syscall.SIGINT, syscall.SIGTERM:
-		event(lognotice, li, "Terminating..")
-		os.Remove(PIDFILE)
-		os.Exit(0)
+		switch signal {
+		case syscall.SIGHUP:
+			reloadTLS()
+		case syscall.SIGINT, syscall.SIGTERM:
+			event(lognotice, sli, "Terminating..")
+			os.Remove(PIDFILE)
+			os.Exit(0)
+		}
 	}
 }
 
 func usage() {
-	str := fmt.Sprintf("%v-%v\nusage: %v [-d] [-h] [-c config file]\n",
-		APPNAME, APPVER, APPNAME)
+	str := fmt.Sprintf("%v-%v\nusage: %v [-d] [-h] [-c config file] "+
+		"[-m user store]\n", APPNAME, APPVER, APPNAME)
 
 	fmt.Fprintf(os.Stderr, str)
 	os.Exit(1)
@@ -0,0 +1,48 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setupTestStore runs ghazal on a fresh SQLite user store without a Redis
+// server, which keeps the Redis state in the same database. The returned
+// function removes the database.
+func setupTestStore(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "ghazal")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app = &AppConfig{ProgName: APPNAME, Version: APPVER, HostName: "test",
+		UserStore: "sqlite", ClockSkew: 10, SignatureMode: "transition",
+		UserStorePath: filepath.Join(dir, "ghazal.db")}
+	stat = &AppStat{HostName: app.HostName}
+
+	sqliteDb, rdp, trp = nil, nil, nil
+
+	if err = checkRedis(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	if err = setupUserStore(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return func() {
+		rdp.Close()
+		sqliteDb.Close()
+		sqliteDb, rdp, trp = nil, nil, nil
+
+		os.RemoveAll(dir)
+	}
+}
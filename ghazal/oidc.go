@@ -0,0 +1,902 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	htemplate "html/template"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type OIDCClientInfo struct {
+	Id          string
+	Name        string
+	RedirectUri []string
+	Public      bool
+	Created     string
+
+	ErrNo int
+}
+
+type OIDCClientInfoList struct {
+	Id    int64
+	Entry []OIDCClientInfo
+}
+
+// OIDCCode is what an authorization code stands for until it is redeemed
+type OIDCCode struct {
+	Client      string
+	Uid         int64
+	RedirectUri string
+	Scope       string
+	Nonce       string
+	Challenge   string
+	AuthTime    int64
+}
+
+// OIDCAuthRequest carries the authorization request parameters through the
+// login form
+type OIDCAuthRequest struct {
+	ClientId        string
+	ClientName      string
+	RedirectUri     string
+	ResponseType    string
+	Scope           string
+	State           string
+	Nonce           string
+	Challenge       string
+	ChallengeMethod string
+
+	Brand string
+	Error string
+}
+
+var (
+	oidcKey *rsa.PrivateKey
+	oidcKid string
+)
+
+var oidcLoginPage = htemplate.Must(htemplate.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Brand}} sign in</title>
+</head>
+<body>
+<h1>Sign in to {{.ClientName}}</h1>
+<p>with your {{.Brand}} account</p>
+{{if .Error}}<p><strong>{{.Error}}</strong></p>{{end}}
+<form method="post" action="authorize">
+<input type="hidden" name="client_id" value="{{.ClientId}}">
+<input type="hidden" name="redirect_uri" value="{{.RedirectUri}}">
+<input type="hidden" name="response_type" value="{{.ResponseType}}">
+<input type="hidden" name="scope" value="{{.Scope}}">
+<input type="hidden" name="state" value="{{.State}}">
+<input type="hidden" name="nonce" value="{{.Nonce}}">
+<input type="hidden" name="code_challenge" value="{{.Challenge}}">
+<input type="hidden" name="code_challenge_method" value="{{.ChallengeMethod}}">
+<p><label>Login <input type="email" name="login" required></label></p>
+<p><label>Password <input type="password" name="password" required></label></p>
+<p><label>Two-factor code, if enabled <input type="text" name="totp"
+autocomplete="one-time-code"></label></p>
+<p><input type="submit" value="Sign in"></p>
+</form>
+</body>
+</html>
+`))
+
+// setupOIDC serves the OpenID Connect provider endpoints when an issuer is
+// configured
+func setupOIDC() (err error) {
+	if app.OIDCIssuer == "" {
+		return
+	}
+
+	if oidcKey, err = loadOIDCKey(app.OIDCKeyFile); err != nil {
+		return
+	}
+
+	dgst := sha256.Sum256(oidcKey.PublicKey.N.Bytes())
+	oidcKid = encodeOIDCSegment(dgst[:12])
+
+	http.HandleFunc("/.well-known/openid-configuration", oidcDiscovery)
+	http.HandleFunc("/oidc/jwks", oidcJWKS)
+	http.HandleFunc("/oidc/authorize", oidcAuthorize)
+	http.HandleFunc("/oidc/token", oidcToken)
+	http.HandleFunc("/oidc/userinfo", oidcUserInfo)
+
+	event(loginfo, sli, "OpenID Connect provider enabled: %v",
+		app.OIDCIssuer)
+	return
+}
+
+func loadOIDCKey(f string) (k *rsa.PrivateKey, err error) {
+	var data []byte
+
+	if data, err = ioutil.ReadFile(f); err != nil {
+		return k, errors.New("Error reading OpenID Connect key: " + f)
+	}
+
+	var asn1 *pem.Block
+
+	if asn1, _ = pem.Decode(data); asn1 == nil {
+		return k, errors.New("Error decoding OpenID Connect key: " + f)
+	}
+
+	if k, err = x509.ParsePKCS1PrivateKey(asn1.Bytes); err == nil {
+		return
+	}
+
+	var p interface{}
+	var ok bool
+
+	if p, err = x509.ParsePKCS8PrivateKey(asn1.Bytes); err != nil {
+		return k, errors.New("Error parsing OpenID Connect key: " + f)
+	}
+
+	if k, ok = p.(*rsa.PrivateKey); !ok {
+		return k, errors.New("OpenID Connect key is not an RSA key: " + f)
+	}
+
+	return k, nil
+}
+
+func getOIDCUrl(p string) string {
+	return strings.TrimRight(app.OIDCIssuer, "/") + p
+}
+
+// getOIDCRedirect appends the response parameters to a registered redirect
+// URI, which may carry a query of its own
+func getOIDCRedirect(uri string, v url.Values) string {
+	if strings.Contains(uri, "?") {
+		return uri + "&" + v.Encode()
+	}
+
+	return uri + "?" + v.Encode()
+}
+
+func encodeOIDCSegment(b []byte) string {
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(b), "=")
+}
+
+func decodeOIDCSegment(s string) ([]byte, error) {
+	if n := len(s) % 4; n != 0 {
+		s += strings.Repeat("=", 4-n)
+	}
+
+	return base64.URLEncoding.DecodeString(s)
+}
+
+// signOIDCToken returns the claims as an RS256 signed JWT
+func signOIDCToken(c map[string]interface{}) (tok string, err error) {
+	h, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT",
+		"kid": oidcKid})
+	p, _ := json.Marshal(c)
+
+	tok = encodeOIDCSegment(h) + "." + encodeOIDCSegment(p)
+	dgst := sha256.Sum256([]byte(tok))
+
+	var sig []byte
+
+	if sig, err = rsa.SignPKCS1v15(nil, oidcKey, crypto.SHA256,
+		dgst[:]); err != nil {
+		return tok, errors.New("Error signing OpenID Connect token")
+	}
+
+	return tok + "." + encodeOIDCSegment(sig), nil
+}
+
+// checkOIDCToken verifies a token issued by signOIDCToken and returns its
+// claims
+func checkOIDCToken(tok string) (c map[string]interface{}, err error) {
+	p := strings.Split(tok, ".")
+
+	if len(p) != 3 {
+		return c, errors.New("Malformed OpenID Connect token")
+	}
+
+	var sig, data []byte
+
+	if sig, err = decodeOIDCSegment(p[2]); err != nil {
+		return c, errors.New("Malformed OpenID Connect token signature")
+	}
+
+	dgst := sha256.Sum256([]byte(p[0] + "." + p[1]))
+
+	if err = rsa.VerifyPKCS1v15(&oidcKey.PublicKey, crypto.SHA256, dgst[:],
+		sig); err != nil {
+		return c, errors.New("OpenID Connect token signature did not match")
+	}
+
+	if data, err = decodeOIDCSegment(p[1]); err != nil {
+		return c, errors.New("Malformed OpenID Connect token claims")
+	}
+
+	if err = json.Unmarshal(data, &c); err != nil {
+		return c, errors.New("Malformed OpenID Connect token claims")
+	}
+
+	if c["iss"] != app.OIDCIssuer {
+		return c, errors.New(fmt.Sprintf("Invalid token issuer: %v",
+			c["iss"]))
+	}
+
+	if exp, ok := c["exp"].(float64); !ok ||
+		int64(exp) < time.Now().Unix() {
+		return c, errors.New("OpenID Connect token has expired")
+	}
+
+	return c, nil
+}
+
+// checkOIDCRedirectUri accepts absolute https URLs, and http only for
+// clients running on the local host
+func checkOIDCRedirectUri(s string) (err error) {
+	var u *url.URL
+
+	if u, err = url.Parse(s); err != nil || u.Host == "" ||
+		u.Fragment != "" {
+		return errors.New("Invalid redirect URI: " + s)
+	}
+
+	h := strings.Split(u.Host, ":")[0]
+
+	if u.Scheme == "https" || (u.Scheme == "http" &&
+		(h == "localhost" || h == "127.0.0.1")) {
+		return nil
+	}
+
+	return errors.New("Redirect URI must use https: " + s)
+}
+
+// checkOIDCAuthRequest validates an authorization request. Errors that leave
+// the redirect URI unverified are returned without an OAuth error code, they
+// must not be redirected to the client.
+func checkOIDCAuthRequest(a *OIDCAuthRequest) (code string, err error) {
+	var c *OIDCClientInfo
+
+	if c, _, err = getRedisOIDCClient(a.ClientId); err != nil {
+		return "", errors.New("Unknown client: " + a.ClientId)
+	}
+
+	a.ClientName = c.Name
+
+	var ok bool
+
+	for i := range c.RedirectUri {
+		if a.RedirectUri == c.RedirectUri[i] {
+			ok = true
+		}
+	}
+
+	if !ok {
+		return "", errors.New("Redirect URI not registered: " +
+			a.RedirectUri)
+	}
+
+	if a.ResponseType != "code" {
+		return "unsupported_response_type", errors.New("Unsupported " +
+			"response type: " + a.ResponseType)
+	}
+
+	ok = false
+
+	for _, v := range strings.Fields(a.Scope) {
+		if v == "openid" {
+			ok = true
+		}
+	}
+
+	if !ok {
+		return "invalid_scope", errors.New("Scope lacks openid: " + a.Scope)
+	}
+
+	// PKCE is required of every client, public or not
+	if a.Challenge == "" || a.ChallengeMethod != "S256" {
+		return "invalid_request", errors.New("S256 code challenge required")
+	}
+
+	return "", nil
+}
+
+// checkOIDCLogin authenticates the user on the login form, with the same
+// lockout and second factor rules as the login command
+func checkOIDCLogin(li *LogInfo, login, pw, code, ip string) (uid int64,
+	err error) {
+	if err = checkUserLoginBlock(li, login, ip); err != nil {
+		return
+	}
+
+	if uid, err = users.GetUserIdFromLogin(login); err != nil {
+		setUserLoginFail(li, 0, login, ip, "failed")
+		return
+	}
+
+	if err = users.CheckUserStatus(uid); err != nil {
+		return
+	}
+
+	if err = checkUserPassword(uid, login, pw); err != nil {
+		setUserLoginFail(li, uid, login, ip, "failed")
+		return
+	}
+
+	var secret string
+
+	if secret, _, _, err = getRedisUserTOTP(uid); err != nil {
+		return
+	}
+
+	if secret != "" {
+		if err = checkUserTOTP(li, uid, code); err != nil {
+			setUserLoginFail(li, uid, login, ip,
+				"two-factor failed")
+			return
+		}
+	}
+
+	var s *UserInfo
+
+	if s, err = users.GetUserInfo(uid); err != nil {
+		return
+	}
+
+	if s.FirstLogin == "" {
+		if err = users.SetUserFirstLogin(uid, ip); err != nil {
+			return
+		}
+	}
+
+	if err = deleteRedisLoginFail(login); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	return uid, nil
+}
+
+// getOIDCClaims returns the user claims the granted scopes allow
+func getOIDCClaims(s *UserInfo, scope string) map[string]interface{} {
+	c := map[string]interface{}{"sub": fmt.Sprintf("%v", s.Id)}
+
+	for _, v := range strings.Fields(scope) {
+		switch v {
+		case "profile":
+			c["name"] = s.Name
+			c["preferred_username"] = s.Login
+
+			if s.Locale != "" {
+				c["locale"] = s.Locale
+			}
+
+		case "email":
+			c["email"] = s.Login
+			c["email_verified"] = s.Verified != ""
+		}
+	}
+
+	return c
+}
+
+// getOIDCClientAuth reads the client credentials from HTTP basic
+// authentication or, failing that, from the form
+func getOIDCClientAuth(r *http.Request) (id, secret string) {
+	h := r.Header.Get("Authorization")
+
+	if !strings.HasPrefix(h, "Basic ") {
+		return r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	b, err := base64.StdEncoding.DecodeString(h[6:])
+
+	if err != nil {
+		return
+	}
+
+	p := strings.SplitN(string(b), ":", 2)
+
+	if len(p) != 2 {
+		return
+	}
+
+	id, _ = url.QueryUnescape(p[0])
+	secret, _ = url.QueryUnescape(p[1])
+	return
+}
+
+func setOIDCRequest(r *http.Request) *LogInfo {
+	incStat(&stat.ReqAll)
+
+	li := &LogInfo{Src: getRequestSource(r)}
+
+	event(logdebug, li, "New connection from %v to %v", li.Src, r.URL.Path)
+	return li
+}
+
+func sendOIDCResponse(w http.ResponseWriter, i int, v interface{}) {
+	buf, _ := json.Marshal(v)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(i)
+	w.Write(buf)
+}
+
+func sendOIDCError(w http.ResponseWriter, li *LogInfo, i int, code string,
+	e error) {
+	event(logwarn, li, e.Error())
+	incStat(&stat.ReqError)
+
+	sendOIDCResponse(w, i, map[string]string{"error": code,
+		"error_description": e.Error()})
+}
+
+func sendOIDCLoginPage(w http.ResponseWriter, li *LogInfo,
+	a *OIDCAuthRequest) {
+	a.Brand = app.BrandName
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+
+	if err := oidcLoginPage.Execute(w, a); err != nil {
+		event(logwarn, li, err.Error())
+	}
+}
+
+func oidcDiscovery(w http.ResponseWriter, r *http.Request) {
+	setOIDCRequest(r)
+
+	sendOIDCResponse(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                app.OIDCIssuer,
+		"authorization_endpoint":                getOIDCUrl("/oidc/authorize"),
+		"token_endpoint":                        getOIDCUrl("/oidc/token"),
+		"userinfo_endpoint":                     getOIDCUrl("/oidc/userinfo"),
+		"jwks_uri":                              getOIDCUrl("/oidc/jwks"),
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported": []string{"openid", "profile",
+			"email"},
+		"token_endpoint_auth_methods_supported": []string{
+			"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported": []string{"S256"},
+		"claims_supported": []string{"sub", "name",
+			"preferred_username", "locale", "email", "email_verified"},
+	})
+}
+
+func oidcJWKS(w http.ResponseWriter, r *http.Request) {
+	setOIDCRequest(r)
+
+	k := oidcKey.PublicKey
+	e := big.NewInt(int64(k.E)).Bytes()
+
+	sendOIDCResponse(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{map[string]string{"kty": "RSA",
+			"use": "sig", "alg": "RS256", "kid": oidcKid,
+			"n": encodeOIDCSegment(k.N.Bytes()),
+			"e": encodeOIDCSegment(e)}}})
+}
+
+func oidcAuthorize(w http.ResponseWriter, r *http.Request) {
+	li := setOIDCRequest(r)
+	incStat(&stat.ReqOIDCAuthorize)
+
+	var err error
+
+	if err = checkRedis(); err != nil {
+		incStat(&stat.ReqErrRedis)
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	r.ParseForm()
+
+	a := &OIDCAuthRequest{ClientId: r.Form.Get("client_id"),
+		RedirectUri:  r.Form.Get("redirect_uri"),
+		ResponseType: r.Form.Get("response_type"),
+		Scope:        r.Form.Get("scope"), State: r.Form.Get("state"),
+		Nonce: r.Form.Get("nonce"), Challenge: r.Form.Get("code_challenge"),
+		ChallengeMethod: r.Form.Get("code_challenge_method")}
+
+	var code string
+
+	if code, err = checkOIDCAuthRequest(a); err != nil {
+		incStat(&stat.ReqErrOIDCAuthorize)
+		event(logwarn, li, err.Error())
+
+		if code == "" {
+			http.Error(w, "Invalid authorization request",
+				http.StatusBadRequest)
+			return
+		}
+
+		v := url.Values{"error": {code}, "error_description": {err.Error()}}
+
+		if a.State != "" {
+			v.Set("state", a.State)
+		}
+
+		http.Redirect(w, r, getOIDCRedirect(a.RedirectUri, v),
+			http.StatusFound)
+		return
+	}
+
+	if r.Method != "POST" {
+		sendOIDCLoginPage(w, li, a)
+		return
+	}
+
+	var uid int64
+
+	if uid, err = checkOIDCLogin(li, r.PostForm.Get("login"),
+		r.PostForm.Get("password"), r.PostForm.Get("totp"),
+		li.Src); err != nil {
+		incStat(&stat.ReqErrOIDCAuthorize)
+		event(logwarn, li, err.Error())
+
+		a.Error = "Sign in failed, check your login and password"
+		sendOIDCLoginPage(w, li, a)
+		return
+	}
+
+	li.Uid = uid
+
+	if code, err = generateToken(24); err != nil {
+		incStat(&stat.ReqErrOIDCAuthorize)
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	c := &OIDCCode{Client: a.ClientId, Uid: uid, RedirectUri: a.RedirectUri,
+		Scope: a.Scope, Nonce: a.Nonce, Challenge: a.Challenge,
+		AuthTime: time.Now().Unix()}
+
+	if err = setRedisOIDCCode(hashToken(code), c,
+		app.OIDCCodeTTL); err != nil {
+		incStat(&stat.ReqErrOIDCAuthorize)
+		event(logwarn, li, err.Error())
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	if err = users.SetUserLogin(uid, li.Src,
+		"oidc: "+a.ClientName); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	v := url.Values{"code": {code}}
+
+	if a.State != "" {
+		v.Set("state", a.State)
+	}
+
+	event(lognotice, li, "User [%v] signed in to OpenID Connect client %v",
+		uid, a.ClientId)
+
+	http.Redirect(w, r, getOIDCRedirect(a.RedirectUri, v), http.StatusFound)
+}
+
+func oidcToken(w http.ResponseWriter, r *http.Request) {
+	li := setOIDCRequest(r)
+	incStat(&stat.ReqOIDCToken)
+
+	var err error
+
+	if err = checkRedis(); err != nil {
+		incStat(&stat.ReqErrRedis)
+		sendOIDCError(w, li, http.StatusServiceUnavailable,
+			"server_error", err)
+		return
+	}
+
+	if r.Method != "POST" {
+		incStat(&stat.ReqErrOIDCToken)
+		sendOIDCError(w, li, http.StatusMethodNotAllowed,
+			"invalid_request",
+			errors.New("Invalid method: "+r.Method))
+		return
+	}
+
+	r.ParseForm()
+
+	if g := r.PostForm.Get("grant_type"); g != "authorization_code" {
+		incStat(&stat.ReqErrOIDCToken)
+		sendOIDCError(w, li, http.StatusBadRequest,
+			"unsupported_grant_type",
+			errors.New("Unsupported grant type: "+g))
+		return
+	}
+
+	id, secret := getOIDCClientAuth(r)
+
+	var dgst string
+
+	if _, dgst, err = getRedisOIDCClient(id); err != nil ||
+		(dgst != "" && subtle.ConstantTimeCompare([]byte(hashToken(secret)),
+			[]byte(dgst)) != 1) {
+		incStat(&stat.ReqErrOIDCToken)
+		w.Header().Set("WWW-Authenticate", "Basic")
+		sendOIDCError(w, li, http.StatusUnauthorized, "invalid_client",
+			errors.New("Client authentication failed: "+id))
+		return
+	}
+
+	var c *OIDCCode
+
+	if c, err = getRedisOIDCCode(hashToken(r.PostForm.Get(
+		"code"))); err != nil {
+		incStat(&stat.ReqErrOIDCToken)
+		sendOIDCError(w, li, http.StatusBadRequest, "invalid_grant",
+			err)
+		return
+	}
+
+	v := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+
+	if c.Client != id || c.RedirectUri != r.PostForm.Get("redirect_uri") ||
+		encodeOIDCSegment(v[:]) != c.Challenge {
+		incStat(&stat.ReqErrOIDCToken)
+		sendOIDCError(w, li, http.StatusBadRequest, "invalid_grant",
+			errors.New("Authorization code does not match the request"))
+		return
+	}
+
+	li.Uid = c.Uid
+
+	var s *UserInfo
+
+	if err = users.CheckUserStatus(c.Uid); err == nil {
+		s, err = users.GetUserInfo(c.Uid)
+	}
+
+	if err != nil {
+		incStat(&stat.ReqErrOIDCToken)
+		sendOIDCError(w, li, http.StatusBadRequest, "invalid_grant",
+			err)
+		return
+	}
+
+	now := time.Now().Unix()
+	exp := now + app.OIDCTokenTTL
+
+	at := map[string]interface{}{"iss": app.OIDCIssuer,
+		"sub": fmt.Sprintf("%v", c.Uid), "aud": id, "client_id": id,
+		"iat": now, "exp": exp, "scope": c.Scope, "token_use": "access"}
+
+	it := getOIDCClaims(s, c.Scope)
+	it["iss"], it["aud"], it["iat"], it["exp"] = app.OIDCIssuer, id, now, exp
+	it["auth_time"] = c.AuthTime
+
+	if c.Nonce != "" {
+		it["nonce"] = c.Nonce
+	}
+
+	var atok, itok string
+
+	if atok, err = signOIDCToken(at); err == nil {
+		itok, err = signOIDCToken(it)
+	}
+
+	if err != nil {
+		incStat(&stat.ReqErrOIDCToken)
+		sendOIDCError(w, li, http.StatusInternalServerError,
+			"server_error", err)
+		return
+	}
+
+	event(logdebug, li, "Tokens issued to OpenID Connect client %v", id)
+
+	sendOIDCResponse(w, http.StatusOK, map[string]interface{}{
+		"access_token": atok, "token_type": "Bearer",
+		"expires_in": app.OIDCTokenTTL, "id_token": itok,
+		"scope": c.Scope})
+}
+
+func oidcUserInfo(w http.ResponseWriter, r *http.Request) {
+	li := setOIDCRequest(r)
+	incStat(&stat.ReqOIDCUserInfo)
+
+	var err error
+
+	if err = checkRedis(); err != nil {
+		incStat(&stat.ReqErrRedis)
+		sendOIDCError(w, li, http.StatusServiceUnavailable,
+			"server_error", err)
+		return
+	}
+
+	h := r.Header.Get("Authorization")
+
+	var c map[string]interface{}
+
+	if !strings.HasPrefix(h, "Bearer ") {
+		err = errors.New("Bearer token required")
+	} else if c, err = checkOIDCToken(h[7:]); err == nil &&
+		c["token_use"] != "access" {
+		err = errors.New("Token is not an access token")
+	}
+
+	var s *UserInfo
+
+	if err == nil {
+		var uid int64
+
+		fmt.Sscan(fmt.Sprintf("%v", c["sub"]), &uid)
+		li.Uid = uid
+
+		if err = users.CheckUserStatus(uid); err == nil {
+			s, err = users.GetUserInfo(uid)
+		}
+	}
+
+	if err != nil {
+		incStat(&stat.ReqErrOIDCUserInfo)
+		w.Header().Set("WWW-Authenticate", "Bearer error=\"invalid_token\"")
+		sendOIDCError(w, li, http.StatusUnauthorized, "invalid_token",
+			err)
+		return
+	}
+
+	sendOIDCResponse(w, http.StatusOK, getOIDCClaims(s,
+		fmt.Sprintf("%v", c["scope"])))
+}
+
+func createOIDCClient(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqCreateOIDCClient)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrCreateOIDCClient)
+		return
+	}
+
+	c := &OIDCClientInfo{Created: time.Now().Format(time.RFC1123)}
+
+	for i := range m.Entry {
+		e := m.Entry[i]
+
+		switch e.Name {
+		case "name":
+			c.Name = e.Opt
+		case "redirect-uri":
+			if err = checkOIDCRedirectUri(e.Opt); err != nil {
+				incStat(&stat.ReqErrCreateOIDCClient)
+				return
+			}
+
+			c.RedirectUri = append(c.RedirectUri, e.Opt)
+		case "public":
+			c.Public = e.Opt == "true"
+		default:
+			incStat(&stat.ReqErrCreateOIDCClient)
+			return errors.New("Invalid client parameter: " + e.Name)
+		}
+	}
+
+	if c.Name == "" || len(c.RedirectUri) == 0 {
+		incStat(&stat.ReqErrCreateOIDCClient)
+		return errors.New("Insufficient client parameters")
+	}
+
+	var secret, dgst string
+
+	if c.Id, err = generateToken(12); err != nil {
+		incStat(&stat.ReqErrCreateOIDCClient)
+		return
+	}
+
+	// public clients cannot keep a secret and rely on PKCE alone
+	if !c.Public {
+		if secret, err = generateToken(30); err != nil {
+			incStat(&stat.ReqErrCreateOIDCClient)
+			return
+		}
+
+		dgst = hashToken(secret)
+	}
+
+	if err = setRedisOIDCClient(li, c, dgst); err != nil {
+		incStat(&stat.ReqErrCreateOIDCClient)
+		return
+	}
+
+	event(lognotice, li, "OpenID Connect client %v [%v] created by user "+
+		"[%v]", c.Name, c.Id, d.UserId)
+
+	// the secret is only ever shown here
+	si := []Name{Name{Name: c.Id, Opt: secret}}
+
+	buf, _ := json.Marshal(&NameList{Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+func listOIDCClient(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqListOIDCClient)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrListOIDCClient)
+		return
+	}
+
+	var ids []string
+
+	// a single empty entry lists all clients
+	if len(m.Entry) == 1 && m.Entry[0].Name == "" {
+		if ids, err = getRedisOIDCClientList(); err != nil {
+			incStat(&stat.ReqErrListOIDCClient)
+			return
+		}
+	} else {
+		for i := range m.Entry {
+			ids = append(ids, m.Entry[i].Name)
+		}
+	}
+
+	si := make([]OIDCClientInfo, len(ids))
+
+	for i := range ids {
+		if c, _, err := getRedisOIDCClient(ids[i]); err != nil {
+			si[i] = OIDCClientInfo{Id: ids[i], ErrNo: ENOENT}
+		} else {
+			si[i] = *c
+		}
+	}
+
+	buf, _ := json.Marshal(&OIDCClientInfoList{Id: int64(len(si)),
+		Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+func deleteOIDCClient(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqDeleteOIDCClient)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrDeleteOIDCClient)
+		return
+	}
+
+	si := make([]Name, len(m.Entry))
+
+	for i := range m.Entry {
+		e := m.Entry[i]
+		si[i] = Name{Name: e.Name}
+
+		if err := deleteRedisOIDCClient(li, e.Name); err != nil {
+			event(logwarn, li, err.Error())
+			si[i].ErrNo = ENOENT
+		}
+	}
+
+	buf, _ := json.Marshal(&NameList{Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"bufio"
+	"code.google.com/p/go.crypto/bcrypt"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// PolicyError names each password policy rule a password failed, it is
+// sent back as EPOLICY with the rules as a NameList
+type PolicyError struct {
+	Rules []Name
+}
+
+func (e *PolicyError) Error() string {
+	r := make([]string, len(e.Rules))
+
+	for i := range e.Rules {
+		r[i] = e.Rules[i].Name
+	}
+
+	return "Password policy violated: " + strings.Join(r, ", ")
+}
+
+func (e *PolicyError) Data() string {
+	buf, _ := json.Marshal(&NameList{Entry: e.Rules})
+	return string(buf)
+}
+
+// character classes a policy may require
+var passwordClasses = map[string]struct {
+	desc string
+	fn   func(rune) bool
+}{
+	"lower": {"a lower case letter", unicode.IsLower},
+	"upper": {"an upper case letter", unicode.IsUpper},
+	"digit": {"a digit", unicode.IsDigit},
+	"symbol": {"a symbol", func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) &&
+			!unicode.IsSpace(r)
+	}},
+}
+
+// checkPasswordPolicy returns a PolicyError listing every rule the password
+// fails for the user
+func checkPasswordPolicy(li *LogInfo, s *UserInfo, pw string) (err error) {
+	p := app.PasswordPolicy
+
+	var rules []Name
+
+	fail := func(rule, msg string) {
+		rules = append(rules, Name{Name: rule, ErrNo: EINVAL, Opt: msg})
+	}
+
+	if n := len([]rune(pw)); n < p.MinLength {
+		fail("min-length", fmt.Sprintf("must be at least %v characters",
+			p.MinLength))
+	}
+
+	for _, c := range p.Classes {
+		if strings.IndexFunc(pw, passwordClasses[c].fn) < 0 {
+			fail("class-"+c, "must contain "+passwordClasses[c].desc)
+		}
+	}
+
+	for _, v := range getPasswordBannedWords(s) {
+		if strings.Contains(strings.ToLower(pw), v) {
+			fail("banned-word", "must not contain "+v)
+		}
+	}
+
+	if p.History > 0 && checkPasswordHistory(li, s, pw) {
+		fail("history", fmt.Sprintf("must not reuse any of the last %v "+
+			"passwords", p.History))
+	}
+
+	if p.BreachedDir != "" {
+		if ok, err := checkPasswordBreached(pw); err != nil {
+			event(logwarn, li, err.Error())
+		} else if ok {
+			fail("breached", "appears in a list of breached passwords")
+		}
+	}
+
+	if len(rules) != 0 {
+		incStat(&stat.ReqErrPasswordPolicy)
+		return &PolicyError{Rules: rules}
+	}
+
+	return
+}
+
+// getPasswordBannedWords returns the configured words along with the login
+// and the words of the user name, ignoring anything shorter than 3 letters
+func getPasswordBannedWords(s *UserInfo) (l []string) {
+	w := append([]string{}, app.PasswordPolicy.BannedWords...)
+	w = append(w, strings.Split(s.Login, "@")[0])
+	w = append(w, strings.Fields(s.Name)...)
+
+	seen := make(map[string]bool)
+
+	for i := range w {
+		v := strings.ToLower(w[i])
+
+		if len([]rune(v)) < 3 || seen[v] {
+			continue
+		}
+
+		seen[v] = true
+		l = append(l, v)
+	}
+
+	return
+}
+
+// checkPasswordHistory reports whether pw matches the current password or
+// one kept in the password history
+func checkPasswordHistory(li *LogInfo, s *UserInfo, pw string) bool {
+	l, err := getRedisUserPasswordHistory(s.Id)
+
+	if err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	l = append(l, s.Password)
+
+	for i := range l {
+		if bcrypt.CompareHashAndPassword([]byte(l[i]), []byte(pw)) == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkPasswordBreached looks the password up in a local copy of a
+// k-anonymity breached password list. Each file in BreachedDir is named
+// after the first 5 hex digits of the SHA-1 digest and holds one
+// SUFFIX:COUNT line for every breached digest with that prefix.
+func checkPasswordBreached(pw string) (ok bool, err error) {
+	dgst := strings.ToUpper(fmt.Sprintf("%x", sha1.Sum([]byte(pw))))
+
+	var f *os.File
+
+	if f, err = os.Open(filepath.Join(app.PasswordPolicy.BreachedDir,
+		dgst[:5])); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return
+	}
+
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+
+	for sc.Scan() {
+		if strings.HasPrefix(strings.ToUpper(sc.Text()), dgst[5:]+":") {
+			return true, nil
+		}
+	}
+
+	return false, sc.Err()
+}
+
+// setUserPassword applies the password policy, then stores the new
+// password and records it in the password history
+func setUserPassword(li *LogInfo, uid int64, pw, ip string) (err error) {
+	var s *UserInfo
+
+	if s, err = users.GetUserInfo(uid); err != nil {
+		return
+	}
+
+	if err = checkPasswordPolicy(li, s, pw); err != nil {
+		return
+	}
+
+	var dgst []byte
+
+	if dgst, err = bcrypt.GenerateFromPassword([]byte(pw), 10); err != nil {
+		return errors.New("Error generating password")
+	}
+
+	if err = users.SetUserAttr(li, uid, "password", string(dgst),
+		ip); err != nil {
+		return
+	}
+
+	if app.PasswordPolicy.History > 0 {
+		if err = setRedisUserPasswordHistory(uid, string(dgst),
+			app.PasswordPolicy.History); err != nil {
+			event(logwarn, li, err.Error())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"code.google.com/p/go.crypto/bcrypt"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckPasswordPolicy(t *testing.T) {
+	defer setupTestStore(t)()
+
+	dir, err := ioutil.TempDir("", "breached")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// a breached password list in the k-anonymity layout
+	dgst := strings.ToUpper(fmt.Sprintf("%x",
+		sha1.Sum([]byte("Breached#Pw1"))))
+	buf := "0000000000000000000000000000000000A:3\n" + dgst[5:] + ":12\n"
+
+	if err = ioutil.WriteFile(filepath.Join(dir, dgst[:5]), []byte(buf),
+		0600); err != nil {
+		t.Fatal(err)
+	}
+
+	app.PasswordPolicy = PasswordPolicy{MinLength: 10,
+		Classes:     []string{"lower", "upper", "digit", "symbol"},
+		BannedWords: []string{"Acme", "it"}, History: 2,
+		BreachedDir: dir}
+
+	hash := func(pw string) string {
+		h, err := bcrypt.GenerateFromPassword([]byte(pw),
+			bcrypt.MinCost)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return string(h)
+	}
+
+	s := &UserInfo{Id: 1, Login: "jsmith@example.com", Name: "John Doe",
+		Password: hash("Current#Pass9")}
+
+	if err = setRedisUserPasswordHistory(s.Id, hash("Older#Pass99"),
+		app.PasswordPolicy.History); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		pw    string
+		rules string
+	}{
+		{"Xy7#longenough", ""},
+		{"Xy7#a", "min-length"},
+		{"xy7#longenough", "class-upper"},
+		{"XY7#LONGENOUGH", "class-lower"},
+		{"Xyz#longenough", "class-digit"},
+		{"Xy7 longenough", "class-symbol"},
+		{"Xy7#AcmeRocket", "banned-word"},
+		{"Xy7#JohnRocket", "banned-word"},
+		{"Xy7#rocketJSMITH", "banned-word"},
+		{"Current#Pass9", "history"},
+		{"Older#Pass99", "history"},
+		{"Breached#Pw1", "breached"},
+		{"short", "min-length,class-upper,class-digit,class-symbol"},
+		{"Acme#Doe1", "min-length,banned-word,banned-word"},
+	}
+
+	for _, v := range tests {
+		err := checkPasswordPolicy(&LogInfo{}, s, v.pw)
+
+		var r []string
+
+		if e, ok := err.(*PolicyError); ok {
+			for i := range e.Rules {
+				r = append(r, e.Rules[i].Name)
+			}
+		} else if err != nil {
+			t.Fatalf("%v: %v", v.pw, err)
+		}
+
+		if strings.Join(r, ",") != v.rules {
+			t.Errorf("%v: got rules %v, want %v", v.pw,
+				strings.Join(r, ","), v.rules)
+		}
+	}
+}
+
+func TestCheckPasswordBreached(t *testing.T) {
+	app = &AppConfig{PasswordPolicy: PasswordPolicy{BreachedDir: "/none"}}
+
+	// a list without the prefix file is not an error
+	if ok, err := checkPasswordBreached("anything"); ok || err != nil {
+		t.Errorf("got %v, %v for a missing prefix file", ok, err)
+	}
+}
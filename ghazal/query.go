@@ -0,0 +1,555 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// the page size limits of list-user and get-user-list
+const (
+	queryLimit    = 10
+	queryLimitMax = 500
+)
+
+// UserQuery selects a page of users for list-user, or a page of a user's
+// activity or login history for get-user-list. Filters must all match, sorts
+// apply in order and the cursor carries on from where the previous page of
+// the same query ended.
+type UserQuery struct {
+	List   string
+	Filter []UserFilter
+	Sort   []UserSort
+	Limit  int64
+	Cursor string
+}
+
+// UserFilter compares a field with eq, ne, lt, gt, prefix or contains.
+// Numeric fields compare as numbers, the rest as strings without case.
+type UserFilter struct {
+	Field string
+	Op    string
+	Value string
+}
+
+type UserSort struct {
+	Field string
+	Desc  bool
+}
+
+// UserEventList is a page of a user's activity or login history
+type UserEventList struct {
+	Id     int64
+	Entry  []Name
+	Cursor string
+}
+
+// queryCursor is the signed content of a cursor token. Q is the digest of
+// the query it belongs to, P the index position for queries served by an
+// index, K and U the sort values and ID of the last user otherwise.
+type queryCursor struct {
+	Q string
+	P string
+	K []string
+	U int64
+}
+
+// the sort fields that the store indexes serve without loading every user
+var queryIndexes = map[string]string{
+	"Id":      "id",
+	"RegDate": "registered",
+	"Login":   "login",
+	"Name":    "name",
+}
+
+// the lists that are a test of a user attribute
+var queryListFilters = map[string]UserFilter{
+	"enabled":  UserFilter{Field: "Admin", Op: "eq", Value: "enabled"},
+	"disabled": UserFilter{Field: "Admin", Op: "eq", Value: "disabled"},
+	"active":   UserFilter{Field: "Status", Op: "eq", Value: "active"},
+	"inactive": UserFilter{Field: "Status", Op: "eq", Value: "inactive"},
+}
+
+// getUserField returns the UserInfo field a query names, matched without
+// case. The password digest and the response bookkeeping are not
+// selectable and Registered stands for the sortable RegDate.
+func getUserField(name string) (f string, numeric bool, err error) {
+	if strings.EqualFold(name, "registered") {
+		name = "RegDate"
+	}
+
+	t := reflect.TypeOf(UserInfo{})
+
+	for i := 0; i < t.NumField(); i++ {
+		v := t.Field(i)
+
+		if !strings.EqualFold(v.Name, name) || v.Name == "Password" ||
+			v.Name == "Idx" || v.Name == "ErrNo" {
+			continue
+		}
+
+		return v.Name, v.Type.Kind() == reflect.Int64, nil
+	}
+
+	return f, numeric, errors.New("Invalid user field: " + name)
+}
+
+func getUserFieldValue(s *UserInfo, f string) string {
+	v := reflect.ValueOf(s).Elem().FieldByName(f)
+
+	if v.Kind() == reflect.Int64 {
+		return strconv.FormatInt(v.Int(), 10)
+	}
+
+	return v.String()
+}
+
+func compareUserField(numeric bool, a, b string) int {
+	if numeric {
+		x, _ := strconv.ParseInt(a, 0, 64)
+		y, _ := strconv.ParseInt(b, 0, 64)
+
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+
+		return 0
+	}
+
+	a, b = strings.ToLower(a), strings.ToLower(b)
+
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+
+	return 0
+}
+
+// getUserQuery decodes a query, checks its list, page size and filter
+// operators and fills in the defaults
+func getUserQuery(s string, lists map[string]bool) (q *UserQuery,
+	err error) {
+	if err = json.Unmarshal([]byte(s), &q); err != nil || q == nil {
+		return nil, errors.New("Invalid list query")
+	}
+
+	if q.List == "" {
+		q.List = "all"
+	}
+
+	if !lists[q.List] {
+		return nil, errors.New("Invalid list: " + q.List)
+	}
+
+	if q.Limit == 0 {
+		q.Limit = queryLimit
+	}
+
+	if q.Limit < 1 || q.Limit > queryLimitMax {
+		return nil, errors.New(fmt.Sprintf("Invalid list limit: %v",
+			q.Limit))
+	}
+
+	for i := range q.Filter {
+		f := &q.Filter[i]
+
+		switch f.Op {
+		case "eq", "ne", "lt", "gt", "prefix", "contains":
+		default:
+			return nil, errors.New("Invalid filter operator: " + f.Op)
+		}
+	}
+
+	return
+}
+
+// getQueryDigest identifies a query apart from its page size and cursor so
+// a cursor cannot be replayed against a different query
+func getQueryDigest(q *UserQuery, id int64) string {
+	c := *q
+	c.Limit, c.Cursor = 0, ""
+
+	buf, _ := json.Marshal(&c)
+	h := sha256.Sum256([]byte(fmt.Sprintf("%v:%s", id, buf)))
+
+	return hex.EncodeToString(h[:8])
+}
+
+// getQueryCursor signs the position of the last entry on a page
+func getQueryCursor(c *queryCursor) string {
+	buf, _ := json.Marshal(c)
+
+	dgst := hmac.New(sha256.New, []byte(app.Secret))
+	dgst.Write([]byte("cursor:"))
+	dgst.Write(buf)
+
+	return base64.URLEncoding.EncodeToString(buf) + "." +
+		base64.URLEncoding.EncodeToString(dgst.Sum(nil))
+}
+
+func checkQueryCursor(tok, q string) (c *queryCursor, err error) {
+	t := strings.Split(tok, ".")
+
+	if len(t) != 2 {
+		return nil, errors.New("Invalid list cursor")
+	}
+
+	var buf []byte
+
+	if buf, err = base64.URLEncoding.DecodeString(t[0]); err != nil {
+		return nil, errors.New("Invalid list cursor")
+	}
+
+	if err = json.Unmarshal(buf, &c); err != nil || c == nil {
+		return nil, errors.New("Invalid list cursor")
+	}
+
+	if !hmac.Equal([]byte(getQueryCursor(c)), []byte(tok)) {
+		return nil, errors.New("List cursor signature does not match")
+	}
+
+	if c.Q != q {
+		return nil, errors.New("List cursor belongs to a different query")
+	}
+
+	return
+}
+
+// queryUsers returns a page of users matching q and the cursor of the next
+// page, empty on the last one
+func queryUsers(li *LogInfo, q *UserQuery) (si []UserInfo, next string,
+	err error) {
+	var fl []UserFilter
+	var fn []bool
+
+	if f, ok := queryListFilters[q.List]; ok {
+		fl = append(fl, f)
+	}
+
+	fl = append(fl, q.Filter...)
+
+	for i := range fl {
+		var n bool
+
+		if fl[i].Field, n, err = getUserField(fl[i].Field); err != nil {
+			return
+		}
+
+		fn = append(fn, n)
+	}
+
+	sl := append([]UserSort{}, q.Sort...)
+	sn := make([]bool, len(sl))
+
+	for i := range sl {
+		if sl[i].Field, sn[i], err = getUserField(sl[i].Field); err != nil {
+			return
+		}
+	}
+
+	// the role holder and new user lists are not user attributes
+	var member map[int64]bool
+
+	if q.List == "new" || q.List == "admin" {
+		member = make(map[int64]bool)
+		v, _ := users.GetUserList(q.List)
+
+		for i := range v {
+			uid, _ := strconv.ParseInt(v[i], 0, 64)
+			member[uid] = true
+		}
+	}
+
+	match := func(s *UserInfo) bool {
+		if member != nil && !member[s.Id] {
+			return false
+		}
+
+		for i := range fl {
+			f := &fl[i]
+			v := getUserFieldValue(s, f.Field)
+			c := compareUserField(fn[i], v, f.Value)
+			lv, lf := strings.ToLower(v), strings.ToLower(f.Value)
+
+			if (f.Op == "eq" && c != 0) || (f.Op == "ne" && c == 0) ||
+				(f.Op == "lt" && c >= 0) || (f.Op == "gt" && c <= 0) ||
+				(f.Op == "prefix" && !strings.HasPrefix(lv, lf)) ||
+				(f.Op == "contains" && !strings.Contains(lv, lf)) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	qd := getQueryDigest(q, 0)
+	cur := &queryCursor{Q: qd}
+
+	if q.Cursor != "" {
+		if cur, err = checkQueryCursor(q.Cursor, qd); err != nil {
+			return
+		}
+	}
+
+	if len(sl) == 0 {
+		sl = []UserSort{UserSort{Field: "Id"}}
+		sn = []bool{true}
+	}
+
+	if idx, ok := queryIndexes[sl[0].Field]; ok && len(sl) == 1 {
+		return queryUserIndex(li, q, idx, sl[0].Desc, cur, match)
+	}
+
+	return queryUserSort(li, q, sl, sn, cur, match)
+}
+
+// queryUserIndex walks a store index in batches, so only the users up to
+// the end of the page are loaded
+func queryUserIndex(li *LogInfo, q *UserQuery, idx string, desc bool,
+	cur *queryCursor, match func(*UserInfo) bool) (si []UserInfo,
+	next string, err error) {
+	var sp []string
+
+	n := q.Limit + 1
+
+	if n < 100 {
+		n = 100
+	}
+
+	for pos := cur.P; int64(len(si)) <= q.Limit; {
+		var l []int64
+		var p []string
+
+		if l, p, err = users.GetUserSorted(idx, desc, pos, n); err != nil {
+			return
+		}
+
+		for i := range l {
+			s, err := users.GetUserInfo(l[i])
+
+			if err != nil {
+				event(logwarn, li, err.Error())
+				continue
+			}
+
+			if !match(s) {
+				continue
+			}
+
+			s.Password = ""
+			s.Idx = l[i]
+			si = append(si, *s)
+			sp = append(sp, p[i])
+
+			if int64(len(si)) > q.Limit {
+				break
+			}
+		}
+
+		if int64(len(l)) < n {
+			break
+		}
+
+		pos = p[len(p)-1]
+	}
+
+	// the extra user only tells whether there is a next page
+	if int64(len(si)) > q.Limit {
+		si = si[:q.Limit]
+		next = getQueryCursor(&queryCursor{Q: cur.Q, P: sp[q.Limit-1]})
+	}
+
+	return
+}
+
+// queryUserSort loads the whole list for sorts that no index serves. The
+// cursor keeps the sort values of the last user rather than an offset so
+// users added or removed before it do not shift the next page.
+func queryUserSort(li *LogInfo, q *UserQuery, sl []UserSort, sn []bool,
+	cur *queryCursor, match func(*UserInfo) bool) (si []UserInfo,
+	next string, err error) {
+	list := q.List
+
+	if _, ok := queryListFilters[list]; ok {
+		list = "all"
+	}
+
+	// an empty list is an empty page
+	v, _ := users.GetUserList(list)
+	keys := make(map[int64][]string)
+
+	for i := range v {
+		uid, _ := strconv.ParseInt(v[i], 0, 64)
+
+		s, err := users.GetUserInfo(uid)
+
+		if err != nil {
+			event(logwarn, li, err.Error())
+			continue
+		}
+
+		if !match(s) {
+			continue
+		}
+
+		k := make([]string, len(sl))
+
+		for j := range sl {
+			k[j] = getUserFieldValue(s, sl[j].Field)
+		}
+
+		s.Password = ""
+		s.Idx = uid
+		si = append(si, *s)
+		keys[uid] = k
+	}
+
+	// the ID breaks ties so the order is total
+	cmp := func(k1 []string, u1 int64, k2 []string, u2 int64) int {
+		for i := range sl {
+			if c := compareUserField(sn[i], k1[i], k2[i]); c != 0 {
+				if sl[i].Desc {
+					return -c
+				}
+
+				return c
+			}
+		}
+
+		return compareUserField(true, strconv.FormatInt(u1, 10),
+			strconv.FormatInt(u2, 10))
+	}
+
+	UserSortBy(func(s1, s2 *UserInfo) bool {
+		return cmp(keys[s1.Idx], s1.Idx, keys[s2.Idx], s2.Idx) < 0
+	}).Sort(si)
+
+	sofs := 0
+
+	if len(cur.K) == len(sl) {
+		for sofs < len(si) && cmp(keys[si[sofs].Idx], si[sofs].Idx, cur.K,
+			cur.U) <= 0 {
+			sofs++
+		}
+	}
+
+	si = si[sofs:]
+
+	if int64(len(si)) > q.Limit {
+		si = si[:q.Limit]
+		e := si[q.Limit-1]
+		next = getQueryCursor(&queryCursor{Q: cur.Q, K: keys[e.Idx],
+			U: e.Idx})
+	}
+
+	return
+}
+
+// queryUserEvents returns a page of a user's activity or login history,
+// newest first unless sorted by Time ascending. The lists grow at the head
+// so the cursor counts from the tail to stay put as entries are added.
+func queryUserEvents(uid int64, q *UserQuery) (si []Name, next string,
+	err error) {
+	desc := true
+
+	if len(q.Sort) > 1 || (len(q.Sort) == 1 &&
+		!strings.EqualFold(q.Sort[0].Field, "time")) {
+		return si, next, errors.New("Invalid history sort, only Time is " +
+			"supported")
+	}
+
+	if len(q.Sort) == 1 {
+		desc = q.Sort[0].Desc
+	}
+
+	for i := range q.Filter {
+		if !strings.EqualFold(q.Filter[i].Field, "entry") {
+			return si, next, errors.New("Invalid history field: " +
+				q.Filter[i].Field)
+		}
+	}
+
+	qd := getQueryDigest(q, uid)
+	cur := &queryCursor{Q: qd}
+
+	if q.Cursor != "" {
+		if cur, err = checkQueryCursor(q.Cursor, qd); err != nil {
+			return
+		}
+	}
+
+	var v []string
+
+	if v, err = users.GetUserUidList(uid, q.List); err != nil {
+		return
+	}
+
+	c := int64(len(v))
+	p, _ := strconv.ParseInt(cur.P, 0, 64)
+
+	var sp []int64
+
+	for k := int64(0); k < c; k++ {
+		i := k
+
+		if !desc {
+			i = c - 1 - k
+		}
+
+		// the position counted from the oldest entry
+		t, e := c-1-i, v[i]
+
+		if q.Cursor != "" && ((desc && t >= p) || (!desc && t <= p)) {
+			continue
+		}
+
+		ok := true
+
+		for j := range q.Filter {
+			f := &q.Filter[j]
+			le, lf := strings.ToLower(e), strings.ToLower(f.Value)
+
+			if (f.Op == "eq" && le != lf) || (f.Op == "ne" && le == lf) ||
+				(f.Op == "lt" && le >= lf) || (f.Op == "gt" && le <= lf) ||
+				(f.Op == "prefix" && !strings.HasPrefix(le, lf)) ||
+				(f.Op == "contains" && !strings.Contains(le, lf)) {
+				ok = false
+				break
+			}
+		}
+
+		if !ok {
+			continue
+		}
+
+		si = append(si, Name{Name: e})
+		sp = append(sp, t)
+
+		if int64(len(si)) > q.Limit {
+			break
+		}
+	}
+
+	if int64(len(si)) > q.Limit {
+		si = si[:q.Limit]
+		next = getQueryCursor(&queryCursor{Q: qd,
+			P: strconv.FormatInt(sp[q.Limit-1], 10)})
+	}
+
+	return
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestGetQueryDigest(t *testing.T) {
+	f := []UserFilter{UserFilter{Field: "Login", Op: "prefix",
+		Value: "a"}}
+	q := &UserQuery{List: "active", Filter: f, Limit: 10,
+		Sort: []UserSort{UserSort{Field: "Name"}}}
+	d := getQueryDigest(q, 1)
+
+	tests := []struct {
+		name string
+		q    UserQuery
+		id   int64
+		same bool
+	}{
+		{"page size", UserQuery{List: q.List, Filter: q.Filter,
+			Sort: q.Sort, Limit: 50}, 1, true},
+		{"cursor", UserQuery{List: q.List, Filter: q.Filter,
+			Sort: q.Sort, Cursor: "x.y"}, 1, true},
+		{"user ID", *q, 2, false},
+		{"list", UserQuery{List: "inactive", Filter: q.Filter,
+			Sort: q.Sort}, 1, false},
+		{"filter", UserQuery{List: q.List, Sort: q.Sort}, 1, false},
+		{"sort", UserQuery{List: q.List, Filter: q.Filter,
+			Sort: []UserSort{UserSort{Field: "Name",
+				Desc: true}}}, 1, false},
+	}
+
+	for _, v := range tests {
+		if s := getQueryDigest(&v.q, v.id) == d; s != v.same {
+			t.Errorf("%v: digest match is %v, want %v", v.name, s,
+				v.same)
+		}
+	}
+}
+
+func TestCheckQueryCursor(t *testing.T) {
+	app = &AppConfig{Secret: "secret"}
+
+	c := &queryCursor{Q: "query", P: "5", K: []string{"a"}, U: 7}
+	tok := getQueryCursor(c)
+	sig := tok[strings.Index(tok, ".")+1:]
+
+	// the same signature on a different position
+	buf, _ := json.Marshal(&queryCursor{Q: "query", P: "5",
+		K: []string{"a"}, U: 8})
+	moved := base64.URLEncoding.EncodeToString(buf) + "." + sig
+
+	app.Secret = "other"
+	foreign := getQueryCursor(c)
+	app.Secret = "secret"
+
+	tests := []struct {
+		name string
+		tok  string
+		q    string
+		ok   bool
+	}{
+		{"valid", tok, "query", true},
+		{"other query", tok, "other", false},
+		{"moved position", moved, "query", false},
+		{"other secret", foreign, "query", false},
+		{"no signature", tok[:strings.Index(tok, ".")], "query", false},
+		{"extra part", tok + ".x", "query", false},
+		{"bad encoding", "!!." + sig, "query", false},
+		{"not JSON", base64.URLEncoding.EncodeToString([]byte("x")) +
+			"." + sig, "query", false},
+		{"null", base64.URLEncoding.EncodeToString([]byte("null")) +
+			"." + sig, "query", false},
+		{"empty", "", "query", false},
+	}
+
+	for _, v := range tests {
+		r, err := checkQueryCursor(v.tok, v.q)
+
+		if v.ok && err != nil {
+			t.Errorf("%v: %v", v.name, err)
+		} else if !v.ok && err == nil {
+			t.Errorf("%v: cursor accepted", v.name)
+		} else if v.ok && (r.P != c.P || r.U != c.U) {
+			t.Errorf("%v: got cursor %+v, want %+v", v.name, r, c)
+		}
+	}
+}
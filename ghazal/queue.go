@@ -0,0 +1,468 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type MailInfo struct {
+	Id      int64
+	Rcpt    []string
+	Subject string
+	Text    string
+	Html    string
+	Service bool
+
+	Tries   int64
+	Error   string
+	Created string
+	Next    string
+
+	ErrNo int
+}
+
+type MailInfoList struct {
+	Id    int64
+	Entry []MailInfo
+}
+
+// MailTransport delivers a fully formed message to its recipients
+type MailTransport interface {
+	Send(from string, rcpt []string, msg []byte) error
+}
+
+// mailTransports maps the MailTransport config value to its constructor
+var mailTransports = map[string]func() MailTransport{
+	"starttls": func() MailTransport { return &smtpTransport{} },
+	"tls":      func() MailTransport { return &smtpTransport{implicit: true} },
+	"sendmail": func() MailTransport {
+		return &sendmailTransport{path: app.SendmailPath}
+	},
+	"file": func() MailTransport { return &fileTransport{dir: app.MailSinkDir} },
+}
+
+type smtpTransport struct {
+	implicit bool
+}
+
+func (t *smtpTransport) Send(from string, rcpt []string,
+	msg []byte) (err error) {
+	url := net.JoinHostPort(app.SMTPHost, app.SMTPPort)
+
+	var con *smtp.Client
+
+	if t.implicit {
+		var c net.Conn
+
+		if c, err = tls.Dial("tcp", url,
+			getTLSClientConfig()); err != nil {
+			return errors.New("SMTP server not available: " + err.Error())
+		}
+
+		if con, err = smtp.NewClient(c, app.SMTPHost); err != nil {
+			c.Close()
+			return errors.New("SMTP greeting failed: " + err.Error())
+		}
+	} else {
+		if con, err = smtp.Dial(url); err != nil {
+			return errors.New("SMTP server not available: " + err.Error())
+		}
+
+		if err = con.StartTLS(getTLSClientConfig()); err != nil {
+			con.Close()
+			return errors.New("StartTLS negotiation failed: " +
+				err.Error())
+		}
+	}
+
+	defer con.Close()
+
+	auth := smtp.PlainAuth("", app.SMTPUser, app.SMTPPw, app.SMTPHost)
+
+	if err = con.Auth(auth); err != nil {
+		return errors.New("SMTP Plain authentication failed: " +
+			err.Error())
+	}
+
+	if err = con.Mail(from); err != nil {
+		return errors.New("SMTP sender rejected: " + err.Error())
+	}
+
+	for i := range rcpt {
+		if err = con.Rcpt(rcpt[i]); err != nil {
+			return errors.New(fmt.Sprintf("SMTP recipient %v rejected: "+
+				"%v", rcpt[i], err))
+		}
+	}
+
+	var wc io.WriteCloser
+
+	if wc, err = con.Data(); err != nil {
+		return errors.New("Unable to open SMTP DATA request: " +
+			err.Error())
+	}
+
+	if _, err = wc.Write(msg); err != nil {
+		wc.Close()
+		return errors.New("Unable to write message body: " + err.Error())
+	}
+
+	// the server only accepts the message once DATA is closed
+	if err = wc.Close(); err != nil {
+		return errors.New("SMTP message rejected: " + err.Error())
+	}
+
+	con.Quit()
+	return
+}
+
+type sendmailTransport struct {
+	path string
+}
+
+func (t *sendmailTransport) Send(from string, rcpt []string,
+	msg []byte) (err error) {
+	args := append([]string{"-i", "-f", from, "--"}, rcpt...)
+
+	cmd := exec.Command(t.path, args...)
+	cmd.Stdin = bytes.NewReader(msg)
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.New(fmt.Sprintf("%v failed: %v %v", t.path, err,
+			strings.TrimSpace(string(out))))
+	}
+
+	return
+}
+
+// fileTransport writes each message into a maildir for test environments
+type fileTransport struct {
+	dir string
+}
+
+func (t *fileTransport) Send(from string, rcpt []string,
+	msg []byte) (err error) {
+	for _, d := range []string{"tmp", "new", "cur"} {
+		if err = os.MkdirAll(filepath.Join(t.dir, d), 0700); err != nil {
+			return
+		}
+	}
+
+	name := fmt.Sprintf("%v.%v.%v", time.Now().UnixNano(), app.Pid,
+		app.HostName)
+	tmp := filepath.Join(t.dir, "tmp", name)
+
+	if err = ioutil.WriteFile(tmp, msg, 0600); err != nil {
+		return
+	}
+
+	return os.Rename(tmp, filepath.Join(t.dir, "new", name))
+}
+
+// getMailMessage formats a queued mail, every message is copied to the
+// administrator as before
+func getMailMessage(m *MailInfo) (from string, rcpt []string, msg []byte,
+	err error) {
+	ghazal := mail.Address{"Ghazal Web Service", "ghazal@s.rebung.io"}
+	admin := mail.Address{app.BrandName + " Administrator", app.AdminEmail}
+
+	header := make(map[string]string)
+
+	if m.Service {
+		header["From"] = ghazal.String()
+		from = ghazal.Address
+	} else {
+		header["From"] = admin.String()
+		from = admin.Address
+	}
+
+	if len(m.Rcpt) == 0 {
+		header["To"] = admin.String()
+	} else {
+		header["To"] = strings.Join(m.Rcpt, ", ")
+	}
+
+	rcpt = append(m.Rcpt, admin.Address)
+
+	header["Subject"] = m.Subject
+	header["Date"] = time.Now().Format(time.RFC1123Z)
+	header["MIME-Version"] = "1.0"
+
+	body := &bytes.Buffer{}
+
+	if m.Html == "" {
+		header["Content-Type"] = "text/plain; charset=\"utf-8\""
+		header["Content-Transfer-Encoding"] = "base64"
+
+		body.WriteString(base64.StdEncoding.EncodeToString([]byte(m.Text)))
+	} else {
+		mw := multipart.NewWriter(body)
+
+		header["Content-Type"] = "multipart/alternative; boundary=" +
+			mw.Boundary()
+
+		parts := []string{"text/plain", m.Text, "text/html", m.Html}
+
+		for i := 0; i < len(parts); i += 2 {
+			ph := textproto.MIMEHeader{}
+			ph.Set("Content-Type", parts[i]+"; charset=\"utf-8\"")
+			ph.Set("Content-Transfer-Encoding", "base64")
+
+			var pw io.Writer
+
+			if pw, err = mw.CreatePart(ph); err != nil {
+				return from, rcpt, msg, errors.New("Unable to create " +
+					"MIME part")
+			}
+
+			pw.Write([]byte(base64.StdEncoding.EncodeToString(
+				[]byte(parts[i+1]))))
+		}
+
+		mw.Close()
+	}
+
+	var s string
+
+	for k, v := range header {
+		s += fmt.Sprintf("%s: %s\r\n", k, v)
+	}
+
+	s += "\r\n" + body.String()
+
+	return from, rcpt, []byte(s), nil
+}
+
+// getMailRetryDelay doubles the retry delay with every failed attempt,
+// capped at six hours
+func getMailRetryDelay(n int64) int64 {
+	d := app.MailRetryDelay
+
+	for i := int64(1); i < n && d < 21600; i++ {
+		d *= 2
+	}
+
+	if d > 21600 {
+		d = 21600
+	}
+
+	return d
+}
+
+func processMailQueue() {
+	t := time.NewTicker(time.Duration(app.MailQueueInterval) * time.Second)
+
+	for {
+		if err := deliverMailQueue(); err != nil {
+			event(logwarn, sli, err.Error())
+		}
+
+		<-t.C
+	}
+}
+
+func deliverMailQueue() (err error) {
+	if err = checkRedis(); err != nil {
+		return
+	}
+
+	var l []int64
+
+	if l, err = getRedisMailDue(time.Now().Unix()); err != nil {
+		return
+	}
+
+	mt := mailTransports[app.MailTransport]()
+
+	for i := range l {
+		// another worker may have taken it
+		if err = deleteRedisMailQueue(l[i]); err != nil {
+			continue
+		}
+
+		var m *MailInfo
+
+		if m, err = getRedisMail(l[i]); err != nil {
+			event(logwarn, sli, err.Error())
+			continue
+		}
+
+		from, rcpt, msg, err := getMailMessage(m)
+
+		if err == nil {
+			err = mt.Send(from, rcpt, msg)
+		}
+
+		if err == nil {
+			incStat(&stat.MailSent)
+
+			deleteRedisMail(m.Id)
+
+			event(logdebug, sli, "Mail [%v] sent: %v", m.Id,
+				m.Subject)
+			continue
+		}
+
+		if m.Tries++; m.Tries >= app.MailRetryLimit {
+			incStat(&stat.MailDead)
+
+			if err := setRedisMailDead(m.Id, m.Tries,
+				err.Error()); err != nil {
+				event(logwarn, sli, err.Error())
+			}
+
+			event(logwarn, sli, "Mail [%v] moved to dead-letter "+
+				"list after %v attempts: %v", m.Id, m.Tries,
+				err.Error())
+			continue
+		}
+
+		incStat(&stat.MailRetry)
+
+		next := time.Now().Unix() + getMailRetryDelay(m.Tries)
+
+		if err := setRedisMailRetry(m.Id, m.Tries, next,
+			err.Error()); err != nil {
+			event(logwarn, sli, err.Error())
+		}
+
+		event(logwarn, sli,
+			"Mail [%v] attempt %v failed, retrying at %v: %v",
+			m.Id, m.Tries, time.Unix(next, 0).Format(time.RFC1123),
+			err.Error())
+	}
+
+	return nil
+}
+
+func listMail(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqListMail)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrListMail)
+		return
+	}
+
+	list := m.Entry[0].Name
+
+	if list != "queue" && list != "dead" {
+		incStat(&stat.ReqErrListMail)
+		return errors.New("Invalid mail list: " + list)
+	}
+
+	var l []int64
+
+	if l, err = getRedisMailList(list); err != nil {
+		incStat(&stat.ReqErrListMail)
+		return
+	}
+
+	si := make([]MailInfo, len(l))
+
+	for i := range l {
+		if mi, err := getRedisMail(l[i]); err != nil {
+			si[i] = MailInfo{Id: l[i], ErrNo: ENOENT}
+		} else {
+			// bodies may carry passwords and tokens
+			mi.Text, mi.Html = "", ""
+			si[i] = *mi
+		}
+	}
+
+	buf, _ := json.Marshal(&MailInfoList{Id: int64(len(si)), Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+func retryMail(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqRetryMail)
+
+	var m *IdList
+
+	if m, err = getIdList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrRetryMail)
+		return
+	}
+
+	si := make([]Id, len(m.Entry))
+
+	for i := range m.Entry {
+		e := m.Entry[i]
+		si[i] = Id{Id: e.Id}
+
+		if err := setRedisMailRequeue(e.Id); err != nil {
+			event(logwarn, li, err.Error())
+			si[i].ErrNo = ENOENT
+		}
+	}
+
+	buf, _ := json.Marshal(&IdList{Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+func purgeMail(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqPurgeMail)
+
+	var m *IdList
+
+	if m, err = getIdList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrPurgeMail)
+		return
+	}
+
+	// a zero ID purges the whole dead-letter list
+	if len(m.Entry) == 1 && m.Entry[0].Id == 0 {
+		var l []int64
+
+		if l, err = getRedisMailList("dead"); err != nil {
+			incStat(&stat.ReqErrPurgeMail)
+			return
+		}
+
+		m.Entry = make([]Id, len(l))
+
+		for i := range l {
+			m.Entry[i] = Id{Id: l[i]}
+		}
+	}
+
+	si := make([]Id, len(m.Entry))
+
+	for i := range m.Entry {
+		e := m.Entry[i]
+		si[i] = Id{Id: e.Id}
+
+		if err := deleteRedisMail(e.Id); err != nil {
+			event(logwarn, li, err.Error())
+			si[i].ErrNo = ENOENT
+		}
+	}
+
+	buf, _ := json.Marshal(&IdList{Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
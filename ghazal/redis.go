@@ -11,7 +11,7 @@
  * user:disabled-list
  * user:active-list
  * user:inactive-list
- * user:admin-list
+ * user:admin-list (users holding any role)
  * user:new-list
  *
  * uid:next
@@ -22,10 +22,84 @@
  * Messaging keys
  * --------------
  * msgid:next
+ * nonce:[nonce] (expires after twice the clock skew)
  *
  * Session keys
  * ------------
- * uid:[uid]:session
+ * session:[token digest]
+ * uid:[uid]:login-sessions
+ *
+ * Password reset keys
+ * -------------------
+ * reset:[token digest]
+ * uid:[uid]:reset
+ * uid:[uid]:password-history
+ *
+ * Two-factor keys
+ * ---------------
+ * uid:[uid]:totp
+ * uid:[uid]:totp-recovery
+ * login:[challenge digest]
+ *
+ * Login throttling keys
+ * ---------------------
+ * fail:login:[login]
+ * fail:ip:[ip]
+ * lock:login:[login]
+ * lock:ip:[ip]
+ *
+ * Role keys
+ * ---------
+ * role:all-list
+ * role:[name]:perms
+ * role:[name]:uids
+ * uid:[uid]:roles
+ *
+ * API keys
+ * --------
+ * apikey:[key id]
+ * uid:[uid]:apikeys
+ *
+ * Search index keys
+ * -----------------
+ * index:login (lexical, [login]:[uid])
+ * index:name (lexical, [name]:[uid])
+ * index:login:[trigram]
+ * index:name:[trigram]
+ * index:registered (scored by registration time)
+ * index:id (scored by uid)
+ *
+ * Mail queue keys
+ * ---------------
+ * mail:next
+ * mail:[id]
+ * mail:queue (scored by next delivery attempt)
+ * mail:dead-list
+ *
+ * OpenID Connect keys
+ * --------------------
+ * oidc:client-list
+ * oidc:client:[client id]
+ * oidc:code:[code digest]
+ *
+ * Signing keyring keys (also read by rebana)
+ * ------------------------------------------
+ * keyring:key-list
+ * keyring:key:[key id]
+ *
+ * Acceptable use policy keys
+ * --------------------------
+ * aup:next
+ * aup:version-list
+ * aup:[version]
+ * aup:[version]:accepted (hash, [uid]: [time];[ip])
+ *
+ * Tunnel keys (TunnelRedisDb)
+ * ---------------------------
+ * uid:[uid]:sessions-list
+ *
+ * Without a Redis server the same keys live in the SQLite user store, see
+ * kv.go.
  */
 
 package main
@@ -36,12 +110,17 @@ import (
 	"fmt"
 	"github.com/garyburd/redigo/redis"
 	"strconv"
+	"strings"
 	"time"
 )
 
 var rdp *redis.Pool
 
-func setRedisUserNew(s *UserInfo, ip string) (uid int64, pw string, err error) {
+// trp reaches the rebana database to look up tunnel session ownership
+var trp *redis.Pool
+
+func setRedisUserNew(li *LogInfo, s *UserInfo, ip string) (uid int64, pw string,
+	err error) {
 	rdb := rdp.Get()
 	defer rdb.Close()
 
@@ -61,7 +140,9 @@ func setRedisUserNew(s *UserInfo, ip string) (uid int64, pw string, err error) {
 		return uid, pw, errors.New("User " + s.Login + " ID exists")
 	}
 
-	pw = generateTempPassword()
+	if pw, err = generateTempPassword(); err != nil {
+		return
+	}
 
 	var dgst []byte
 
@@ -72,12 +153,29 @@ func setRedisUserNew(s *UserInfo, ip string) (uid int64, pw string, err error) {
 	rdb.Do("set", ukey, uid)
 	rdb.Do("hmset", key, "id", uid, "name", s.Name, "login", s.Login,
 		"password", string(dgst), "admin", "enabled", "status", "active",
-		"registered", time.Now().Format(time.RFC1123))
+		"registered", time.Now().Format(time.RFC1123), "locale",
+		s.Locale)
 
-	rdb.Do("rpush", "user:all-list", s.Id)
-	rdb.Do("rpush", "user:enabled-list", s.Id)
-	rdb.Do("rpush", "user:active-list", s.Id)
-	rdb.Do("rpush", "user:new-list", s.Id)
+	rdb.Do("rpush", "user:all-list", uid)
+	rdb.Do("rpush", "user:enabled-list", uid)
+	rdb.Do("rpush", "user:active-list", uid)
+	rdb.Do("rpush", "user:new-list", uid)
+
+	if err = setRedisUserRegistered(uid, time.Now().Unix()); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	if err = setRedisUserIdIndex(uid); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	if err = setRedisUserIndex(uid, "login", s.Login); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	if err = setRedisUserIndex(uid, "name", s.Name); err != nil {
+		event(logwarn, li, err.Error())
+	}
 
 	if err = setRedisUserActivityList(uid, "created", ip); err != nil {
 		event(logwarn, li, err.Error())
@@ -89,7 +187,8 @@ func setRedisUserNew(s *UserInfo, ip string) (uid int64, pw string, err error) {
 	return
 }
 
-func setRedisUserAttr(uid int64, field, value, ip string) (err error) {
+func setRedisUserAttr(li *LogInfo, uid int64, field, value,
+	ip string) (err error) {
 	rdb := rdp.Get()
 	defer rdb.Close()
 
@@ -99,6 +198,16 @@ func setRedisUserAttr(uid int64, field, value, ip string) (err error) {
 		return
 	}
 
+	if field == "name" {
+		if s, err := redis.String(rdb.Do("hget", key, field)); err == nil {
+			deleteRedisUserIndex(uid, field, s)
+		}
+
+		if err = setRedisUserIndex(uid, field, value); err != nil {
+			event(logwarn, li, err.Error())
+		}
+	}
+
 	rdb.Do("hset", key, field, value)
 
 	action := fmt.Sprintf("attribute changed: %v", field)
@@ -122,7 +231,29 @@ func setRedisUserFirstLogin(uid int64, ip string) (err error) {
 	}
 
 	rdb.Do("hset", key, "flogin", time.Now().Format(time.RFC1123))
-	rdb.Do("lrem", "user:new:list", 0, uid)
+	rdb.Do("lrem", "user:new-list", 0, uid)
+	return
+}
+
+func setRedisUserVerified(li *LogInfo, uid int64, ip string) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := fmt.Sprintf("uid:%v", uid)
+
+	if err = checkRedisKeyExist(key); err != nil {
+		return
+	}
+
+	rdb.Do("hset", key, "verified", time.Now().Format(time.RFC1123))
+	rdb.Do("lrem", "user:new-list", 0, uid)
+
+	if err = setRedisUserActivityList(uid, "email verified",
+		ip); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	event(logdebug, li, "User [%v] email verified", uid)
 	return
 }
 
@@ -170,7 +301,8 @@ func setRedisUserLoginList(uid int64, ip, act string) (err error) {
 	return
 }
 
-func setRedisUserAdminStatus(uid int64, f bool, ip string) (err error) {
+func setRedisUserAdminStatus(li *LogInfo, uid int64, f bool,
+	ip string) (err error) {
 	rdb := rdp.Get()
 	defer rdb.Close()
 
@@ -211,7 +343,7 @@ func setRedisUserAdminStatus(uid int64, f bool, ip string) (err error) {
 	return
 }
 
-func setRedisUserStatus(uid int64, f bool, ip string) (err error) {
+func setRedisUserStatus(li *LogInfo, uid int64, f bool, ip string) (err error) {
 	rdb := rdp.Get()
 	defer rdb.Close()
 
@@ -252,289 +384,2285 @@ func setRedisUserStatus(uid int64, f bool, ip string) (err error) {
 	return
 }
 
-func setRedisUserSession(uid int64, tok, ip string) (err error) {
+// setRedisUserRoleHolder keeps the admin list in step with the user roles
+func setRedisUserRoleHolder(uid int64, f bool) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	rdb.Do("lrem", "user:admin-list", 0, uid)
+
+	if !f {
+		return
+	}
+
+	if _, err = rdb.Do("rpush", "user:admin-list", uid); err != nil {
+		return errors.New("Error saving Redis key user:admin-list")
+	}
+
+	return
+}
+
+// setRedisUserImport copies a user record from another store as is,
+// keeping its ID, password digest and history
+func setRedisUserImport(s *UserInfo, act, login []string, isnew,
+	admin bool) (err error) {
 	rdb := rdp.Get()
 	defer rdb.Close()
 
-	key := fmt.Sprintf("uid:%v:session", uid)
+	ukey := fmt.Sprintf("user:%v:id", s.Login)
+	key := fmt.Sprintf("uid:%v", s.Id)
+
+	if err = checkRedisKeyExist(ukey); err == nil {
+		return errors.New("User " + s.Login + " exists")
+	}
 
 	if err = checkRedisKeyExist(key); err == nil {
-		event(logwarn, li, "Redis key %v exists", key)
+		return errors.New("User " + s.Login + " ID exists")
+	}
+
+	if _, err = rdb.Do("hmset", key, "id", s.Id, "name", s.Name, "login",
+		s.Login, "password", s.Password, "admin", s.Admin, "status",
+		s.Status, "registered", s.Registered, "flogin", s.FirstLogin,
+		"verified", s.Verified, "locale", s.Locale); err != nil {
+		return errors.New("Error saving Redis key " + key)
 	}
 
-	rdb.Do("hset", key, "session-key", tok)
+	rdb.Do("set", ukey, s.Id)
 
-	if err = setRedisUserLoginList(uid, ip, "login"); err != nil {
-		return
+	rdb.Do("rpush", "user:all-list", s.Id)
+	rdb.Do("rpush", fmt.Sprintf("user:%v-list", s.Admin), s.Id)
+	rdb.Do("rpush", fmt.Sprintf("user:%v-list", s.Status), s.Id)
+
+	if isnew {
+		rdb.Do("rpush", "user:new-list", s.Id)
+	}
+
+	if admin {
+		rdb.Do("rpush", "user:admin-list", s.Id)
+	}
+
+	// both lists are kept newest first
+	for i := range act {
+		rdb.Do("rpush", key+":activity-list", act[i])
+	}
+
+	for i := range login {
+		rdb.Do("rpush", key+":login-list", login[i])
+	}
+
+	if t, err := time.Parse(time.RFC1123, s.Registered); err == nil {
+		setRedisUserRegistered(s.Id, t.Unix())
+	}
+
+	setRedisUserIdIndex(s.Id)
+
+	setRedisUserIndex(s.Id, "login", s.Login)
+	setRedisUserIndex(s.Id, "name", s.Name)
+
+	// new users must never reuse an imported ID
+	if n, err := redis.Int64(rdb.Do("get", "uid:next")); err != nil ||
+		n <= s.Id {
+		rdb.Do("set", "uid:next", s.Id+1)
 	}
 
-	event(logdebug, li, "User [%v] session info updated", uid)
 	return nil
 }
 
-func getRedisMsgId(c string) (id int64, err error) {
+func setRedisUserSession(li *LogInfo, uid int64, tok, ip,
+	client string) (err error) {
 	rdb := rdp.Get()
 	defer rdb.Close()
 
-	key := "msgid:next"
+	sid := hashToken(tok)
+	key := "session:" + sid
+	skey := fmt.Sprintf("uid:%v:login-sessions", uid)
 
-	if err = checkRedisKeyExist(key); err != nil {
+	now := time.Now().Unix()
+	ttl := getSessionTTL(now, now)
+
+	if _, err = rdb.Do("hmset", key, "uid", uid, "origin", ip, "client",
+		client, "created", now, "last-seen", now); err != nil {
+		return errors.New("Error saving Redis key " + key)
+	}
+
+	rdb.Do("expire", key, ttl)
+	rdb.Do("sadd", skey, sid)
+
+	if err = users.SetUserLogin(uid, ip, "login"); err != nil {
 		return
 	}
 
-	if id, err = redis.Int64(rdb.Do("get", key)); err != nil {
-		return id, errors.New("Error retrieving Redis key " + key)
+	event(logdebug, li, "User [%v] session [%v] created", uid, sid[:8])
+	return nil
+}
+
+// setRedisUserImpersonation creates a session for uid on behalf of the
+// admin auid, it counts as neither a login nor a first login of the user
+func setRedisUserImpersonation(li *LogInfo, uid, auid int64, tok, ip,
+	client string) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	sid := hashToken(tok)
+	key := "session:" + sid
+	skey := fmt.Sprintf("uid:%v:login-sessions", uid)
+
+	now := time.Now().Unix()
+	ttl := getImpersonationTTL(now, now)
+
+	if _, err = rdb.Do("hmset", key, "uid", uid, "origin", ip, "client",
+		client, "created", now, "last-seen", now, "impersonator",
+		auid); err != nil {
+		return errors.New("Error saving Redis key " + key)
 	}
 
-	rdb.Do("incr", key)
-	return
+	rdb.Do("expire", key, ttl)
+	rdb.Do("sadd", skey, sid)
+
+	event(logdebug, li, "User [%v] impersonation session [%v] created for "+
+		"[%v]", uid, sid[:8], auid)
+	return nil
 }
 
-func getRedisUserId() (uid int64, err error) {
+func setRedisSessionSeen(li *LogInfo, sid string) (ttl int64, err error) {
 	rdb := rdp.Get()
 	defer rdb.Close()
 
-	key := "uid:next"
+	key := "session:" + sid
 
-	if err = checkRedisKeyExist(key); err != nil {
-		return
+	var r []string
+
+	if r, err = redis.Strings(rdb.Do("hmget", key, "uid", "created",
+		"impersonator")); err != nil || len(r) != 3 || r[0] == "" {
+		return ttl, errors.New("Error retrieving Redis key " + key)
 	}
 
-	if uid, err = redis.Int64(rdb.Do("get", key)); err != nil {
-		return uid, errors.New("Error retrieving Redis key " + key)
+	created, _ := strconv.ParseInt(r[1], 0, 64)
+	now := time.Now().Unix()
+
+	if r[2] != "" {
+		ttl = getImpersonationTTL(created, now)
+	} else {
+		ttl = getSessionTTL(created, now)
 	}
 
-	rdb.Do("incr", key)
+	if ttl <= 0 {
+		rdb.Do("del", key)
+		rdb.Do("srem", fmt.Sprintf("uid:%v:login-sessions", r[0]), sid)
+		return ttl, errors.New("User session has expired")
+	}
+
+	rdb.Do("hset", key, "last-seen", now)
+	rdb.Do("expire", key, ttl)
+
+	event(logdebug, li, "User [%v] session [%v] renewed for %vs", r[0],
+		sid[:8], ttl)
 	return
 }
 
-func getRedisUserIdFromLogin(login string) (uid int64, err error) {
+func setRedisUserResetToken(li *LogInfo, uid int64, dgst string, ttl int64,
+	ip string) (err error) {
 	rdb := rdp.Get()
 	defer rdb.Close()
 
-	key := fmt.Sprintf("user:%v:id", login)
+	ukey := fmt.Sprintf("uid:%v:reset", uid)
 
-	if err = checkRedisKeyExist(key); err != nil {
-		return
+	// a new token invalidates any outstanding one
+	if s, err := redis.String(rdb.Do("get", ukey)); err == nil && s != "" {
+		rdb.Do("del", "reset:"+s)
+	}
+
+	key := "reset:" + dgst
+
+	if _, err = rdb.Do("set", key, uid, "ex", ttl); err != nil {
+		return errors.New("Error saving Redis key " + key)
+	}
+
+	if _, err = rdb.Do("set", ukey, dgst, "ex", ttl); err != nil {
+		return errors.New("Error saving Redis key " + ukey)
 	}
 
+	if err = users.SetUserActivity(uid, "password reset requested",
+		ip); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	event(logdebug, li, "User [%v] password reset token issued", uid)
+	return nil
+}
+
+func getRedisUserResetToken(dgst string) (uid int64, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "reset:" + dgst
+
 	if uid, err = redis.Int64(rdb.Do("get", key)); err != nil || uid == 0 {
 		return uid, errors.New("Error retrieving Redis key " + key)
 	}
 
+	// the token is single-use, only the request that deletes it wins
+	var n int64
+
+	if n, err = redis.Int64(rdb.Do("del", key)); err != nil || n != 1 {
+		return 0, errors.New("Error deleting Redis key " + key)
+	}
+
+	rdb.Do("del", fmt.Sprintf("uid:%v:reset", uid))
 	return
 }
 
-func getRedisUserInfo(uid int64) (s *UserInfo, err error) {
+func getRedisSession(sid string) (s *SessionInfo, err error) {
 	rdb := rdp.Get()
 	defer rdb.Close()
 
-	key := fmt.Sprintf("uid:%v", uid)
+	key := "session:" + sid
 
-	if err = checkRedisKeyExist(key); err != nil {
-		return
+	var r []string
+
+	if r, err = redis.Strings(rdb.Do("hmget", key, "uid", "origin",
+		"client", "created", "last-seen", "impersonator")); err != nil ||
+		len(r) != 6 || r[0] == "" {
+		return s, errors.New("Error retrieving Redis key " + key)
 	}
 
-	var r []string
+	var ttl int64
 
-	if r, err = redis.Strings(rdb.Do("hmget", key, "id", "name", "login",
-		"password", "admin", "status", "registered",
-		"flogin")); err != nil || len(r) == 0 {
+	if ttl, err = redis.Int64(rdb.Do("ttl", key)); err != nil {
 		return s, errors.New("Error retrieving Redis key " + key)
 	}
 
-	id, _ := strconv.ParseInt(r[0], 0, 64)
+	created, _ := strconv.ParseInt(r[3], 0, 64)
+	seen, _ := strconv.ParseInt(r[4], 0, 64)
 
-	s = &UserInfo{Id: id, Name: r[1], Login: r[2], Password: r[3],
-		Admin: r[4], Status: r[5], Registered: r[6], FirstLogin: r[7]}
+	life := app.SessionTTL
 
-	if s.FirstLogin != "" {
-		rdb.Do("hset", "flogin", time.Now().Format(time.RFC1123))
+	if r[5] != "" {
+		life = app.ImpersonateTTL
 	}
 
+	s = &SessionInfo{Id: sid, Uid: r[0], Origin: r[1], Client: r[2],
+		Created:  time.Unix(created, 0).Format(time.RFC1123),
+		LastSeen: time.Unix(seen, 0).Format(time.RFC1123),
+		Expire: time.Unix(created+life,
+			0).Format(time.RFC1123), TTL: ttl, Impersonator: r[5]}
 	return
 }
 
-func getRedisUserList(s string) (l []string, err error) {
+func getRedisUserSessions(uid int64) (l []SessionInfo, err error) {
 	rdb := rdp.Get()
 	defer rdb.Close()
 
-	key := fmt.Sprintf("user:%v-list", s)
+	key := fmt.Sprintf("uid:%v:login-sessions", uid)
 
-	if err = checkRedisKeyExist(key); err != nil {
-		return
-	}
+	var v []string
 
-	if l, err = redis.Strings(rdb.Do("lrange", key, 0, -1)); err != nil ||
-		len(l) == 0 {
+	if v, err = redis.Strings(rdb.Do("smembers", key)); err != nil {
 		return l, errors.New("Error retrieving Redis key " + key)
 	}
 
+	l = make([]SessionInfo, 0, len(v))
+
+	for i := range v {
+		if s, err := getRedisSession(v[i]); err != nil {
+			// session record has expired, drop it from the index
+			rdb.Do("srem", key, v[i])
+		} else {
+			l = append(l, *s)
+		}
+	}
+
 	return
 }
 
-func getRedisUserUidList(uid int64, s string) (l []string, err error) {
+func setRedisUserTOTP(li *LogInfo, uid int64, secret string, pending bool,
+	ip string) (err error) {
 	rdb := rdp.Get()
 	defer rdb.Close()
 
-	key := fmt.Sprintf("uid:%v:%v-list", uid, s)
+	key := fmt.Sprintf("uid:%v:totp", uid)
+
+	if pending {
+		if _, err = rdb.Do("hset", key, "pending", secret); err != nil {
+			return errors.New("Error saving Redis key " + key)
+		}
 
-	if err = checkRedisKeyExist(key); err != nil {
 		return
 	}
 
-	if l, err = redis.Strings(rdb.Do("lrange", key, 0, -1)); err != nil ||
-		len(l) == 0 {
-		return l, errors.New("Error retrieving Redis key " + key)
+	if _, err = rdb.Do("hmset", key, "secret", secret, "last-step",
+		0); err != nil {
+		return errors.New("Error saving Redis key " + key)
+	}
+
+	rdb.Do("hdel", key, "pending")
+
+	if err = users.SetUserActivity(uid, "two-factor enabled",
+		ip); err != nil {
+		event(logwarn, li, err.Error())
 	}
 
+	event(logdebug, li, "User [%v] two-factor authentication enabled", uid)
 	return
 }
 
-func getRedisUserSessionKey(uid int64) (s string, err error) {
+func setRedisUserTOTPStep(uid int64, step int64) (err error) {
 	rdb := rdp.Get()
 	defer rdb.Close()
 
-	key := fmt.Sprintf("uid:%v:session", uid)
-
-	if err = checkRedisKeyExist(key); err != nil {
-		return
-	}
+	key := fmt.Sprintf("uid:%v:totp", uid)
 
-	if s, err = redis.String(rdb.Do("hget", key,
-		"session-key")); err != nil || s == "" {
-		return s, errors.New("Error retrieving Redis key " + key)
+	if _, err = rdb.Do("hset", key, "last-step", step); err != nil {
+		return errors.New("Error saving Redis key " + key)
 	}
 
 	return
 }
 
-func deleteRedisUserSession(uid int64, ip string) (err error) {
+func setRedisUserTOTPRecovery(uid int64, dgst []string) (err error) {
 	rdb := rdp.Get()
 	defer rdb.Close()
 
-	key := fmt.Sprintf("uid:%v:session", uid)
+	key := fmt.Sprintf("uid:%v:totp-recovery", uid)
 
-	if err = checkRedisKeyExist(key); err != nil {
-		return
-	}
-
-	if _, err = rdb.Do("del", key); err != nil {
-		return errors.New("Error deleting Redis key " + key)
-	}
+	rdb.Do("del", key)
 
-	if err = setRedisUserLoginList(uid, ip, "logout"); err != nil {
-		return
+	for i := range dgst {
+		if _, err = rdb.Do("sadd", key, dgst[i]); err != nil {
+			return errors.New("Error saving Redis key " + key)
+		}
 	}
 
 	return
 }
 
-func checkRedisUserStatus(uid int64) (err error) {
+func setRedisLoginChallenge(dgst string, uid int64, client string,
+	ttl int64) (err error) {
 	rdb := rdp.Get()
 	defer rdb.Close()
 
-	if s := fmt.Sprintf("%v", uid); uid == 0 {
-		return errors.New("Invalid user ID: " + s)
+	key := "login:" + dgst
+
+	if _, err = rdb.Do("hmset", key, "uid", uid, "client", client,
+		"tries", 0); err != nil {
+		return errors.New("Error saving Redis key " + key)
 	}
 
-	key := fmt.Sprintf("uid:%v", uid)
+	rdb.Do("expire", key, ttl)
+	return
+}
 
-	if err = checkRedisKeyExist(key); err != nil {
-		return
-	}
+// setRedisLoginChallengeFail counts a failed second factor and discards the
+// challenge once too many codes have been tried against it
+func setRedisLoginChallengeFail(dgst string) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
 
-	var s *UserInfo
+	key := "login:" + dgst
 
-	if s, err = getRedisUserInfo(uid); err != nil {
-		return
-	}
+	var n int64
 
-	if s.Admin != "enabled" {
-		return errors.New("User is disabled: " + s.Name)
+	if n, err = redis.Int64(rdb.Do("hincrby", key, "tries", 1)); err != nil {
+		return errors.New("Error saving Redis key " + key)
 	}
 
-	if s.Status != "active" {
-		return errors.New("User is inactive: " + s.Name)
+	if n >= 5 {
+		rdb.Do("del", key)
 	}
 
 	return
 }
 
-func checkRedisUserSession(uid int64) (err error) {
+// setRedisLoginFail records a failed login attempt against both the login and
+// the source IP, returning the number of failures left inside the window
+func setRedisLoginFail(login, ip string, window int64) (nl, ni int64,
+	err error) {
 	rdb := rdp.Get()
 	defer rdb.Close()
 
-	key := fmt.Sprintf("uid:%v:session", uid)
+	now := time.Now()
+	key := []string{"fail:login:" + login, "fail:ip:" + ip}
+	n := make([]int64, len(key))
 
-	if err = checkRedisKeyExist(key); err == nil {
-		return errors.New("Redis key " + key + " exists")
+	for i := range key {
+		if _, err = rdb.Do("zadd", key[i], now.Unix(),
+			now.UnixNano()); err != nil {
+			return nl, ni, errors.New("Error saving Redis key " + key[i])
+		}
+
+		rdb.Do("zremrangebyscore", key[i], "-inf", now.Unix()-window)
+		rdb.Do("expire", key[i], window)
+
+		if n[i], err = redis.Int64(rdb.Do("zcard", key[i])); err != nil {
+			return nl, ni, errors.New("Error retrieving Redis key " +
+				key[i])
+		}
 	}
 
-	return
+	return n[0], n[1], nil
 }
 
-func checkRedisKeyExist(key string) (err error) {
+func setRedisLoginLock(kind, val string, ttl int64) (err error) {
 	rdb := rdp.Get()
 	defer rdb.Close()
 
-	var exist bool
+	key := "lock:" + kind + ":" + val
 
-	if exist, err = redis.Bool(rdb.Do("exists", key)); err != nil || !exist {
-		return errors.New("Error retrieving Redis key " + key)
+	if _, err = rdb.Do("setex", key, ttl, time.Now().Unix()); err != nil {
+		return errors.New("Error saving Redis key " + key)
 	}
 
 	return
 }
 
-func checkRedisUserId(uid int64) (err error) {
+func setRedisRoleNew(li *LogInfo, name string, perms []string) (err error) {
 	rdb := rdp.Get()
 	defer rdb.Close()
 
-	key := fmt.Sprintf("uid:%v", uid)
+	key := fmt.Sprintf("role:%v:perms", name)
 
-	if err = checkRedisKeyExist(key); err != nil {
-		return
+	for i := range perms {
+		if _, err = rdb.Do("sadd", key, perms[i]); err != nil {
+			return errors.New("Error saving Redis key " + key)
+		}
 	}
 
+	rdb.Do("lrem", "role:all-list", 0, name)
+	rdb.Do("rpush", "role:all-list", name)
+
+	event(logdebug, li, "Role %v created: %v", name, perms)
 	return
 }
 
-func checkRedisMsgId(id int64) (err error) {
+func setRedisUserRole(li *LogInfo, uid int64, role, ip string) (err error) {
 	rdb := rdp.Get()
 	defer rdb.Close()
 
-	key := fmt.Sprintf("msgid:%v", id)
+	key := fmt.Sprintf("uid:%v:roles", uid)
 
-	if err = checkRedisKeyExist(key); err != nil {
-		return
+	if _, err = rdb.Do("sadd", key, role); err != nil {
+		return errors.New("Error saving Redis key " + key)
 	}
 
-	return
+	rdb.Do("sadd", fmt.Sprintf("role:%v:uids", role), uid)
+
+	if err = users.SetUserRoleHolder(uid, true); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	action := fmt.Sprintf("role granted: %v", role)
+
+	if err = users.SetUserActivity(uid, action, ip); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	event(logdebug, li, "User [%v] granted role %v", uid, role)
+	return nil
 }
 
-func checkRedis() (err error) {
-	if rdp != nil {
-		return
+func setRedisApiKey(li *LogInfo, uid int64, k *ApiKeyInfo, dgst string,
+	ttl int64, ip string) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "apikey:" + k.Id
+
+	if err = checkRedisKeyExist(key); err == nil {
+		return errors.New("API key " + k.Id + " exists")
 	}
 
-	rdp = &redis.Pool{MaxIdle: 5, IdleTimeout: 300 * time.Second,
-		Dial: func() (rdb redis.Conn, err error) {
-			if rdb, err = redis.Dial("tcp", app.RedisUrl); err != nil {
-				return
-			}
+	if _, err = rdb.Do("hmset", key, "uid", uid, "name", k.Name, "scope",
+		k.Scope, "digest", dgst, "created", k.Created, "expire",
+		k.Expire); err != nil {
+		return errors.New("Error saving Redis key " + key)
+	}
 
-			if _, err = rdb.Do("auth", app.RedisPw); err != nil {
-				return
-			}
+	if ttl > 0 {
+		rdb.Do("expire", key, ttl)
+	}
 
-			if _, err = rdb.Do("select", app.RedisDb); err != nil {
-				return
-			}
+	rdb.Do("sadd", fmt.Sprintf("uid:%v:apikeys", uid), k.Id)
 
-			return
-		}}
+	action := fmt.Sprintf("api key created: %v [%v]", k.Name, k.Id)
 
-	event(loginfo, li, "Connected to Redis: %v", app.RedisUrl)
-	return
+	if err = users.SetUserActivity(uid, action, ip); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	event(logdebug, li, "User [%v] API key created: %v", uid, k.Id)
+	return nil
+}
+
+func setRedisApiKeyUsed(kid string) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "apikey:" + kid
+
+	if _, err = rdb.Do("hset", key, "last-used",
+		time.Now().Format(time.RFC1123)); err != nil {
+		return errors.New("Error saving Redis key " + key)
+	}
+
+	return
+}
+
+// setRedisUserIndex adds a login or name to the lexical index used for
+// prefix matches and to the trigram sets used for substring matches
+func setRedisUserIndex(uid int64, field, value string) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "index:" + field
+	v := strings.ToLower(value)
+
+	if _, err = rdb.Do("zadd", key, 0, fmt.Sprintf("%v:%v", v,
+		uid)); err != nil {
+		return errors.New("Error saving Redis key " + key)
+	}
+
+	t := getTrigrams(v)
+
+	for i := range t {
+		rdb.Do("sadd", key+":"+t[i], uid)
+	}
+
+	return
+}
+
+func setRedisUserRegistered(uid, t int64) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "index:registered"
+
+	if _, err = rdb.Do("zadd", key, t, uid); err != nil {
+		return errors.New("Error saving Redis key " + key)
+	}
+
+	return
+}
+
+// setRedisNonce remembers a request nonce for ttl seconds, failing with a
+// ReplayError if it is already known
+func setRedisNonce(n string, ttl int64) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "nonce:" + n
+
+	var r interface{}
+
+	if r, err = rdb.Do("set", key, 1, "ex", ttl, "nx"); err != nil {
+		return errors.New("Error saving Redis key " + key)
+	}
+
+	if r == nil {
+		return &ReplayError{Nonce: n}
+	}
+
+	return
+}
+
+// setRedisUserIdIndex adds the user to the ID index that list-user walks
+// when sorting by ID
+func setRedisUserIdIndex(uid int64) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "index:id"
+
+	if _, err = rdb.Do("zadd", key, uid, uid); err != nil {
+		return errors.New("Error saving Redis key " + key)
+	}
+
+	return
+}
+
+func setRedisMailNew(m *MailInfo) (id int64, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	if id, err = redis.Int64(rdb.Do("incr", "mail:next")); err != nil {
+		return id, errors.New("Error retrieving Redis key mail:next")
+	}
+
+	key := fmt.Sprintf("mail:%v", id)
+	now := time.Now()
+
+	if _, err = rdb.Do("hmset", key, "rcpt", strings.Join(m.Rcpt, "\n"),
+		"subject", m.Subject, "text", m.Text, "html", m.Html, "service",
+		m.Service, "tries", 0, "created", now.Format(time.RFC1123),
+		"next", now.Unix()); err != nil {
+		return id, errors.New("Error saving Redis key " + key)
+	}
+
+	if _, err = rdb.Do("zadd", "mail:queue", now.Unix(), id); err != nil {
+		return id, errors.New("Error saving Redis key mail:queue")
+	}
+
+	return
+}
+
+func setRedisMailRetry(id, tries, next int64, e string) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := fmt.Sprintf("mail:%v", id)
+
+	if _, err = rdb.Do("hmset", key, "tries", tries, "next", next, "error",
+		e); err != nil {
+		return errors.New("Error saving Redis key " + key)
+	}
+
+	if _, err = rdb.Do("zadd", "mail:queue", next, id); err != nil {
+		return errors.New("Error saving Redis key mail:queue")
+	}
+
+	return
+}
+
+func setRedisMailDead(id, tries int64, e string) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := fmt.Sprintf("mail:%v", id)
+
+	if _, err = rdb.Do("hmset", key, "tries", tries, "next", 0, "error",
+		e); err != nil {
+		return errors.New("Error saving Redis key " + key)
+	}
+
+	rdb.Do("rpush", "mail:dead-list", id)
+	return
+}
+
+// setRedisMailRequeue moves a dead-letter mail back to the queue with a
+// fresh retry budget
+func setRedisMailRequeue(id int64) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	var n int64
+
+	if n, err = redis.Int64(rdb.Do("lrem", "mail:dead-list", 0,
+		id)); err != nil || n == 0 {
+		return errors.New(fmt.Sprintf("Mail [%v] is not in the dead-letter "+
+			"list", id))
+	}
+
+	now := time.Now().Unix()
+
+	rdb.Do("hmset", fmt.Sprintf("mail:%v", id), "tries", 0, "next", now)
+	rdb.Do("zadd", "mail:queue", now, id)
+	return
+}
+
+// setRedisUserPasswordHistory keeps the digests of the last n passwords
+func setRedisUserPasswordHistory(uid int64, dgst string, n int) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := fmt.Sprintf("uid:%v:password-history", uid)
+
+	if _, err = rdb.Do("lpush", key, dgst); err != nil {
+		return errors.New("Error saving Redis key " + key)
+	}
+
+	rdb.Do("ltrim", key, 0, n-1)
+	return
+}
+
+func setRedisOIDCClient(li *LogInfo, c *OIDCClientInfo,
+	dgst string) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "oidc:client:" + c.Id
+
+	if err = checkRedisKeyExist(key); err == nil {
+		return errors.New("OpenID Connect client " + c.Id + " exists")
+	}
+
+	if _, err = rdb.Do("hmset", key, "name", c.Name, "redirect",
+		strings.Join(c.RedirectUri, " "), "digest", dgst, "created",
+		c.Created); err != nil {
+		return errors.New("Error saving Redis key " + key)
+	}
+
+	rdb.Do("rpush", "oidc:client-list", c.Id)
+
+	event(logdebug, li, "OpenID Connect client %v created: %v", c.Id,
+		c.Name)
+	return
+}
+
+func setRedisSigningKey(li *LogInfo, k *SigningKey, secret string) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "keyring:key:" + k.Id
+
+	if err = checkRedisKeyExist(key); err == nil {
+		return errors.New("Signing key " + k.Id + " exists")
+	}
+
+	if _, err = rdb.Do("hmset", key, "service", k.Service, "callers",
+		strings.Join(k.Callers, " "), "secret", secret, "not-before",
+		k.NotBefore, "not-after", k.NotAfter, "created",
+		k.Created); err != nil {
+		return errors.New("Error saving Redis key " + key)
+	}
+
+	if k.NotAfter != 0 {
+		rdb.Do("expireat", key, k.NotAfter)
+	}
+
+	rdb.Do("rpush", "keyring:key-list", k.Id)
+
+	event(logdebug, li, "Signing key %v created for %v", k.Id, k.Service)
+	return
+}
+
+// setRedisSigningKeyExpiry brings the end of a key validity forward to t,
+// a key due to expire earlier keeps its own expiry
+func setRedisSigningKeyExpiry(li *LogInfo, kid string, t int64) (n int64,
+	err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "keyring:key:" + kid
+
+	var k *SigningKey
+
+	if k, _, err = getRedisSigningKey(kid); err != nil {
+		return
+	}
+
+	if k.NotAfter != 0 && k.NotAfter <= t {
+		return k.NotAfter, nil
+	}
+
+	if _, err = rdb.Do("hset", key, "not-after", t); err != nil {
+		return n, errors.New("Error saving Redis key " + key)
+	}
+
+	// the record goes with the key, the key list is pruned when listed
+	rdb.Do("expireat", key, t)
+
+	event(logdebug, li, "Signing key %v expires at %v", kid, t)
+	return t, nil
+}
+
+func setRedisOIDCCode(dgst string, c *OIDCCode, ttl int64) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "oidc:code:" + dgst
+
+	if _, err = rdb.Do("hmset", key, "client", c.Client, "uid", c.Uid,
+		"redirect", c.RedirectUri, "scope", c.Scope, "nonce", c.Nonce,
+		"challenge", c.Challenge, "auth-time", c.AuthTime); err != nil {
+		return errors.New("Error saving Redis key " + key)
+	}
+
+	rdb.Do("expire", key, ttl)
+	return
+}
+
+func setRedisAUPNew(a *AUPInfo) (ver int64, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "aup:next"
+
+	if ver, err = redis.Int64(rdb.Do("incr", key)); err != nil {
+		return ver, errors.New("Error saving Redis key " + key)
+	}
+
+	key = fmt.Sprintf("aup:%v", ver)
+
+	if _, err = rdb.Do("hmset", key, "title", a.Title, "text", a.Text,
+		"published", a.Published); err != nil {
+		return ver, errors.New("Error saving Redis key " + key)
+	}
+
+	rdb.Do("rpush", "aup:version-list", ver)
+	return
+}
+
+// setRedisUserAUP records the first acceptance of an AUP version, accepting
+// the same version again keeps the original record
+func setRedisUserAUP(li *LogInfo, uid, ver int64, ip string) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := fmt.Sprintf("aup:%v:accepted", ver)
+	val := fmt.Sprintf("%v;%v", time.Now().Format(time.RFC1123), ip)
+
+	var n int64
+
+	if n, err = redis.Int64(rdb.Do("hsetnx", key, uid, val)); err != nil {
+		return errors.New("Error saving Redis key " + key)
+	}
+
+	if n == 0 {
+		return
+	}
+
+	if err = users.SetUserActivity(uid, fmt.Sprintf("AUP version %v "+
+		"accepted", ver), ip); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	event(logdebug, li, "User [%v] accepted AUP version %v", uid, ver)
+	return
+}
+
+func getRedisMsgId(c string) (id int64, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "msgid:next"
+
+	if err = checkRedisKeyExist(key); err != nil {
+		return
+	}
+
+	if id, err = redis.Int64(rdb.Do("get", key)); err != nil {
+		return id, errors.New("Error retrieving Redis key " + key)
+	}
+
+	rdb.Do("incr", key)
+	return
+}
+
+func getRedisUserId() (uid int64, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "uid:next"
+
+	if err = checkRedisKeyExist(key); err != nil {
+		return
+	}
+
+	if uid, err = redis.Int64(rdb.Do("get", key)); err != nil {
+		return uid, errors.New("Error retrieving Redis key " + key)
+	}
+
+	rdb.Do("incr", key)
+	return
+}
+
+func getRedisUserIdFromLogin(login string) (uid int64, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := fmt.Sprintf("user:%v:id", login)
+
+	if err = checkRedisKeyExist(key); err != nil {
+		return
+	}
+
+	if uid, err = redis.Int64(rdb.Do("get", key)); err != nil || uid == 0 {
+		return uid, errors.New("Error retrieving Redis key " + key)
+	}
+
+	return
+}
+
+func getRedisUserInfo(uid int64) (s *UserInfo, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := fmt.Sprintf("uid:%v", uid)
+
+	if err = checkRedisKeyExist(key); err != nil {
+		return
+	}
+
+	var r []string
+
+	if r, err = redis.Strings(rdb.Do("hmget", key, "id", "name", "login",
+		"password", "admin", "status", "registered", "flogin",
+		"verified", "locale")); err != nil || len(r) == 0 {
+		return s, errors.New("Error retrieving Redis key " + key)
+	}
+
+	id, _ := strconv.ParseInt(r[0], 0, 64)
+
+	s = &UserInfo{Id: id, Name: r[1], Login: r[2], Password: r[3],
+		Admin: r[4], Status: r[5], Registered: r[6], FirstLogin: r[7],
+		Verified: r[8], Locale: r[9]}
+
+	if s.FirstLogin != "" {
+		rdb.Do("hset", "flogin", time.Now().Format(time.RFC1123))
+	}
+
+	return
+}
+
+func getRedisUserList(s string) (l []string, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := fmt.Sprintf("user:%v-list", s)
+
+	if err = checkRedisKeyExist(key); err != nil {
+		return
+	}
+
+	if l, err = redis.Strings(rdb.Do("lrange", key, 0, -1)); err != nil ||
+		len(l) == 0 {
+		return l, errors.New("Error retrieving Redis key " + key)
+	}
+
+	return
+}
+
+// getRedisUserIndex returns the IDs of users whose login or name starts
+// with, or contains, value. Substring matches on the trigram sets may hold
+// false positives that the caller has to filter.
+func getRedisUserIndex(field, value string, prefix bool) (l []int64,
+	err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "index:" + field
+	v := strings.ToLower(value)
+	t := getTrigrams(v)
+
+	var r []string
+
+	if !prefix && len(t) != 0 {
+		args := make([]interface{}, len(t))
+
+		for i := range t {
+			args[i] = key + ":" + t[i]
+		}
+
+		if r, err = redis.Strings(rdb.Do("sinter", args...)); err != nil {
+			return l, errors.New("Error retrieving Redis key " + key)
+		}
+
+		for i := range r {
+			uid, _ := strconv.ParseInt(r[i], 0, 64)
+			l = append(l, uid)
+		}
+
+		return
+	}
+
+	// prefixes and short substrings are matched on the lexical index
+	if prefix {
+		r, err = redis.Strings(rdb.Do("zrangebylex", key, "["+v,
+			"["+v+"\xff"))
+	} else {
+		r, err = redis.Strings(rdb.Do("zrange", key, 0, -1))
+	}
+
+	if err != nil {
+		return l, errors.New("Error retrieving Redis key " + key)
+	}
+
+	for i := range r {
+		n := strings.LastIndex(r[i], ":")
+
+		if n < 0 || (!prefix && !strings.Contains(r[i][:n], v)) {
+			continue
+		}
+
+		uid, _ := strconv.ParseInt(r[i][n+1:], 0, 64)
+		l = append(l, uid)
+	}
+
+	return
+}
+
+// getRedisUserSorted walks the id, registered, login or name index from the
+// position after, an empty position starts at either end. It returns up to n
+// user IDs with the index position of each so a later call can continue
+// from any of them.
+func getRedisUserSorted(field string, desc bool, after string,
+	n int64) (l []int64, pos []string, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "index:" + field
+
+	var r []string
+
+	switch field {
+	case "id", "registered":
+		// positions are [score]:[uid], members sharing a score are ordered
+		// by their rank
+		var ofs int64 = -1
+
+		if after != "" {
+			i := strings.LastIndex(after, ":")
+
+			if i < 0 {
+				return l, pos, errors.New("Invalid index position: " + after)
+			}
+
+			cmd := "zrank"
+
+			if desc {
+				cmd = "zrevrank"
+			}
+
+			if v, err := redis.Int64(rdb.Do(cmd, key,
+				after[i+1:])); err == nil {
+				ofs = v
+			}
+		}
+
+		if ofs >= 0 || after == "" {
+			cmd := "zrange"
+
+			if desc {
+				cmd = "zrevrange"
+			}
+
+			r, err = redis.Strings(rdb.Do(cmd, key, ofs+1, ofs+n,
+				"withscores"))
+		} else {
+			// the user at the position is gone, carry on from its score
+			v := "(" + after[:strings.LastIndex(after, ":")]
+			args := []interface{}{key, v, "+inf"}
+			cmd := "zrangebyscore"
+
+			if desc {
+				args[2] = "-inf"
+				cmd = "zrevrangebyscore"
+			}
+
+			args = append(args, "withscores", "limit", 0, n)
+			r, err = redis.Strings(rdb.Do(cmd, args...))
+		}
+
+		if err != nil {
+			return l, pos, errors.New("Error retrieving Redis key " + key)
+		}
+
+		for i := 0; i+1 < len(r); i += 2 {
+			uid, _ := strconv.ParseInt(r[i], 0, 64)
+			l = append(l, uid)
+			pos = append(pos, r[i+1]+":"+r[i])
+		}
+
+	case "login", "name":
+		// positions are the [value]:[uid] members themselves
+		min, max, cmd := "-", "+", "zrangebylex"
+
+		if after != "" {
+			min = "(" + after
+		}
+
+		if desc {
+			min, max, cmd = "+", "-", "zrevrangebylex"
+
+			if after != "" {
+				min = "(" + after
+			}
+		}
+
+		if r, err = redis.Strings(rdb.Do(cmd, key, min, max, "limit", 0,
+			n)); err != nil {
+			return l, pos, errors.New("Error retrieving Redis key " + key)
+		}
+
+		for i := range r {
+			j := strings.LastIndex(r[i], ":")
+
+			if j < 0 {
+				continue
+			}
+
+			uid, _ := strconv.ParseInt(r[i][j+1:], 0, 64)
+			l = append(l, uid)
+			pos = append(pos, r[i])
+		}
+
+	default:
+		return l, pos, errors.New("Invalid index: " + field)
+	}
+
+	return
+}
+
+// getRedisUserRegistered returns the IDs of users registered between the two
+// timestamps, inclusive
+func getRedisUserRegistered(from, to int64) (l []int64, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "index:registered"
+
+	var r []string
+
+	if r, err = redis.Strings(rdb.Do("zrangebyscore", key, from,
+		to)); err != nil {
+		return l, errors.New("Error retrieving Redis key " + key)
+	}
+
+	for i := range r {
+		uid, _ := strconv.ParseInt(r[i], 0, 64)
+		l = append(l, uid)
+	}
+
+	return
+}
+
+func getRedisMail(id int64) (m *MailInfo, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := fmt.Sprintf("mail:%v", id)
+
+	if err = checkRedisKeyExist(key); err != nil {
+		return
+	}
+
+	var r []string
+
+	if r, err = redis.Strings(rdb.Do("hmget", key, "rcpt", "subject",
+		"text", "html", "service", "tries", "error", "created",
+		"next")); err != nil || len(r) != 9 {
+		return m, errors.New("Error retrieving Redis key " + key)
+	}
+
+	tries, _ := strconv.ParseInt(r[5], 0, 64)
+	next, _ := strconv.ParseInt(r[8], 0, 64)
+
+	m = &MailInfo{Id: id, Subject: r[1], Text: r[2], Html: r[3],
+		Service: r[4] == "1", Tries: tries, Error: r[6], Created: r[7]}
+
+	if r[0] != "" {
+		m.Rcpt = strings.Split(r[0], "\n")
+	}
+
+	if next != 0 {
+		m.Next = time.Unix(next, 0).Format(time.RFC1123)
+	}
+
+	return
+}
+
+// getRedisMailDue returns the queued mail due for delivery, in batches
+func getRedisMailDue(now int64) (l []int64, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	var r []string
+
+	if r, err = redis.Strings(rdb.Do("zrangebyscore", "mail:queue", "-inf",
+		now, "limit", 0, 50)); err != nil {
+		return l, errors.New("Error retrieving Redis key mail:queue")
+	}
+
+	for i := range r {
+		id, _ := strconv.ParseInt(r[i], 0, 64)
+		l = append(l, id)
+	}
+
+	return
+}
+
+func getRedisMailList(list string) (l []int64, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	var r []string
+
+	if list == "queue" {
+		r, err = redis.Strings(rdb.Do("zrange", "mail:queue", 0, -1))
+	} else {
+		r, err = redis.Strings(rdb.Do("lrange", "mail:dead-list", 0, -1))
+	}
+
+	if err != nil {
+		return l, errors.New("Error retrieving Redis key mail:" + list)
+	}
+
+	for i := range r {
+		id, _ := strconv.ParseInt(r[i], 0, 64)
+		l = append(l, id)
+	}
+
+	return
+}
+
+func getRedisUserUidList(uid int64, s string) (l []string, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := fmt.Sprintf("uid:%v:%v-list", uid, s)
+
+	if err = checkRedisKeyExist(key); err != nil {
+		return
+	}
+
+	if l, err = redis.Strings(rdb.Do("lrange", key, 0, -1)); err != nil ||
+		len(l) == 0 {
+		return l, errors.New("Error retrieving Redis key " + key)
+	}
+
+	return
+}
+
+func deleteRedisUserSession(li *LogInfo, uid int64, sid, act,
+	ip string) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "session:" + sid
+
+	if err = checkRedisKeyExist(key); err != nil {
+		return
+	}
+
+	if _, err = rdb.Do("del", key); err != nil {
+		return errors.New("Error deleting Redis key " + key)
+	}
+
+	rdb.Do("srem", fmt.Sprintf("uid:%v:login-sessions", uid), sid)
+
+	if err = users.SetUserLogin(uid, ip, act); err != nil {
+		return
+	}
+
+	event(logdebug, li, "User [%v] session [%v] deleted", uid, sid[:8])
+	return
+}
+
+// deleteRedisUserSessions revokes every session of a user except the one
+// identified by keep, which may be empty to revoke them all
+func deleteRedisUserSessions(li *LogInfo, uid int64, keep, ip string) (n int,
+	err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := fmt.Sprintf("uid:%v:login-sessions", uid)
+
+	var v []string
+
+	if v, err = redis.Strings(rdb.Do("smembers", key)); err != nil {
+		return n, errors.New("Error retrieving Redis key " + key)
+	}
+
+	for i := range v {
+		if v[i] == keep {
+			continue
+		}
+
+		rdb.Do("del", "session:"+v[i])
+		rdb.Do("srem", key, v[i])
+		n++
+	}
+
+	if n == 0 {
+		return
+	}
+
+	if err = users.SetUserLogin(uid, ip, "revoked"); err != nil {
+		return
+	}
+
+	action := fmt.Sprintf("sessions revoked: %v", n)
+
+	if err = users.SetUserActivity(uid, action, ip); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	event(logdebug, li, "User [%v] %v sessions revoked", uid, n)
+	return n, nil
+}
+
+func getRedisUserTOTP(uid int64) (secret, pending string, last int64,
+	err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := fmt.Sprintf("uid:%v:totp", uid)
+
+	var r []string
+
+	if r, err = redis.Strings(rdb.Do("hmget", key, "secret", "pending",
+		"last-step")); err != nil || len(r) != 3 {
+		return secret, pending, last, errors.New("Error retrieving " +
+			"Redis key " + key)
+	}
+
+	last, _ = strconv.ParseInt(r[2], 0, 64)
+
+	return r[0], r[1], last, nil
+}
+
+func getRedisLoginChallenge(dgst string) (uid int64, client string,
+	err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "login:" + dgst
+
+	var r []string
+
+	if r, err = redis.Strings(rdb.Do("hmget", key, "uid",
+		"client")); err != nil || len(r) != 2 || r[0] == "" {
+		return uid, client, errors.New("Error retrieving Redis key " + key)
+	}
+
+	uid, _ = strconv.ParseInt(r[0], 0, 64)
+
+	return uid, r[1], nil
+}
+
+func getRedisLoginFail(login string, window int64) (n, last int64,
+	err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "fail:login:" + login
+	now := time.Now().Unix()
+
+	if n, err = redis.Int64(rdb.Do("zcount", key, now-window,
+		"+inf")); err != nil {
+		return n, last, errors.New("Error retrieving Redis key " + key)
+	}
+
+	var r []string
+
+	if r, err = redis.Strings(rdb.Do("zrevrange", key, 0, 0,
+		"withscores")); err != nil {
+		return n, last, errors.New("Error retrieving Redis key " + key)
+	}
+
+	if len(r) == 2 {
+		last, _ = strconv.ParseInt(r[1], 0, 64)
+	}
+
+	return
+}
+
+func getRedisRoleList() (l []string, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "role:all-list"
+
+	if l, err = redis.Strings(rdb.Do("lrange", key, 0, -1)); err != nil {
+		return l, errors.New("Error retrieving Redis key " + key)
+	}
+
+	return
+}
+
+func getRedisRole(name string) (r *RoleInfo, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	if err = checkRedisRoleExist(name); err != nil {
+		return
+	}
+
+	r = &RoleInfo{Name: name}
+
+	key := fmt.Sprintf("role:%v:perms", name)
+
+	if r.Perms, err = redis.Strings(rdb.Do("smembers", key)); err != nil {
+		return r, errors.New("Error retrieving Redis key " + key)
+	}
+
+	key = fmt.Sprintf("role:%v:uids", name)
+
+	if r.Uids, err = redis.Strings(rdb.Do("smembers", key)); err != nil {
+		return r, errors.New("Error retrieving Redis key " + key)
+	}
+
+	return
+}
+
+func getRedisUserRoles(uid int64) (l []string, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := fmt.Sprintf("uid:%v:roles", uid)
+
+	if l, err = redis.Strings(rdb.Do("smembers", key)); err != nil {
+		return l, errors.New("Error retrieving Redis key " + key)
+	}
+
+	return
+}
+
+func getRedisApiKey(kid string) (k *ApiKeyInfo, dgst string, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "apikey:" + kid
+
+	var r []string
+
+	if r, err = redis.Strings(rdb.Do("hmget", key, "uid", "name", "scope",
+		"digest", "created", "expire", "last-used")); err != nil ||
+		len(r) != 7 || r[0] == "" {
+		return k, dgst, errors.New("Error retrieving Redis key " + key)
+	}
+
+	k = &ApiKeyInfo{Id: kid, Uid: r[0], Name: r[1], Scope: r[2],
+		Created: r[4], Expire: r[5], LastUsed: r[6]}
+
+	return k, r[3], nil
+}
+
+func getRedisUserApiKeys(uid int64) (l []ApiKeyInfo, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := fmt.Sprintf("uid:%v:apikeys", uid)
+
+	var v []string
+
+	if v, err = redis.Strings(rdb.Do("smembers", key)); err != nil {
+		return l, errors.New("Error retrieving Redis key " + key)
+	}
+
+	for i := range v {
+		// drop keys that have expired
+		if k, _, err := getRedisApiKey(v[i]); err != nil {
+			rdb.Do("srem", key, v[i])
+		} else {
+			l = append(l, *k)
+		}
+	}
+
+	return
+}
+
+func getRedisUserPasswordHistory(uid int64) (l []string, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := fmt.Sprintf("uid:%v:password-history", uid)
+
+	if l, err = redis.Strings(rdb.Do("lrange", key, 0, -1)); err != nil {
+		return l, errors.New("Error retrieving Redis key " + key)
+	}
+
+	return
+}
+
+func getRedisOIDCClient(id string) (c *OIDCClientInfo, dgst string,
+	err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "oidc:client:" + id
+
+	var r []string
+
+	if r, err = redis.Strings(rdb.Do("hmget", key, "name", "redirect",
+		"digest", "created")); err != nil || len(r) != 4 || r[0] == "" {
+		return c, dgst, errors.New("Error retrieving Redis key " + key)
+	}
+
+	c = &OIDCClientInfo{Id: id, Name: r[0],
+		RedirectUri: strings.Fields(r[1]), Public: r[2] == "",
+		Created: r[3]}
+
+	return c, r[2], nil
+}
+
+func getRedisSigningKey(kid string) (k *SigningKey, secret string,
+	err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "keyring:key:" + kid
+
+	var r []string
+
+	if r, err = redis.Strings(rdb.Do("hmget", key, "service", "callers",
+		"secret", "not-before", "not-after",
+		"created")); err != nil || len(r) != 6 || r[0] == "" {
+		return k, secret, errors.New("Error retrieving Redis key " +
+			key)
+	}
+
+	k = &SigningKey{Id: kid, Service: r[0], Callers: strings.Fields(r[1]),
+		Created: r[5]}
+	k.NotBefore, _ = strconv.ParseInt(r[3], 0, 64)
+	k.NotAfter, _ = strconv.ParseInt(r[4], 0, 64)
+
+	return k, r[2], nil
+}
+
+// getRedisSigningKeyList returns the keyring, dropping the keys that have
+// expired since it was last read
+func getRedisSigningKeyList() (l []string, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "keyring:key-list"
+
+	var v []string
+
+	if v, err = redis.Strings(rdb.Do("lrange", key, 0, -1)); err != nil {
+		return l, errors.New("Error retrieving Redis key " + key)
+	}
+
+	for i := range v {
+		k := "keyring:key:" + v[i]
+
+		if err := checkRedisKeyExist(k); err != nil {
+			rdb.Do("lrem", key, 0, v[i])
+			continue
+		}
+
+		l = append(l, v[i])
+	}
+
+	return
+}
+
+func getRedisOIDCClientList() (l []string, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "oidc:client-list"
+
+	if l, err = redis.Strings(rdb.Do("lrange", key, 0, -1)); err != nil {
+		return l, errors.New("Error retrieving Redis key " + key)
+	}
+
+	return
+}
+
+// getRedisOIDCCode redeems an authorization code, a code can only be
+// redeemed once
+func getRedisOIDCCode(dgst string) (c *OIDCCode, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "oidc:code:" + dgst
+
+	var r []string
+
+	if r, err = redis.Strings(rdb.Do("hmget", key, "client", "uid",
+		"redirect", "scope", "nonce", "challenge",
+		"auth-time")); err != nil || len(r) != 7 || r[0] == "" {
+		return c, errors.New("Error retrieving Redis key " + key)
+	}
+
+	var n int64
+
+	if n, err = redis.Int64(rdb.Do("del", key)); err != nil || n != 1 {
+		return c, errors.New("Error deleting Redis key " + key)
+	}
+
+	uid, _ := strconv.ParseInt(r[1], 0, 64)
+	t, _ := strconv.ParseInt(r[6], 0, 64)
+
+	c = &OIDCCode{Client: r[0], Uid: uid, RedirectUri: r[2], Scope: r[3],
+		Nonce: r[4], Challenge: r[5], AuthTime: t}
+
+	return c, nil
+}
+
+func getRedisAUP(ver int64) (a *AUPInfo, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := fmt.Sprintf("aup:%v", ver)
+
+	var r []string
+
+	if r, err = redis.Strings(rdb.Do("hmget", key, "title", "text",
+		"published")); err != nil || len(r) != 3 || r[0] == "" {
+		return a, errors.New("Error retrieving Redis key " + key)
+	}
+
+	a = &AUPInfo{Version: ver, Title: r[0], Text: r[1], Published: r[2]}
+	return a, nil
+}
+
+func getRedisAUPList() (l []int64, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "aup:version-list"
+
+	var r []string
+
+	if r, err = redis.Strings(rdb.Do("lrange", key, 0, -1)); err != nil {
+		return l, errors.New("Error retrieving Redis key " + key)
+	}
+
+	for i := range r {
+		ver, _ := strconv.ParseInt(r[i], 0, 64)
+		l = append(l, ver)
+	}
+
+	return
+}
+
+// getRedisAUPLatest returns the newest AUP version, 0 if none has been
+// published
+func getRedisAUPLatest() (ver int64, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "aup:version-list"
+
+	var r []string
+
+	if r, err = redis.Strings(rdb.Do("lrange", key, -1, -1)); err != nil {
+		return ver, errors.New("Error retrieving Redis key " + key)
+	}
+
+	if len(r) == 1 {
+		ver, _ = strconv.ParseInt(r[0], 0, 64)
+	}
+
+	return
+}
+
+// getRedisAUPAccepted returns every acceptance recorded for an AUP version
+func getRedisAUPAccepted(ver int64) (l []AUPAcceptInfo, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := fmt.Sprintf("aup:%v:accepted", ver)
+
+	var r []string
+
+	if r, err = redis.Strings(rdb.Do("hgetall", key)); err != nil {
+		return l, errors.New("Error retrieving Redis key " + key)
+	}
+
+	for i := 0; i+1 < len(r); i += 2 {
+		uid, _ := strconv.ParseInt(r[i], 0, 64)
+		v := strings.SplitN(r[i+1], ";", 2)
+
+		a := AUPAcceptInfo{Version: ver, Uid: uid, Accepted: v[0]}
+
+		if len(v) == 2 {
+			a.Ip = v[1]
+		}
+
+		l = append(l, a)
+	}
+
+	return
+}
+
+// getRedisUserAUP returns when and from where a user accepted an AUP
+// version, both are empty if it has not been accepted
+func getRedisUserAUP(uid, ver int64) (t, ip string, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := fmt.Sprintf("aup:%v:accepted", ver)
+
+	var r []string
+
+	if r, err = redis.Strings(rdb.Do("hmget", key, uid)); err != nil ||
+		len(r) != 1 {
+		return t, ip, errors.New("Error retrieving Redis key " + key)
+	}
+
+	v := strings.SplitN(r[0], ";", 2)
+
+	if len(v) == 2 {
+		ip = v[1]
+	}
+
+	return v[0], ip, nil
+}
+
+func deleteRedisUserTOTP(li *LogInfo, uid int64, ip string) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := fmt.Sprintf("uid:%v:totp", uid)
+
+	if _, err = rdb.Do("del", key, fmt.Sprintf("uid:%v:totp-recovery",
+		uid)); err != nil {
+		return errors.New("Error deleting Redis key " + key)
+	}
+
+	if err = users.SetUserActivity(uid, "two-factor disabled",
+		ip); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	event(logdebug, li, "User [%v] two-factor authentication disabled", uid)
+	return
+}
+
+// deleteRedisUserTOTPRecovery consumes a recovery code, failing if the code
+// was never issued or has already been used
+func deleteRedisUserTOTPRecovery(uid int64, dgst string) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := fmt.Sprintf("uid:%v:totp-recovery", uid)
+
+	var n int64
+
+	if n, err = redis.Int64(rdb.Do("srem", key, dgst)); err != nil || n != 1 {
+		return errors.New("Invalid recovery code")
+	}
+
+	return
+}
+
+func deleteRedisLoginChallenge(dgst string) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "login:" + dgst
+
+	var n int64
+
+	if n, err = redis.Int64(rdb.Do("del", key)); err != nil || n != 1 {
+		return errors.New("Error deleting Redis key " + key)
+	}
+
+	return
+}
+
+func deleteRedisUserIndex(uid int64, field, value string) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "index:" + field
+	v := strings.ToLower(value)
+
+	rdb.Do("zrem", key, fmt.Sprintf("%v:%v", v, uid))
+
+	t := getTrigrams(v)
+
+	for i := range t {
+		rdb.Do("srem", key+":"+t[i], uid)
+	}
+}
+
+// deleteRedisMailQueue claims a queued mail for delivery, failing if
+// another worker has already claimed it
+func deleteRedisMailQueue(id int64) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	var n int64
+
+	if n, err = redis.Int64(rdb.Do("zrem", "mail:queue", id)); err != nil ||
+		n != 1 {
+		return errors.New(fmt.Sprintf("Mail [%v] is not queued", id))
+	}
+
+	return
+}
+
+func deleteRedisMail(id int64) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := fmt.Sprintf("mail:%v", id)
+
+	var n int64
+
+	if n, err = redis.Int64(rdb.Do("del", key)); err != nil || n != 1 {
+		return errors.New("Error deleting Redis key " + key)
+	}
+
+	rdb.Do("zrem", "mail:queue", id)
+	rdb.Do("lrem", "mail:dead-list", 0, id)
+	return
+}
+
+func deleteRedisUserNew(uid int64) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	rdb.Do("lrem", "user:new-list", 0, uid)
+}
+
+func deleteRedisLoginFail(login string) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "fail:login:" + login
+
+	if _, err = rdb.Do("del", key, "lock:login:"+login); err != nil {
+		return errors.New("Error deleting Redis key " + key)
+	}
+
+	return
+}
+
+func deleteRedisApiKey(li *LogInfo, uid int64, kid, ip string) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	var k *ApiKeyInfo
+
+	if k, _, err = getRedisApiKey(kid); err != nil ||
+		k.Uid != fmt.Sprintf("%v", uid) {
+		return errors.New(fmt.Sprintf("User [%v] has no API key %v", uid,
+			kid))
+	}
+
+	rdb.Do("del", "apikey:"+kid)
+	rdb.Do("srem", fmt.Sprintf("uid:%v:apikeys", uid), kid)
+
+	action := fmt.Sprintf("api key revoked: %v [%v]", k.Name, kid)
+
+	if err = users.SetUserActivity(uid, action, ip); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	event(logdebug, li, "User [%v] API key revoked: %v", uid, kid)
+	return nil
+}
+
+func deleteRedisOIDCClient(li *LogInfo, id string) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "oidc:client:" + id
+
+	var n int64
+
+	if n, err = redis.Int64(rdb.Do("del", key)); err != nil || n != 1 {
+		return errors.New("Error deleting Redis key " + key)
+	}
+
+	rdb.Do("lrem", "oidc:client-list", 0, id)
+
+	event(logdebug, li, "OpenID Connect client %v deleted", id)
+	return
+}
+
+// deleteRedisUserAUP removes the acceptance records of a user
+func deleteRedisUserAUP(uid int64) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	var l []int64
+
+	if l, err = getRedisAUPList(); err != nil {
+		return
+	}
+
+	for i := range l {
+		rdb.Do("hdel", fmt.Sprintf("aup:%v:accepted", l[i]), uid)
+	}
+
+	return
+}
+
+func deleteRedisRole(li *LogInfo, name, ip string) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	if err = checkRedisRoleExist(name); err != nil {
+		return
+	}
+
+	key := fmt.Sprintf("role:%v:uids", name)
+
+	var l []string
+
+	if l, err = redis.Strings(rdb.Do("smembers", key)); err != nil {
+		return errors.New("Error retrieving Redis key " + key)
+	}
+
+	for i := range l {
+		rdb.Do("srem", fmt.Sprintf("uid:%v:roles", l[i]), name)
+
+		uid, _ := strconv.ParseInt(l[i], 0, 64)
+
+		if err = checkRedisUserAdmin(uid); err != nil {
+			event(logwarn, li, err.Error())
+		}
+		action := fmt.Sprintf("role revoked: %v", name)
+
+		if err = users.SetUserActivity(uid, action, ip); err != nil {
+			event(logwarn, li, err.Error())
+		}
+	}
+
+	rdb.Do("del", key, fmt.Sprintf("role:%v:perms", name))
+	rdb.Do("lrem", "role:all-list", 0, name)
+
+	event(logdebug, li, "Role %v deleted", name)
+	return nil
+}
+
+func deleteRedisUserRole(li *LogInfo, uid int64, role, ip string) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := fmt.Sprintf("role:%v:uids", role)
+
+	var n int64
+
+	if role == superadmin {
+		if n, err = redis.Int64(rdb.Do("scard", key)); err != nil {
+			return errors.New("Error retrieving Redis key " + key)
+		}
+
+		if n <= 1 {
+			return errors.New("Cannot revoke the last " + superadmin)
+		}
+	}
+
+	if n, err = redis.Int64(rdb.Do("srem", fmt.Sprintf("uid:%v:roles", uid),
+		role)); err != nil || n != 1 {
+		return errors.New(fmt.Sprintf("User [%v] does not have role %v",
+			uid, role))
+	}
+
+	rdb.Do("srem", key, uid)
+
+	if err = checkRedisUserAdmin(uid); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	action := fmt.Sprintf("role revoked: %v", role)
+
+	if err = users.SetUserActivity(uid, action, ip); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	event(logdebug, li, "User [%v] revoked role %v", uid, role)
+	return nil
+}
+
+// deleteRedisUser removes every key held by a user. Roles are revoked first
+// so that the last superadmin cannot be deleted.
+func deleteRedisUser(li *LogInfo, uid int64, ip string) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	var s *UserInfo
+
+	if s, err = users.GetUserInfo(uid); err != nil {
+		return
+	}
+
+	var l []string
+
+	if l, err = getRedisUserRoles(uid); err != nil {
+		return
+	}
+
+	for i := range l {
+		if err = deleteRedisUserRole(li, uid, l[i], ip); err != nil {
+			return
+		}
+	}
+
+	if _, err = deleteRedisUserSessions(li, uid, "", ip); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	var k []ApiKeyInfo
+
+	if k, err = getRedisUserApiKeys(uid); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	for i := range k {
+		rdb.Do("del", "apikey:"+k[i].Id)
+	}
+
+	if err = deleteRedisUserAUP(uid); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	if r, err := redis.String(rdb.Do("get", fmt.Sprintf("uid:%v:reset",
+		uid))); err == nil && r != "" {
+		rdb.Do("del", "reset:"+r)
+	}
+
+	key := fmt.Sprintf("uid:%v:reset", uid)
+
+	if _, err = rdb.Do("del", key,
+		fmt.Sprintf("uid:%v:login-sessions", uid),
+		fmt.Sprintf("uid:%v:totp", uid),
+		fmt.Sprintf("uid:%v:totp-recovery", uid),
+		fmt.Sprintf("uid:%v:roles", uid),
+		fmt.Sprintf("uid:%v:apikeys", uid),
+		fmt.Sprintf("uid:%v:password-history", uid),
+		"fail:login:"+s.Login, "lock:login:"+s.Login); err != nil {
+		return errors.New("Error deleting Redis key " + key)
+	}
+
+	if err = users.DeleteUser(uid); err != nil {
+		return
+	}
+
+	event(lognotice, li, "User %v deleted: [%v] from %v", s.Login, uid, ip)
+	return nil
+}
+
+// deleteRedisUserRecord removes the user hash, its lists and index entries
+func deleteRedisUserRecord(uid int64) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	var s *UserInfo
+
+	if s, err = getRedisUserInfo(uid); err != nil {
+		return
+	}
+
+	for _, v := range []string{"all", "enabled", "disabled", "active",
+		"inactive", "admin", "new"} {
+		rdb.Do("lrem", fmt.Sprintf("user:%v-list", v), 0, uid)
+	}
+
+	deleteRedisUserIndex(uid, "login", s.Login)
+	deleteRedisUserIndex(uid, "name", s.Name)
+
+	rdb.Do("zrem", "index:registered", uid)
+	rdb.Do("zrem", "index:id", uid)
+
+	key := fmt.Sprintf("uid:%v", uid)
+
+	if _, err = rdb.Do("del", key, fmt.Sprintf("user:%v:id", s.Login),
+		fmt.Sprintf("uid:%v:activity-list", uid),
+		fmt.Sprintf("uid:%v:login-list", uid)); err != nil {
+		return errors.New("Error deleting Redis key " + key)
+	}
+
+	return
+}
+
+func checkRedisUserStatus(uid int64) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	if s := fmt.Sprintf("%v", uid); uid == 0 {
+		return errors.New("Invalid user ID: " + s)
+	}
+
+	key := fmt.Sprintf("uid:%v", uid)
+
+	if err = checkRedisKeyExist(key); err != nil {
+		return
+	}
+
+	var s *UserInfo
+
+	if s, err = getRedisUserInfo(uid); err != nil {
+		return
+	}
+
+	if s.Admin != "enabled" {
+		return errors.New("User is disabled: " + s.Name)
+	}
+
+	if s.Status != "active" {
+		return errors.New("User is inactive: " + s.Name)
+	}
+
+	return
+}
+
+// checkRedisUserResetToken returns the owner of a reset token without
+// redeeming it
+func checkRedisUserResetToken(dgst string) (uid int64, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := "reset:" + dgst
+
+	if uid, err = redis.Int64(rdb.Do("get", key)); err != nil || uid == 0 {
+		return uid, errors.New("Error retrieving Redis key " + key)
+	}
+
+	return
+}
+
+// checkRedisLoginLock returns the remaining lockout of either the login or the
+// source IP, zero if neither is locked out
+func checkRedisLoginLock(login, ip string) (ttl int64, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := []string{"lock:login:" + login, "lock:ip:" + ip}
+
+	for i := range key {
+		var n int64
+
+		if n, err = redis.Int64(rdb.Do("ttl", key[i])); err != nil {
+			return ttl, errors.New("Error retrieving Redis key " + key[i])
+		}
+
+		if n > ttl {
+			ttl = n
+		}
+	}
+
+	return
+}
+
+// checkRedisUserAdmin drops the user from the admin list once the last role
+// has been revoked
+func checkRedisUserAdmin(uid int64) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := fmt.Sprintf("uid:%v:roles", uid)
+
+	var n int64
+
+	if n, err = redis.Int64(rdb.Do("scard", key)); err != nil {
+		return errors.New("Error retrieving Redis key " + key)
+	}
+
+	if n == 0 {
+		return users.SetUserRoleHolder(uid, false)
+	}
+
+	return
+}
+
+func checkRedisRoleExist(name string) (err error) {
+	return checkRedisKeyExist(fmt.Sprintf("role:%v:perms", name))
+}
+
+// checkRedisUserPermission looks for the permission in any of the user roles
+func checkRedisUserPermission(uid int64, perm string) (ok bool, err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	var l []string
+
+	if l, err = getRedisUserRoles(uid); err != nil {
+		return
+	}
+
+	for i := range l {
+		key := fmt.Sprintf("role:%v:perms", l[i])
+
+		if ok, err = redis.Bool(rdb.Do("sismember", key, perm)); err != nil {
+			return ok, errors.New("Error retrieving Redis key " + key)
+		}
+
+		if ok {
+			return
+		}
+	}
+
+	return
+}
+
+// checkRedisUserTunnel returns the number of tunnel sessions rebana has
+// assigned to a user
+func checkRedisUserTunnel(uid int64) (n int64, err error) {
+	rdb := trp.Get()
+	defer rdb.Close()
+
+	key := fmt.Sprintf("uid:%v:sessions-list", uid)
+
+	if n, err = redis.Int64(rdb.Do("llen", key)); err != nil {
+		return n, errors.New("Error retrieving Redis key " + key)
+	}
+
+	return
+}
+
+func checkRedisKeyExist(key string) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	var exist bool
+
+	if exist, err = redis.Bool(rdb.Do("exists", key)); err != nil || !exist {
+		return errors.New("Error retrieving Redis key " + key)
+	}
+
+	return
+}
+
+func checkRedisUserId(uid int64) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := fmt.Sprintf("uid:%v", uid)
+
+	if err = checkRedisKeyExist(key); err != nil {
+		return
+	}
+
+	return
+}
+
+func checkRedisMsgId(id int64) (err error) {
+	rdb := rdp.Get()
+	defer rdb.Close()
+
+	key := fmt.Sprintf("msgid:%v", id)
+
+	if err = checkRedisKeyExist(key); err != nil {
+		return
+	}
+
+	return
+}
+
+func checkRedis() (err error) {
+	// a SQLite user store without a Redis server keeps the state in its
+	// database, there are no tunnel sessions without rebana
+	if app.RedisUrl == "" {
+		if rdp == nil {
+			if rdp, err = newKVPool(); err != nil {
+				return
+			}
+
+			trp = rdp
+
+			event(loginfo, sli, "Keeping state in SQLite: %v",
+				app.UserStorePath)
+		}
+
+		return
+	}
+
+	if rdp == nil {
+		rdp = newRedisPool(app.RedisDb)
+
+		event(loginfo, sli, "Connected to Redis: %v", app.RedisUrl)
+	}
+
+	if trp == nil {
+		trp = newRedisPool(app.TunnelRedisDb)
+	}
+
+	return
+}
+
+func newRedisPool(db string) *redis.Pool {
+	return &redis.Pool{MaxIdle: 5, IdleTimeout: 300 * time.Second,
+		Dial: func() (rdb redis.Conn, err error) {
+			if rdb, err = redis.Dial("tcp", app.RedisUrl); err != nil {
+				return
+			}
+
+			if _, err = rdb.Do("auth", app.RedisPw); err != nil {
+				return
+			}
+
+			if _, err = rdb.Do("select", db); err != nil {
+				return
+			}
+
+			return
+		}}
 }
@@ -0,0 +1,319 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type RoleInfo struct {
+	Name  string
+	Perms []string
+	Uids  []string
+
+	ErrNo int
+}
+
+type RoleInfoList struct {
+	Id    int64
+	Entry []RoleInfo
+}
+
+const superadmin = "superadmin"
+
+// permissions known to ghazal and rebana, superadmin holds all of them
+var permissions = []string{
+	"user.read",
+	"user.write",
+	"user.admin",
+	"role.read",
+	"role.write",
+	"server.read",
+	"server.write",
+	"session.assign",
+}
+
+// adminPermissions control other users or roles, holding one makes a user an
+// admin who is flagged as such. TOTPAdminRequired applies to any role holder
+// since every one of them may sign in to the control panel.
+var adminPermissions = []string{"user.admin", "role.write"}
+
+// adminPermission declares the permission each admin command requires
+var adminPermission = map[string]string{
+	"resolve-user":          "user.read",
+	"resolve-user-id":       "user.read",
+	"list-user":             "user.read",
+	"get-user-list":         "user.read",
+	"list-login-sessions":   "user.read",
+	"reset-user-pw":         "user.write",
+	"add-user":              "user.write",
+	"set-user-attr":         "user.write",
+	"activate-user":         "user.write",
+	"deactivate-user":       "user.write",
+	"revoke-login-sessions": "user.write",
+	"unlock-user":           "user.write",
+	"enable-user":           "user.admin",
+	"disable-user":          "user.admin",
+	"delete-user":           "user.admin",
+	"impersonate-user":      "user.admin",
+	"export-user-data":      "user.read",
+	"search-user":           "user.read",
+	"import-users":          "user.write",
+	"export-users":          "user.read",
+	"render-template":       "user.admin",
+	"list-mail":             "user.admin",
+	"retry-mail":            "user.admin",
+	"purge-mail":            "user.admin",
+	"create-oidc-client":    "user.admin",
+	"list-oidc-client":      "user.read",
+	"delete-oidc-client":    "user.admin",
+	"publish-aup":           "user.admin",
+	"list-aup":              "user.read",
+	"report-aup":            "user.read",
+	"add-signing-key":       "role.write",
+	"list-signing-keys":     "role.read",
+	"retire-signing-key":    "role.write",
+	"list-role":             "role.read",
+	"create-role":           "role.write",
+	"delete-role":           "role.write",
+	"grant-role":            "role.write",
+	"revoke-role":           "role.write",
+}
+
+func checkPermission(p string) (err error) {
+	for i := range permissions {
+		if p == permissions[i] {
+			return
+		}
+	}
+
+	return errors.New("Invalid permission: " + p)
+}
+
+// setupRoles gives the superadmin role every permission and grants it to the
+// users of the legacy admin list that hold no role yet. The role is
+// refreshed on every start so permissions added since reach it.
+func setupRoles() (err error) {
+	if err = checkRedis(); err != nil {
+		return
+	}
+
+	isnew := checkRedisRoleExist(superadmin) != nil
+
+	if err = setRedisRoleNew(sli, superadmin, permissions); err != nil {
+		return
+	}
+
+	if isnew {
+		event(lognotice, sli, "Role %v created", superadmin)
+	}
+
+	var l []string
+
+	// an empty admin list means there is nothing to migrate
+	if l, err = users.GetUserList("admin"); err != nil {
+		return nil
+	}
+
+	for i := range l {
+		uid, _ := strconv.ParseInt(l[i], 0, 64)
+
+		var r []string
+
+		if r, err = getRedisUserRoles(uid); err != nil {
+			return
+		}
+
+		if len(r) != 0 {
+			continue
+		}
+
+		if err = setRedisUserRole(sli, uid, superadmin,
+			"localhost"); err != nil {
+			return
+		}
+
+		event(lognotice, sli, "User [%v] migrated to role %v", uid,
+			superadmin)
+	}
+
+	return
+}
+
+func listRole(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqListRole)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrListRole)
+		return
+	}
+
+	var names []string
+
+	// a single empty entry lists all roles
+	if len(m.Entry) == 1 && m.Entry[0].Name == "" {
+		if names, err = getRedisRoleList(); err != nil {
+			incStat(&stat.ReqErrListRole)
+			return
+		}
+	} else {
+		for i := range m.Entry {
+			names = append(names, m.Entry[i].Name)
+		}
+	}
+
+	si := make([]RoleInfo, len(names))
+
+	for i := range names {
+		if r, err := getRedisRole(names[i]); err != nil {
+			si[i] = RoleInfo{Name: names[i], ErrNo: ENOENT}
+		} else {
+			si[i] = *r
+		}
+	}
+
+	buf, _ := json.Marshal(&RoleInfoList{Id: int64(len(si)), Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+func createRole(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqCreateRole)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrCreateRole)
+		return
+	}
+
+	si := make([]Name, len(m.Entry))
+
+	for i := range m.Entry {
+		e := m.Entry[i]
+		si[i] = Name{Name: e.Name, Opt: e.Opt}
+
+		if e.Name == "" || strings.ContainsAny(e.Name, ": ") {
+			si[i].ErrNo = EINVAL
+			continue
+		}
+
+		if checkRedisRoleExist(e.Name) == nil {
+			si[i].ErrNo = EAGAIN
+			continue
+		}
+
+		p := strings.Split(e.Opt, ",")
+
+		for j := range p {
+			if err = checkPermission(p[j]); err != nil {
+				event(logwarn, li, err.Error())
+				si[i].ErrNo = EINVAL
+				break
+			}
+		}
+
+		if si[i].ErrNo != EOK {
+			continue
+		}
+
+		if err = setRedisRoleNew(li, e.Name, p); err != nil {
+			event(logwarn, li, err.Error())
+			si[i].ErrNo = EINVAL
+		}
+	}
+
+	err = nil
+
+	buf, _ := json.Marshal(&NameList{Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+func deleteRole(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqDeleteRole)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrDeleteRole)
+		return
+	}
+
+	si := make([]Name, len(m.Entry))
+
+	for i := range m.Entry {
+		e := m.Entry[i]
+		si[i] = Name{Name: e.Name}
+
+		if e.Name == superadmin {
+			si[i].ErrNo = EPERM
+		} else if err := deleteRedisRole(li, e.Name,
+			d.Origin); err != nil {
+			event(logwarn, li, err.Error())
+			si[i].ErrNo = ENOENT
+		}
+	}
+
+	buf, _ := json.Marshal(&NameList{Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+func setUserRole(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	grant := d.Command == "grant-role"
+
+	if grant {
+		incStat(&stat.ReqGrantRole)
+	} else {
+		incStat(&stat.ReqRevokeRole)
+	}
+
+	var m *IdList
+
+	if m, err = getIdList(d.Data, d.Command); err != nil {
+		if grant {
+			incStat(&stat.ReqErrGrantRole)
+		} else {
+			incStat(&stat.ReqErrRevokeRole)
+		}
+
+		return
+	}
+
+	si := make([]Id, len(m.Entry))
+
+	for i := range m.Entry {
+		e := m.Entry[i]
+		si[i] = Id{Id: e.Id, Opt: e.Opt}
+
+		if err := users.CheckUserId(e.Id); err != nil {
+			si[i].ErrNo = ENOENT
+		} else if err = checkRedisRoleExist(e.Opt); err != nil {
+			si[i].ErrNo = EINVAL
+		} else if grant {
+			if err = setRedisUserRole(li, e.Id, e.Opt,
+				d.Origin); err != nil {
+				event(logwarn, li, err.Error())
+				si[i].ErrNo = EINVAL
+			}
+		} else if err = deleteRedisUserRole(li, e.Id, e.Opt,
+			d.Origin); err != nil {
+			event(logwarn, li, err.Error())
+			si[i].ErrNo = EPERM
+		}
+	}
+
+	buf, _ := json.Marshal(&IdList{Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
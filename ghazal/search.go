@@ -0,0 +1,244 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// intersectUid keeps the IDs of l that are also in r, a nil l is treated as
+// the set of all users
+func intersectUid(l, r []int64) []int64 {
+	if l == nil {
+		return r
+	}
+
+	m := make(map[int64]bool)
+
+	for i := range r {
+		m[r[i]] = true
+	}
+
+	v := []int64{}
+
+	for i := range l {
+		if m[l[i]] {
+			v = append(v, l[i])
+		}
+	}
+
+	return v
+}
+
+func searchUser(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqSearchUser)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrSearchUser)
+		return
+	}
+
+	var login, name, status, admin string
+	var from, to int64
+	var prefix bool
+
+	page, npage := int64(1), int64(10)
+	to = time.Now().Unix()
+
+	for i := range m.Entry {
+		e := m.Entry[i]
+
+		switch e.Name {
+		case "login":
+			login = strings.ToLower(e.Opt)
+
+		case "name":
+			name = strings.ToLower(e.Opt)
+
+		case "match":
+			if e.Opt != "prefix" && e.Opt != "substring" {
+				incStat(&stat.ReqErrSearchUser)
+				return errors.New("Invalid match type: " + e.Opt)
+			}
+
+			prefix = e.Opt == "prefix"
+
+		case "status":
+			if e.Opt != "active" && e.Opt != "inactive" {
+				incStat(&stat.ReqErrSearchUser)
+				return errors.New("Invalid status: " + e.Opt)
+			}
+
+			status = e.Opt
+
+		case "admin":
+			if e.Opt != "enabled" && e.Opt != "disabled" {
+				incStat(&stat.ReqErrSearchUser)
+				return errors.New("Invalid admin status: " + e.Opt)
+			}
+
+			admin = e.Opt
+
+		case "from", "to":
+			t, err := time.ParseInLocation("2006-01-02", e.Opt, time.Local)
+
+			if err != nil {
+				incStat(&stat.ReqErrSearchUser)
+				return errors.New("Invalid date: " + e.Opt)
+			}
+
+			if e.Name == "from" {
+				from = t.Unix()
+			} else {
+				to = t.Add(24*time.Hour).Unix() - 1
+			}
+
+		case "page":
+			args := strings.Split(e.Opt, ":")
+
+			if len(args) != 2 {
+				incStat(&stat.ReqErrSearchUser)
+				return errors.New("Invalid page parameter: " + e.Opt)
+			}
+
+			page, _ = strconv.ParseInt(args[0], 0, 32)
+			npage, _ = strconv.ParseInt(args[1], 0, 32)
+
+			if page < 1 || npage < 1 {
+				incStat(&stat.ReqErrSearchUser)
+				return errors.New("Invalid list page count")
+			}
+
+		case "":
+
+		default:
+			incStat(&stat.ReqErrSearchUser)
+			return errors.New("Invalid search field: " + e.Name)
+		}
+	}
+
+	var l, r []int64
+
+	if login != "" {
+		if r, err = users.GetUserIndex("login", login, prefix); err != nil {
+			incStat(&stat.ReqErrSearchUser)
+			return
+		}
+
+		l = intersectUid(l, r)
+	}
+
+	if name != "" {
+		if r, err = users.GetUserIndex("name", name, prefix); err != nil {
+			incStat(&stat.ReqErrSearchUser)
+			return
+		}
+
+		l = intersectUid(l, r)
+	}
+
+	if r, err = users.GetUserRegistered(from, to); err != nil {
+		incStat(&stat.ReqErrSearchUser)
+		return
+	}
+
+	l = intersectUid(l, r)
+
+	// the status and admin lists filter by ID, no user is loaded for them
+	f := []string{status, admin}
+
+	for i := range f {
+		if f[i] == "" {
+			continue
+		}
+
+		// an empty list matches no one
+		v, _ := users.GetUserList(f[i])
+
+		r = make([]int64, len(v))
+
+		for j := range v {
+			r[j], _ = strconv.ParseInt(v[j], 0, 64)
+		}
+
+		l = intersectUid(l, r)
+	}
+
+	sort.Sort(UidSlice(l))
+
+	um := make(map[int64]*UserInfo)
+
+	// trigram matches may contain the letters out of order, only these
+	// candidates are loaded ahead of paging
+	if !prefix && (login != "" || name != "") {
+		v := []int64{}
+
+		for i := range l {
+			s, err := users.GetUserInfo(l[i])
+
+			if err != nil {
+				event(logwarn, li, err.Error())
+				continue
+			}
+
+			sl := strings.ToLower(s.Login)
+			sn := strings.ToLower(s.Name)
+
+			if (login != "" && !strings.Contains(sl, login)) ||
+				(name != "" && !strings.Contains(sn, name)) {
+				continue
+			}
+
+			um[l[i]] = s
+			v = append(v, l[i])
+		}
+
+		l = v
+	}
+
+	c := int64(len(l))
+	sofs := (page - 1) * npage
+	eofs := sofs + npage
+
+	if sofs > c {
+		incStat(&stat.ReqErrSearchUser)
+		return errors.New("Invalid page offset")
+	}
+
+	if eofs > c {
+		eofs = c
+	}
+
+	var si []UserInfo
+
+	for i := sofs; i < eofs; i++ {
+		s, ok := um[l[i]]
+
+		if !ok {
+			var e error
+
+			if s, e = users.GetUserInfo(l[i]); e != nil {
+				event(logwarn, li, e.Error())
+				continue
+			}
+		}
+
+		s.Password = ""
+		s.Idx = l[i]
+		si = append(si, *s)
+	}
+
+	buf, _ := json.Marshal(&UserInfoList{Id: c, Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
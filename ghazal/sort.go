@@ -35,3 +35,18 @@ func (s *UserInfoSorter) Swap(i, j int) {
 func (s *UserInfoSorter) Less(i, j int) bool {
 	return s.by(&s.us[i], &s.us[j])
 }
+
+// UidSlice sorts user IDs in ascending order
+type UidSlice []int64
+
+func (p UidSlice) Len() int {
+	return len(p)
+}
+
+func (p UidSlice) Swap(i, j int) {
+	p[i], p[j] = p[j], p[i]
+}
+
+func (p UidSlice) Less(i, j int) bool {
+	return p[i] < p[j]
+}
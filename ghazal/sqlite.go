@@ -0,0 +1,584 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+/*
+ * User tables
+ * -----------
+ * users (one row per user, the Redis uid:[uid] hash and status lists)
+ * user_events (activity and login history, newest 1000 per user and kind)
+ *
+ * The state tables used without a Redis server are described in kv.go.
+ */
+
+package main
+
+import (
+	"code.google.com/p/go.crypto/bcrypt"
+	"database/sql"
+	"errors"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var sqliteSchema = []string{
+	`create table if not exists users (
+		id integer primary key autoincrement,
+		login text not null unique,
+		name text not null,
+		password text not null,
+		admin text not null default 'enabled',
+		status text not null default 'active',
+		registered text not null default '',
+		registered_at integer not null default 0,
+		flogin text not null default '',
+		verified text not null default '',
+		locale text not null default '',
+		new integer not null default 0,
+		role_holder integer not null default 0)`,
+	`create index if not exists users_name on users (name)`,
+	`create index if not exists users_admin on users (admin)`,
+	`create index if not exists users_status on users (status)`,
+	`create index if not exists users_registered on users (registered_at)`,
+	`create index if not exists users_new on users (new)`,
+	`create table if not exists user_events (
+		id integer primary key autoincrement,
+		uid integer not null,
+		kind text not null,
+		entry text not null)`,
+	`create index if not exists user_events_uid on user_events
+		(uid, kind, id)`,
+}
+
+// the conditions behind each of the Redis user lists
+var sqliteUserLists = map[string]string{
+	"all":      "1 = 1",
+	"enabled":  "admin = 'enabled'",
+	"disabled": "admin = 'disabled'",
+	"active":   "status = 'active'",
+	"inactive": "status = 'inactive'",
+	"new":      "new = 1",
+	"admin":    "role_holder = 1",
+}
+
+// the columns behind each of the Redis sort indexes
+var sqliteUserSorts = map[string]string{
+	"id":         "id",
+	"registered": "registered_at",
+	"login":      "lower(login)",
+	"name":       "lower(name)",
+}
+
+// attributes that set-user-attr and the password commands may change
+var sqliteUserAttrs = map[string]bool{
+	"name":     true,
+	"password": true,
+	"locale":   true,
+}
+
+type sqliteUserStore struct {
+	db *sql.DB
+}
+
+// sqliteDb is opened once and shared by the user store and, without a Redis
+// server, the state kept in its place
+var sqliteDb *sql.DB
+
+func openSQLite() (db *sql.DB, err error) {
+	if sqliteDb != nil {
+		return sqliteDb, nil
+	}
+
+	if app.UserStorePath == "" {
+		return nil, errors.New("User store path is empty")
+	}
+
+	if db, err = sql.Open("sqlite3", app.UserStorePath); err != nil {
+		return nil, errors.New("Unable to open user store: " + err.Error())
+	}
+
+	// SQLite allows a single writer, serialise rather than fail with
+	// database is locked
+	db.SetMaxOpenConns(1)
+
+	event(loginfo, sli, "Opened user store: %v", app.UserStorePath)
+
+	sqliteDb = db
+	return
+}
+
+func newSQLiteUserStore() (UserStore, error) {
+	db, err := openSQLite()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range sqliteSchema {
+		if _, err = db.Exec(sqliteSchema[i]); err != nil {
+			return nil, errors.New("Unable to create user store schema: " +
+				err.Error())
+		}
+	}
+
+	return &sqliteUserStore{db: db}, nil
+}
+
+func (r *sqliteUserStore) NewUser(li *LogInfo, s *UserInfo,
+	ip string) (uid int64, pw string, err error) {
+	if _, err = r.GetUserIdFromLogin(s.Login); err == nil {
+		return uid, pw, errors.New("User " + s.Login + " exists")
+	}
+
+	if pw, err = generateTempPassword(); err != nil {
+		return
+	}
+
+	var dgst []byte
+
+	if dgst, err = bcrypt.GenerateFromPassword([]byte(pw), 10); err != nil {
+		return uid, pw, errors.New("Error generating " + s.Login + " password")
+	}
+
+	now := time.Now()
+
+	var res sql.Result
+
+	if res, err = r.db.Exec(`insert into users (login, name, password,
+		registered, registered_at, locale, new) values (?, ?, ?, ?, ?, ?,
+		1)`, s.Login, s.Name, string(dgst), now.Format(time.RFC1123),
+		now.Unix(), s.Locale); err != nil {
+		return uid, pw, errors.New("Error saving user " + s.Login)
+	}
+
+	if uid, err = res.LastInsertId(); err != nil {
+		return uid, pw, errors.New("Unable to retrieve new user ID")
+	}
+
+	if err = r.SetUserActivity(uid, "created", ip); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	err = nil
+
+	event(logdebug, li, "User %v added: [%v]", s.Login, uid)
+	return
+}
+
+func (r *sqliteUserStore) ImportUser(s *UserInfo, act, login []string,
+	isnew, admin bool) (err error) {
+	t, _ := time.Parse(time.RFC1123, s.Registered)
+
+	var tx *sql.Tx
+
+	if tx, err = r.db.Begin(); err != nil {
+		return
+	}
+
+	if _, err = tx.Exec(`insert into users (id, login, name, password,
+		admin, status, registered, registered_at, flogin, verified, locale,
+		new, role_holder) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.Id, s.Login, s.Name, s.Password, s.Admin, s.Status, s.Registered,
+		t.Unix(), s.FirstLogin, s.Verified, s.Locale, isnew,
+		admin); err != nil {
+		tx.Rollback()
+		return errors.New(fmt.Sprintf("Error saving user %v [%v]: %v",
+			s.Login, s.Id, err))
+	}
+
+	h := map[string][]string{"activity": act, "login": login}
+
+	for kind, l := range h {
+		// the lists are newest first, insert oldest first
+		for i := len(l) - 1; i >= 0; i-- {
+			if _, err = tx.Exec(`insert into user_events (uid, kind, entry)
+				values (?, ?, ?)`, s.Id, kind, l[i]); err != nil {
+				tx.Rollback()
+				return errors.New(fmt.Sprintf("Error saving user [%v] "+
+					"%v list", s.Id, kind))
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (r *sqliteUserStore) SetUserAttr(li *LogInfo, uid int64, field, value,
+	ip string) (err error) {
+	if !sqliteUserAttrs[field] {
+		return errors.New("Invalid user attribute: " + field)
+	}
+
+	if err = r.setUser(uid, field+" = ?", value); err != nil {
+		return
+	}
+
+	action := fmt.Sprintf("attribute changed: %v", field)
+
+	if err = r.SetUserActivity(uid, action, ip); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	event(logdebug, li, "User [%v] has new [%v]: [%v]", uid, field, value)
+	return nil
+}
+
+func (r *sqliteUserStore) SetUserFirstLogin(uid int64, ip string) error {
+	return r.setUser(uid, "flogin = ?, new = 0",
+		time.Now().Format(time.RFC1123))
+}
+
+func (r *sqliteUserStore) SetUserVerified(li *LogInfo, uid int64,
+	ip string) (err error) {
+	if err = r.setUser(uid, "verified = ?, new = 0",
+		time.Now().Format(time.RFC1123)); err != nil {
+		return
+	}
+
+	if err = r.SetUserActivity(uid, "email verified", ip); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	event(logdebug, li, "User [%v] email verified", uid)
+	return nil
+}
+
+func (r *sqliteUserStore) SetUserActivity(uid int64, act, ip string) error {
+	return r.setUserEvent(uid, "activity", act, ip)
+}
+
+func (r *sqliteUserStore) SetUserLogin(uid int64, ip, act string) error {
+	return r.setUserEvent(uid, "login", act, ip)
+}
+
+func (r *sqliteUserStore) SetUserAdminStatus(li *LogInfo, uid int64, f bool,
+	ip string) (err error) {
+	status := "disabled"
+
+	if f {
+		status = "enabled"
+	}
+
+	if err = r.setUser(uid, "admin = ?", status); err != nil {
+		return
+	}
+
+	action := fmt.Sprintf("status changed: %v", status)
+
+	if err = r.SetUserActivity(uid, action, ip); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	event(logdebug, li, "User [%v] admin status is now %v", uid, status)
+	return nil
+}
+
+func (r *sqliteUserStore) SetUserStatus(li *LogInfo, uid int64, f bool,
+	ip string) (err error) {
+	status := "inactive"
+
+	if f {
+		status = "active"
+	}
+
+	if err = r.setUser(uid, "status = ?", status); err != nil {
+		return
+	}
+
+	action := fmt.Sprintf("status changed: %v", status)
+
+	if err = r.SetUserActivity(uid, action, ip); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	event(logdebug, li, "User [%v] is now %v", uid, status)
+	return nil
+}
+
+func (r *sqliteUserStore) SetUserRoleHolder(uid int64, f bool) error {
+	return r.setUser(uid, "role_holder = ?", f)
+}
+
+func (r *sqliteUserStore) GetUserIdFromLogin(login string) (uid int64,
+	err error) {
+	if err = r.db.QueryRow("select id from users where login = ?",
+		login).Scan(&uid); err != nil {
+		return uid, errors.New("Error retrieving user " + login)
+	}
+
+	return
+}
+
+func (r *sqliteUserStore) GetUserInfo(uid int64) (s *UserInfo, err error) {
+	s = &UserInfo{}
+
+	if err = r.db.QueryRow(`select id, name, login, password, admin,
+		status, registered, flogin, verified, locale from users where
+		id = ?`, uid).Scan(&s.Id, &s.Name, &s.Login, &s.Password, &s.Admin,
+		&s.Status, &s.Registered, &s.FirstLogin, &s.Verified,
+		&s.Locale); err != nil {
+		return nil, errors.New(fmt.Sprintf("Error retrieving user [%v]",
+			uid))
+	}
+
+	return
+}
+
+func (r *sqliteUserStore) GetUserList(s string) (l []string, err error) {
+	cond, ok := sqliteUserLists[s]
+
+	if !ok {
+		return l, errors.New("Invalid user list: " + s)
+	}
+
+	var v []int64
+
+	if v, err = r.getUserIds("select id from users where " + cond +
+		" order by id"); err != nil || len(v) == 0 {
+		return l, errors.New("Error retrieving user list " + s)
+	}
+
+	for i := range v {
+		l = append(l, strconv.FormatInt(v[i], 10))
+	}
+
+	return
+}
+
+func (r *sqliteUserStore) GetUserUidList(uid int64, s string) (l []string,
+	err error) {
+	var rows *sql.Rows
+
+	if rows, err = r.db.Query(`select entry from user_events where uid = ?
+		and kind = ? order by id desc`, uid, s); err != nil {
+		return l, errors.New(fmt.Sprintf("Error retrieving user [%v] %v "+
+			"list", uid, s))
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var e string
+
+		if err = rows.Scan(&e); err != nil {
+			return
+		}
+
+		l = append(l, e)
+	}
+
+	if len(l) == 0 {
+		return l, errors.New(fmt.Sprintf("Error retrieving user [%v] %v "+
+			"list", uid, s))
+	}
+
+	return l, rows.Err()
+}
+
+func (r *sqliteUserStore) GetUserIndex(field, value string,
+	prefix bool) (l []int64, err error) {
+	if field != "login" && field != "name" {
+		return l, errors.New("Invalid index: " + field)
+	}
+
+	v := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(
+		strings.ToLower(value))
+
+	if prefix {
+		v = v + "%"
+	} else {
+		v = "%" + v + "%"
+	}
+
+	return r.getUserIds("select id from users where lower("+field+
+		`) like ? escape '\' order by id`, v)
+}
+
+func (r *sqliteUserStore) GetUserRegistered(from, to int64) ([]int64,
+	error) {
+	return r.getUserIds(`select id from users where registered_at between
+		? and ? order by registered_at`, from, to)
+}
+
+func (r *sqliteUserStore) GetUserSorted(field string, desc bool,
+	after string, n int64) (l []int64, pos []string, err error) {
+	col, ok := sqliteUserSorts[field]
+
+	if !ok {
+		return l, pos, errors.New("Invalid index: " + field)
+	}
+
+	cmp, dir := ">", "asc"
+
+	if desc {
+		cmp, dir = "<", "desc"
+	}
+
+	q := "select id, " + col + " from users"
+
+	var args []interface{}
+
+	// positions are [value]:[uid], the uid breaks ties between equal values
+	if after != "" {
+		i := strings.LastIndex(after, ":")
+
+		if i < 0 {
+			return l, pos, errors.New("Invalid index position: " + after)
+		}
+
+		var v interface{} = after[:i]
+
+		if field == "id" || field == "registered" {
+			v, _ = strconv.ParseInt(after[:i], 0, 64)
+		}
+
+		uid, _ := strconv.ParseInt(after[i+1:], 0, 64)
+
+		q += " where " + col + " " + cmp + " ? or (" + col + " = ? and id " +
+			cmp + " ?)"
+		args = append(args, v, v, uid)
+	}
+
+	q += " order by " + col + " " + dir + ", id " + dir + " limit ?"
+	args = append(args, n)
+
+	var rows *sql.Rows
+
+	if rows, err = r.db.Query(q, args...); err != nil {
+		return l, pos, errors.New("Error retrieving user store: " +
+			err.Error())
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var uid int64
+		var v string
+
+		if err = rows.Scan(&uid, &v); err != nil {
+			return
+		}
+
+		l = append(l, uid)
+		pos = append(pos, fmt.Sprintf("%v:%v", v, uid))
+	}
+
+	return l, pos, rows.Err()
+}
+
+func (r *sqliteUserStore) DeleteUserNew(uid int64) {
+	r.setUser(uid, "new = 0")
+}
+
+func (r *sqliteUserStore) DeleteUser(uid int64) (err error) {
+	var tx *sql.Tx
+
+	if tx, err = r.db.Begin(); err != nil {
+		return
+	}
+
+	tx.Exec("delete from user_events where uid = ?", uid)
+
+	if _, err = tx.Exec("delete from users where id = ?", uid); err != nil {
+		tx.Rollback()
+		return errors.New(fmt.Sprintf("Error deleting user [%v]", uid))
+	}
+
+	return tx.Commit()
+}
+
+func (r *sqliteUserStore) CheckUserId(uid int64) (err error) {
+	var n int64
+
+	if err = r.db.QueryRow("select count(*) from users where id = ?",
+		uid).Scan(&n); err != nil || n == 0 {
+		return errors.New(fmt.Sprintf("Error retrieving user [%v]", uid))
+	}
+
+	return
+}
+
+func (r *sqliteUserStore) CheckUserStatus(uid int64) (err error) {
+	if uid == 0 {
+		return errors.New("Invalid user ID: 0")
+	}
+
+	var s *UserInfo
+
+	if s, err = r.GetUserInfo(uid); err != nil {
+		return
+	}
+
+	if s.Admin != "enabled" {
+		return errors.New("User is disabled: " + s.Name)
+	}
+
+	if s.Status != "active" {
+		return errors.New("User is inactive: " + s.Name)
+	}
+
+	return
+}
+
+// setUser updates the columns in set, failing if the user does not exist
+func (r *sqliteUserStore) setUser(uid int64, set string,
+	args ...interface{}) (err error) {
+	var res sql.Result
+
+	args = append(args, uid)
+
+	if res, err = r.db.Exec("update users set "+set+" where id = ?",
+		args...); err != nil {
+		return errors.New(fmt.Sprintf("Error saving user [%v]", uid))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New(fmt.Sprintf("Error retrieving user [%v]", uid))
+	}
+
+	return
+}
+
+// setUserEvent records an activity or login entry, keeping the newest 1000
+// as the Redis lists do
+func (r *sqliteUserStore) setUserEvent(uid int64, kind, act,
+	ip string) (err error) {
+	val := fmt.Sprintf("%v;%v;%v", act, ip, time.Now().Format(time.RFC1123))
+
+	if _, err = r.db.Exec(`insert into user_events (uid, kind, entry)
+		values (?, ?, ?)`, uid, kind, val); err != nil {
+		return errors.New(fmt.Sprintf("Error saving user [%v] %v list",
+			uid, kind))
+	}
+
+	r.db.Exec(`delete from user_events where uid = ? and kind = ? and id
+		not in (select id from user_events where uid = ? and kind = ?
+		order by id desc limit 1000)`, uid, kind, uid, kind)
+	return
+}
+
+func (r *sqliteUserStore) getUserIds(q string, args ...interface{}) (l []int64,
+	err error) {
+	var rows *sql.Rows
+
+	if rows, err = r.db.Query(q, args...); err != nil {
+		return l, errors.New("Error retrieving user store: " + err.Error())
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var uid int64
+
+		if err = rows.Scan(&uid); err != nil {
+			return
+		}
+
+		l = append(l, uid)
+	}
+
+	return l, rows.Err()
+}
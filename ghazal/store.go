@@ -0,0 +1,282 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// UserStore keeps the user records, their status lists, activity and login
+// history, and the search indexes. Sessions, roles, API and signing keys,
+// nonces, reset tokens, TOTP state, OIDC codes and the mail queue are kept
+// by the Redis helpers, in Redis or with a sqlite store and no Redis server
+// in its database.
+type UserStore interface {
+	NewUser(li *LogInfo, s *UserInfo, ip string) (uid int64, pw string,
+		err error)
+	ImportUser(s *UserInfo, act, login []string, isnew, admin bool) error
+	SetUserAttr(li *LogInfo, uid int64, field, value, ip string) error
+	SetUserFirstLogin(uid int64, ip string) error
+	SetUserVerified(li *LogInfo, uid int64, ip string) error
+	SetUserActivity(uid int64, act, ip string) error
+	SetUserLogin(uid int64, ip, act string) error
+	SetUserAdminStatus(li *LogInfo, uid int64, f bool, ip string) error
+	SetUserStatus(li *LogInfo, uid int64, f bool, ip string) error
+	SetUserRoleHolder(uid int64, f bool) error
+
+	GetUserIdFromLogin(login string) (uid int64, err error)
+	GetUserInfo(uid int64) (s *UserInfo, err error)
+	GetUserList(s string) (l []string, err error)
+	GetUserUidList(uid int64, s string) (l []string, err error)
+	GetUserIndex(field, value string, prefix bool) (l []int64, err error)
+	GetUserRegistered(from, to int64) (l []int64, err error)
+	GetUserSorted(field string, desc bool, after string, n int64) (l []int64,
+		pos []string, err error)
+
+	DeleteUserNew(uid int64)
+	DeleteUser(uid int64) error
+
+	CheckUserId(uid int64) error
+	CheckUserStatus(uid int64) error
+}
+
+var users UserStore
+
+// userStores maps the UserStore config value to its constructor
+var userStores = map[string]func() (UserStore, error){
+	"redis":  newRedisUserStore,
+	"sqlite": newSQLiteUserStore,
+}
+
+func setupUserStore() (err error) {
+	users, err = userStores[app.UserStore]()
+	return
+}
+
+// migrateUserStore copies every user from the configured store into the
+// target store, keeping the user IDs
+func migrateUserStore(target string) (err error) {
+	fn, ok := userStores[target]
+
+	if !ok || target == app.UserStore {
+		return errors.New("Invalid migration target: " + target)
+	}
+
+	// the state is copied between Redis and the sqlite store alongside
+	if app.RedisUrl == "" {
+		return errors.New("Redis URL is empty")
+	}
+
+	var dst UserStore
+
+	if dst, err = fn(); err != nil {
+		return
+	}
+
+	var l []string
+
+	if l, err = users.GetUserList("all"); err != nil {
+		return errors.New("No users to migrate")
+	}
+
+	flag := func(list string) map[string]bool {
+		m := make(map[string]bool)
+		v, _ := users.GetUserList(list)
+
+		for i := range v {
+			m[v[i]] = true
+		}
+
+		return m
+	}
+
+	isnew := flag("new")
+	admin := flag("admin")
+
+	for i := range l {
+		uid, _ := strconv.ParseInt(l[i], 0, 64)
+
+		var s *UserInfo
+
+		if s, err = users.GetUserInfo(uid); err != nil {
+			event(logwarn, sli, err.Error())
+			continue
+		}
+
+		act, _ := users.GetUserUidList(uid, "activity")
+		login, _ := users.GetUserUidList(uid, "login")
+
+		if err = dst.ImportUser(s, act, login, isnew[l[i]],
+			admin[l[i]]); err != nil {
+			return
+		}
+	}
+
+	event(lognotice, sli, "%v users migrated from %v to %v", len(l),
+		app.UserStore, target)
+
+	return migrateState(target)
+}
+
+type redisUserStore struct{}
+
+func newRedisUserStore() (UserStore, error) {
+	r := &redisUserStore{}
+
+	if err := r.setupIndex(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// setupIndex builds the search indexes on first start for users created
+// before they existed. The users are read through the store itself, which
+// may be the target of a migration rather than the configured store.
+func (r *redisUserStore) setupIndex() (err error) {
+	if err = checkRedis(); err != nil {
+		return
+	}
+
+	// the ID index is the newest, its presence means all of them are built
+	if err = checkRedisKeyExist("index:id"); err == nil {
+		return
+	}
+
+	var l []string
+
+	// an empty user list means there is nothing to index
+	if l, err = r.GetUserList("all"); err != nil {
+		return nil
+	}
+
+	for i := range l {
+		uid, _ := strconv.ParseInt(l[i], 0, 64)
+
+		var s *UserInfo
+
+		if s, err = r.GetUserInfo(uid); err != nil {
+			event(logwarn, sli, err.Error())
+			continue
+		}
+
+		if err = setRedisUserIndex(uid, "login", s.Login); err != nil {
+			return
+		}
+
+		if err = setRedisUserIndex(uid, "name", s.Name); err != nil {
+			return
+		}
+
+		t, _ := time.Parse(time.RFC1123, s.Registered)
+
+		if err = setRedisUserRegistered(uid, t.Unix()); err != nil {
+			return
+		}
+
+		if err = setRedisUserIdIndex(uid); err != nil {
+			return
+		}
+	}
+
+	event(lognotice, sli, "Search index built for %v users", len(l))
+	return
+}
+
+func (r *redisUserStore) NewUser(li *LogInfo, s *UserInfo, ip string) (int64,
+	string, error) {
+	return setRedisUserNew(li, s, ip)
+}
+
+func (r *redisUserStore) ImportUser(s *UserInfo, act, login []string,
+	isnew, admin bool) error {
+	return setRedisUserImport(s, act, login, isnew, admin)
+}
+
+func (r *redisUserStore) SetUserAttr(li *LogInfo, uid int64, field, value,
+	ip string) error {
+	return setRedisUserAttr(li, uid, field, value, ip)
+}
+
+func (r *redisUserStore) SetUserFirstLogin(uid int64, ip string) error {
+	return setRedisUserFirstLogin(uid, ip)
+}
+
+func (r *redisUserStore) SetUserVerified(li *LogInfo, uid int64,
+	ip string) error {
+	return setRedisUserVerified(li, uid, ip)
+}
+
+func (r *redisUserStore) SetUserActivity(uid int64, act, ip string) error {
+	return setRedisUserActivityList(uid, act, ip)
+}
+
+func (r *redisUserStore) SetUserLogin(uid int64, ip, act string) error {
+	return setRedisUserLoginList(uid, ip, act)
+}
+
+func (r *redisUserStore) SetUserAdminStatus(li *LogInfo, uid int64, f bool,
+	ip string) error {
+	return setRedisUserAdminStatus(li, uid, f, ip)
+}
+
+func (r *redisUserStore) SetUserStatus(li *LogInfo, uid int64, f bool,
+	ip string) error {
+	return setRedisUserStatus(li, uid, f, ip)
+}
+
+func (r *redisUserStore) SetUserRoleHolder(uid int64, f bool) error {
+	return setRedisUserRoleHolder(uid, f)
+}
+
+func (r *redisUserStore) GetUserIdFromLogin(login string) (int64, error) {
+	return getRedisUserIdFromLogin(login)
+}
+
+func (r *redisUserStore) GetUserInfo(uid int64) (*UserInfo, error) {
+	return getRedisUserInfo(uid)
+}
+
+func (r *redisUserStore) GetUserList(s string) ([]string, error) {
+	return getRedisUserList(s)
+}
+
+func (r *redisUserStore) GetUserUidList(uid int64, s string) ([]string,
+	error) {
+	return getRedisUserUidList(uid, s)
+}
+
+func (r *redisUserStore) GetUserIndex(field, value string,
+	prefix bool) ([]int64, error) {
+	return getRedisUserIndex(field, value, prefix)
+}
+
+func (r *redisUserStore) GetUserRegistered(from, to int64) ([]int64,
+	error) {
+	return getRedisUserRegistered(from, to)
+}
+
+func (r *redisUserStore) GetUserSorted(field string, desc bool,
+	after string, n int64) ([]int64, []string, error) {
+	return getRedisUserSorted(field, desc, after, n)
+}
+
+func (r *redisUserStore) DeleteUserNew(uid int64) {
+	deleteRedisUserNew(uid)
+}
+
+func (r *redisUserStore) DeleteUser(uid int64) error {
+	return deleteRedisUserRecord(uid)
+}
+
+func (r *redisUserStore) CheckUserId(uid int64) error {
+	return checkRedisUserId(uid)
+}
+
+func (r *redisUserStore) CheckUserStatus(uid int64) error {
+	return checkRedisUserStatus(uid)
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpSkew   = 1
+)
+
+func generateTOTPSecret() (s string, err error) {
+	p := make([]byte, 20)
+
+	if _, err = crand.Read(p); err != nil {
+		return s, errors.New("Error generating TOTP secret")
+	}
+
+	return base32.StdEncoding.EncodeToString(p), nil
+}
+
+func generateRecoveryCodes(n int) (c []string, err error) {
+	c = make([]string, n)
+
+	for i := range c {
+		p := make([]byte, 5)
+
+		if _, err = crand.Read(p); err != nil {
+			return c, errors.New("Error generating recovery codes")
+		}
+
+		c[i] = hex.EncodeToString(p)
+	}
+
+	return
+}
+
+// getTOTPUri labels the account with the brand name, authenticator apps
+// show it as the issuer
+func getTOTPUri(login, secret string) string {
+	issuer := url.QueryEscape(app.BrandName)
+
+	return fmt.Sprintf("otpauth://totp/%v:%v?secret=%v&issuer=%v&"+
+		"algorithm=SHA1&digits=%v&period=%v", issuer,
+		url.QueryEscape(login), secret, issuer, totpDigits, totpPeriod)
+}
+
+// getTOTPCode computes the RFC 6238 code of a base32 secret for a time step
+func getTOTPCode(secret string, step int64) (c string, err error) {
+	var k []byte
+
+	if k, err = base32.StdEncoding.DecodeString(secret); err != nil {
+		return c, errors.New("Error decoding TOTP secret")
+	}
+
+	m := make([]byte, 8)
+	binary.BigEndian.PutUint64(m, uint64(step))
+
+	dgst := hmac.New(sha1.New, k)
+	dgst.Write(m)
+
+	h := dgst.Sum(nil)
+	o := h[len(h)-1] & 0x0f
+	v := binary.BigEndian.Uint32(h[o:o+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, v%1000000), nil
+}
+
+// checkTOTPCode accepts a code within the allowed clock skew whose time step
+// is newer than the last one used, so that a code cannot be replayed
+func checkTOTPCode(secret, code string, last int64) (step int64, err error) {
+	code = strings.TrimSpace(code)
+
+	if len(code) != totpDigits {
+		return step, errors.New("Invalid TOTP code")
+	}
+
+	now := time.Now().Unix() / totpPeriod
+
+	for i := -totpSkew; i <= totpSkew; i++ {
+		s := now + int64(i)
+
+		if s <= last {
+			continue
+		}
+
+		var c string
+
+		if c, err = getTOTPCode(secret, s); err != nil {
+			return
+		}
+
+		if hmac.Equal([]byte(c), []byte(code)) {
+			return s, nil
+		}
+	}
+
+	return step, errors.New("TOTP code did not match")
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// the SHA-1 seed of the RFC 6238 test vectors, base32 encoded
+const testTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestGetTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, truncated to 6 digits
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, v := range tests {
+		c, err := getTOTPCode(testTOTPSecret, v.time/totpPeriod)
+
+		if err != nil {
+			t.Fatalf("time %v: %v", v.time, err)
+		}
+
+		if c != v.code {
+			t.Errorf("time %v: got %v, want %v", v.time, c, v.code)
+		}
+	}
+
+	if _, err := getTOTPCode("not base32!", 1); err == nil {
+		t.Errorf("invalid secret accepted")
+	}
+}
+
+func TestCheckTOTPCode(t *testing.T) {
+	now := time.Now().Unix() / totpPeriod
+
+	code := func(step int64) string {
+		c, err := getTOTPCode(testTOTPSecret, step)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return c
+	}
+
+	tests := []struct {
+		name string
+		code string
+		last int64
+		step int64
+		ok   bool
+	}{
+		{"current step", code(now), 0, now, true},
+		{"previous step", code(now - 1), 0, now - 1, true},
+		{"next step", code(now + 1), 0, now + 1, true},
+		{"spaces trimmed", " " + code(now) + " ", 0, now, true},
+		{"outside window", code(now - 2), 0, 0, false},
+		{"ahead of window", code(now + 2), 0, 0, false},
+		{"step already used", code(now), now, 0, false},
+		{"older step than used", code(now - 1), now, 0, false},
+		{"newer step than used", code(now + 1), now, now + 1, true},
+		{"too short", code(now)[1:], 0, 0, false},
+		{"too long", code(now) + "0", 0, 0, false},
+	}
+
+	for _, v := range tests {
+		// a step boundary crossed mid-test shifts the window
+		if time.Now().Unix()/totpPeriod != now {
+			t.Skip("time step changed during the test")
+		}
+
+		step, err := checkTOTPCode(testTOTPSecret, v.code, v.last)
+
+		if v.ok && err != nil {
+			t.Errorf("%v: %v", v.name, err)
+		} else if !v.ok && err == nil {
+			t.Errorf("%v: code accepted", v.name)
+		} else if v.ok && step != v.step {
+			t.Errorf("%v: got step %v, want %v", v.name, step,
+				v.step)
+		}
+	}
+}
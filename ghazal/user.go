@@ -5,22 +5,25 @@
 package main
 
 import (
+	"code.google.com/p/go.crypto/bcrypt"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 )
 
-func userLogin(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqUserLogin++
+func userLogin(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqUserLogin)
 
 	var m *NameList
 
 	if m, err = getNameList(d.Data, d.Command); err != nil {
-		stat.ReqErrUserLogin++
+		incStat(&stat.ReqErrUserLogin)
 		return
 	}
 
-	var login, pw string
+	var login, pw, client string
 	var admin bool
 
 	si := make([]Id, 1)
@@ -40,123 +43,816 @@ func userLogin(w http.ResponseWriter, d *RequestMsg) (err error) {
 		} else if e.Name == "password" {
 			pw = e.Opt
 			c--
+		} else if e.Name == "client" {
+			client = e.Opt
 		}
 	}
 
 	if c != 0 {
-		stat.ReqErrUserLogin++
+		incStat(&stat.ReqErrUserLogin)
 		return errors.New("Insufficient user login parameters")
 	}
 
+	if err = checkUserLoginBlock(li, login, d.Origin); err != nil {
+		incStat(&stat.ReqErrUserLogin)
+		return
+	}
+
 	var uid int64
 
-	if uid, err = checkUserSession(login); err != nil {
-		stat.ReqErrUserLogin++
+	if uid, err = users.GetUserIdFromLogin(login); err != nil {
+		incStat(&stat.ReqErrUserLogin)
+		setUserLoginFail(li, 0, login, d.Origin, "failed")
 		return
 	}
 
-	if err = checkRedisUserStatus(uid); err != nil {
-		stat.ReqErrUserLogin++
+	if err = users.CheckUserStatus(uid); err != nil {
+		incStat(&stat.ReqErrUserLogin)
 		return
 	}
 
 	if admin {
-		if err = checkUserAdmin(uid); err != nil {
-			stat.ReqErrUserLogin++
+		if err = checkUserStaff(uid); err != nil {
+			incStat(&stat.ReqErrUserLogin)
 			return
 		}
 	}
 
+	if err = checkUserPassword(uid, login, pw); err != nil {
+		incStat(&stat.ReqErrUserLogin)
+		setUserLoginFail(li, uid, login, d.Origin, "failed")
+		return
+	}
+
+	var secret string
+
+	if secret, _, _, err = getRedisUserTOTP(uid); err != nil {
+		incStat(&stat.ReqErrUserLogin)
+		return
+	}
+
+	// decided from the user's roles, clients need not flag an admin login
+	if app.TOTPAdminRequired && secret == "" &&
+		checkUserStaff(uid) == nil {
+		incStat(&stat.ReqErrUserLogin)
+		return errors.New("Two-factor authentication is required for " +
+			"admin login")
+	}
+
+	// second factor required, hand out a login challenge instead
+	if secret != "" {
+		var chal string
+
+		if chal, err = setUserLoginChallenge(uid, client); err != nil {
+			incStat(&stat.ReqErrUserLogin)
+			return
+		}
+
+		si[0] = Id{Id: uid, ErrNo: EAGAIN, Opt: chal}
+
+		buf, _ := json.Marshal(&IdList{Id: uid, Entry: si})
+		sendResponse(w, li, &Msg{Data: string(buf)})
+		return
+	}
+
 	var tok string
 
-	if tok, err = setUserSession(uid, login, pw, d.Origin); err != nil {
-		stat.ReqErrUserLogin++
+	if tok, err = setUserSession(li, uid, d.Origin, client); err != nil {
+		incStat(&stat.ReqErrUserLogin)
 		return
 	}
 
 	si[0] = Id{Id: uid, Opt: tok}
+	si = setLoginAUPPending(li, uid, si)
 
 	buf, _ := json.Marshal(&IdList{Id: uid, Entry: si})
-	sendResponse(w, &Msg{Data: string(buf)})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
-func userLogout(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqUserLogout++
+func userLogout(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqUserLogout)
 
 	var m *NameList
 
 	if m, err = getNameList(d.Data, d.Command); err != nil {
-		stat.ReqErrUserLogout++
+		incStat(&stat.ReqErrUserLogout)
 		return
 	}
 
-	var si []Id
-	var tok string
+	var sid string
 
-	if tok, err = getRedisUserSessionKey(m.Id); err != nil {
-		stat.ReqErrUserLogout++
+	if sid, err = checkUserSession(li, m.Id, m.Entry[0].Name); err != nil {
+		incStat(&stat.ReqErrUserLogout)
 		return
-	} else {
-		e := m.Entry[0]
+	}
+
+	if err = deleteRedisUserSession(li, m.Id, sid, "logout",
+		d.Origin); err != nil {
+		incStat(&stat.ReqErrUserLogout)
+		return
+	}
+
+	si := []Id{Id{Id: m.Id}}
 
-		if tok != e.Name {
-			stat.ReqErrUserLogout++
-			event(logwarn, li, "Mismatched user [%v] session key", m.Id)
+	data := &IdList{Id: m.Id, Entry: si}
+	buf, _ := json.Marshal(data)
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+func changePassword(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqChangePassword)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrChangePassword)
+		return
+	}
+
+	var tok, opw, npw string
+
+	c := 3
+
+	for i := range m.Entry {
+		e := m.Entry[i]
+
+		if e.Name == "session-key" {
+			tok = e.Opt
+			c--
+		} else if e.Name == "password" {
+			opw = e.Opt
+			c--
+		} else if e.Name == "new-password" {
+			npw = e.Opt
+			c--
 		}
+	}
 
-		if err = deleteRedisUserSession(m.Id, d.Origin); err != nil {
-			stat.ReqErrUserLogout++
-			return
-		} else {
-			si = []Id{Id{Id: m.Id}}
+	if c != 0 || tok == "" || npw == "" {
+		incStat(&stat.ReqErrChangePassword)
+		return errors.New("Insufficient change password parameters")
+	}
+
+	if err = users.CheckUserStatus(m.Id); err != nil {
+		incStat(&stat.ReqErrChangePassword)
+		return
+	}
+
+	var sid string
+
+	if sid, err = checkUserSession(li, m.Id, tok); err != nil {
+		incStat(&stat.ReqErrChangePassword)
+		return
+	}
+
+	if err = checkUserImpersonation(li); err != nil {
+		incStat(&stat.ReqErrChangePassword)
+		return
+	}
+
+	var s *UserInfo
+
+	if s, err = users.GetUserInfo(m.Id); err != nil {
+		incStat(&stat.ReqErrChangePassword)
+		return
+	}
+
+	if err = bcrypt.CompareHashAndPassword([]byte(s.Password),
+		[]byte(opw)); err != nil {
+		incStat(&stat.ReqErrChangePassword)
+		return errors.New("User password did not match")
+	}
+
+	if err = setUserPassword(li, m.Id, npw, d.Origin); err != nil {
+		incStat(&stat.ReqErrChangePassword)
+		return
+	}
+
+	if _, err = deleteRedisUserSessions(li, m.Id, sid,
+		d.Origin); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	si := []Id{Id{Id: m.Id}}
+
+	buf, _ := json.Marshal(&IdList{Id: m.Id, Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+func requestPasswordReset(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqRequestPwReset)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrRequestPwReset)
+		return
+	}
+
+	e := m.Entry[0]
+
+	if e.Name != "login" || e.Opt == "" {
+		incStat(&stat.ReqErrRequestPwReset)
+		return errors.New("Insufficient password reset parameters")
+	}
+
+	// do not disclose whether the login exists
+	if uid, err := users.GetUserIdFromLogin(e.Opt); err != nil {
+		event(logwarn, li, err.Error())
+	} else if err = users.CheckUserStatus(uid); err != nil {
+		event(logwarn, li, err.Error())
+	} else if s, err := users.GetUserInfo(uid); err != nil {
+		event(logwarn, li, err.Error())
+	} else if err = setUserResetToken(li, s, d.Origin, false); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	si := []Name{Name{Name: e.Opt}}
+
+	buf, _ := json.Marshal(&NameList{Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return nil
+}
+
+func completePasswordReset(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqCompletePwReset)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrCompletePwReset)
+		return
+	}
+
+	var tok, pw string
+
+	c := 2
+
+	for i := range m.Entry {
+		e := m.Entry[i]
+
+		if e.Name == "reset-token" {
+			tok = e.Opt
+			c--
+		} else if e.Name == "new-password" {
+			pw = e.Opt
+			c--
 		}
+	}
 
+	if c != 0 || tok == "" || pw == "" {
+		incStat(&stat.ReqErrCompletePwReset)
+		return errors.New("Insufficient password reset parameters")
 	}
 
-	data := &IdList{Id: m.Id, Entry: si}
-	buf, _ := json.Marshal(data)
-	sendResponse(w, &Msg{Data: string(buf)})
+	var uid int64
+
+	if uid, err = checkRedisUserResetToken(hashToken(tok)); err != nil {
+		incStat(&stat.ReqErrCompletePwReset)
+		return errors.New("Invalid or expired password reset token")
+	}
+
+	if err = users.CheckUserStatus(uid); err != nil {
+		incStat(&stat.ReqErrCompletePwReset)
+		return
+	}
+
+	var s *UserInfo
+
+	if s, err = users.GetUserInfo(uid); err != nil {
+		incStat(&stat.ReqErrCompletePwReset)
+		return
+	}
+
+	// a rejected password leaves the token for another attempt
+	if err = checkPasswordPolicy(li, s, pw); err != nil {
+		incStat(&stat.ReqErrCompletePwReset)
+		return
+	}
+
+	if _, err = getRedisUserResetToken(hashToken(tok)); err != nil {
+		incStat(&stat.ReqErrCompletePwReset)
+		return errors.New("Invalid or expired password reset token")
+	}
+
+	if err = setUserPassword(li, uid, pw, d.Origin); err != nil {
+		incStat(&stat.ReqErrCompletePwReset)
+		return
+	}
+
+	// a reset password invalidates any existing login
+	if _, err = deleteRedisUserSessions(li, uid, "", d.Origin); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	si := []Id{Id{Id: uid}}
+
+	buf, _ := json.Marshal(&IdList{Id: uid, Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+func validateSession(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqValidateSession)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrValidateSession)
+		return
+	}
+
+	tok := m.Entry[0].Name
+
+	var si *SessionInfo
+
+	if si, err = getRedisSession(hashToken(tok)); err != nil {
+		incStat(&stat.ReqErrValidateSession)
+		return errors.New("Invalid or expired session key")
+	}
+
+	li.Session = si
+
+	uid, _ := strconv.ParseInt(si.Uid, 0, 64)
+
+	if err = users.CheckUserStatus(uid); err != nil {
+		incStat(&stat.ReqErrValidateSession)
+		return
+	}
+
+	if si.TTL, err = setRedisSessionSeen(li, si.Id); err != nil {
+		incStat(&stat.ReqErrValidateSession)
+		return
+	}
+
+	si.AccessToken = tok
+	si.Current = true
+
+	if si.Impersonator == "" && checkUserAdmin(uid) == nil {
+		si.Admin = true
+	}
+
+	buf, _ := json.Marshal(si)
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+func listSessions(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqListSessions)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrListSessions)
+		return
+	}
+
+	var sid string
+
+	if sid, err = checkUserSession(li, m.Id, m.Entry[0].Name); err != nil {
+		incStat(&stat.ReqErrListSessions)
+		return
+	}
+
+	var si []SessionInfo
+
+	if si, err = getRedisUserSessions(m.Id); err != nil {
+		incStat(&stat.ReqErrListSessions)
+		return
+	}
+
+	for i := range si {
+		if si[i].Id == sid {
+			si[i].Current = true
+		}
+	}
+
+	buf, _ := json.Marshal(&SessionInfoList{Id: int64(len(si)), Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+func revokeSession(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqRevokeSession)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrRevokeSession)
+		return
+	}
+
+	e := m.Entry[0]
+
+	if _, err = checkUserSession(li, m.Id, e.Name); err != nil {
+		incStat(&stat.ReqErrRevokeSession)
+		return
+	}
+
+	var s *SessionInfo
+
+	if s, err = getRedisSession(e.Opt); err != nil ||
+		s.Uid != fmt.Sprintf("%v", m.Id) {
+		incStat(&stat.ReqErrRevokeSession)
+		return errors.New("Invalid session ID: " + e.Opt)
+	}
+
+	if err = deleteRedisUserSession(li, m.Id, s.Id, "revoked",
+		d.Origin); err != nil {
+		incStat(&stat.ReqErrRevokeSession)
+		return
+	}
+
+	si := []Name{Name{Name: s.Id}}
+
+	buf, _ := json.Marshal(&NameList{Id: m.Id, Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+func revokeAllSessions(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqRevokeAllSessions)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrRevokeAllSessions)
+		return
+	}
+
+	if _, err = checkUserSession(li, m.Id, m.Entry[0].Name); err != nil {
+		incStat(&stat.ReqErrRevokeAllSessions)
+		return
+	}
+
+	var n int
+
+	if n, err = deleteRedisUserSessions(li, m.Id, "",
+		d.Origin); err != nil {
+		incStat(&stat.ReqErrRevokeAllSessions)
+		return
+	}
+
+	si := []Id{Id{Id: int64(n)}}
+
+	buf, _ := json.Marshal(&IdList{Id: m.Id, Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+func userLoginTOTP(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqUserLoginTOTP)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrUserLoginTOTP)
+		return
+	}
+
+	var chal, code string
+
+	c := 2
+
+	for i := range m.Entry {
+		e := m.Entry[i]
+
+		if e.Name == "challenge" {
+			chal = e.Opt
+			c--
+		} else if e.Name == "code" {
+			code = e.Opt
+			c--
+		}
+	}
+
+	if c != 0 || chal == "" || code == "" {
+		incStat(&stat.ReqErrUserLoginTOTP)
+		return errors.New("Insufficient user login parameters")
+	}
+
+	dgst := hashToken(chal)
+
+	var uid int64
+	var client string
+
+	if uid, client, err = getRedisLoginChallenge(dgst); err != nil {
+		incStat(&stat.ReqErrUserLoginTOTP)
+		return errors.New("Invalid or expired login challenge")
+	}
+
+	if err = users.CheckUserStatus(uid); err != nil {
+		incStat(&stat.ReqErrUserLoginTOTP)
+		return
+	}
+
+	var s *UserInfo
+
+	if s, err = users.GetUserInfo(uid); err != nil {
+		incStat(&stat.ReqErrUserLoginTOTP)
+		return
+	}
+
+	if err = checkUserLoginBlock(li, s.Login, d.Origin); err != nil {
+		incStat(&stat.ReqErrUserLoginTOTP)
+		return
+	}
+
+	if err = checkUserTOTP(li, uid, code); err != nil {
+		incStat(&stat.ReqErrUserLoginTOTP)
+
+		if err := setRedisLoginChallengeFail(dgst); err != nil {
+			event(logwarn, li, err.Error())
+		}
+
+		setUserLoginFail(li, uid, s.Login, d.Origin,
+			"failed two-factor")
+		return
+	}
+
+	// the challenge is single-use
+	if err = deleteRedisLoginChallenge(dgst); err != nil {
+		incStat(&stat.ReqErrUserLoginTOTP)
+		return errors.New("Invalid or expired login challenge")
+	}
+
+	var tok string
+
+	if tok, err = setUserSession(li, uid, d.Origin, client); err != nil {
+		incStat(&stat.ReqErrUserLoginTOTP)
+		return
+	}
+
+	si := setLoginAUPPending(li, uid, []Id{Id{Id: uid, Opt: tok}})
+
+	buf, _ := json.Marshal(&IdList{Id: uid, Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+func enrollTOTP(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqEnrollTOTP)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrEnrollTOTP)
+		return
+	}
+
+	if _, err = checkUserSession(li, m.Id, m.Entry[0].Name); err != nil {
+		incStat(&stat.ReqErrEnrollTOTP)
+		return
+	}
+
+	if err = checkUserImpersonation(li); err != nil {
+		incStat(&stat.ReqErrEnrollTOTP)
+		return
+	}
+
+	var s *UserInfo
+
+	if s, err = users.GetUserInfo(m.Id); err != nil {
+		incStat(&stat.ReqErrEnrollTOTP)
+		return
+	}
+
+	var secret string
+
+	if secret, _, _, err = getRedisUserTOTP(m.Id); err != nil {
+		incStat(&stat.ReqErrEnrollTOTP)
+		return
+	}
+
+	if secret != "" {
+		incStat(&stat.ReqErrEnrollTOTP)
+		return errors.New("Two-factor authentication is already enabled")
+	}
+
+	if secret, err = generateTOTPSecret(); err != nil {
+		incStat(&stat.ReqErrEnrollTOTP)
+		return
+	}
+
+	if err = setRedisUserTOTP(li, m.Id, secret, true,
+		d.Origin); err != nil {
+		incStat(&stat.ReqErrEnrollTOTP)
+		return
+	}
+
+	si := []Name{Name{Name: secret, Opt: getTOTPUri(s.Login, secret)}}
+
+	buf, _ := json.Marshal(&NameList{Id: m.Id, Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+func confirmTOTP(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqConfirmTOTP)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrConfirmTOTP)
+		return
+	}
+
+	e := m.Entry[0]
+
+	if _, err = checkUserSession(li, m.Id, e.Name); err != nil {
+		incStat(&stat.ReqErrConfirmTOTP)
+		return
+	}
+
+	if err = checkUserImpersonation(li); err != nil {
+		incStat(&stat.ReqErrConfirmTOTP)
+		return
+	}
+
+	var pending string
+
+	if _, pending, _, err = getRedisUserTOTP(m.Id); err != nil ||
+		pending == "" {
+		incStat(&stat.ReqErrConfirmTOTP)
+		return errors.New("No pending two-factor enrollment")
+	}
+
+	if _, err = checkTOTPCode(pending, e.Opt, 0); err != nil {
+		incStat(&stat.ReqErrConfirmTOTP)
+		return
+	}
+
+	var rc []string
+
+	if rc, err = generateRecoveryCodes(10); err != nil {
+		incStat(&stat.ReqErrConfirmTOTP)
+		return
+	}
+
+	dgst := make([]string, len(rc))
+
+	for i := range rc {
+		dgst[i] = hashToken(rc[i])
+	}
+
+	if err = setRedisUserTOTPRecovery(m.Id, dgst); err != nil {
+		incStat(&stat.ReqErrConfirmTOTP)
+		return
+	}
+
+	if err = setRedisUserTOTP(li, m.Id, pending, false,
+		d.Origin); err != nil {
+		incStat(&stat.ReqErrConfirmTOTP)
+		return
+	}
+
+	si := make([]Name, len(rc))
+
+	for i := range rc {
+		si[i] = Name{Name: rc[i]}
+	}
+
+	buf, _ := json.Marshal(&NameList{Id: m.Id, Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+func disableTOTP(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqDisableTOTP)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrDisableTOTP)
+		return
+	}
+
+	e := m.Entry[0]
+
+	if _, err = checkUserSession(li, m.Id, e.Name); err != nil {
+		incStat(&stat.ReqErrDisableTOTP)
+		return
+	}
+
+	if err = checkUserImpersonation(li); err != nil {
+		incStat(&stat.ReqErrDisableTOTP)
+		return
+	}
+
+	if app.TOTPAdminRequired && checkUserStaff(m.Id) == nil {
+		incStat(&stat.ReqErrDisableTOTP)
+		return errors.New("Two-factor authentication is required for " +
+			"admin users")
+	}
+
+	if err = checkUserTOTP(li, m.Id, e.Opt); err != nil {
+		incStat(&stat.ReqErrDisableTOTP)
+		return
+	}
+
+	if err = deleteRedisUserTOTP(li, m.Id, d.Origin); err != nil {
+		incStat(&stat.ReqErrDisableTOTP)
+		return
+	}
+
+	si := []Id{Id{Id: m.Id}}
+
+	buf, _ := json.Marshal(&IdList{Id: m.Id, Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
+	return
+}
+
+func verifyEmail(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqVerifyEmail)
+
+	var m *NameList
+
+	if m, err = getNameList(d.Data, d.Command); err != nil {
+		incStat(&stat.ReqErrVerifyEmail)
+		return
+	}
+
+	var uid int64
+
+	if uid, err = checkVerifyToken(m.Entry[0].Name); err != nil {
+		incStat(&stat.ReqErrVerifyEmail)
+		return
+	}
+
+	var s *UserInfo
+
+	if s, err = users.GetUserInfo(uid); err != nil {
+		incStat(&stat.ReqErrVerifyEmail)
+		return
+	}
+
+	// verifying twice is harmless, keep the original date
+	if s.Verified == "" {
+		if err = users.SetUserVerified(li, uid, d.Origin); err != nil {
+			incStat(&stat.ReqErrVerifyEmail)
+			return
+		}
+	}
+
+	si := []Id{Id{Id: uid, Opt: s.Login}}
+
+	buf, _ := json.Marshal(&IdList{Id: uid, Entry: si})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
 func defaultUserHandler(w http.ResponseWriter, r *http.Request) {
-	stat.ReqAll++
-	li.Msgid = 0
+	incStat(&stat.ReqAll)
+
+	li := &LogInfo{}
 
 	var err error
 
 	str := "Invalid request"
 
-	if err = checkUrl(r); err != nil {
-		stat.ReqErrUrl++
-		sendError(w, EINVAL, str, err)
+	if err = checkUrl(li, r); err != nil {
+		incStat(&stat.ReqErrUrl)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
 	if err = checkHeader(r); err != nil {
-		stat.ReqErrHeader++
-		sendError(w, EINVAL, str, err)
+		incStat(&stat.ReqErrHeader)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
 	if err = checkRedis(); err != nil {
-		stat.ReqErrRedis++
-		sendError(w, EINVAL, str, err)
+		incStat(&stat.ReqErrRedis)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
 	var d *RequestMsg
 
-	if d, err = checkData(r); err != nil {
-		stat.ReqErrPayload++
-		sendError(w, EINVAL, str, err)
+	if d, err = checkData(li, r); err != nil {
+		incStat(&stat.ReqErrPayload)
+		sendError(w, li, getDataErrNo(err), str, err)
 		return
 	}
 
 	if li.Msgid, err = getRedisMsgId(d.Command); err != nil {
-		stat.ReqErrMsgId++
-		sendError(w, EINVAL, str, err)
+		incStat(&stat.ReqErrMsgId)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
@@ -164,18 +860,79 @@ func defaultUserHandler(w http.ResponseWriter, r *http.Request) {
 
 	switch d.Command {
 	case "register":
-		err = addUser(w, d)
+		err = addUser(w, li, d)
 
 	case "login":
-		err = userLogin(w, d)
+		err = userLogin(w, li, d)
 
 	case "logout":
-		err = userLogout(w, d)
+		err = userLogout(w, li, d)
+
+	case "change-password":
+		err = changePassword(w, li, d)
+
+	case "request-password-reset":
+		err = requestPasswordReset(w, li, d)
+
+	case "complete-password-reset":
+		err = completePasswordReset(w, li, d)
+
+	case "validate-session":
+		err = validateSession(w, li, d)
+
+	case "list-sessions":
+		err = listSessions(w, li, d)
+
+	case "revoke-session":
+		err = revokeSession(w, li, d)
+
+	case "revoke-all-sessions":
+		err = revokeAllSessions(w, li, d)
+
+	case "login-totp":
+		err = userLoginTOTP(w, li, d)
+
+	case "enroll-totp":
+		err = enrollTOTP(w, li, d)
+
+	case "confirm-totp":
+		err = confirmTOTP(w, li, d)
+
+	case "disable-totp":
+		err = disableTOTP(w, li, d)
+
+	case "verify-email":
+		err = verifyEmail(w, li, d)
+
+	case "create-api-key":
+		err = createApiKey(w, li, d)
+
+	case "list-api-keys":
+		err = listApiKeys(w, li, d)
+
+	case "revoke-api-key":
+		err = revokeApiKey(w, li, d)
+
+	case "show-aup":
+		err = showAUP(w, li, d)
+
+	case "accept-aup":
+		err = acceptAUP(w, li, d)
+	}
+
+	// actions taken while impersonated are audited for both users
+	if li.Session != nil && li.Session.Impersonator != "" {
+		setImpersonationActivity(li, d.Command, d.Origin, err != nil)
+	}
+
+	if pe, ok := err.(*PolicyError); ok {
+		sendError(w, li, EPOLICY, pe.Data(), err)
+		return
 	}
 
 	if err != nil {
 		str += ": " + d.Command
-		sendError(w, EINVAL, str, err)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
@@ -5,24 +5,25 @@
 package main
 
 import (
-	"bytes"
 	"code.google.com/p/go.crypto/bcrypt"
 	"crypto/hmac"
+	crand "crypto/rand"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"math/rand"
 	"net"
 	"net/http"
-	"net/mail"
-	"net/smtp"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -71,6 +72,144 @@ func parseConfig(f string) (err error) {
 		fatal("SMTP password is empty")
 	}
 
+	if app.ResetTokenTTL == 0 {
+		app.ResetTokenTTL = 3600
+	}
+
+	if app.SessionTTL == 0 {
+		app.SessionTTL = 86400
+	}
+
+	if app.SessionIdleTTL == 0 {
+		app.SessionIdleTTL = 3600
+	}
+
+	if app.SessionIdleTTL > app.SessionTTL {
+		fatal("Session idle lifetime exceeds absolute lifetime")
+	}
+
+	if app.ImpersonateTTL == 0 {
+		app.ImpersonateTTL = 900
+	}
+
+	if app.ImpersonateTTL > app.SessionTTL {
+		fatal("Impersonation lifetime exceeds session lifetime")
+	}
+
+	if app.ClockSkew == 0 {
+		app.ClockSkew = 10
+	}
+
+	// legacy clients have until 2027-04-01, the default is canonical after
+	if app.SignatureMode == "" {
+		app.SignatureMode = "transition"
+	}
+
+	if app.SignatureMode != "transition" &&
+		app.SignatureMode != "canonical" {
+		fatal("Invalid signature mode: %v", app.SignatureMode)
+	}
+
+	if app.KeyGraceTTL == 0 {
+		app.KeyGraceTTL = 86400
+	}
+
+	if app.LoginFailWindow == 0 {
+		app.LoginFailWindow = 900
+	}
+
+	if app.LoginFailDelay == 0 {
+		app.LoginFailDelay = 3
+	}
+
+	if app.LoginFailLimit == 0 {
+		app.LoginFailLimit = 10
+	}
+
+	if app.LoginIPFailLimit == 0 {
+		app.LoginIPFailLimit = 100
+	}
+
+	if app.LoginLockTTL == 0 {
+		app.LoginLockTTL = 900
+	}
+
+	if app.LoginFailDelay > app.LoginFailLimit {
+		fatal("Login failure delay threshold exceeds lockout threshold")
+	}
+
+	if app.SMTPPort == "" {
+		app.SMTPPort = "587"
+	}
+
+	if app.MailTransport == "" {
+		app.MailTransport = "starttls"
+	}
+
+	if _, ok := mailTransports[app.MailTransport]; !ok {
+		fatal("Invalid mail transport: %v", app.MailTransport)
+	}
+
+	if app.SendmailPath == "" {
+		app.SendmailPath = "/usr/sbin/sendmail"
+	}
+
+	if app.MailTransport == "file" && app.MailSinkDir == "" {
+		fatal("Mail sink directory is empty")
+	}
+
+	if app.MailRetryLimit == 0 {
+		app.MailRetryLimit = 8
+	}
+
+	if app.MailRetryDelay == 0 {
+		app.MailRetryDelay = 60
+	}
+
+	if app.MailQueueInterval == 0 {
+		app.MailQueueInterval = 5
+	}
+
+	if app.BrandName == "" {
+		app.BrandName = "Rebung.IO"
+	}
+
+	if app.MailTemplateDir == "" {
+		app.MailTemplateDir = TPLDIR
+	}
+
+	if app.MailLocale == "" {
+		app.MailLocale = "en"
+	}
+
+	if app.PasswordPolicy.MinLength == 0 {
+		app.PasswordPolicy.MinLength = 8
+	}
+
+	for _, c := range app.PasswordPolicy.Classes {
+		if _, ok := passwordClasses[c]; !ok {
+			fatal("Invalid password character class: %v", c)
+		}
+	}
+
+	if d := app.PasswordPolicy.BreachedDir; d != "" {
+		if _, err = os.Stat(d); err != nil {
+			fatal("Breached password directory not found: %v", d)
+		}
+	}
+
+	if app.VerifyUrl == "" {
+		app.VerifyUrl = "https://" + app.HostName + "/verify"
+	}
+
+	if app.VerifyTTL == 0 {
+		app.VerifyTTL = 172800
+	}
+
+	if app.VerifySweepInterval == 0 {
+		app.VerifySweepInterval = 3600
+	}
+
 	if app.Secret == "" {
 		fatal("Secret is empty")
 	}
@@ -86,18 +225,47 @@ func parseConfig(f string) (err error) {
 		}
 	}
 
-	if app.RedisUrl == "" {
+	if app.UserStore == "" {
+		app.UserStore = "redis"
+	}
+
+	if _, ok := userStores[app.UserStore]; !ok {
+		fatal("Invalid user store: %v", app.UserStore)
+	}
+
+	if app.UserStore == "sqlite" && app.UserStorePath == "" {
+		fatal("User store path is empty")
+	}
+
+	// only a SQLite user store can keep the state in place of Redis
+	if app.RedisUrl == "" && app.UserStore != "sqlite" {
 		fatal("Redis URL is empty")
 	}
 
-	if app.RedisPw == "" {
+	if app.RedisUrl != "" && app.RedisPw == "" {
 		fatal("Redis password is empty")
 	}
 
-	if app.RedisDb == "" {
+	if app.RedisUrl != "" && app.RedisDb == "" {
 		fatal("Redis database index is empty")
 	}
 
+	if app.TunnelRedisDb == "" {
+		app.TunnelRedisDb = app.RedisDb
+	}
+
+	if app.OIDCIssuer != "" && app.OIDCKeyFile == "" {
+		fatal("OpenID Connect signing key is empty")
+	}
+
+	if app.OIDCCodeTTL == 0 {
+		app.OIDCCodeTTL = 60
+	}
+
+	if app.OIDCTokenTTL == 0 {
+		app.OIDCTokenTTL = 3600
+	}
+
 	return
 }
 
@@ -105,24 +273,30 @@ func getNameList(s string, c string) (d *NameList, err error) {
 	d = &NameList{}
 
 	if err = json.Unmarshal([]byte(s), d); err != nil {
-		stat.ReqErrData++
+		incStat(&stat.ReqErrData)
 		return d, errors.New("Error unmarshaling NameList struct")
 	}
 
 	if d.Id != 0 {
-		if c == "set-user-attr" || c == "logout" {
-			if err = checkRedisUserId(d.Id); err != nil {
-				stat.ReqErrUserId++
+		if c == "set-user-attr" || c == "logout" ||
+			c == "change-password" || c == "list-sessions" ||
+			c == "revoke-session" || c == "revoke-all-sessions" ||
+			c == "enroll-totp" || c == "confirm-totp" ||
+			c == "disable-totp" || c == "create-api-key" ||
+			c == "list-api-keys" || c == "revoke-api-key" ||
+			c == "show-aup" || c == "accept-aup" {
+			if err = users.CheckUserId(d.Id); err != nil {
+				incStat(&stat.ReqErrUserId)
 				return
 			}
 		} else {
-			stat.ReqErrUserId++
+			incStat(&stat.ReqErrUserId)
 			return d, errors.New("Invalid user ID")
 		}
 	}
 
 	if len(d.Entry) == 0 {
-		stat.ReqErrData++
+		incStat(&stat.ReqErrData)
 		return d, errors.New("Invalid arg list")
 	}
 
@@ -133,99 +307,475 @@ func getIdList(s string, c string) (d *IdList, err error) {
 	d = &IdList{}
 
 	if err = json.Unmarshal([]byte(s), d); err != nil {
-		stat.ReqErrData++
+		incStat(&stat.ReqErrData)
 		return d, errors.New("Error unmarshaling IdList struct")
 	}
 
 	if d.Id != 0 {
 		if c == "get-user-list" {
-			if err = checkRedisUserId(d.Id); err != nil {
-				stat.ReqErrUserId++
+			if err = users.CheckUserId(d.Id); err != nil {
+				incStat(&stat.ReqErrUserId)
 				return
 			}
 		} else {
-			stat.ReqErrUserId++
+			incStat(&stat.ReqErrUserId)
 			return d, errors.New("Invalid user ID")
 		}
 	}
 
 	if len(d.Entry) == 0 {
-		stat.ReqErrData++
+		incStat(&stat.ReqErrData)
 		return d, errors.New("Invalid arg list for")
 	}
 
 	return
 }
 
-func generateTempPassword() string {
+// generateTempPassword draws 8 characters from crypto/rand, bytes past the
+// last whole multiple of the alphabet are skipped so each is equally likely
+func generateTempPassword() (pw string, err error) {
 	const c string = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz" +
 		"1234567890"
 
-	rand.Seed(time.Now().UnixNano())
+	p := make([]byte, 0, 8)
+	b := make([]byte, 1)
 
-	p := make([]byte, 8)
+	for len(p) < cap(p) {
+		if _, err = crand.Read(b); err != nil {
+			return pw, errors.New("Error generating temporary password")
+		}
 
-	for i := range p {
-		r := rand.Intn(len(c))
-		p[i] = c[r]
+		if int(b[0]) < 256-256%len(c) {
+			p = append(p, c[int(b[0])%len(c)])
+		}
 	}
 
-	return string(p)
+	return string(p), nil
 }
 
-func setUserSession(uid int64, login, pw, ip string) (tok string, err error) {
-	const c string = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz" +
-		"1234567890"
+func generateToken(n int) (tok string, err error) {
+	p := make([]byte, n)
+
+	if _, err = crand.Read(p); err != nil {
+		return tok, errors.New("Error generating random token")
+	}
+
+	return base64.URLEncoding.EncodeToString(p), nil
+}
+
+func hashToken(tok string) string {
+	h := sha256.Sum256([]byte(tok))
+
+	return hex.EncodeToString(h[:])
+}
+
+// getTrigrams splits a lower-cased string into its distinct three character
+// substrings, shorter strings have none
+func getTrigrams(s string) (t []string) {
+	r := []rune(s)
+	m := make(map[string]bool)
+
+	for i := 0; i+3 <= len(r); i++ {
+		v := string(r[i : i+3])
+
+		if !m[v] {
+			m[v] = true
+			t = append(t, v)
+		}
+	}
+
+	return
+}
+
+// getVerifyToken signs the user ID and the verification deadline so that the
+// link in the registration email needs no server-side state
+func getVerifyToken(uid int64, exp int64) string {
+	p := fmt.Sprintf("%v:%v", uid, exp)
+
+	dgst := hmac.New(sha256.New, []byte(app.Secret))
+	dgst.Write([]byte("verify:" + p))
+
+	return base64.URLEncoding.EncodeToString([]byte(p)) + "." +
+		base64.URLEncoding.EncodeToString(dgst.Sum(nil))
+}
+
+func checkVerifyToken(tok string) (uid int64, err error) {
+	t := strings.Split(tok, ".")
+
+	if len(t) != 2 {
+		return uid, errors.New("Invalid verification token")
+	}
+
+	var p []byte
+
+	if p, err = base64.URLEncoding.DecodeString(t[0]); err != nil {
+		return uid, errors.New("Invalid verification token")
+	}
+
+	v := strings.Split(string(p), ":")
+
+	if len(v) != 2 {
+		return uid, errors.New("Invalid verification token")
+	}
+
+	uid, _ = strconv.ParseInt(v[0], 0, 64)
+	exp, _ := strconv.ParseInt(v[1], 0, 64)
+
+	if !hmac.Equal([]byte(getVerifyToken(uid, exp)), []byte(tok)) {
+		return 0, errors.New("Verification token signature does not match")
+	}
+
+	if time.Now().Unix() > exp {
+		return 0, errors.New("Verification token has expired")
+	}
+
+	return
+}
+
+// sweepNewUsers periodically disables the new accounts that have been neither
+// verified nor logged into within the verification period
+func sweepNewUsers() {
+	t := time.NewTicker(time.Duration(app.VerifySweepInterval) * time.Second)
+
+	for {
+		if err := expireNewUsers(); err != nil {
+			event(logwarn, sli, err.Error())
+		}
+
+		<-t.C
+	}
+}
+
+func expireNewUsers() (err error) {
+	var l []string
+
+	// an empty list is not an error
+	if l, err = users.GetUserList("new"); err != nil {
+		return nil
+	}
+
+	var exp []string
+
+	now := time.Now()
+
+	for i := range l {
+		uid, _ := strconv.ParseInt(l[i], 0, 64)
+
+		var s *UserInfo
+
+		if s, err = users.GetUserInfo(uid); err != nil {
+			event(logwarn, sli, err.Error())
+			users.DeleteUserNew(uid)
+			continue
+		}
+
+		if s.Verified != "" || s.FirstLogin != "" {
+			users.DeleteUserNew(uid)
+			continue
+		}
+
+		var t time.Time
+
+		if t, err = time.Parse(time.RFC1123, s.Registered); err != nil {
+			event(logwarn, sli, "User [%v] has invalid "+
+				"registration date: %v", uid, s.Registered)
+			continue
+		}
+
+		if now.Sub(t) < time.Duration(app.VerifyTTL)*time.Second {
+			continue
+		}
+
+		if err = users.SetUserStatus(sli, uid, false,
+			"localhost"); err != nil {
+			event(logwarn, sli, err.Error())
+			continue
+		}
+
+		if err = users.SetUserActivity(uid, "expired: not verified",
+			"localhost"); err != nil {
+			event(logwarn, sli, err.Error())
+		}
+
+		users.DeleteUserNew(uid)
+
+		event(lognotice, sli,
+			"User %v [%v] expired, not verified since %v",
+			s.Login, uid, s.Registered)
+
+		exp = append(exp, fmt.Sprintf("%v [%v], registered on %v",
+			s.Login, uid, s.Registered))
+	}
+
+	if len(exp) == 0 {
+		return nil
+	}
+
+	md := &MailData{List: exp, Count: int64(len(exp)),
+		Hours: app.VerifyTTL / 3600}
+
+	return sendTemplateMail(sli, []string{}, "expired-digest",
+		app.MailLocale, md, true)
+}
 
+func setUserResetToken(li *LogInfo, s *UserInfo, ip string,
+	admin bool) (err error) {
+	var tok string
+
+	if tok, err = generateToken(24); err != nil {
+		return
+	}
+
+	if err = setRedisUserResetToken(li, s.Id, hashToken(tok),
+		app.ResetTokenTTL, ip); err != nil {
+		return
+	}
+
+	md := &MailData{Name: s.Name, Token: tok, Origin: ip, Admin: admin,
+		Minutes: app.ResetTokenTTL / 60}
+
+	if err = sendTemplateMail(li, []string{s.Login}, "password-reset",
+		s.Locale, md, false); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	return nil
+}
+
+// sendUserWelcome mails a new user the temporary password and the email
+// verification link
+func sendUserWelcome(li *LogInfo, uid int64, s *UserInfo,
+	pw string) (err error) {
+	exp := time.Now().Unix() + app.VerifyTTL
+	link := app.VerifyUrl + "?token=" + getVerifyToken(uid, exp)
+
+	md := &MailData{Name: s.Name, Login: s.Login, Password: pw, Link: link,
+		Hours: app.VerifyTTL / 3600}
+
+	return sendTemplateMail(li, []string{s.Login}, "user-welcome", s.Locale,
+		md, false)
+}
+
+func checkUserPassword(uid int64, login, pw string) (err error) {
 	var s *UserInfo
 
-	if s, err = getRedisUserInfo(uid); err != nil {
+	if s, err = users.GetUserInfo(uid); err != nil {
 		return
 	}
 
 	if login != s.Login {
-		return tok, errors.New("User login did not match: " + login)
+		return errors.New("User login did not match: " + login)
 	}
 
 	if err = bcrypt.CompareHashAndPassword([]byte(s.Password),
 		[]byte(pw)); err != nil {
-		return tok, errors.New("User password did not match")
+		return errors.New("User password did not match")
+	}
+
+	return
+}
+
+// checkUserTOTP verifies a second factor, either a TOTP code or one of the
+// user's unused recovery codes
+func checkUserTOTP(li *LogInfo, uid int64, code string) (err error) {
+	var secret string
+	var last int64
+
+	if secret, _, last, err = getRedisUserTOTP(uid); err != nil ||
+		secret == "" {
+		return errors.New("Two-factor authentication is not enabled")
+	}
+
+	var step int64
+
+	if step, err = checkTOTPCode(secret, code, last); err == nil {
+		return setRedisUserTOTPStep(uid, step)
+	}
+
+	if err = deleteRedisUserTOTPRecovery(uid, hashToken(code)); err != nil {
+		return errors.New("Two-factor code did not match")
+	}
+
+	event(lognotice, li, "User [%v] logged in with a recovery code", uid)
+	return
+}
+
+// checkUserLoginBlock refuses a login attempt while the login or source IP is
+// locked out, or while the backoff following recent failures is running
+func checkUserLoginBlock(li *LogInfo, login, ip string) (err error) {
+	var ttl int64
+
+	if ttl, err = checkRedisLoginLock(login, ip); err != nil {
+		return
+	}
+
+	if ttl > 0 {
+		incStat(&stat.ReqLockedLogin)
+
+		event(lognotice, li, "Login %v from %v refused, locked out for "+
+			"another %vs", login, ip, ttl)
+		return errors.New("Too many failed login attempts, try again " +
+			"later")
+	}
+
+	var n, last int64
+
+	if n, last, err = getRedisLoginFail(login,
+		app.LoginFailWindow); err != nil {
+		return
+	}
+
+	if n < app.LoginFailDelay {
+		return
+	}
+
+	if wait := getLoginFailDelay(n) - (time.Now().Unix() -
+		last); wait > 0 {
+		incStat(&stat.ReqBlockedLogin)
+
+		return errors.New(fmt.Sprintf("Too many failed login attempts, "+
+			"try again in %v seconds", wait))
+	}
+
+	return
+}
+
+// getLoginFailDelay doubles the wait between attempts for every failure past
+// the delay threshold, up to five minutes
+func getLoginFailDelay(n int64) int64 {
+	if n -= app.LoginFailDelay; n > 8 {
+		n = 8
+	}
+
+	if d := int64(2) << uint(n); d < 300 {
+		return d
+	}
+
+	return 300
+}
+
+func setUserLoginFail(li *LogInfo, uid int64, login, ip, act string) {
+	nl, ni, err := setRedisLoginFail(login, ip, app.LoginFailWindow)
+
+	if err != nil {
+		event(logwarn, li, err.Error())
+		return
+	}
+
+	if uid != 0 {
+		if err = users.SetUserLogin(uid, ip, act); err != nil {
+			event(logwarn, li, err.Error())
+		}
+	}
+
+	if nl >= app.LoginFailLimit {
+		if err = setRedisLoginLock("login", login,
+			app.LoginLockTTL); err != nil {
+			event(logwarn, li, err.Error())
+		}
+
+		if uid != 0 {
+			if err = users.SetUserActivity(uid, "locked out",
+				ip); err != nil {
+				event(logwarn, li, err.Error())
+			}
+		}
+
+		event(lognotice, li, "Login %v locked out after %v failed "+
+			"attempts", login, nl)
+	}
+
+	if ni >= app.LoginIPFailLimit {
+		if err = setRedisLoginLock("ip", ip, app.LoginLockTTL); err != nil {
+			event(logwarn, li, err.Error())
+		}
+
+		event(lognotice, li, "IP %v locked out after %v failed login "+
+			"attempts", ip, ni)
+	}
+}
+
+func setUserLoginChallenge(uid int64, client string) (chal string, err error) {
+	if chal, err = generateToken(24); err != nil {
+		return
+	}
+
+	if err = setRedisLoginChallenge(hashToken(chal), uid, client,
+		300); err != nil {
+		return
+	}
+
+	return
+}
+
+func setUserSession(li *LogInfo, uid int64, ip, client string) (tok string,
+	err error) {
+	var s *UserInfo
+
+	if s, err = users.GetUserInfo(uid); err != nil {
+		return
 	}
 
 	// record first-time login
 	if s.FirstLogin == "" {
-		if err = setRedisUserFirstLogin(uid, ip); err != nil {
+		if err = users.SetUserFirstLogin(uid, ip); err != nil {
 			return
 		}
 	}
 
-	rand.Seed(time.Now().UnixNano())
-
-	p := make([]byte, 24)
-
-	for i := range p {
-		r := rand.Intn(len(c))
-		p[i] = c[r]
+	// a completed login clears the failure history of the login
+	if err = deleteRedisLoginFail(s.Login); err != nil {
+		event(logwarn, li, err.Error())
 	}
 
-	tok = base64.StdEncoding.EncodeToString(p)
+	if tok, err = generateToken(24); err != nil {
+		return
+	}
 
-	if err = setRedisUserSession(uid, tok, ip); err != nil {
+	if err = setRedisUserSession(li, uid, tok, ip, client); err != nil {
 		return
 	}
 
 	return
 }
 
-func signRequest(m []byte, id int64) string {
-	dgst := hmac.New(sha256.New, []byte(app.Secret))
+// getSessionTTL returns how long a session created at c may live from n,
+// bounded by both the idle and the absolute session lifetimes
+func getSessionTTL(c, n int64) int64 {
+	ttl := app.SessionTTL - (n - c)
+
+	if ttl > app.SessionIdleTTL {
+		ttl = app.SessionIdleTTL
+	}
+
+	return ttl
+}
+
+// getImpersonationTTL is getSessionTTL for impersonation sessions, which
+// are never renewed past their short lifetime
+func getImpersonationTTL(c, n int64) int64 {
+	ttl := app.ImpersonateTTL - (n - c)
+
+	if t := getSessionTTL(c, n); t < ttl {
+		ttl = t
+	}
+
+	return ttl
+}
+
+func signRequest(m []byte, key string) string {
+	if key == "" {
+		key = app.Secret
+	}
+
+	dgst := hmac.New(sha256.New, []byte(key))
 	dgst.Write(m)
 
 	return base64.StdEncoding.EncodeToString(dgst.Sum(nil))
 }
 
-func checkSignature(sig string, m []byte) (err error) {
-	dgst := hmac.New(sha256.New, []byte(app.Secret))
+func checkKeySignature(sig string, m []byte, key string) (err error) {
+	dgst := hmac.New(sha256.New, []byte(key))
 	dgst.Write(m)
 
 	var s []byte
@@ -241,63 +791,289 @@ func checkSignature(sig string, m []byte) (err error) {
 	return
 }
 
+// getSignedHeaders lists the headers a canonical signature has to cover,
+// Content-Type, Date and every X-N3 header save the signature itself
+func getSignedHeaders(h http.Header) []string {
+	l := []string{"content-type", "date"}
+
+	for k := range h {
+		k = strings.ToLower(k)
+
+		if strings.HasPrefix(k, "x-n3-") && k != "x-n3-signature" {
+			l = append(l, k)
+		}
+	}
+
+	sort.Strings(l)
+	return l
+}
+
+// getCanonicalSignature signs the method, path, signed headers and body
+// digest of a request, hashed into a string to sign alongside its Date
+func getCanonicalSignature(r *http.Request, signed []string, body []byte,
+	key string) []byte {
+	b := sha256.Sum256(body)
+	c := r.Method + "\n" + r.URL.Path + "\n" + r.URL.RawQuery + "\n"
+
+	for _, k := range signed {
+		v := r.Header[http.CanonicalHeaderKey(k)]
+		c += k + ":" + strings.TrimSpace(strings.Join(v, ",")) + "\n"
+	}
+
+	c += "\n" + strings.Join(signed, ";") + "\n" + hex.EncodeToString(b[:])
+
+	d := sha256.Sum256([]byte(c))
+	s := SIGALG + "\n" + r.Header.Get("Date") + "\n" +
+		hex.EncodeToString(d[:])
+
+	dgst := hmac.New(sha256.New, []byte(key))
+	dgst.Write([]byte(s))
+
+	return dgst.Sum(nil)
+}
+
+// checkRequestSignature verifies the canonical signature of a request, the
+// legacy signature of the body alone is accepted in transition mode
+func checkRequestSignature(r *http.Request, sig string, body []byte,
+	key string) (err error) {
+	if !strings.HasPrefix(sig, SIGALG+" ") {
+		if app.SignatureMode != "transition" {
+			return errors.New("Legacy signature not accepted")
+		}
+
+		if err = checkKeySignature(sig, body, key); err == nil {
+			incStat(&stat.ReqLegacySignature)
+		}
+
+		return
+	}
+
+	var signed []string
+	var str string
+
+	for _, v := range strings.Split(sig[len(SIGALG)+1:], ",") {
+		v = strings.TrimSpace(v)
+
+		if strings.HasPrefix(v, "SignedHeaders=") {
+			signed = strings.Split(v[len("SignedHeaders="):], ";")
+		} else if strings.HasPrefix(v, "Signature=") {
+			str = v[len("Signature="):]
+		}
+	}
+
+	m := make(map[string]bool)
+
+	for _, v := range signed {
+		m[v] = true
+	}
+
+	for _, v := range getSignedHeaders(r.Header) {
+		if !m[v] {
+			return errors.New("Header not signed: " + v)
+		}
+	}
+
+	var s []byte
+
+	if s, err = base64.StdEncoding.DecodeString(str); err != nil {
+		return errors.New("Error decoding signature string")
+	}
+
+	if !hmac.Equal(s, getCanonicalSignature(r, signed, body, key)) {
+		return errors.New("Message signature does not match")
+	}
+
+	return
+}
+
+// checkMsgExpiry rejects a request dated outside the allowed clock skew, a
+// date ahead of the local clock is reported apart from an expired one
 func checkMsgExpiry(t time.Time) (err error) {
-	if time.Now().Sub(t).Seconds() > 10.0 {
+	d := time.Now().Sub(t).Seconds()
+
+	if d > float64(app.ClockSkew) {
+		incStat(&stat.ReqErrExpired)
 		return errors.New("Message has expired")
 	}
 
+	if -d > float64(app.ClockSkew) {
+		incStat(&stat.ReqErrFuture)
+		return errors.New("Message is dated in the future")
+	}
+
 	return
 }
 
-func checkUserSession(login string) (uid int64, err error) {
-	if uid, err = getRedisUserIdFromLogin(login); err != nil {
+// ReplayError reports a request nonce seen before within the clock skew
+// window
+type ReplayError struct {
+	Nonce string
+}
+
+func (e *ReplayError) Error() string {
+	return "Message nonce has been used: " + e.Nonce
+}
+
+// checkNonce rejects a request whose nonce is malformed or already used.
+// Nonces are [unix time].[random], the time has to match the Date header so
+// a captured request cannot be replayed later under a fresh date.
+func checkNonce(n string, t time.Time) (err error) {
+	if n == "" {
+		return errors.New("Missing message nonce")
+	}
+
+	p := strings.Split(n, ".")
+
+	if len(p) != 2 || p[1] == "" {
+		return errors.New("Invalid message nonce: " + n)
+	}
+
+	if ts, _ := strconv.ParseInt(p[0], 0, 64); ts != t.Unix() {
+		return errors.New("Message nonce does not match Date header")
+	}
+
+	// a nonce is kept for both sides of the window it can be accepted in
+	if err = setRedisNonce(n, 2*app.ClockSkew); err != nil {
+		incStat(&stat.ReqErrReplay)
 		return
 	}
 
-	// ignore if user already has a session
-	if err = checkRedisUserSession(uid); err != nil {
-		event(logwarn, li, err.Error())
-		return uid, nil
+	return
+}
+
+// getDataErrNo returns the result code for a checkData failure
+func getDataErrNo(err error) int {
+	if _, ok := err.(*ReplayError); ok {
+		return EREPLAY
+	}
+
+	return EINVAL
+}
+
+// checkUserSession verifies that a session key belongs to a user and
+// returns the session ID
+func checkUserSession(li *LogInfo, uid int64, tok string) (sid string,
+	err error) {
+	if tok == "" {
+		return sid, errors.New("Invalid user session key")
+	}
+
+	var s *SessionInfo
+
+	if s, err = getRedisSession(hashToken(tok)); err != nil {
+		return sid, errors.New("Invalid or expired user session key")
+	}
+
+	if s.Uid != fmt.Sprintf("%v", uid) {
+		return sid, errors.New(fmt.Sprintf("Mismatched user [%v] "+
+			"session key", uid))
+	}
+
+	li.Session = s
+	return s.Id, nil
+}
+
+// checkUserImpersonation refuses credential changes made with an
+// impersonation session
+func checkUserImpersonation(li *LogInfo) (err error) {
+	if li.Session != nil && li.Session.Impersonator != "" {
+		return errors.New(fmt.Sprintf("Not permitted while impersonated "+
+			"by user [%v]", li.Session.Impersonator))
 	}
 
 	return
 }
 
-func checkUserAdmin(uid int64) (err error) {
-	var m bool
-	var list []string
+// checkUserStaff succeeds for any user holding at least one role, staff may
+// sign in to the control panel and cannot be impersonated
+func checkUserStaff(uid int64) (err error) {
+	var l []string
 
-	if list, err = getRedisUserList("admin"); err != nil {
+	if l, err = getRedisUserRoles(uid); err != nil {
 		return
 	}
 
-	var uids = fmt.Sprintf("%v", uid)
+	if len(l) == 0 {
+		return errors.New(fmt.Sprintf("User [%v] holds no role", uid))
+	}
+
+	return
+}
 
-	for i := range list {
-		if uids == list[i] {
-			m = true
-			break
+// checkUserAdmin succeeds for users holding one of adminPermissions, staff
+// that can only look up and reset users are not admins
+func checkUserAdmin(uid int64) (err error) {
+	for i := range adminPermissions {
+		if checkUserPermission(uid, adminPermissions[i]) == nil {
+			return
 		}
 	}
 
-	if !m {
-		return errors.New("User [" + uids + "] is not an admin")
+	return errors.New(fmt.Sprintf("User [%v] is not an admin", uid))
+}
+
+// checkUserTarget refuses password and status changes on a role holder
+// unless the actor is an admin, staff with user.write could otherwise take
+// over an account that holds more permissions than their own
+func checkUserTarget(actor, uid int64) (err error) {
+	var l []string
+
+	if l, err = getRedisUserRoles(uid); err != nil || len(l) == 0 {
+		return
+	}
+
+	if checkUserAdmin(actor) != nil {
+		return errors.New(fmt.Sprintf("User [%v] holds a role and can "+
+			"only be changed by an admin", uid))
 	}
 
 	return
 }
 
-func checkUrl(r *http.Request) (err error) {
+func checkUserPermission(uid int64, perm string) (err error) {
+	var ok bool
+
+	if ok, err = checkRedisUserPermission(uid, perm); err != nil {
+		return
+	}
+
+	if !ok {
+		return errors.New(fmt.Sprintf("User [%v] lacks permission %v",
+			uid, perm))
+	}
+
+	return
+}
+
+func checkUrl(li *LogInfo, r *http.Request) (err error) {
 	switch r.URL.Path {
 	case "/s/resolve":
 	case "/s/add":
 	case "/s/set":
 	case "/s/reset":
 	case "/s/list":
+	case "/s/session":
+	case "/s/delete":
+	case "/s/export":
+	case "/s/search":
+	case "/s/import":
+	case "/s/template":
+	case "/s/mail":
+	case "/s/oidc":
+	case "/s/aup":
+	case "/s/keyring":
 
 	case "/u/register":
 	case "/u/login":
 	case "/u/logout":
+	case "/u/set":
+	case "/u/reset":
+	case "/u/session":
+	case "/u/totp":
+	case "/u/verify":
+	case "/s/role":
+	case "/u/apikey":
+	case "/u/aup":
 
 	case "/status":
 
@@ -305,16 +1081,20 @@ func checkUrl(r *http.Request) (err error) {
 		return errors.New("Invalid URL: " + r.URL.Path)
 	}
 
-	if ip := r.Header.Get("X-Forwarded-For"); ip == "" {
-		li.Src = r.RemoteAddr
-	} else {
-		li.Src = ip
-	}
+	li.Src = getRequestSource(r)
 
 	event(logdebug, li, "New connection from %v to %v", li.Src, r.URL.Path)
 	return
 }
 
+func getRequestSource(r *http.Request) string {
+	if ip := r.Header.Get("X-Forwarded-For"); ip != "" {
+		return ip
+	}
+
+	return r.RemoteAddr
+}
+
 func checkHeader(r *http.Request) (err error) {
 	if r.Method != "POST" {
 		return errors.New("Invalid method: " + r.Method)
@@ -331,27 +1111,62 @@ func checkHeader(r *http.Request) (err error) {
 	return
 }
 
-func checkData(r *http.Request) (d *RequestMsg, err error) {
-	if err = json.NewDecoder(r.Body).Decode(&d); err != nil {
+func checkData(li *LogInfo, r *http.Request) (d *RequestMsg, err error) {
+	var body []byte
+
+	if body, err = ioutil.ReadAll(r.Body); err != nil {
+		return d, errors.New("Error reading request body")
+	}
+
+	if err = json.Unmarshal(body, &d); err != nil {
 		return d, errors.New("Invalid JSON payload")
 	}
 
-	t, _ := time.Parse(time.RFC1123, r.Header.Get("Date"))
+	h := r.Header.Get("Date")
+
+	if h == "" {
+		return d, errors.New("Missing Date header")
+	}
+
+	var t time.Time
+
+	if t, err = time.Parse(time.RFC1123, h); err != nil {
+		return d, errors.New("Invalid Date header: " + h)
+	}
 
 	if err = checkMsgExpiry(t); err != nil {
 		return
 	}
 
 	sig := r.Header.Get("X-N3-Signature")
-	buf, _ := json.Marshal(d)
 
-	if err = checkSignature(sig, buf); err != nil {
-		stat.ReqErrSignature++
+	if kid := r.Header.Get("X-N3-Api-Key"); kid != "" {
+		if err = checkApiKey(li, r, kid, sig, body, d); err != nil {
+			incStat(&stat.ReqErrApiKey)
+			return
+		}
+	} else if kid := r.Header.Get("X-N3-Key-Id"); kid != "" {
+		if err = checkKeyId(li, r, kid, sig, body); err != nil {
+			incStat(&stat.ReqErrKeyId)
+			return
+		}
+	} else if err = checkRequestSignature(r, sig, body,
+		app.Secret); err != nil {
+		incStat(&stat.ReqErrSignature)
 		return
 	}
 
+	// only a signed nonce is remembered, so forged requests cannot use
+	// up a legitimate one. Legacy clients send none, their requests are
+	// only bounded by the Date window until transition mode is retired.
+	if strings.HasPrefix(sig, SIGALG+" ") {
+		if err = checkNonce(d.Nonce, t); err != nil {
+			return
+		}
+	}
+
 	if err = checkCommand(d.Command); err != nil {
-		stat.ReqErrCommand++
+		incStat(&stat.ReqErrCommand)
 		return
 	}
 
@@ -383,6 +1198,51 @@ func checkCommand(c string) (err error) {
 	case "register":
 	case "login":
 	case "logout":
+	case "change-password":
+	case "request-password-reset":
+	case "complete-password-reset":
+	case "validate-session":
+	case "list-sessions":
+	case "revoke-session":
+	case "revoke-all-sessions":
+	case "login-totp":
+	case "enroll-totp":
+	case "confirm-totp":
+	case "disable-totp":
+
+	case "list-login-sessions":
+	case "revoke-login-sessions":
+	case "impersonate-user":
+	case "unlock-user":
+	case "list-role":
+	case "create-role":
+	case "delete-role":
+	case "grant-role":
+	case "revoke-role":
+	case "verify-email":
+	case "create-api-key":
+	case "list-api-keys":
+	case "revoke-api-key":
+	case "delete-user":
+	case "export-user-data":
+	case "search-user":
+	case "import-users":
+	case "export-users":
+	case "render-template":
+	case "list-mail":
+	case "retry-mail":
+	case "purge-mail":
+	case "create-oidc-client":
+	case "list-oidc-client":
+	case "delete-oidc-client":
+	case "publish-aup":
+	case "list-aup":
+	case "report-aup":
+	case "add-signing-key":
+	case "list-signing-keys":
+	case "retire-signing-key":
+	case "show-aup":
+	case "accept-aup":
 
 	default:
 		return errors.New("Invalid command: " + c)
@@ -391,14 +1251,14 @@ func checkCommand(c string) (err error) {
 	return
 }
 
-func sendResponse(w http.ResponseWriter, m *Msg) {
+func sendResponse(w http.ResponseWriter, li *LogInfo, m *Msg) {
 	data := &Msg{HostName: app.HostName, UserId: li.Uid, MsgId: li.Msgid,
 		Data: m.Data}
 	buf, _ := json.Marshal(data)
 
 	w.Header().Add("Content-Type", "application/json")
 	w.Header().Add("X-N3-Service-Name", "ghazal")
-	w.Header().Add("X-N3-Signature", signRequest(buf, data.MsgId))
+	w.Header().Add("X-N3-Signature", signRequest(buf, li.Key))
 
 	fmt.Fprintf(w, "%s", buf)
 
@@ -408,9 +1268,10 @@ func sendResponse(w http.ResponseWriter, m *Msg) {
 
 }
 
-func sendError(w http.ResponseWriter, i int, s string, e error) {
+func sendError(w http.ResponseWriter, li *LogInfo, i int, s string,
+	e error) {
 	event(logwarn, li, e.Error())
-	stat.ReqError++
+	incStat(&stat.ReqError)
 
 	data := &Msg{HostName: app.HostName, UserId: li.Uid, MsgId: li.Msgid,
 		ErrNo: i, Data: s}
@@ -418,7 +1279,7 @@ func sendError(w http.ResponseWriter, i int, s string, e error) {
 
 	w.Header().Add("Content-Type", "application/json")
 	w.Header().Add("X-N3-Service-Name", "ghazal")
-	w.Header().Add("X-N3-Signature", signRequest(buf, data.MsgId))
+	w.Header().Add("X-N3-Signature", signRequest(buf, li.Key))
 
 	fmt.Fprintf(w, "%s", buf)
 
@@ -427,72 +1288,19 @@ func sendError(w http.ResponseWriter, i int, s string, e error) {
 		data.UserId, data.MsgId, data.ErrNo)
 }
 
-func sendMail(r []string, s, b string, f bool) (err error) {
-	ghazal := mail.Address{"Ghazal Web Service", "ghazal@s.rebung.io"}
-	admin := mail.Address{"Rebung.IO Administrator", app.AdminEmail}
-
-	auth := smtp.PlainAuth("", app.SMTPUser, app.SMTPPw, app.SMTPHost)
-	url := net.JoinHostPort(app.SMTPHost, "587")
-	con := &smtp.Client{}
-
-	if con, err = smtp.Dial(url); err != nil {
-		return errors.New("SMTP server not available")
-	}
-
-	if err = con.StartTLS(tlsc); err != nil {
-		return errors.New("StartTLS negotiation failed")
-	}
-
-	if err = con.Auth(auth); err != nil {
-		return errors.New("SMTP Plain authentication failed")
-	}
-
-	header := make(map[string]string)
-
-	if f {
-		header["From"] = ghazal.String()
-	} else {
-		header["From"] = admin.String()
-	}
-
-	header["Subject"] = s
-	header["MIME-Version"] = "1.0"
-	header["Content-Type"] = "text/plain; charset=\"utf-8\""
-	header["Content-Transfer-Encoding"] = "base64"
-
-	r = append(r, admin.String())
-
-	if f {
-		con.Mail(ghazal.String())
-	} else {
-		con.Mail(admin.String())
-	}
-
-	for i := range r {
-		con.Rcpt(r[i])
-		header["To"] = r[i]
-	}
-
-	wc, err := con.Data()
-	if err != nil {
-		return errors.New("Unable to open SMTP DATA request")
-	}
-	defer wc.Close()
+// sendMail queues b as the plain text body, and h as an alternative HTML
+// part when it is not empty, for the mail worker to deliver. f sends from
+// the service address instead of the administrator.
+func sendMail(li *LogInfo, r []string, s, b, h string, f bool) (err error) {
+	m := &MailInfo{Rcpt: r, Subject: s, Text: b, Html: h, Service: f}
 
-	var msg string
-
-	for k, v := range header {
-		msg += fmt.Sprintf("%s: %s\r\n", k, v)
-	}
+	var id int64
 
-	msg += "\r\n" + base64.StdEncoding.EncodeToString([]byte(b))
-
-	buf := bytes.NewBufferString(msg)
-
-	if _, err = buf.WriteTo(wc); err != nil {
-		return errors.New("Unable write message body")
+	if id, err = setRedisMailNew(m); err != nil {
+		return
 	}
 
+	event(logdebug, li, "Mail [%v] queued: %v", id, s)
 	return
 }
 
@@ -501,11 +1309,19 @@ func setupServer() (err error) {
 	http.HandleFunc("/s/", defaultAdminUserHandler)
 	http.HandleFunc("/u/", defaultUserHandler)
 
+	if err = setupOIDC(); err != nil {
+		return
+	}
+
 	for i := range app.Bind {
-		b := net.JoinHostPort(app.Bind[i].Host, app.Bind[i].Port)
+		var ln net.Listener
+
+		if ln, err = getListener(&app.Bind[i]); err != nil {
+			return
+		}
 
-		go http.ListenAndServe(b, nil)
-		event(loginfo, li, "Listening on %v", b)
+		go http.Serve(ln, nil)
+		event(loginfo, sli, "Listening on %v", ln.Addr())
 	}
 
 	if tlsc, err = setTLSConfig(); err != nil {
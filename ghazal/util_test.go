@@ -0,0 +1,287 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSignature signs a request the way rctl does, over the given headers
+func testSignature(r *http.Request, signed []string, body []byte,
+	key string) string {
+	return fmt.Sprintf("%v SignedHeaders=%v,Signature=%v", SIGALG,
+		strings.Join(signed, ";"), base64.StdEncoding.EncodeToString(
+			getCanonicalSignature(r, signed, body, key)))
+}
+
+func newTestRequest(t *testing.T, body []byte) *http.Request {
+	r, err := http.NewRequest("POST", "https://ghazal/u/login?v=1",
+		bytes.NewReader(body))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Header.Add("Content-Type", "application/json")
+	r.Header.Add("Date", time.Now().UTC().Format(time.RFC1123))
+	r.Header.Add("X-N3-Service-Name", "ghazal")
+	r.Header.Add("X-N3-Caller", "rctl")
+	return r
+}
+
+func TestGetSignedHeaders(t *testing.T) {
+	tests := []struct {
+		headers []string
+		signed  string
+	}{
+		{nil, "content-type;date"},
+		{[]string{"Accept", "User-Agent"}, "content-type;date"},
+		{[]string{"X-N3-Signature"}, "content-type;date"},
+		{[]string{"X-N3-Caller", "X-N3-Api-Key", "X-N3-Signature"},
+			"content-type;date;x-n3-api-key;x-n3-caller"},
+		{[]string{"x-n3-tunnel-server"},
+			"content-type;date;x-n3-tunnel-server"},
+	}
+
+	for _, v := range tests {
+		h := make(http.Header)
+
+		for _, k := range v.headers {
+			h[k] = []string{"value"}
+		}
+
+		if s := strings.Join(getSignedHeaders(h), ";"); s != v.signed {
+			t.Errorf("%v: got %v, want %v", v.headers, s, v.signed)
+		}
+	}
+}
+
+func TestCheckRequestSignature(t *testing.T) {
+	app = &AppConfig{}
+	stat = &AppStat{}
+
+	key := "secret"
+	body := []byte(`{"UserId":1,"Command":"login"}`)
+
+	canonical := func(r *http.Request, b []byte) string {
+		return testSignature(r, getSignedHeaders(r.Header), b, key)
+	}
+
+	legacy := func(r *http.Request, b []byte) string {
+		dgst := hmac.New(sha256.New, []byte(key))
+		dgst.Write(b)
+
+		return base64.StdEncoding.EncodeToString(dgst.Sum(nil))
+	}
+
+	epoch := time.Unix(0, 0).UTC().Format(time.RFC1123)
+
+	// sign is applied to the request as built, change after signing
+	tests := []struct {
+		name   string
+		mode   string
+		sign   func(r *http.Request, b []byte) string
+		change func(r *http.Request) []byte
+		ok     bool
+	}{
+		{"canonical", "canonical", canonical, nil, true},
+		{"other key", "canonical", func(r *http.Request,
+			b []byte) string {
+			return testSignature(r, getSignedHeaders(r.Header), b,
+				"other")
+		}, nil, false},
+		{"body changed", "canonical", canonical,
+			func(r *http.Request) []byte {
+				return []byte(`{"UserId":2,"Command":"login"}`)
+			}, false},
+		{"method changed", "canonical", canonical,
+			func(r *http.Request) []byte {
+				r.Method = "PUT"
+				return body
+			}, false},
+		{"path changed", "canonical", canonical,
+			func(r *http.Request) []byte {
+				r.URL.Path = "/u/logout"
+				return body
+			}, false},
+		{"query changed", "canonical", canonical,
+			func(r *http.Request) []byte {
+				r.URL.RawQuery = "v=2"
+				return body
+			}, false},
+		{"date changed", "canonical", canonical,
+			func(r *http.Request) []byte {
+				r.Header.Set("Date", epoch)
+				return body
+			}, false},
+		{"signed header changed", "canonical", canonical,
+			func(r *http.Request) []byte {
+				r.Header.Set("X-N3-Caller", "rctlweb")
+				return body
+			}, false},
+		{"unsigned header added", "canonical", canonical,
+			func(r *http.Request) []byte {
+				r.Header.Set("X-N3-Key-Id", "kid")
+				return body
+			}, false},
+		{"header left out", "canonical", func(r *http.Request,
+			b []byte) string {
+			return testSignature(r, []string{"content-type", "date",
+				"x-n3-service-name"}, b, key)
+		}, nil, false},
+		{"other header added", "canonical", canonical,
+			func(r *http.Request) []byte {
+				r.Header.Set("User-Agent", "test")
+				return body
+			}, true},
+		{"bad encoding", "canonical", func(r *http.Request,
+			b []byte) string {
+			return SIGALG + " SignedHeaders=content-type;date;" +
+				"x-n3-caller;x-n3-service-name,Signature=!!"
+		}, nil, false},
+		{"legacy in transition", "transition", legacy, nil, true},
+		{"legacy body changed", "transition", legacy,
+			func(r *http.Request) []byte {
+				return []byte(`{}`)
+			}, false},
+		{"legacy in canonical", "canonical", legacy, nil, false},
+		{"canonical in transition", "transition", canonical, nil, true},
+	}
+
+	for _, v := range tests {
+		app.SignatureMode = v.mode
+
+		r := newTestRequest(t, body)
+		sig := v.sign(r, body)
+		b := body
+
+		if v.change != nil {
+			b = v.change(r)
+		}
+
+		err := checkRequestSignature(r, sig, b, key)
+
+		if v.ok && err != nil {
+			t.Errorf("%v: %v", v.name, err)
+		} else if !v.ok && err == nil {
+			t.Errorf("%v: signature accepted", v.name)
+		}
+	}
+
+	if stat.ReqLegacySignature != 1 {
+		t.Errorf("got %v legacy signatures counted, want 1",
+			stat.ReqLegacySignature)
+	}
+}
+
+// legacy clients send no nonce, canonical ones have to
+func TestCheckDataNonce(t *testing.T) {
+	defer setupTestStore(t)()
+
+	app.Secret = "secret"
+
+	legacy := func(r *http.Request, b []byte) string {
+		dgst := hmac.New(sha256.New, []byte(app.Secret))
+		dgst.Write(b)
+
+		return base64.StdEncoding.EncodeToString(dgst.Sum(nil))
+	}
+
+	canonical := func(r *http.Request, b []byte) string {
+		return testSignature(r, getSignedHeaders(r.Header), b,
+			app.Secret)
+	}
+
+	tests := []struct {
+		name  string
+		mode  string
+		sign  func(r *http.Request, b []byte) string
+		nonce bool
+		ok    bool
+	}{
+		{"canonical", "canonical", canonical, true, true},
+		{"canonical without nonce", "canonical", canonical, false,
+			false},
+		{"canonical without nonce in transition", "transition",
+			canonical, false, false},
+		{"legacy without nonce", "transition", legacy, false, true},
+		{"legacy with nonce", "transition", legacy, true, true},
+		{"legacy in canonical", "canonical", legacy, false, false},
+	}
+
+	for i, v := range tests {
+		app.SignatureMode = v.mode
+
+		now := time.Now()
+		m := &RequestMsg{UserId: 1, Command: "server-status"}
+
+		if v.nonce {
+			m.Nonce = fmt.Sprintf("%v.nonce%v", now.Unix(), i)
+		}
+
+		body, _ := json.Marshal(m)
+		r := newTestRequest(t, body)
+
+		r.Header.Set("Date", now.UTC().Format(time.RFC1123))
+		r.Header.Set("X-N3-Signature", v.sign(r, body))
+
+		_, err := checkData(&LogInfo{}, r)
+
+		if v.ok && err != nil {
+			t.Errorf("%v: %v", v.name, err)
+		} else if !v.ok && err == nil {
+			t.Errorf("%v: request accepted", v.name)
+		}
+	}
+}
+
+func TestCheckNonce(t *testing.T) {
+	defer setupTestStore(t)()
+
+	now := time.Unix(time.Now().Unix(), 0)
+	n := fmt.Sprintf("%v.abcdef", now.Unix())
+
+	tests := []struct {
+		name  string
+		nonce string
+		errno int
+	}{
+		{"missing", "", EINVAL},
+		{"no random part", fmt.Sprintf("%v.", now.Unix()), EINVAL},
+		{"extra part", n + ".x", EINVAL},
+		{"no time", "abcdef", EINVAL},
+		{"other time", fmt.Sprintf("%v.abcdef", now.Unix()-1), EINVAL},
+		{"fresh", n, EOK},
+		{"replayed", n, EREPLAY},
+		{"another fresh", n + "g", EOK},
+		{"replayed again", n, EREPLAY},
+	}
+
+	for _, v := range tests {
+		err := checkNonce(v.nonce, now)
+
+		if v.errno == EOK && err != nil {
+			t.Errorf("%v: %v", v.name, err)
+		} else if v.errno != EOK && err == nil {
+			t.Errorf("%v: nonce accepted", v.name)
+		} else if err != nil && getDataErrNo(err) != v.errno {
+			t.Errorf("%v: got result %v, want %v", v.name,
+				getDataErrNo(err), v.errno)
+		}
+	}
+
+	if stat.ReqErrReplay != 2 {
+		t.Errorf("got %v replays counted, want 2", stat.ReqErrReplay)
+	}
+}
@@ -0,0 +1,235 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+)
+
+type AUPInfo struct {
+	Version   int64
+	Title     string
+	Text      string
+	Published string
+	Accepted  string
+
+	ErrNo int
+}
+
+type AUPInfoList struct {
+	Id    int64
+	Entry []AUPInfo
+}
+
+type AUPAcceptInfo struct {
+	Version  int64
+	Uid      int64
+	Login    string
+	Accepted string
+	Ip       string
+
+	ErrNo int
+}
+
+type AUPAcceptInfoList struct {
+	Id    int64
+	Entry []AUPAcceptInfo
+}
+
+func publishAUP() (err error) {
+	if len(app.Cmd.Args) != 2 {
+		return errors.New("Incorrect number of arguments")
+	}
+
+	var buf []byte
+
+	if buf, err = ioutil.ReadFile(app.Cmd.Args[1]); err != nil {
+		return
+	}
+
+	var list = []Name{Name{Name: "title", Opt: app.Cmd.Args[0]},
+		Name{Name: "text", Opt: string(buf)}}
+
+	var d, _ = json.Marshal(&NameList{Entry: list})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	var m *IdList
+
+	if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+		return
+	}
+
+	event("AUP version %v published: %v", m.Entry[0].Id, m.Entry[0].Opt)
+	return
+}
+
+func listAUP() (err error) {
+	if len(app.Cmd.Args) > 1 {
+		return errors.New("Incorrect number of arguments")
+	}
+
+	var list = []Id{Id{}}
+
+	if len(app.Cmd.Args) == 1 {
+		if list, err = setIdParam(strings.Split(app.Cmd.Args[0],
+			",")); err != nil {
+			return
+		}
+	}
+
+	var d, _ = json.Marshal(&IdList{Entry: list})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	var m *AUPInfoList
+
+	if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+		return
+	}
+
+	for i := range m.Entry {
+		var e = m.Entry[i]
+
+		if e.ErrNo != EOK {
+			event("AUP version %v not found", e.Version)
+			continue
+		}
+
+		event("AUP version [%v]:\n"+
+			"------------------------------\n"+
+			"Title: %v\n"+
+			"Published: %v\n", e.Version, e.Title, e.Published)
+
+		if e.Text != "" {
+			event("%v\n", e.Text)
+		}
+	}
+
+	return
+}
+
+func reportAUP() (err error) {
+	if len(app.Cmd.Args) > 1 {
+		return errors.New("Incorrect number of arguments")
+	}
+
+	var list = []Id{Id{}}
+
+	if len(app.Cmd.Args) == 1 {
+		if list, err = setIdParam(strings.Split(app.Cmd.Args[0],
+			",")); err != nil {
+			return
+		}
+	}
+
+	var d, _ = json.Marshal(&IdList{Entry: list})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	var m *AUPAcceptInfoList
+
+	if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+		return
+	}
+
+	for i := range m.Entry {
+		var e = m.Entry[i]
+
+		if e.ErrNo == ENOENT {
+			event("AUP version %v not found", e.Version)
+			continue
+		} else if e.ErrNo != EOK {
+			event("AUP version %v acceptances unavailable", e.Version)
+			continue
+		}
+
+		event("Version %v: %v [%v] accepted on %v from %v", e.Version,
+			e.Login, e.Uid, e.Accepted, e.Ip)
+	}
+
+	return
+}
+
+func setAUP() (err error) {
+	var list []Name
+
+	switch app.Cmd.Command {
+	case "show-aup":
+		if len(app.Cmd.Args) < 1 || len(app.Cmd.Args) > 2 {
+			return errors.New("Incorrect number of arguments")
+		}
+
+		list = []Name{Name{Name: app.Cmd.Args[0]}}
+
+		if len(app.Cmd.Args) == 2 {
+			list[0].Opt = app.Cmd.Args[1]
+		}
+
+	case "accept-aup":
+		if len(app.Cmd.Args) != 2 {
+			return errors.New("Incorrect number of arguments")
+		}
+
+		list = []Name{Name{Name: app.Cmd.Args[0], Opt: app.Cmd.Args[1]}}
+	}
+
+	var d, _ = json.Marshal(&NameList{Id: app.Cmd.UserId, Entry: list})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	switch app.Cmd.Command {
+	case "show-aup":
+		var m *AUPInfoList
+
+		if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+			return
+		}
+
+		var e = m.Entry[0]
+
+		if e.Accepted == "" {
+			e.Accepted = "not accepted, use accept-aup"
+		}
+
+		event("AUP version [%v]:\n"+
+			"------------------------------\n"+
+			"Title: %v\n"+
+			"Published: %v\n"+
+			"Accepted: %v\n\n%v\n", e.Version, e.Title, e.Published,
+			e.Accepted, e.Text)
+
+	case "accept-aup":
+		var m *IdList
+
+		if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+			return
+		}
+
+		event("AUP version %v accepted on %v", m.Entry[0].Id,
+			m.Entry[0].Opt)
+	}
+
+	return
+}
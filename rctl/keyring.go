@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type SigningKey struct {
+	Id        string
+	Service   string
+	Callers   []string
+	NotBefore int64
+	NotAfter  int64
+	Created   string
+
+	ErrNo int
+}
+
+type SigningKeyList struct {
+	Id    int64
+	Entry []SigningKey
+}
+
+func addSigningKey() (err error) {
+	if len(app.Cmd.Args) < 1 || len(app.Cmd.Args) > 6 {
+		return errors.New("Incorrect number of arguments")
+	}
+
+	var args = app.Cmd.Args
+	var list = []Name{Name{Name: "service", Opt: args[0]}}
+
+	if len(args) > 1 && args[1] != "-" {
+		for _, v := range strings.Split(args[1], ",") {
+			list = append(list, Name{Name: "caller", Opt: v})
+		}
+	}
+
+	var opts = []string{"delay", "expire", "id", "secret"}
+
+	for i := 2; i < len(args); i++ {
+		list = append(list, Name{Name: opts[i-2], Opt: args[i]})
+	}
+
+	var d, _ = json.Marshal(&NameList{Entry: list})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	var m *NameList
+
+	if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+		return
+	}
+
+	event("Signing key added, the secret will not be shown again:\n"+
+		"------------------------------\n"+
+		"Key ID: %v\n"+
+		"Secret: %v\n", m.Entry[0].Name, m.Entry[0].Opt)
+	return
+}
+
+func listSigningKeys() (err error) {
+	if len(app.Cmd.Args) > 1 {
+		return errors.New("Incorrect number of arguments")
+	}
+
+	var list = []Name{Name{}}
+
+	if len(app.Cmd.Args) == 1 {
+		if list, err = setNameParam(strings.Split(app.Cmd.Args[0],
+			",")); err != nil {
+			return
+		}
+	}
+
+	var d, _ = json.Marshal(&NameList{Entry: list})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	var m *SigningKeyList
+
+	if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+		return
+	}
+
+	for i := range m.Entry {
+		var e = m.Entry[i]
+
+		if e.ErrNo != EOK {
+			event("Signing key %v not found", e.Id)
+			continue
+		}
+
+		var callers = "any"
+
+		if len(e.Callers) != 0 {
+			callers = strings.Join(e.Callers, ", ")
+		}
+
+		var expire = "never"
+
+		if e.NotAfter != 0 {
+			expire = time.Unix(e.NotAfter, 0).Format(time.RFC1123)
+		}
+
+		event("Signing key [%v]:\n"+
+			"------------------------------\n"+
+			"Service: %v\n"+
+			"Callers: %v\n"+
+			"Valid from: %v\n"+
+			"Valid until: %v\n"+
+			"Created: %v\n", e.Id, e.Service, callers,
+			time.Unix(e.NotBefore, 0).Format(time.RFC1123), expire,
+			e.Created)
+	}
+
+	return
+}
+
+func retireSigningKey() (err error) {
+	if len(app.Cmd.Args) < 1 || len(app.Cmd.Args) > 2 {
+		return errors.New("Incorrect number of arguments")
+	}
+
+	var list []Name
+
+	if list, err = setNameParam(strings.Split(app.Cmd.Args[0],
+		",")); err != nil {
+		return
+	}
+
+	if len(app.Cmd.Args) == 2 {
+		var grace = app.Cmd.Args[1]
+
+		if _, err = strconv.ParseInt(grace, 0, 64); err != nil {
+			return errors.New("Invalid grace period: " + grace)
+		}
+
+		for i := range list {
+			list[i].Opt = grace
+		}
+	}
+
+	var d, _ = json.Marshal(&NameList{Entry: list})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	var m *NameList
+
+	if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+		return
+	}
+
+	for i := range m.Entry {
+		var e = m.Entry[i]
+
+		if e.ErrNo != EOK {
+			event("Signing key %v not found", e.Name)
+			continue
+		}
+
+		var t, _ = strconv.ParseInt(e.Opt, 0, 64)
+
+		event("Signing key %v retired, valid until %v", e.Name,
+			time.Unix(t, 0).Format(time.RFC1123))
+	}
+
+	return
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+type MailInfo struct {
+	Id      int64
+	Rcpt    []string
+	Subject string
+	Service bool
+
+	Tries   int64
+	Error   string
+	Created string
+	Next    string
+
+	ErrNo int
+}
+
+type MailInfoList struct {
+	Id    int64
+	Entry []MailInfo
+}
+
+func listMail() (err error) {
+	if len(app.Cmd.Args) != 1 {
+		return errors.New("Incorrect number of arguments")
+	}
+
+	var d, _ = json.Marshal(&NameList{Entry: []Name{
+		Name{Name: app.Cmd.Args[0]}}})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	var m *MailInfoList
+
+	if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+		return
+	}
+
+	for i := range m.Entry {
+		var e = m.Entry[i]
+
+		if e.ErrNo != EOK {
+			continue
+		}
+
+		event("Mail [%v]:\n"+
+			"------------------------------\n"+
+			"Recipients: %v\n"+
+			"Subject: %v\n"+
+			"Queued: %v\n"+
+			"Attempts: %v\n"+
+			"Next attempt: %v\n"+
+			"Last error: %v\n", e.Id, strings.Join(e.Rcpt, ", "),
+			e.Subject, e.Created, e.Tries, e.Next, e.Error)
+	}
+
+	return
+}
+
+func setMail() (err error) {
+	if len(app.Cmd.Args) != 1 {
+		return errors.New("Incorrect number of arguments")
+	}
+
+	var list []Id
+
+	// purging "dead" empties the whole dead-letter list
+	if app.Cmd.Command == "purge-mail" && app.Cmd.Args[0] == "dead" {
+		list = []Id{Id{}}
+	} else {
+		var args = strings.Split(app.Cmd.Args[0], ",")
+
+		if list, err = setIdParam(args); err != nil {
+			return
+		}
+	}
+
+	var d, _ = json.Marshal(&IdList{Entry: list})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	var m *IdList
+
+	if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+		return
+	}
+
+	var v = "requeued"
+
+	if app.Cmd.Command == "purge-mail" {
+		v = "purged"
+	}
+
+	for i := range m.Entry {
+		var e = m.Entry[i]
+
+		if e.ErrNo == EOK {
+			event("Mail [%v] has been %v", e.Id, v)
+		} else {
+			event("Mail [%v] not found", e.Id)
+		}
+	}
+
+	return
+}
@@ -8,6 +8,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 )
 
 type Command struct {
@@ -19,9 +20,15 @@ type Command struct {
 
 type AppVar struct {
 	Key       string
+	KeyId     string
+	ApiKeyId  string
 	RebanaUrl string
 	GhazalUrl string
 	Cmd       *Command
+
+	// client certificate for services that require mutual TLS
+	TLSCert string
+	TLSKey  string
 }
 
 const (
@@ -30,12 +37,18 @@ const (
 	REBANABASEURL = "https://rebana.rebung.io/"
 	GHAZALBASEURL = "https://ghazal.rebung.io/"
 
+	// canonical request signature scheme
+	SIGALG = "N3-HMAC-SHA256"
+
 	// error codes
-	EOK    = 0
-	EINVAL = 1
-	EAGAIN = 2
-	ENOENT = 3
-	EPERM  = 4
+	EOK     = 0
+	EINVAL  = 1
+	EAGAIN  = 2
+	ENOENT  = 3
+	EPERM   = 4
+	EPOLICY = 5
+	EREPLAY = 6
+	EAUP    = 7
 )
 
 var (
@@ -46,7 +59,7 @@ var (
 func main() {
 	var help bool
 	var err error
-	var svc string
+	var svc, apikey, signkey string
 
 	app = &AppVar{}
 	app.Cmd = &Command{}
@@ -55,6 +68,13 @@ func main() {
 	flag.Int64Var(&app.Cmd.UserId, "i", 0, "User ID")
 	flag.StringVar(&app.Cmd.Command, "c", "", "Command to issue")
 	flag.StringVar(&svc, "s", "rebana", "Service to configure")
+	flag.StringVar(&apikey, "k", "", "API key [key-id:key]")
+	flag.StringVar(&signkey, "K", os.Getenv("REBUNGCTL_KEY"),
+		"Signing key [key-id:secret]")
+	flag.StringVar(&app.TLSCert, "C", os.Getenv("REBUNGCTL_TLS_CERT"),
+		"TLS client certificate")
+	flag.StringVar(&app.TLSKey, "P", os.Getenv("REBUNGCTL_TLS_KEY"),
+		"TLS client key")
 
 	flag.Parse()
 
@@ -63,7 +83,34 @@ func main() {
 	}
 
 	app.Cmd.Args = flag.Args()
-	app.Key = "secret"
+
+	// there is no shared default secret to fall back on
+	if signkey == "" && apikey == "" {
+		fatal("Missing signing key or API key, use -K or -k")
+	}
+
+	if signkey != "" {
+		var k = strings.SplitN(signkey, ":", 2)
+
+		if len(k) != 2 {
+			fatal("Invalid signing key format")
+		}
+
+		app.KeyId = k[0]
+		app.Key = k[1]
+	}
+
+	// an API key takes the place of a signing key
+	if apikey != "" {
+		var k = strings.SplitN(apikey, ":", 2)
+
+		if len(k) != 2 {
+			fatal("Invalid API key format")
+		}
+
+		app.ApiKeyId = k[0]
+		app.Key = k[1]
+	}
 
 	if svc == "rebana" {
 		switch app.Cmd.Command {
@@ -147,7 +194,7 @@ func main() {
 			err = setUserAttr()
 
 		case "disable-user", "enable-user", "activate-user",
-		        "deactivate-user":
+		        "deactivate-user", "unlock-user":
 			app.GhazalUrl = GHAZALBASEURL + "s/set"
 			err = setUserStatus()
 
@@ -159,6 +206,98 @@ func main() {
 			app.GhazalUrl = GHAZALBASEURL + "s/list"
 			err = getUserList()
 
+		case "list-login-sessions":
+			app.GhazalUrl = GHAZALBASEURL + "s/session"
+			err = listSessions()
+
+		case "revoke-login-sessions":
+			app.GhazalUrl = GHAZALBASEURL + "s/session"
+			err = revokeSession()
+
+		case "impersonate-user":
+			app.GhazalUrl = GHAZALBASEURL + "s/session"
+			err = impersonateUser()
+
+		case "list-role":
+			app.GhazalUrl = GHAZALBASEURL + "s/role"
+			err = listRole()
+
+		case "create-role", "delete-role":
+			app.GhazalUrl = GHAZALBASEURL + "s/role"
+			err = setRole()
+
+		case "grant-role", "revoke-role":
+			app.GhazalUrl = GHAZALBASEURL + "s/role"
+			err = setUserRole()
+
+		case "delete-user":
+			app.GhazalUrl = GHAZALBASEURL + "s/delete"
+			err = deleteUser()
+
+		case "export-user-data":
+			app.GhazalUrl = GHAZALBASEURL + "s/export"
+			err = exportUserData()
+
+		case "search-user":
+			app.GhazalUrl = GHAZALBASEURL + "s/search"
+			err = searchUser()
+
+		case "import-users":
+			app.GhazalUrl = GHAZALBASEURL + "s/import"
+			err = importUsers()
+
+		case "export-users":
+			app.GhazalUrl = GHAZALBASEURL + "s/export"
+			err = exportUsers()
+
+		case "render-template":
+			app.GhazalUrl = GHAZALBASEURL + "s/template"
+			err = renderTemplate()
+
+		case "list-mail":
+			app.GhazalUrl = GHAZALBASEURL + "s/mail"
+			err = listMail()
+
+		case "retry-mail", "purge-mail":
+			app.GhazalUrl = GHAZALBASEURL + "s/mail"
+			err = setMail()
+
+		case "create-oidc-client":
+			app.GhazalUrl = GHAZALBASEURL + "s/oidc"
+			err = createOIDCClient()
+
+		case "list-oidc-client":
+			app.GhazalUrl = GHAZALBASEURL + "s/oidc"
+			err = listOIDCClient()
+
+		case "delete-oidc-client":
+			app.GhazalUrl = GHAZALBASEURL + "s/oidc"
+			err = deleteOIDCClient()
+
+		case "publish-aup":
+			app.GhazalUrl = GHAZALBASEURL + "s/aup"
+			err = publishAUP()
+
+		case "list-aup":
+			app.GhazalUrl = GHAZALBASEURL + "s/aup"
+			err = listAUP()
+
+		case "report-aup":
+			app.GhazalUrl = GHAZALBASEURL + "s/aup"
+			err = reportAUP()
+
+		case "add-signing-key":
+			app.GhazalUrl = GHAZALBASEURL + "s/keyring"
+			err = addSigningKey()
+
+		case "list-signing-keys":
+			app.GhazalUrl = GHAZALBASEURL + "s/keyring"
+			err = listSigningKeys()
+
+		case "retire-signing-key":
+			app.GhazalUrl = GHAZALBASEURL + "s/keyring"
+			err = retireSigningKey()
+
 		case "register":
 			app.GhazalUrl = GHAZALBASEURL + "u/register"
 			err = addUser()
@@ -171,6 +310,46 @@ func main() {
 			app.GhazalUrl = GHAZALBASEURL + "u/logout"
 			err = userLogout()
 
+		case "change-password":
+			app.GhazalUrl = GHAZALBASEURL + "u/set"
+			err = changePassword()
+
+		case "request-password-reset":
+			app.GhazalUrl = GHAZALBASEURL + "u/reset"
+			err = requestPasswordReset()
+
+		case "complete-password-reset":
+			app.GhazalUrl = GHAZALBASEURL + "u/reset"
+			err = completePasswordReset()
+
+		case "verify-email":
+			app.GhazalUrl = GHAZALBASEURL + "u/verify"
+			err = verifyEmail()
+
+		case "validate-session":
+			app.GhazalUrl = GHAZALBASEURL + "u/session"
+			err = validateSession()
+
+		case "list-sessions":
+			app.GhazalUrl = GHAZALBASEURL + "u/session"
+			err = listSessions()
+
+		case "revoke-session", "revoke-all-sessions":
+			app.GhazalUrl = GHAZALBASEURL + "u/session"
+			err = revokeSession()
+
+		case "create-api-key", "list-api-keys", "revoke-api-key":
+			app.GhazalUrl = GHAZALBASEURL + "u/apikey"
+			err = setApiKey()
+
+		case "enroll-totp", "confirm-totp", "disable-totp":
+			app.GhazalUrl = GHAZALBASEURL + "u/totp"
+			err = enrollTOTP()
+
+		case "show-aup", "accept-aup":
+			app.GhazalUrl = GHAZALBASEURL + "u/aup"
+			err = setAUP()
+
 		case "server-status":
 			app.GhazalUrl = GHAZALBASEURL + "status"
 			err = status()
@@ -190,7 +369,9 @@ func main() {
 
 func usage() {
 	var str = fmt.Sprintf("%v-%v\nBase usage: %v [-d] [-h] [-c config file] "+
-		"[-s service]\n\n", APPNAME, APPVER, APPNAME)
+		"[-s service] [-k key-id:key] [-K key-id:secret] "+
+		"[-C client cert] [-P client key]\n\n", APPNAME, APPVER,
+		APPNAME)
 
 	str += fmt.Sprintf("Rebana usage\n" +
 		"------------\n" +
@@ -210,8 +391,8 @@ func usage() {
                 "-c activate-session -i [uid] [svid] [ip]\n" +
                 "-c deactivate-session -i [uid] [svid] [ip]\n" +
                 "-c check-session -i [uid] [svid] [ip]\n" +
-                "-c assign-session -i [uid] [svid]\n" +
-                "-c reassign-session -i [uid] [svid]\n" +
+                "-c assign-session -i [auid] [uid] [svid]\n" +
+                "-c reassign-session -i [auid] [uid] [svid]\n" +
 		"-c tunnel-server-status -i [auid] [svid]\n" +
 		"-c server-status -i [auid]\n\n")
 
@@ -225,11 +406,55 @@ func usage() {
 		"-c disable-user -i [auid] [uid1],[uid2],..\n" +
 		"-c activate-user -i [auid] [uid1],[uid2],..\n" +
 		"-c deactivate-user -i [auid] [uid1],[uid2],..\n" +
+		"-c unlock-user -i [auid] [uid1],[uid2],..\n" +
 		"-c list-user -i [auid] [uid1],[uid2],..\n" +
-                "-c list-user -i [auid] [0:list-name,page,entries,sort-field]\n" +
-		"-c get-user-list -i [auid] [uid:list-name,page,entries,sort-field]\n" +
+		"-c list-user -i [auid] [list-name] [field:op:val],..|- [field[-r]],..|- [entries] [cursor]\n" +
+		"-c get-user-list -i [auid] [uid] [activity|login] [entry:op:val],..|- [time[-r]] [entries] [cursor]\n" +
+		"-c list-login-sessions -i [auid] [uid1],[uid2],..\n" +
+		"-c revoke-login-sessions -i [auid] [uid] [session-id]\n" +
+		"-c impersonate-user -i [auid] [uid] [reason]\n" +
+		"-c list-role -i [auid] [role1],[role2],..\n" +
+		"-c create-role -i [auid] [role] [perm1],[perm2],..\n" +
+		"-c delete-role -i [auid] [role]\n" +
+		"-c grant-role -i [auid] [uid] [role]\n" +
+		"-c revoke-role -i [auid] [uid] [role]\n" +
+		"-c delete-user -i [auid] [uid1],[uid2],.. [force]\n" +
+		"-c export-user-data -i [auid] [uid1],[uid2],..\n" +
+		"-c search-user -i [auid] [field1=val],[field2=val],..\n" +
+		"-c import-users -i [auid] [file.csv|file.jsonl] [dry-run],[welcome]\n" +
+		"-c export-users -i [auid] [list] [csv|jsonl] [file]\n" +
+		"-c render-template -i [auid] [template=val],[locale=val],[uid=val],[reload=true]\n" +
+		"-c list-mail -i [auid] [queue|dead]\n" +
+		"-c retry-mail -i [auid] [id1],[id2],..\n" +
+		"-c purge-mail -i [auid] [id1],[id2],..|dead\n" +
+		"-c create-oidc-client -i [auid] [name] [uri1],[uri2],.. [public]\n" +
+		"-c list-oidc-client -i [auid] [client1],[client2],..\n" +
+		"-c delete-oidc-client -i [auid] [client1],[client2],..\n" +
+		"-c publish-aup -i [auid] [title] [file]\n" +
+		"-c list-aup -i [auid] [version1],[version2],..\n" +
+		"-c report-aup -i [auid] [version1],[version2],..\n" +
+		"-c add-signing-key -i [auid] [service] [caller1],..|- " +
+		"[delay-secs] [expire-days] [key-id] [secret]\n" +
+		"-c list-signing-keys -i [auid] [key1],[key2],..\n" +
+		"-c retire-signing-key -i [auid] [key1],.. [grace-secs]\n" +
 		"-c login [login=val],[password=val]\n" +
 		"-c logout -i [uid] [session-key]\n" +
+		"-c change-password -i [uid] [session-key] [old-pw:new-pw]\n" +
+		"-c request-password-reset [login]\n" +
+		"-c complete-password-reset [reset-token] [new-pw]\n" +
+		"-c verify-email [verify-token]\n" +
+		"-c validate-session [session-key]\n" +
+		"-c list-sessions -i [uid] [session-key]\n" +
+		"-c revoke-session -i [uid] [session-key] [session-id]\n" +
+		"-c revoke-all-sessions -i [uid] [session-key]\n" +
+		"-c create-api-key -i [uid] [session-key] [name] [scope] [days]\n" +
+		"-c list-api-keys -i [uid] [session-key]\n" +
+		"-c revoke-api-key -i [uid] [session-key] [key-id]\n" +
+		"-c enroll-totp -i [uid] [session-key]\n" +
+		"-c confirm-totp -i [uid] [session-key] [code]\n" +
+		"-c disable-totp -i [uid] [session-key] [code]\n" +
+		"-c show-aup -i [uid] [session-key] [version]\n" +
+		"-c accept-aup -i [uid] [session-key] [version]\n" +
 		"-c server-status -i [auid]\n\n")
 
 	fmt.Fprintf(os.Stderr, str)
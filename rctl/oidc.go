@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+type OIDCClientInfo struct {
+	Id          string
+	Name        string
+	RedirectUri []string
+	Public      bool
+	Created     string
+
+	ErrNo int
+}
+
+type OIDCClientInfoList struct {
+	Id    int64
+	Entry []OIDCClientInfo
+}
+
+func createOIDCClient() (err error) {
+	if len(app.Cmd.Args) < 2 || len(app.Cmd.Args) > 3 {
+		return errors.New("Incorrect number of arguments")
+	}
+
+	var list = []Name{Name{Name: "name", Opt: app.Cmd.Args[0]}}
+
+	for _, v := range strings.Split(app.Cmd.Args[1], ",") {
+		list = append(list, Name{Name: "redirect-uri", Opt: v})
+	}
+
+	if len(app.Cmd.Args) == 3 {
+		if app.Cmd.Args[2] != "public" {
+			return errors.New("Invalid client type: " + app.Cmd.Args[2])
+		}
+
+		list = append(list, Name{Name: "public", Opt: "true"})
+	}
+
+	var d, _ = json.Marshal(&NameList{Entry: list})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	var m *NameList
+
+	if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+		return
+	}
+
+	if m.Entry[0].Opt == "" {
+		event("Public client created:\n"+
+			"------------------------------\n"+
+			"Client ID: %v\n", m.Entry[0].Name)
+		return
+	}
+
+	event("Client created, the secret will not be shown again:\n"+
+		"------------------------------\n"+
+		"Client ID: %v\n"+
+		"Client secret: %v\n", m.Entry[0].Name, m.Entry[0].Opt)
+	return
+}
+
+func listOIDCClient() (err error) {
+	if len(app.Cmd.Args) > 1 {
+		return errors.New("Incorrect number of arguments")
+	}
+
+	var list = []Name{Name{}}
+
+	if len(app.Cmd.Args) == 1 {
+		if list, err = setNameParam(strings.Split(app.Cmd.Args[0],
+			",")); err != nil {
+			return
+		}
+	}
+
+	var d, _ = json.Marshal(&NameList{Entry: list})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	var m *OIDCClientInfoList
+
+	if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+		return
+	}
+
+	for i := range m.Entry {
+		var e = m.Entry[i]
+
+		if e.ErrNo != EOK {
+			event("Client %v not found", e.Id)
+			continue
+		}
+
+		event("Client [%v]:\n"+
+			"------------------------------\n"+
+			"Name: %v\n"+
+			"Redirect URIs: %v\n"+
+			"Public: %v\n"+
+			"Created: %v\n", e.Id, e.Name,
+			strings.Join(e.RedirectUri, ", "), e.Public, e.Created)
+	}
+
+	return
+}
+
+func deleteOIDCClient() (err error) {
+	if len(app.Cmd.Args) != 1 {
+		return errors.New("Incorrect number of arguments")
+	}
+
+	var list []Name
+
+	if list, err = setNameParam(strings.Split(app.Cmd.Args[0],
+		",")); err != nil {
+		return
+	}
+
+	var d, _ = json.Marshal(&NameList{Entry: list})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	var m *NameList
+
+	if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+		return
+	}
+
+	for i := range m.Entry {
+		var e = m.Entry[i]
+
+		if e.ErrNo == EOK {
+			event("Client %v has been deleted", e.Name)
+		} else {
+			event("Client %v not found", e.Name)
+		}
+	}
+
+	return
+}
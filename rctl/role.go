@@ -0,0 +1,163 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+type RoleInfo struct {
+	Name  string
+	Perms []string
+	Uids  []string
+
+	ErrNo int
+}
+
+type RoleInfoList struct {
+	Id    int64
+	Entry []RoleInfo
+}
+
+func listRole() (err error) {
+	if len(app.Cmd.Args) > 1 {
+		return errors.New("Incorrect number of arguments")
+	}
+
+	var list = []Name{Name{}}
+
+	if len(app.Cmd.Args) == 1 {
+		if list, err = setNameParam(strings.Split(app.Cmd.Args[0],
+			",")); err != nil {
+			return
+		}
+	}
+
+	var d, _ = json.Marshal(&NameList{Entry: list})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	var m *RoleInfoList
+
+	if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+		return
+	}
+
+	for i := range m.Entry {
+		var e = m.Entry[i]
+
+		if e.ErrNo != EOK {
+			event("Role %v not found", e.Name)
+			continue
+		}
+
+		event("Role %v:\n"+
+			"------------------------------\n"+
+			"Permissions: %v\n"+
+			"Users: %v\n", e.Name, strings.Join(e.Perms, ","),
+			strings.Join(e.Uids, ","))
+	}
+
+	return
+}
+
+func setRole() (err error) {
+	var cmd = app.Cmd.Command
+	var list []Name
+
+	if cmd == "create-role" {
+		if len(app.Cmd.Args) != 2 {
+			return errors.New("Incorrect number of arguments")
+		}
+
+		list = []Name{Name{Name: app.Cmd.Args[0], Opt: app.Cmd.Args[1]}}
+	} else {
+		if len(app.Cmd.Args) != 1 {
+			return errors.New("Incorrect number of arguments")
+		}
+
+		list = []Name{Name{Name: app.Cmd.Args[0]}}
+	}
+
+	var d, _ = json.Marshal(&NameList{Entry: list})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	var m *NameList
+
+	if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+		return
+	}
+
+	var v = "created"
+
+	if cmd == "delete-role" {
+		v = "deleted"
+	}
+
+	for i := range m.Entry {
+		var e = m.Entry[i]
+
+		if e.ErrNo == EOK {
+			event("Role %v has been %v", e.Name, v)
+		} else {
+			event("Role %v cannot be %v", e.Name, v)
+		}
+	}
+
+	return
+}
+
+func setUserRole() (err error) {
+	if len(app.Cmd.Args) != 2 {
+		return errors.New("Incorrect number of arguments")
+	}
+
+	var uid, _ = strconv.ParseInt(app.Cmd.Args[0], 0, 64)
+	var list = []Id{Id{Id: uid, Opt: app.Cmd.Args[1]}}
+
+	var d, _ = json.Marshal(&IdList{Entry: list})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	var m *IdList
+
+	if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+		return
+	}
+
+	var v = "granted"
+
+	if app.Cmd.Command == "revoke-role" {
+		v = "revoked"
+	}
+
+	for i := range m.Entry {
+		var e = m.Entry[i]
+
+		if e.ErrNo == EOK {
+			event("User [%v] has been %v role %v", e.Id, v, e.Opt)
+		} else {
+			event("User [%v] cannot be %v role %v", e.Id, v, e.Opt)
+		}
+	}
+
+	return
+}
@@ -145,17 +145,24 @@ func setSession() (err error) {
 }
 
 func setSessionOwner() (err error) {
-	if len(app.Cmd.Args) != 1 {
+	if len(app.Cmd.Args) != 2 {
 		return errors.New("Invalid argument format")
 	}
 
+	var owner int64
+
+	if owner, err = strconv.ParseInt(app.Cmd.Args[0], 0, 64); err != nil {
+		return errors.New("Invalid user ID: " + app.Cmd.Args[0])
+	}
+
 	var list []Id
 
-	if list, err = setIdParam([]string{app.Cmd.Args[0]}); err != nil {
+	if list, err = setIdParam([]string{app.Cmd.Args[1]}); err != nil {
 		return
 	}
 
-	var d, _ = json.Marshal(&IdList{Entry: list})
+	// the session owner travels in the payload, -i is the acting admin
+	var d, _ = json.Marshal(&IdList{Id: owner, Entry: list})
 
 	var msg *RebanaMsg
 
@@ -170,7 +177,7 @@ func setSessionOwner() (err error) {
 	}
 
 	var cmd = app.Cmd.Command
-	var uid = fmt.Sprintf("%v", app.Cmd.UserId)
+	var uid = fmt.Sprintf("%v", owner)
 
 	var n, u []string
 
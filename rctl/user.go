@@ -5,19 +5,18 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
+	"io/ioutil"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 )
 
 type UserInfo struct {
-	Id         string
+	Id         int64
 	Name       string
 	Login      string
 	Password   string
@@ -31,8 +30,56 @@ type UserInfo struct {
 }
 
 type UserInfoList struct {
-	Id    int
-	Entry []UserInfo
+	Id     int
+	Entry  []UserInfo
+	Cursor string
+}
+
+type UserQuery struct {
+	List   string
+	Filter []UserFilter
+	Sort   []UserSort
+	Limit  int64
+	Cursor string
+}
+
+type UserFilter struct {
+	Field string
+	Op    string
+	Value string
+}
+
+type UserSort struct {
+	Field string
+	Desc  bool
+}
+
+type UserEventList struct {
+	Id     int
+	Entry  []Name
+	Cursor string
+}
+
+type LoginSessionInfo struct {
+	Id          string
+	Uid         string
+	AccessToken string
+	Expire      string
+
+	Origin       string
+	Client       string
+	Created      string
+	LastSeen     string
+	Impersonator string
+
+	Admin   bool
+	Current bool
+	TTL     int64
+}
+
+type LoginSessionInfoList struct {
+	Id    int64
+	Entry []LoginSessionInfo
 }
 
 func resolveUserLogin() (err error) {
@@ -294,6 +341,8 @@ func setUserStatus() (err error) {
 		v = "activated"
 	} else if app.Cmd.Command == "deactivate-user" {
 		v = "deactivated"
+	} else if app.Cmd.Command == "unlock-user" {
+		v = "unlocked"
 	}
 
 	var n []string
@@ -315,8 +364,48 @@ func setUserStatus() (err error) {
 	return
 }
 
+// setUserQuery builds a list query from [list] [filters] [sorts] [entries]
+// [cursor], where filters are field:op:value and sorts are field or
+// field-r, either may be - for none
+func setUserQuery(args []string) (q *UserQuery, err error) {
+	q = &UserQuery{List: args[0]}
+
+	if len(args) > 1 && args[1] != "-" {
+		for _, v := range strings.Split(args[1], ",") {
+			var f = strings.SplitN(v, ":", 3)
+
+			if len(f) != 3 {
+				return nil, errors.New("Invalid filter format: " + v)
+			}
+
+			q.Filter = append(q.Filter, UserFilter{Field: f[0], Op: f[1],
+				Value: f[2]})
+		}
+	}
+
+	if len(args) > 2 && args[2] != "-" {
+		for _, v := range strings.Split(args[2], ",") {
+			q.Sort = append(q.Sort, UserSort{
+				Field: strings.TrimSuffix(v, "-r"),
+				Desc:  strings.HasSuffix(v, "-r")})
+		}
+	}
+
+	if len(args) > 3 {
+		if q.Limit, err = strconv.ParseInt(args[3], 0, 64); err != nil {
+			return nil, errors.New("Invalid entry count: " + args[3])
+		}
+	}
+
+	if len(args) > 4 {
+		q.Cursor = args[4]
+	}
+
+	return
+}
+
 func listUser() (err error) {
-	if len(app.Cmd.Args) != 1 {
+	if len(app.Cmd.Args) < 1 || len(app.Cmd.Args) > 5 {
 		return errors.New("Incorrect number of arguments")
 	}
 
@@ -324,22 +413,24 @@ func listUser() (err error) {
 
 	var args = strings.Split(app.Cmd.Args[0], ",")
 
-	if len(args) == 1 {
-		var a = strings.Split(args[0], ":")
-
-		if len(a) == 5 {
-			var opt = fmt.Sprintf("%v:%v:%v:%v", a[1], a[2], a[3], a[4])
-
-			list = []Id{Id{Opt: opt}}
-		} else {
-			var id, _ = strconv.ParseInt(args[0], 0, 64)
+	if _, err = strconv.ParseInt(args[0], 0, 64); err == nil {
+		if len(app.Cmd.Args) != 1 {
+			return errors.New("Incorrect number of arguments")
+		}
 
-			list = []Id{Id{Id: id}}
+		if list, err = setIdParam(args); err != nil {
+			return
 		}
 	} else {
-		if list, err = setIdParam(args); err != nil {
+		var q *UserQuery
+
+		if q, err = setUserQuery(app.Cmd.Args); err != nil {
 			return
 		}
+
+		var opt, _ = json.Marshal(q)
+
+		list = []Id{Id{Opt: string(opt)}}
 	}
 
 	var d, _ = json.Marshal(&IdList{Entry: list})
@@ -376,27 +467,36 @@ func listUser() (err error) {
 				e.Login, e.Admin, e.Status, trs, tfs)
 		} else {
 			event("User ID [%v] not found\n"+
-				"---------------------------\n", e.Id)
+				"---------------------------\n", e.Idx)
 		}
 	}
 
+	if m.Cursor != "" {
+		event("Next page cursor: %v", m.Cursor)
+	}
+
 	return
 }
 
 func getUserList() (err error) {
-	if len(app.Cmd.Args) != 1 {
+	if len(app.Cmd.Args) < 2 || len(app.Cmd.Args) > 6 {
 		return errors.New("Incorrect number of arguments")
 	}
 
-	var a = strings.Split(app.Cmd.Args[0], ":")
+	var id int64
 
-        if len(a) != 5 {
-		return errors.New("Invalid argument format")
-        }
+	if id, err = strconv.ParseInt(app.Cmd.Args[0], 0, 64); err != nil {
+		return errors.New("Invalid user ID: " + app.Cmd.Args[0])
+	}
+
+	var q *UserQuery
+
+	if q, err = setUserQuery(app.Cmd.Args[1:]); err != nil {
+		return
+	}
 
-        var opt = fmt.Sprintf("%v:%v:%v:%v", a[1], a[2], a[3], a[4])
-	var id, _ = strconv.ParseInt(a[0], 0, 64)
-	var list = []Id{Id{Id: id, Opt: opt}}
+	var opt, _ = json.Marshal(q)
+	var list = []Id{Id{Id: id, Opt: string(opt)}}
 
 	var d, _ = json.Marshal(&IdList{Entry: list})
 
@@ -406,7 +506,7 @@ func getUserList() (err error) {
 		return
 	}
 
-	var m *NameList
+	var m *UserEventList
 
 	if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
 		return
@@ -416,10 +516,14 @@ func getUserList() (err error) {
 		var e = m.Entry[i]
 
 		if e.ErrNo == EOK {
-			event("%v", e)
+			event("%v", e.Name)
 		}
 	}
 
+	if m.Cursor != "" {
+		event("Next page cursor: %v", m.Cursor)
+	}
+
 	return
 }
 
@@ -434,18 +538,17 @@ func userLogin() (err error) {
 		return errors.New("Incorrect number of arguments")
 	}
 
-	var args = strings.Split(app.Cmd.Args[0], ":")
+	var args = strings.SplitN(app.Cmd.Args[0], ":", 2)
 
-	var h = sha256.New()
-
-	io.WriteString(h, args[1])
-
-	var dgst = base64.StdEncoding.EncodeToString(h.Sum(nil))
+	if len(args) != 2 {
+		return errors.New("Invalid argument format")
+	}
 
-	var list = make([]Name, 2)
+	var list = make([]Name, 3)
 
 	list[0] = Name{Name: "login", Opt: args[0]}
-	list[1] = Name{Name: "password", Opt: dgst}
+	list[1] = Name{Name: "password", Opt: args[1]}
+	list[2] = Name{Name: "client", Opt: APPNAME}
 
 	if admin {
 		list[0].ErrNo = 1
@@ -461,10 +564,39 @@ func userLogin() (err error) {
 
 	var m *IdList
 
-	if err = json.Unmarshal([]byte(msg.Data), m); err != nil {
+	if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
 		return
 	}
 
+	// second factor required, prompt for a TOTP or recovery code
+	if len(m.Entry) == 1 && m.Entry[0].ErrNo == EAGAIN {
+		var code string
+
+		fmt.Fprintf(os.Stderr, "Two-factor code: ")
+
+		if _, err = fmt.Scanln(&code); err != nil {
+			return errors.New("Error reading two-factor code")
+		}
+
+		list = []Name{Name{Name: "challenge", Opt: m.Entry[0].Opt},
+			Name{Name: "code", Opt: code}}
+
+		d, _ = json.Marshal(&NameList{Entry: list})
+
+		app.Cmd.Command = "login-totp"
+
+		if msg, err = sendGhazalRequest(string(d),
+			app.GhazalUrl); err != nil {
+			return
+		}
+
+		m = nil
+
+		if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+			return
+		}
+	}
+
 	var uid = fmt.Sprintf("%v", m.Id)
 
 	var n []string
@@ -473,13 +605,20 @@ func userLogin() (err error) {
 		return
 	}
 
-	for i := range m.Entry {
-		var e = m.Entry[i]
+	var e = m.Entry[0]
 
-		if e.ErrNo == EOK {
-			event("%v has been assigned session key %v", n[i], e.Opt)
-		} else {
-			event("User %v not found", n[i])
+	if e.ErrNo != EOK {
+		event("User %v not found", n[0])
+		return
+	}
+
+	event("%v has been assigned session key %v", n[0], e.Opt)
+
+	// a following aup entry names the AUP version still to be accepted
+	for i := 1; i < len(m.Entry); i++ {
+		if m.Entry[i].Opt == "aup" {
+			event("AUP version %v has not been accepted, see show-aup",
+				m.Entry[i].Id)
 		}
 	}
 
@@ -503,10 +642,39 @@ func userLogout() (err error) {
 
 	var m *IdList
 
-	if err = json.Unmarshal([]byte(msg.Data), m); err != nil {
+	if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
 		return
 	}
 
+	// second factor required, prompt for a TOTP or recovery code
+	if len(m.Entry) == 1 && m.Entry[0].ErrNo == EAGAIN {
+		var code string
+
+		fmt.Fprintf(os.Stderr, "Two-factor code: ")
+
+		if _, err = fmt.Scanln(&code); err != nil {
+			return errors.New("Error reading two-factor code")
+		}
+
+		list = []Name{Name{Name: "challenge", Opt: m.Entry[0].Opt},
+			Name{Name: "code", Opt: code}}
+
+		d, _ = json.Marshal(&NameList{Entry: list})
+
+		app.Cmd.Command = "login-totp"
+
+		if msg, err = sendGhazalRequest(string(d),
+			app.GhazalUrl); err != nil {
+			return
+		}
+
+		m = nil
+
+		if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+			return
+		}
+	}
+
 	var uid = fmt.Sprintf("%v", m.Id)
 
 	var n []string
@@ -527,3 +695,752 @@ func userLogout() (err error) {
 
 	return
 }
+
+func changePassword() (err error) {
+	if len(app.Cmd.Args) != 2 {
+		return errors.New("Incorrect number of arguments")
+	}
+
+	var args = strings.Split(app.Cmd.Args[1], ":")
+
+	if len(args) != 2 {
+		return errors.New("Invalid argument format")
+	}
+
+	var list = make([]Name, 3)
+
+	list[0] = Name{Name: "session-key", Opt: app.Cmd.Args[0]}
+	list[1] = Name{Name: "password", Opt: args[0]}
+	list[2] = Name{Name: "new-password", Opt: args[1]}
+
+	var d, _ = json.Marshal(&NameList{Id: app.Cmd.UserId, Entry: list})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	var m *IdList
+
+	if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+		return
+	}
+
+	var uid = fmt.Sprintf("%v", m.Id)
+
+	var n []string
+
+	if n, err = resolveUserId([]string{uid}); err != nil {
+		return
+	}
+
+	for i := range m.Entry {
+		var e = m.Entry[i]
+
+		if e.ErrNo == EOK {
+			event("%v password has been changed", n[i])
+		} else {
+			event("User %v password cannot be changed", n[i])
+		}
+	}
+
+	return
+}
+
+func requestPasswordReset() (err error) {
+	if len(app.Cmd.Args) != 1 {
+		return errors.New("Incorrect number of arguments")
+	}
+
+	var list = []Name{Name{Name: "login", Opt: app.Cmd.Args[0]}}
+
+	var d, _ = json.Marshal(&NameList{Entry: list})
+
+	if _, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	event("Password reset token sent to %v if the account exists",
+		app.Cmd.Args[0])
+	return
+}
+
+func verifyEmail() (err error) {
+	if len(app.Cmd.Args) != 1 {
+		return errors.New("Incorrect number of arguments")
+	}
+
+	var list = []Name{Name{Name: app.Cmd.Args[0]}}
+
+	var d, _ = json.Marshal(&NameList{Entry: list})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	var m *IdList
+
+	if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+		return
+	}
+
+	event("User %v [%v] email address verified", m.Entry[0].Opt, m.Id)
+	return
+}
+
+func completePasswordReset() (err error) {
+	if len(app.Cmd.Args) != 2 {
+		return errors.New("Incorrect number of arguments")
+	}
+
+	var list = make([]Name, 2)
+
+	list[0] = Name{Name: "reset-token", Opt: app.Cmd.Args[0]}
+	list[1] = Name{Name: "new-password", Opt: app.Cmd.Args[1]}
+
+	var d, _ = json.Marshal(&NameList{Entry: list})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	var m *IdList
+
+	if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+		return
+	}
+
+	event("User [%v] password has been reset", m.Id)
+	return
+}
+
+func validateSession() (err error) {
+	if len(app.Cmd.Args) != 1 {
+		return errors.New("Incorrect number of arguments")
+	}
+
+	var list = []Name{Name{Name: app.Cmd.Args[0]}}
+
+	var d, _ = json.Marshal(&NameList{Entry: list})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	var m *LoginSessionInfo
+
+	if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+		return
+	}
+
+	event("Session information:\n"+
+		"------------------------------\n"+
+		"User ID: %v\n"+
+		"Admin: %v\n"+
+		"Idle expiry: %vs\n"+
+		"Absolute expiry: %v\n", m.Uid, m.Admin, m.TTL, m.Expire)
+
+	if m.Impersonator != "" {
+		event("Impersonated by user [%v]", m.Impersonator)
+	}
+
+	return
+}
+
+func listSessions() (err error) {
+	var list []Name
+	var m *LoginSessionInfoList
+
+	if app.Cmd.Command == "list-login-sessions" {
+		if len(app.Cmd.Args) != 1 {
+			return errors.New("Incorrect number of arguments")
+		}
+
+		var ids []Id
+
+		if ids, err = setIdParam(strings.Split(app.Cmd.Args[0],
+			",")); err != nil {
+			return
+		}
+
+		var d, _ = json.Marshal(&IdList{Entry: ids})
+
+		var msg *GhazalMsg
+
+		if msg, err = sendGhazalRequest(string(d),
+			app.GhazalUrl); err != nil {
+			return
+		}
+
+		if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+			return
+		}
+	} else {
+		if len(app.Cmd.Args) != 1 {
+			return errors.New("Incorrect number of arguments")
+		}
+
+		list = []Name{Name{Name: app.Cmd.Args[0]}}
+
+		var d, _ = json.Marshal(&NameList{Id: app.Cmd.UserId,
+			Entry: list})
+
+		var msg *GhazalMsg
+
+		if msg, err = sendGhazalRequest(string(d),
+			app.GhazalUrl); err != nil {
+			return
+		}
+
+		if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+			return
+		}
+	}
+
+	for i := range m.Entry {
+		var e = m.Entry[i]
+		var c string
+
+		if e.Current {
+			c = " (current)"
+		}
+
+		event("Session [%v]%v:\n"+
+			"------------------------------\n"+
+			"User ID: %v\n"+
+			"Origin: %v\n"+
+			"Client: %v\n"+
+			"Created: %v\n"+
+			"Last seen: %v\n"+
+			"Idle expiry: %vs\n", e.Id, c, e.Uid, e.Origin,
+			e.Client, e.Created, e.LastSeen, e.TTL)
+
+		if e.Impersonator != "" {
+			event("Impersonated by user [%v]\n", e.Impersonator)
+		}
+	}
+
+	return
+}
+
+func impersonateUser() (err error) {
+	if len(app.Cmd.Args) != 2 {
+		return errors.New("Incorrect number of arguments")
+	}
+
+	var uid int64
+
+	if uid, err = strconv.ParseInt(app.Cmd.Args[0], 0, 64); err != nil {
+		return errors.New("Invalid user ID: " + app.Cmd.Args[0])
+	}
+
+	var list = []Id{Id{Id: uid, Opt: app.Cmd.Args[1]}}
+
+	var d, _ = json.Marshal(&IdList{Entry: list})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	var m *IdList
+
+	if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+		return
+	}
+
+	event("Impersonating user [%v], the user has been notified:\n"+
+		"------------------------------\n"+
+		"Session key: %v\n", m.Entry[0].Id, m.Entry[0].Opt)
+	return
+}
+
+func revokeSession() (err error) {
+	var d []byte
+
+	if app.Cmd.Command == "revoke-login-sessions" {
+		if len(app.Cmd.Args) < 1 || len(app.Cmd.Args) > 2 {
+			return errors.New("Incorrect number of arguments")
+		}
+
+		var uid, _ = strconv.ParseInt(app.Cmd.Args[0], 0, 64)
+		var list = []Id{Id{Id: uid}}
+
+		if len(app.Cmd.Args) == 2 {
+			list[0].Opt = app.Cmd.Args[1]
+		}
+
+		d, _ = json.Marshal(&IdList{Entry: list})
+	} else if app.Cmd.Command == "revoke-session" {
+		if len(app.Cmd.Args) != 2 {
+			return errors.New("Incorrect number of arguments")
+		}
+
+		var list = []Name{Name{Name: app.Cmd.Args[0],
+			Opt: app.Cmd.Args[1]}}
+
+		d, _ = json.Marshal(&NameList{Id: app.Cmd.UserId, Entry: list})
+	} else {
+		if len(app.Cmd.Args) != 1 {
+			return errors.New("Incorrect number of arguments")
+		}
+
+		var list = []Name{Name{Name: app.Cmd.Args[0]}}
+
+		d, _ = json.Marshal(&NameList{Id: app.Cmd.UserId, Entry: list})
+	}
+
+	if _, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	event("Session revocation completed")
+	return
+}
+
+func enrollTOTP() (err error) {
+	var list []Name
+
+	switch app.Cmd.Command {
+	case "enroll-totp":
+		if len(app.Cmd.Args) != 1 {
+			return errors.New("Incorrect number of arguments")
+		}
+
+		list = []Name{Name{Name: app.Cmd.Args[0]}}
+
+	case "confirm-totp", "disable-totp":
+		if len(app.Cmd.Args) != 2 {
+			return errors.New("Incorrect number of arguments")
+		}
+
+		list = []Name{Name{Name: app.Cmd.Args[0], Opt: app.Cmd.Args[1]}}
+	}
+
+	var d, _ = json.Marshal(&NameList{Id: app.Cmd.UserId, Entry: list})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	switch app.Cmd.Command {
+	case "enroll-totp":
+		var m *NameList
+
+		if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+			return
+		}
+
+		event("Two-factor enrollment pending:\n"+
+			"------------------------------\n"+
+			"Secret: %v\n"+
+			"URI: %v\n"+
+			"Confirm with confirm-totp before the next login\n",
+			m.Entry[0].Name, m.Entry[0].Opt)
+
+	case "confirm-totp":
+		var m *NameList
+
+		if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+			return
+		}
+
+		var rc = make([]string, len(m.Entry))
+
+		for i := range m.Entry {
+			rc[i] = m.Entry[i].Name
+		}
+
+		event("Two-factor authentication enabled for user [%v]\n"+
+			"Recovery codes (each usable once):\n%v\n", m.Id,
+			strings.Join(rc, "\n"))
+
+	case "disable-totp":
+		event("Two-factor authentication disabled for user [%v]",
+			app.Cmd.UserId)
+	}
+
+	return
+}
+
+type ApiKeyInfo struct {
+	Id       string
+	Uid      string
+	Name     string
+	Scope    string
+	Created  string
+	Expire   string
+	LastUsed string
+}
+
+type ApiKeyInfoList struct {
+	Id    int64
+	Entry []ApiKeyInfo
+}
+
+func setApiKey() (err error) {
+	var cmd = app.Cmd.Command
+	var list []Name
+
+	switch cmd {
+	case "create-api-key":
+		if len(app.Cmd.Args) < 3 || len(app.Cmd.Args) > 4 {
+			return errors.New("Incorrect number of arguments")
+		}
+
+		list = []Name{Name{Name: "session-key", Opt: app.Cmd.Args[0]},
+			Name{Name: "name", Opt: app.Cmd.Args[1]},
+			Name{Name: "scope", Opt: app.Cmd.Args[2]}}
+
+		if len(app.Cmd.Args) == 4 {
+			list = append(list, Name{Name: "expire",
+				Opt: app.Cmd.Args[3]})
+		}
+
+	case "list-api-keys":
+		if len(app.Cmd.Args) != 1 {
+			return errors.New("Incorrect number of arguments")
+		}
+
+		list = []Name{Name{Name: app.Cmd.Args[0]}}
+
+	case "revoke-api-key":
+		if len(app.Cmd.Args) != 2 {
+			return errors.New("Incorrect number of arguments")
+		}
+
+		list = []Name{Name{Name: app.Cmd.Args[0], Opt: app.Cmd.Args[1]}}
+	}
+
+	var d, _ = json.Marshal(&NameList{Id: app.Cmd.UserId, Entry: list})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	switch cmd {
+	case "create-api-key":
+		var m *NameList
+
+		if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+			return
+		}
+
+		event("API key created, it will not be shown again:\n"+
+			"------------------------------\n"+
+			"Key ID: %v\n"+
+			"Key: %v\n", m.Entry[0].Name, m.Entry[0].Opt)
+
+	case "list-api-keys":
+		var m *ApiKeyInfoList
+
+		if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+			return
+		}
+
+		for i := range m.Entry {
+			var e = m.Entry[i]
+
+			event("API key [%v]:\n"+
+				"------------------------------\n"+
+				"Name: %v\n"+
+				"Scope: %v\n"+
+				"Created: %v\n"+
+				"Expire: %v\n"+
+				"Last used: %v\n", e.Id, e.Name, e.Scope,
+				e.Created, e.Expire, e.LastUsed)
+		}
+
+	case "revoke-api-key":
+		event("API key %v has been revoked", app.Cmd.Args[1])
+	}
+
+	return
+}
+
+func deleteUser() (err error) {
+	if len(app.Cmd.Args) < 1 || len(app.Cmd.Args) > 2 {
+		return errors.New("Incorrect number of arguments")
+	}
+
+	var args = strings.Split(app.Cmd.Args[0], ",")
+
+	var list []Id
+
+	if list, err = setIdParam(args); err != nil {
+		return
+	}
+
+	if len(app.Cmd.Args) == 2 {
+		if app.Cmd.Args[1] != "force" {
+			return errors.New("Invalid option: " + app.Cmd.Args[1])
+		}
+
+		for i := range list {
+			list[i].Opt = "force"
+		}
+	}
+
+	var d, _ = json.Marshal(&IdList{Entry: list})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	var m *IdList
+
+	if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+		return
+	}
+
+	for i := range m.Entry {
+		var e = m.Entry[i]
+
+		switch e.ErrNo {
+		case EOK:
+			event("User ID %v has been deleted", e.Id)
+		case EAGAIN:
+			event("User ID %v still owns tunnel sessions", e.Id)
+		case ENOENT:
+			event("User ID %v does not exist", e.Id)
+		default:
+			event("User ID %v could not be deleted", e.Id)
+		}
+	}
+
+	return
+}
+
+func exportUserData() (err error) {
+	if len(app.Cmd.Args) != 1 {
+		return errors.New("Incorrect number of arguments")
+	}
+
+	var args = strings.Split(app.Cmd.Args[0], ",")
+
+	var list []Id
+
+	if list, err = setIdParam(args); err != nil {
+		return
+	}
+
+	var d, _ = json.Marshal(&IdList{Entry: list})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	// the export is passed through as is so it can be redirected to a file
+	fmt.Println(msg.Data)
+	return
+}
+
+func searchUser() (err error) {
+	if len(app.Cmd.Args) > 1 {
+		return errors.New("Incorrect number of arguments")
+	}
+
+	// no filter lists every user
+	var list = []Name{Name{}}
+
+	if len(app.Cmd.Args) == 1 {
+		var args = strings.Split(app.Cmd.Args[0], ",")
+
+		if list, err = setNameArgParam(args); err != nil {
+			return
+		}
+	}
+
+	var d, _ = json.Marshal(&NameList{Entry: list})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	var m *UserInfoList
+
+	if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+		return
+	}
+
+	event("%v users matched, showing %v\n", m.Id, len(m.Entry))
+
+	for i := range m.Entry {
+		var e = m.Entry[i]
+
+		event("User ID [%v]: %v <%v>, %v, %v, registered %v", e.Id,
+			e.Name, e.Login, e.Admin, e.Status, e.Registered)
+	}
+
+	return
+}
+
+type ImportInfo struct {
+	Line  int
+	Id    int64
+	Login string
+	Name  string
+
+	ErrNo int
+	Error string
+}
+
+type ImportInfoList struct {
+	Id    int64
+	Entry []ImportInfo
+}
+
+func importUsers() (err error) {
+	if len(app.Cmd.Args) < 1 || len(app.Cmd.Args) > 2 {
+		return errors.New("Incorrect number of arguments")
+	}
+
+	var f = app.Cmd.Args[0]
+	var format = "jsonl"
+
+	if strings.HasSuffix(f, ".csv") {
+		format = "csv"
+	}
+
+	var buf []byte
+
+	if buf, err = ioutil.ReadFile(f); err != nil {
+		return
+	}
+
+	var list = []Name{Name{Name: "format", Opt: format},
+		Name{Name: "data", Opt: string(buf)}}
+
+	if len(app.Cmd.Args) == 2 {
+		var args = strings.Split(app.Cmd.Args[1], ",")
+
+		for i := range args {
+			if args[i] != "dry-run" && args[i] != "welcome" {
+				return errors.New("Invalid option: " + args[i])
+			}
+
+			list = append(list, Name{Name: args[i], Opt: "true"})
+		}
+	}
+
+	var d, _ = json.Marshal(&NameList{Entry: list})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	var m *ImportInfoList
+
+	if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+		return
+	}
+
+	for i := range m.Entry {
+		var e = m.Entry[i]
+
+		if e.ErrNo == EOK && e.Id == 0 {
+			event("Line %v: %v is valid", e.Line, e.Login)
+		} else if e.ErrNo == EOK {
+			event("Line %v: %v created as user ID %v", e.Line, e.Login,
+				e.Id)
+		} else {
+			event("Line %v: %v rejected, %v", e.Line, e.Login, e.Error)
+		}
+	}
+
+	event("%v of %v users created", m.Id, len(m.Entry))
+	return
+}
+
+func exportUsers() (err error) {
+	if len(app.Cmd.Args) != 3 {
+		return errors.New("Incorrect number of arguments")
+	}
+
+	var list = []Name{Name{Name: "list", Opt: app.Cmd.Args[0]},
+		Name{Name: "format", Opt: app.Cmd.Args[1]}}
+
+	var d, _ = json.Marshal(&NameList{Entry: list})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	var m *NameList
+
+	if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+		return
+	}
+
+	if err = ioutil.WriteFile(app.Cmd.Args[2], []byte(m.Entry[0].Opt),
+		0600); err != nil {
+		return
+	}
+
+	event("%v users exported to %v", m.Id, app.Cmd.Args[2])
+	return
+}
+
+func renderTemplate() (err error) {
+	if len(app.Cmd.Args) != 1 {
+		return errors.New("Incorrect number of arguments")
+	}
+
+	var list []Name
+
+	var args = strings.Split(app.Cmd.Args[0], ",")
+
+	if list, err = setNameArgParam(args); err != nil {
+		return
+	}
+
+	var d, _ = json.Marshal(&NameList{Entry: list})
+
+	var msg *GhazalMsg
+
+	if msg, err = sendGhazalRequest(string(d), app.GhazalUrl); err != nil {
+		return
+	}
+
+	var m *NameList
+
+	if err = json.Unmarshal([]byte(msg.Data), &m); err != nil {
+		return
+	}
+
+	for i := range m.Entry {
+		var e = m.Entry[i]
+
+		if e.Opt == "" {
+			continue
+		}
+
+		event("%v:\n"+
+			"------------------------------\n"+
+			"%v\n", e.Name, e.Opt)
+	}
+
+	return
+}
@@ -7,17 +7,21 @@ package main
 import (
 	"bytes"
 	"crypto/hmac"
+	crand "crypto/rand"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -27,6 +31,7 @@ type RebanaRequest struct {
 	UserId  int64
 	Command string
 	Data    string
+	Nonce   string
 }
 
 type RebanaMsg struct {
@@ -42,6 +47,7 @@ type GhazalRequest struct {
 	Origin  string
 	Command string
 	Data    string
+	Nonce   string
 }
 
 type GhazalMsg struct {
@@ -103,12 +109,44 @@ func setTLSConfig() (t *tls.Config, err error) {
 	}
 
 	t = &tls.Config{RootCAs: opts.Roots}
+
+	if app.TLSCert != "" {
+		var c tls.Certificate
+
+		if c, err = tls.LoadX509KeyPair(app.TLSCert,
+			app.TLSKey); err != nil {
+			return
+		}
+
+		t.Certificates = []tls.Certificate{c}
+	}
+
 	return
 }
 
+// newNonce returns a request nonce for a request dated t, the receiving
+// service rejects a nonce it has already seen
+func newNonce(t time.Time) (n string, err error) {
+	var p = make([]byte, 12)
+
+	if _, err = crand.Read(p); err != nil {
+		return
+	}
+
+	return fmt.Sprintf("%v.%v", t.Unix(),
+		base64.URLEncoding.EncodeToString(p)), nil
+}
+
 func sendRebanaRequest(s, url string) (d *RebanaMsg, err error) {
+	var now = time.Now()
+	var nonce string
+
+	if nonce, err = newNonce(now); err != nil {
+		return
+	}
+
 	var m = &RebanaRequest{UserId: app.Cmd.UserId, Command: app.Cmd.Command,
-		Data: s}
+		Data: s, Nonce: nonce}
 	var buf, _ = json.Marshal(m)
 
 	var req *http.Request
@@ -119,11 +157,19 @@ func sendRebanaRequest(s, url string) (d *RebanaMsg, err error) {
 
 	var loc, _ = time.LoadLocation("Etc/GMT")
 
-	req.Header.Add("Date", time.Now().In(loc).Format(time.RFC1123))
+	req.Header.Add("Date", now.In(loc).Format(time.RFC1123))
 	req.Header.Add("Accept", "application/json")
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("X-N3-Service-Name", "rebana")
-	req.Header.Add("X-N3-Signature", signRequest(buf))
+	req.Header.Add("X-N3-Caller", "rctl")
+
+	if app.ApiKeyId != "" {
+		req.Header.Add("X-N3-Api-Key", app.ApiKeyId)
+	} else if app.KeyId != "" {
+		req.Header.Add("X-N3-Key-Id", app.KeyId)
+	}
+
+	req.Header.Add("X-N3-Signature", signRequest(req, buf))
 
 	dumpRequest(req)
 
@@ -154,6 +200,17 @@ func sendRebanaRequest(s, url string) (d *RebanaMsg, err error) {
 		return
 	}
 
+	if d.ErrNo == EREPLAY {
+		err = errors.New("Request rejected as a replay, please retry")
+		return
+	}
+
+	if d.ErrNo == EAUP {
+		err = errors.New("The latest AUP has not been accepted, " +
+			"accept it with -s ghazal -c accept-aup")
+		return
+	}
+
 	if d.ErrNo != EOK {
 		err = errors.New(d.Data)
 		return
@@ -163,8 +220,15 @@ func sendRebanaRequest(s, url string) (d *RebanaMsg, err error) {
 }
 
 func sendGhazalRequest(s, url string) (d *GhazalMsg, err error) {
+	var now = time.Now()
+	var nonce string
+
+	if nonce, err = newNonce(now); err != nil {
+		return
+	}
+
 	var m = &GhazalRequest{UserId: app.Cmd.UserId, Origin: "localhost",
-		Command: app.Cmd.Command, Data: s}
+		Command: app.Cmd.Command, Data: s, Nonce: nonce}
 
 	var buf, _ = json.Marshal(m)
 
@@ -176,11 +240,19 @@ func sendGhazalRequest(s, url string) (d *GhazalMsg, err error) {
 
 	var loc, _ = time.LoadLocation("Etc/GMT")
 
-	req.Header.Add("Date", time.Now().In(loc).Format(time.RFC1123))
+	req.Header.Add("Date", now.In(loc).Format(time.RFC1123))
 	req.Header.Add("Accept", "application/json")
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("X-N3-Service-Name", "ghazal")
-	req.Header.Add("X-N3-Signature", signRequest(buf))
+	req.Header.Add("X-N3-Caller", "rctl")
+
+	if app.ApiKeyId != "" {
+		req.Header.Add("X-N3-Api-Key", app.ApiKeyId)
+	} else if app.KeyId != "" {
+		req.Header.Add("X-N3-Key-Id", app.KeyId)
+	}
+
+	req.Header.Add("X-N3-Signature", signRequest(req, buf))
 
 	dumpRequest(req)
 
@@ -211,6 +283,16 @@ func sendGhazalRequest(s, url string) (d *GhazalMsg, err error) {
 		return
 	}
 
+	if d.ErrNo == EPOLICY {
+		err = getPolicyError(d.Data)
+		return
+	}
+
+	if d.ErrNo == EREPLAY {
+		err = errors.New("Request rejected as a replay, please retry")
+		return
+	}
+
 	if d.ErrNo != EOK {
 		err = errors.New(d.Data)
 		return
@@ -219,12 +301,61 @@ func sendGhazalRequest(s, url string) (d *GhazalMsg, err error) {
 	return
 }
 
-func signRequest(m []byte) (s string) {
+// getPolicyError turns the password policy rules ghazal rejected a password
+// for into an error listing each rule
+func getPolicyError(s string) error {
+	var m *NameList
+
+	if err := json.Unmarshal([]byte(s), &m); err != nil {
+		return errors.New("Invalid password policy response")
+	}
+
+	var str = "Password rejected by policy:"
+
+	for _, v := range m.Entry {
+		str += "\n  " + v.Name + ": " + v.Opt
+	}
+
+	return errors.New(str)
+}
+
+// signRequest returns the canonical signature of the method, path, signed
+// headers and body digest of req, every other header has to be set first
+func signRequest(req *http.Request, m []byte) (s string) {
+	var l = []string{"content-type", "date"}
+
+	for k := range req.Header {
+		k = strings.ToLower(k)
+
+		if strings.HasPrefix(k, "x-n3-") && k != "x-n3-signature" {
+			l = append(l, k)
+		}
+	}
+
+	sort.Strings(l)
+
+	var b = sha256.Sum256(m)
+	var c = req.Method + "\n" + req.URL.Path + "\n" +
+		req.URL.RawQuery + "\n"
+
+	for _, k := range l {
+		var v = req.Header[http.CanonicalHeaderKey(k)]
+
+		c += k + ":" + strings.TrimSpace(strings.Join(v, ",")) + "\n"
+	}
+
+	c += "\n" + strings.Join(l, ";") + "\n" + hex.EncodeToString(b[:])
+
+	var d = sha256.Sum256([]byte(c))
+	var str = SIGALG + "\n" + req.Header.Get("Date") + "\n" +
+		hex.EncodeToString(d[:])
 	var dgst = hmac.New(sha256.New, []byte(app.Key))
 
-	dgst.Write(m)
+	dgst.Write([]byte(str))
 
-	return base64.StdEncoding.EncodeToString(dgst.Sum(nil))
+	return fmt.Sprintf("%v SignedHeaders=%v,Signature=%v", SIGALG,
+		strings.Join(l, ";"),
+		base64.StdEncoding.EncodeToString(dgst.Sum(nil)))
 }
 
 func checkSignature(sig string, m []byte) (err error) {
@@ -13,23 +13,56 @@ import (
 	"strings"
 )
 
-func formLogin(w http.ResponseWriter, r *http.Request) (err error) {
+func formLogin(w http.ResponseWriter, li *LogInfo,
+	r *http.Request) (err error) {
 	login := r.FormValue("login")
 	passwd := r.FormValue("password")
 
 	var idl *IdList
 
-	if idl, err = userLogin(login, passwd); err != nil {
-		redirectLogin(w, r, "Incorrect login information", "", err)
+	client := fmt.Sprintf("%v (%v)", APPNAME, r.UserAgent())
+
+	if idl, err = userLogin(li, login, passwd, client); err != nil {
+		redirectLogin(w, li, r, "Incorrect login information", "", err)
 		return
 	}
 
 	e := idl.Entry[0]
 
+	// second factor required, ask for the code against the challenge
+	if e.ErrNo == EAGAIN {
+		v := &RenderVar{Title: "Rebung.IO Control Panel"}
+		v.Data = map[string]string{"challenge": e.Opt}
+
+		return render(w, v, "login-totp")
+	}
+
+	return setLoginSession(w, li, r, e)
+}
+
+func formLoginTOTP(w http.ResponseWriter, li *LogInfo,
+	r *http.Request) (err error) {
+	chal := r.FormValue("challenge")
+	code := r.FormValue("code")
+
+	var idl *IdList
+
+	if idl, err = userLoginTOTP(li, chal, code); err != nil {
+		redirectLogin(w, li, r, "Incorrect two-factor code", "", err)
+		return
+	}
+
+	return setLoginSession(w, li, r, idl.Entry[0])
+}
+
+func setLoginSession(w http.ResponseWriter, li *LogInfo, r *http.Request,
+	e Id) (err error) {
+
 	var uil *UserInfoList
 
-	if uil, err = listUser(e.Id, []int64{e.Id}, ""); err != nil {
-		redirectLogin(w, r, "Error retrieving user information", "", err)
+	if uil, err = listUser(li, e.Id, []int64{e.Id}, ""); err != nil {
+		redirectLogin(w, li, r, "Error retrieving user information", "",
+			err)
 		return
 	}
 
@@ -42,22 +75,23 @@ func formLogin(w http.ResponseWriter, r *http.Request) (err error) {
 		event(logwarn, li, err.Error())
 	}
 
-	redirectUrl(w, r, s, "/home", "You are logged in as "+u.Login, nil)
+	redirectUrl(w, li, r, s, "/home", "You are logged in as "+u.Login, nil)
 	return
 }
 
-func formSearch(w http.ResponseWriter, r *http.Request) (err error) {
+func formSearch(w http.ResponseWriter, li *LogInfo,
+	r *http.Request) (err error) {
 	var s *Session
 
 	if s, err = getSession(r); err != nil {
-		redirectLogin(w, r, "URL access is restricted", "", err)
+		redirectLogin(w, li, r, "URL access is restricted", "", err)
 		return
 	}
 
 	uid, _ := strconv.ParseInt(r.FormValue("uid"), 0, 64)
 
 	if s.UserId != uid {
-		redirectUrl(w, r, s, "/home", "Invalid search parameter",
+		redirectUrl(w, li, r, s, "/home", "Invalid search parameter",
 			errors.New("Mismatched user ID"))
 		return
 	}
@@ -75,17 +109,18 @@ func formSearch(w http.ResponseWriter, r *http.Request) (err error) {
 	v := url.Values{}
 
 	if user {
-		if id, err = resolveUserLogin(s.UserId, query); err != nil || id == 0 {
-			redirectUrl(w, r, s, "/home", "User ["+query+
+		if id, err = resolveUserLogin(li, s.UserId,
+			query); err != nil || id == 0 {
+			redirectUrl(w, li, r, s, "/home", "User ["+query+
 				"] not found", err)
 			return
 		}
 
 		v.Set("uid", fmt.Sprintf("%v", id))
 	} else {
-		if id, err = resolveServerName(s.UserId, query); err != nil ||
-			id == 0 {
-			redirectUrl(w, r, s, "/home", "Server ["+query+
+		if id, err = resolveServerName(li, s.UserId,
+			query); err != nil || id == 0 {
+			redirectUrl(w, li, r, s, "/home", "Server ["+query+
 				"] not found", err)
 			return
 		}
@@ -93,22 +128,23 @@ func formSearch(w http.ResponseWriter, r *http.Request) (err error) {
 		v.Set("vid", fmt.Sprintf("%v", id))
 	}
 
-	redirectUrl(w, r, s, "/list?"+v.Encode(), "", nil)
+	redirectUrl(w, li, r, s, "/list?"+v.Encode(), "", nil)
 	return
 }
 
-func formAddServer(w http.ResponseWriter, r *http.Request) (err error) {
+func formAddServer(w http.ResponseWriter, li *LogInfo,
+	r *http.Request) (err error) {
 	var s *Session
 
 	if s, err = getSession(r); err != nil {
-		redirectLogin(w, r, "URL access is restricted", "", err)
+		redirectLogin(w, li, r, "URL access is restricted", "", err)
 		return
 	}
 
 	uid, _ := strconv.ParseInt(r.FormValue("uid"), 0, 64)
 
 	if s.UserId != uid {
-		redirectUrl(w, r, s, "/home", "Invalid request parameter",
+		redirectUrl(w, li, r, s, "/home", "Invalid request parameter",
 			errors.New("Mismatched user ID"))
 		return
 	}
@@ -118,35 +154,37 @@ func formAddServer(w http.ResponseWriter, r *http.Request) (err error) {
 	rt := r.FormValue("rtprefix")
 
 	if name == "" || pp == "" || rt == "" {
-		redirectUrl(w, r, s, "/home", "Invalid request parameter", err)
+		redirectUrl(w, li, r, s, "/home", "Invalid request parameter",
+			err)
 		return
 	}
 
 	var idl *IdList
 
-	if idl, err = addServer(s.UserId, name, pp, rt); err != nil {
-		redirectUrl(w, r, s, "/home", "Unable to add tunnel server "+
-			name, err)
+	if idl, err = addServer(li, s.UserId, name, pp, rt); err != nil {
+		redirectUrl(w, li, r, s, "/home",
+			"Unable to add tunnel server "+name, err)
 		return
 	}
 
-	redirectUrl(w, r, s, "/home", fmt.Sprintf("Server %v[%v] successfully "+
-		"added", idl.Entry[0].Opt, idl.Entry[0].Id), nil)
+	redirectUrl(w, li, r, s, "/home", fmt.Sprintf("Server %v[%v] "+
+		"successfully added", idl.Entry[0].Opt, idl.Entry[0].Id), nil)
 	return
 }
 
-func formAddUser(w http.ResponseWriter, r *http.Request) (err error) {
+func formAddUser(w http.ResponseWriter, li *LogInfo,
+	r *http.Request) (err error) {
 	var s *Session
 
 	if s, err = getSession(r); err != nil {
-		redirectLogin(w, r, "URL access is restricted", "", err)
+		redirectLogin(w, li, r, "URL access is restricted", "", err)
 		return
 	}
 
 	uid, _ := strconv.ParseInt(r.FormValue("uid"), 0, 64)
 
 	if s.UserId != uid {
-		redirectUrl(w, r, s, "/home", "Invalid request parameter",
+		redirectUrl(w, li, r, s, "/home", "Invalid request parameter",
 			errors.New("Mismatched user ID"))
 		return
 	}
@@ -155,34 +193,38 @@ func formAddUser(w http.ResponseWriter, r *http.Request) (err error) {
 	name := r.FormValue("name")
 
 	if login == "" || name == "" {
-		redirectUrl(w, r, s, "/home", "Invalid request parameter", err)
+		redirectUrl(w, li, r, s, "/home", "Invalid request parameter",
+			err)
 		return
 	}
 
 	var idl *IdList
 
-	if idl, err = addUser(s.UserId, login, name, li.Src); err != nil {
-		redirectUrl(w, r, s, "/home", "Unable to add user "+login, err)
+	if idl, err = addUser(li, s.UserId, login, name, li.Src); err != nil {
+		redirectUrl(w, li, r, s, "/home", "Unable to add user "+login,
+			err)
 		return
 	}
 
-	redirectUrl(w, r, s, "/home", fmt.Sprintf("User %v[%v] successfully "+
-		"added", idl.Entry[0].Opt, idl.Entry[0].Id), nil)
+	redirectUrl(w, li, r, s, "/home", fmt.Sprintf("User %v[%v] "+
+		"successfully added", idl.Entry[0].Opt, idl.Entry[0].Id), nil)
 	return
 }
 
-func formChangeName(w http.ResponseWriter, r *http.Request) (err error) {
+func formChangeName(w http.ResponseWriter, li *LogInfo,
+	r *http.Request) (err error) {
 	var s *Session
 
 	if s, err = getSession(r); err != nil {
-		redirectLogin(w, r, "URL access is restricted", "", err)
+		redirectLogin(w, li, r, "URL access is restricted", "", err)
 		return
 	}
 
 	uid, _ := strconv.ParseInt(r.FormValue("uid"), 0, 64)
 
 	if s.UserId != uid {
-		redirectUrl(w, r, s, "/profile", "Invalid request parameter",
+		redirectUrl(w, li, r, s, "/profile",
+			"Invalid request parameter",
 			errors.New("Mismatched user ID"))
 		return
 	}
@@ -190,7 +232,8 @@ func formChangeName(w http.ResponseWriter, r *http.Request) (err error) {
 	name := r.FormValue("name")
 
 	if name == "" {
-		redirectUrl(w, r, s, "/profile", "Invalid request parameter", err)
+		redirectUrl(w, li, r, s, "/profile",
+			"Invalid request parameter", err)
 		return
 	}
 
@@ -199,50 +242,64 @@ func formChangeName(w http.ResponseWriter, r *http.Request) (err error) {
 	k := []string{"name"}
 	v := []string{name}
 
-	if nl, err = setUserAttr(s.UserId, s.UserId, k, v); err != nil {
-		redirectUrl(w, r, s, "/profile", "Error changing "+s.Username+
-			" name", err)
+	if nl, err = setUserAttr(li, s.UserId, s.UserId, k, v); err != nil {
+		redirectUrl(w, li, r, s, "/profile",
+			"Error changing "+s.Username+" name", err)
 		return
 	}
 
 	setRedisSessionName(s.UserId, nl.Entry[0].Opt)
-	redirectUrl(w, r, s, "/home", s.Username+" name changed", nil)
+	redirectUrl(w, li, r, s, "/home", s.Username+" name changed", nil)
 	return
 }
 
-func formChangePw(w http.ResponseWriter, r *http.Request) (err error) {
+func formChangePw(w http.ResponseWriter, li *LogInfo,
+	r *http.Request) (err error) {
 	var s *Session
 
 	if s, err = getSession(r); err != nil {
-		redirectLogin(w, r, "URL access is restricted", "", err)
+		redirectLogin(w, li, r, "URL access is restricted", "", err)
 		return
 	}
 
 	uid, _ := strconv.ParseInt(r.FormValue("uid"), 0, 64)
 
 	if s.UserId != uid {
-		redirectUrl(w, r, s, "/profile", "Invalid request parameter",
+		redirectUrl(w, li, r, s, "/profile",
+			"Invalid request parameter",
 			errors.New("Mismatched user ID"))
 		return
 	}
 
+	p0 := r.FormValue("pass0")
 	p1 := r.FormValue("pass1")
 	p2 := r.FormValue("pass2")
 
-	if p1 == "" || p2 == "" {
-		redirectUrl(w, r, s, "/profile", "Invalid request parameter", err)
+	if p0 == "" || p1 == "" || p2 == "" {
+		redirectUrl(w, li, r, s, "/profile",
+			"Invalid request parameter", err)
 		return
 	}
 
-	k := []string{"password"}
-	v := []string{p1}
+	if p1 != p2 {
+		redirectUrl(w, li, r, s, "/profile",
+			"New passwords do not match",
+			errors.New("Mismatched new password"))
+		return
+	}
+
+	if _, err = changePassword(li, s.UserId, s.Key, p0, p1); err != nil {
+		str := "Error changing " + s.Username + " password"
+
+		// name every rule the new password failed
+		if pe, ok := err.(*PolicyError); ok {
+			str = "New password rejected: " + pe.Error()
+		}
 
-	if _, err = setUserAttr(s.UserId, s.UserId, k, v); err != nil {
-		redirectUrl(w, r, s, "/profile", "Error changing "+s.Username+
-			" name", err)
+		redirectUrl(w, li, r, s, "/profile", str, err)
 		return
 	}
 
-	redirectUrl(w, r, s, "/home", s.Username+" password changed", nil)
+	redirectUrl(w, li, r, s, "/home", s.Username+" password changed", nil)
 	return
 }
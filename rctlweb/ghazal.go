@@ -7,7 +7,6 @@ package main
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
 	"strings"
 )
@@ -17,6 +16,7 @@ type GhazalRequest struct {
 	Origin  string
 	Command string
 	Data    string
+	Nonce   string
 }
 
 type GhazalMsg struct {
@@ -45,8 +45,34 @@ type UserInfo struct {
 }
 
 type UserInfoList struct {
-	Id    int64
-	Entry []UserInfo
+	Id     int64
+	Entry  []UserInfo
+	Cursor string
+}
+
+type UserQuery struct {
+	List   string
+	Filter []UserFilter
+	Sort   []UserSort
+	Limit  int64
+	Cursor string
+}
+
+type UserFilter struct {
+	Field string
+	Op    string
+	Value string
+}
+
+type UserSort struct {
+	Field string
+	Desc  bool
+}
+
+type UserEventList struct {
+	Id     int64
+	Entry  []Name
+	Cursor string
 }
 
 type UserUidList struct {
@@ -55,18 +81,19 @@ type UserUidList struct {
 	Time   string
 }
 
-func wsResolveUser(w http.ResponseWriter, r *http.Request) (err error) {
+func wsResolveUser(w http.ResponseWriter, li *LogInfo,
+	r *http.Request) (err error) {
 	var d *WSRequest
 	var s *Session
 
-	if s, d, err = wsCheck(w, r, false); err != nil {
+	if s, d, err = wsCheck(w, li, r, false); err != nil {
 		return
 	}
 
 	var uid int64
 
-	if uid, err = resolveUserLogin(s.UserId, d.Data); err != nil {
-		sendWSResponse(w, EINVAL, err.Error())
+	if uid, err = resolveUserLogin(li, s.UserId, d.Data); err != nil {
+		sendWSResponse(w, li, EINVAL, err.Error())
 		return
 	}
 
@@ -75,29 +102,30 @@ func wsResolveUser(w http.ResponseWriter, r *http.Request) (err error) {
 	}{Id: uid}
 
 	buf, _ := json.Marshal(msg)
-	sendWSResponse(w, EOK, string(buf))
+	sendWSResponse(w, li, EOK, string(buf))
 	return
 }
 
-func wsSetUserAttr(w http.ResponseWriter, r *http.Request) (err error) {
+func wsSetUserAttr(w http.ResponseWriter, li *LogInfo,
+	r *http.Request) (err error) {
 	var d *WSRequest
 	var s *Session
 
-	if s, d, err = wsCheck(w, r, false); err != nil {
+	if s, d, err = wsCheck(w, li, r, false); err != nil {
 		return
 	}
 
 	if d.Cmd == "name" {
 	} else {
-		sendWSResponse(w, EINVAL, "Invalid user attribute")
+		sendWSResponse(w, li, EINVAL, "Invalid user attribute")
 		return
 	}
 
 	var nl *NameList
 
-	if nl, err = setUserAttr(s.UserId, d.Uid, []string{d.Cmd},
+	if nl, err = setUserAttr(li, s.UserId, d.Uid, []string{d.Cmd},
 		[]string{d.Data}); err != nil {
-		sendWSResponse(w, EINVAL, err.Error())
+		sendWSResponse(w, li, EINVAL, err.Error())
 		return
 	}
 
@@ -107,29 +135,30 @@ func wsSetUserAttr(w http.ResponseWriter, r *http.Request) (err error) {
 	}{Name: nl.Entry[0].Name, Value: nl.Entry[0].Opt}
 
 	buf, _ := json.Marshal(msg)
-	sendWSResponse(w, EOK, string(buf))
+	sendWSResponse(w, li, EOK, string(buf))
 	return
 }
 
-func wsSetUserStatus(w http.ResponseWriter, r *http.Request) (err error) {
+func wsSetUserStatus(w http.ResponseWriter, li *LogInfo,
+	r *http.Request) (err error) {
 	var d *WSRequest
 	var s *Session
 
-	if s, d, err = wsCheck(w, r, false); err != nil {
+	if s, d, err = wsCheck(w, li, r, false); err != nil {
 		return
 	}
 
 	if d.Cmd == "enable-user" || d.Cmd == "disable-user" ||
 		d.Cmd == "activate-user" || d.Cmd == "deactivate-user" {
 	} else {
-		sendWSResponse(w, EINVAL, "Invalid command")
+		sendWSResponse(w, li, EINVAL, "Invalid command")
 		return
 	}
 
 	var idl *IdList
 
-	if idl, err = setUserStatus(s.UserId, d.Uid, d.Cmd); err != nil {
-		sendWSResponse(w, EINVAL, "Invalid server response")
+	if idl, err = setUserStatus(li, s.UserId, d.Uid, d.Cmd); err != nil {
+		sendWSResponse(w, li, EINVAL, "Invalid server response")
 		return
 	}
 
@@ -138,125 +167,97 @@ func wsSetUserStatus(w http.ResponseWriter, r *http.Request) (err error) {
 	}{Id: idl.Entry[0].Id}
 
 	buf, _ := json.Marshal(msg)
-	sendWSResponse(w, EOK, string(buf))
+	sendWSResponse(w, li, EOK, string(buf))
 	return
 }
 
-func wsResetUserPw(w http.ResponseWriter, r *http.Request) (err error) {
+func wsResetUserPw(w http.ResponseWriter, li *LogInfo,
+	r *http.Request) (err error) {
 	var d *WSRequest
 	var s *Session
 
-	if s, d, err = wsCheck(w, r, false); err != nil {
+	if s, d, err = wsCheck(w, li, r, false); err != nil {
 		return
 	}
 
-	if _, err = resetUserPw(s.UserId, d.Uid); err != nil {
-		sendWSResponse(w, EINVAL, err.Error())
+	if _, err = resetUserPw(li, s.UserId, d.Uid); err != nil {
+		sendWSResponse(w, li, EINVAL, err.Error())
 		return
 	}
 
-	sendWSResponse(w, EOK, "")
+	sendWSResponse(w, li, EOK, "")
 	return
 }
 
-func wsListUser(w http.ResponseWriter, r *http.Request) (err error) {
+func wsListUser(w http.ResponseWriter, li *LogInfo,
+	r *http.Request) (err error) {
 	var d *WSRequest
 	var s *Session
 
-	if s, d, err = wsCheck(w, r, true); err != nil {
+	if s, d, err = wsCheck(w, li, r, true); err != nil {
 		return
 	}
 
-	var list, page, cnt, order, data string
+	var data string
 
+	// a 0 user ID carries a UserQuery, ghazal checks its fields
 	if d.Uid == 0 {
-		args := strings.Split(d.Data, ":")
+		var q *UserQuery
 
-		if c := len(args); c != 4 {
-			sendWSResponse(w, EINVAL, "Invalid list parameter")
+		if json.Unmarshal([]byte(d.Data), &q) != nil || q == nil {
+			sendWSResponse(w, li, EINVAL, "Invalid list query")
 			return
 		}
 
-		if list = args[0]; list == "all" || list == "enabled" ||
-			list == "disabled" || list == "active" ||
-			list == "inactive" || list == "new" || list == "admin" {
-			if page = args[1]; page == "" {
-				sendWSResponse(w, EINVAL, "Invalid list parameter")
-				return
-			}
-
-			if cnt = args[2]; cnt == "" {
-				sendWSResponse(w, EINVAL, "Invalid list parameter")
-				return
-			}
-
-			if order = args[3]; order == "" {
-				sendWSResponse(w, EINVAL, "Invalid list parameter")
-				return
-			}
-
-			data = fmt.Sprintf("%v:%v:%v:%v", list, page, cnt, order)
-		} else {
-			sendWSResponse(w, EINVAL, "Invalid list name")
-			return
-		}
+		buf, _ := json.Marshal(q)
+		data = string(buf)
 	}
 
 	var uil *UserInfoList
 
-	if uil, err = listUser(s.UserId, []int64{d.Uid}, data); err != nil {
-		sendWSResponse(w, EINVAL, err.Error())
+	if uil, err = listUser(li, s.UserId, []int64{d.Uid}, data); err != nil {
+		sendWSResponse(w, li, EINVAL, err.Error())
 		return
 	}
 
 	msg := struct {
-		Total int64
-		Entry []UserInfo
-	}{Total: uil.Id, Entry: uil.Entry}
+		Total  int64
+		Entry  []UserInfo
+		Cursor string
+	}{Total: uil.Id, Entry: uil.Entry, Cursor: uil.Cursor}
 
 	buf, _ := json.Marshal(msg)
-	sendWSResponse(w, EOK, string(buf))
+	sendWSResponse(w, li, EOK, string(buf))
 	return
 }
 
-func wsGetUserList(w http.ResponseWriter, r *http.Request) (err error) {
+func wsGetUserList(w http.ResponseWriter, li *LogInfo,
+	r *http.Request) (err error) {
 	var d *WSRequest
 	var s *Session
 
-	if s, d, err = wsCheck(w, r, false); err != nil {
+	if s, d, err = wsCheck(w, li, r, false); err != nil {
 		return
 	}
 
-	var list, page, cnt, data string
+	var q *UserQuery
 
-	args := strings.Split(d.Data, ":")
-
-	if c := len(args); c != 4 {
-		sendWSResponse(w, EINVAL, "Invalid list parameter")
+	if json.Unmarshal([]byte(d.Data), &q) != nil || q == nil {
+		sendWSResponse(w, li, EINVAL, "Invalid list query")
 		return
 	}
 
-	if list = args[0]; list == "login" || list == "activity" {
-		if page = args[1]; page == "" {
-			sendWSResponse(w, EINVAL, "Invalid list parameter")
-			return
-		}
-
-		if cnt = args[2]; cnt == "" {
-			sendWSResponse(w, EINVAL, "Invalid list parameter")
-			return
-		}
-
-		data = fmt.Sprintf("%v:%v:%v:", list, page, cnt)
-	} else {
-		sendWSResponse(w, EINVAL, "Invalid list name")
+	if q.List != "login" && q.List != "activity" {
+		sendWSResponse(w, li, EINVAL, "Invalid list name")
 		return
 	}
 
-	var nl *NameList
+	buf, _ := json.Marshal(q)
 
-	if nl, err = getUserList(s.UserId, d.Uid, data); err != nil {
-		sendWSResponse(w, EINVAL, err.Error())
+	var nl *UserEventList
+
+	if nl, err = getUserList(li, s.UserId, d.Uid, string(buf)); err != nil {
+		sendWSResponse(w, li, EINVAL, err.Error())
 		return
 	}
 
@@ -268,26 +269,28 @@ func wsGetUserList(w http.ResponseWriter, r *http.Request) (err error) {
 	}
 
 	msg := struct {
-		Total int64
-		Entry []UserUidList
-	}{Total: nl.Id, Entry: ul}
+		Total  int64
+		Entry  []UserUidList
+		Cursor string
+	}{Total: nl.Id, Entry: ul, Cursor: nl.Cursor}
 
-	buf, _ := json.Marshal(msg)
-	sendWSResponse(w, EOK, string(buf))
+	buf, _ = json.Marshal(msg)
+	sendWSResponse(w, li, EOK, string(buf))
 	return
 }
 
-func wsGetUserSessions(w http.ResponseWriter, r *http.Request) (err error) {
+func wsGetUserSessions(w http.ResponseWriter, li *LogInfo,
+	r *http.Request) (err error) {
 	var d *WSRequest
 
-	if _, d, err = wsCheck(w, r, false); err != nil {
+	if _, d, err = wsCheck(w, li, r, false); err != nil {
 		return
 	}
 
 	var usl *UserSessionInfoList
 
-	if usl, err = listUserSession(d.Uid); err != nil {
-		sendWSResponse(w, EINVAL, err.Error())
+	if usl, err = listUserSession(li, d.Uid); err != nil {
+		sendWSResponse(w, li, EINVAL, err.Error())
 		return
 	}
 
@@ -297,11 +300,11 @@ func wsGetUserSessions(w http.ResponseWriter, r *http.Request) (err error) {
 	}{Total: usl.Id, Entry: usl.Entry}
 
 	buf, _ := json.Marshal(msg)
-	sendWSResponse(w, EOK, string(buf))
+	sendWSResponse(w, li, EOK, string(buf))
 	return
 }
 
-func resolveUserLogin(id int64, s string) (uid int64, err error) {
+func resolveUserLogin(li *LogInfo, id int64, s string) (uid int64, err error) {
 	url := app.GhazalUrl + "/s/resolve"
 	cmd := "resolve-user"
 
@@ -314,7 +317,7 @@ func resolveUserLogin(id int64, s string) (uid int64, err error) {
 
 	var res *GhazalMsg
 
-	if res, err = sendGhazalRequest(req); err != nil {
+	if res, err = sendGhazalRequest(li, req); err != nil {
 		return
 	}
 
@@ -333,7 +336,7 @@ func resolveUserLogin(id int64, s string) (uid int64, err error) {
 	return
 }
 
-func addUser(id int64, l, n, ip string) (idl *IdList, err error) {
+func addUser(li *LogInfo, id int64, l, n, ip string) (idl *IdList, err error) {
 	url := app.GhazalUrl + "/s/add"
 	cmd := "add-user"
 
@@ -350,7 +353,7 @@ func addUser(id int64, l, n, ip string) (idl *IdList, err error) {
 
 	var res *GhazalMsg
 
-	if res, err = sendGhazalRequest(req); err != nil {
+	if res, err = sendGhazalRequest(li, req); err != nil {
 		return
 	}
 
@@ -361,7 +364,8 @@ func addUser(id int64, l, n, ip string) (idl *IdList, err error) {
 	return
 }
 
-func setUserAttr(id, uid int64, k, v []string) (nl *NameList, err error) {
+func setUserAttr(li *LogInfo, id, uid int64, k, v []string) (nl *NameList,
+	err error) {
 	url := app.GhazalUrl + "/s/set"
 	cmd := "set-user-attr"
 
@@ -378,7 +382,7 @@ func setUserAttr(id, uid int64, k, v []string) (nl *NameList, err error) {
 
 	var res *GhazalMsg
 
-	if res, err = sendGhazalRequest(req); err != nil {
+	if res, err = sendGhazalRequest(li, req); err != nil {
 		return
 	}
 
@@ -389,7 +393,8 @@ func setUserAttr(id, uid int64, k, v []string) (nl *NameList, err error) {
 	return
 }
 
-func setUserStatus(id, uid int64, cmd string) (idl *IdList, err error) {
+func setUserStatus(li *LogInfo, id, uid int64, cmd string) (idl *IdList,
+	err error) {
 	url := app.GhazalUrl + "/s/set"
 
 	e := []Id{Id{Id: uid}}
@@ -400,7 +405,7 @@ func setUserStatus(id, uid int64, cmd string) (idl *IdList, err error) {
 
 	var res *GhazalMsg
 
-	if res, err = sendGhazalRequest(req); err != nil {
+	if res, err = sendGhazalRequest(li, req); err != nil {
 		return
 	}
 
@@ -411,7 +416,7 @@ func setUserStatus(id, uid int64, cmd string) (idl *IdList, err error) {
 	return
 }
 
-func resetUserPw(id, uid int64) (idl *IdList, err error) {
+func resetUserPw(li *LogInfo, id, uid int64) (idl *IdList, err error) {
 	url := app.GhazalUrl + "/s/reset"
 	cmd := "reset-user-pw"
 
@@ -423,7 +428,7 @@ func resetUserPw(id, uid int64) (idl *IdList, err error) {
 
 	var res *GhazalMsg
 
-	if res, err = sendGhazalRequest(req); err != nil {
+	if res, err = sendGhazalRequest(li, req); err != nil {
 		return
 	}
 
@@ -434,7 +439,8 @@ func resetUserPw(id, uid int64) (idl *IdList, err error) {
 	return
 }
 
-func listUser(id int64, ids []int64, opt string) (uil *UserInfoList, err error) {
+func listUser(li *LogInfo, id int64, ids []int64,
+	opt string) (uil *UserInfoList, err error) {
 	url := app.GhazalUrl + "/s/list"
 	cmd := "list-user"
 
@@ -451,7 +457,7 @@ func listUser(id int64, ids []int64, opt string) (uil *UserInfoList, err error)
 
 	var res *GhazalMsg
 
-	if res, err = sendGhazalRequest(req); err != nil {
+	if res, err = sendGhazalRequest(li, req); err != nil {
 		return
 	}
 
@@ -462,7 +468,8 @@ func listUser(id int64, ids []int64, opt string) (uil *UserInfoList, err error)
 	return
 }
 
-func getUserList(id, uid int64, opt string) (nl *NameList, err error) {
+func getUserList(li *LogInfo, id, uid int64, opt string) (nl *UserEventList,
+	err error) {
 	url := app.GhazalUrl + "/s/list"
 	cmd := "get-user-list"
 
@@ -475,25 +482,77 @@ func getUserList(id, uid int64, opt string) (nl *NameList, err error) {
 
 	var res *GhazalMsg
 
-	if res, err = sendGhazalRequest(req); err != nil {
+	if res, err = sendGhazalRequest(li, req); err != nil {
 		return
 	}
 
-	if nl, err = getNameList(res.Data, cmd); err != nil {
+	if nl, err = getUserEventList(res.Data, cmd); err != nil {
 		return
 	}
 
 	return
 }
 
-func userLogin(login, pw string) (idl *IdList, err error) {
+func userLogin(li *LogInfo, login, pw, client string) (idl *IdList, err error) {
 	url := app.GhazalUrl + "/u/login"
 	cmd := "login"
 
-	e := make([]Name, 2)
+	e := make([]Name, 3)
 
 	e[0] = Name{Name: "login", Opt: login}
 	e[1] = Name{Name: "password", Opt: pw}
+	e[2] = Name{Name: "client", Opt: client}
+
+	buf, _ := json.Marshal(&NameList{Entry: e})
+
+	data := string(buf)
+	req := &RequestOpt{Cmd: cmd, Data: data, Url: url}
+
+	var res *GhazalMsg
+
+	if res, err = sendGhazalRequest(li, req); err != nil {
+		return
+	}
+
+	if idl, err = getIdList(res.Data, cmd); err != nil {
+		return
+	}
+
+	return
+}
+
+func userLoginTOTP(li *LogInfo, chal, code string) (idl *IdList, err error) {
+	url := app.GhazalUrl + "/u/login"
+	cmd := "login-totp"
+
+	e := make([]Name, 2)
+
+	e[0] = Name{Name: "challenge", Opt: chal}
+	e[1] = Name{Name: "code", Opt: code}
+
+	buf, _ := json.Marshal(&NameList{Entry: e})
+
+	data := string(buf)
+	req := &RequestOpt{Cmd: cmd, Data: data, Url: url}
+
+	var res *GhazalMsg
+
+	if res, err = sendGhazalRequest(li, req); err != nil {
+		return
+	}
+
+	if idl, err = getIdList(res.Data, cmd); err != nil {
+		return
+	}
+
+	return
+}
+
+func verifyEmail(li *LogInfo, tok string) (idl *IdList, err error) {
+	url := app.GhazalUrl + "/u/verify"
+	cmd := "verify-email"
+
+	e := []Name{Name{Name: tok}}
 
 	buf, _ := json.Marshal(&NameList{Entry: e})
 
@@ -502,7 +561,7 @@ func userLogin(login, pw string) (idl *IdList, err error) {
 
 	var res *GhazalMsg
 
-	if res, err = sendGhazalRequest(req); err != nil {
+	if res, err = sendGhazalRequest(li, req); err != nil {
 		return
 	}
 
@@ -513,7 +572,8 @@ func userLogin(login, pw string) (idl *IdList, err error) {
 	return
 }
 
-func userLogout(id int64, key, ip string) (idl *IdList, err error) {
+func userLogout(li *LogInfo, id int64, key, ip string) (idl *IdList,
+	err error) {
 	url := app.GhazalUrl + "/u/logout"
 	cmd := "logout"
 
@@ -526,7 +586,36 @@ func userLogout(id int64, key, ip string) (idl *IdList, err error) {
 
 	var res *GhazalMsg
 
-	if res, err = sendGhazalRequest(req); err != nil {
+	if res, err = sendGhazalRequest(li, req); err != nil {
+		return
+	}
+
+	if idl, err = getIdList(res.Data, cmd); err != nil {
+		return
+	}
+
+	return
+}
+
+func changePassword(li *LogInfo, id int64, key, opw, npw string) (idl *IdList,
+	err error) {
+	url := app.GhazalUrl + "/u/set"
+	cmd := "change-password"
+
+	e := make([]Name, 3)
+
+	e[0] = Name{Name: "session-key", Opt: key}
+	e[1] = Name{Name: "password", Opt: opw}
+	e[2] = Name{Name: "new-password", Opt: npw}
+
+	buf, _ := json.Marshal(&NameList{Id: id, Entry: e})
+
+	data := string(buf)
+	req := &RequestOpt{Uid: id, Cmd: cmd, Data: data, Url: url}
+
+	var res *GhazalMsg
+
+	if res, err = sendGhazalRequest(li, req); err != nil {
 		return
 	}
 
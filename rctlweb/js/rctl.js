@@ -51,7 +51,7 @@
 							$(self).addClass('disabled');
 						}
 
-                        getUserUidList('Activity History', 'activity', '1', '10');
+                        getUserUidList('Activity History', 'activity', [''], '10');
 
                         var msg = $form.find('#login').val() + ' is now ' + val;
                         $wrap.append('<div class="notify"><div class="alert alert-success">' + msg + '</div></div>');
@@ -94,7 +94,7 @@
 							$(self).addClass('inactive');
 						}
 
-                        getUserUidList('Activity History', 'activity', '1', '10');
+                        getUserUidList('Activity History', 'activity', [''], '10');
 
                         var msg = $form.find('#login').val() + ' is now ' + val;
                         $wrap.append('<div class="notify"><div class="alert alert-success">' + msg + '</div></div>');
@@ -122,7 +122,7 @@
                     if(data.ErrNo != 0) {
                         $wrap.append('<div class="notify"><div class="alert alert-danger">' + data.Data + '</div></div>');
                     } else {
-                        getUserUidList('Activity History', 'activity', '1', '10');
+                        getUserUidList('Activity History', 'activity', [''], '10');
 
                         var e = JSON.parse(data.Data);
                         var msg = $('#login', $form).val() + ' ' + attr + ' is now ' + e.Value;
@@ -132,12 +132,24 @@
             });
         };
 
-        var getUserList = function (title, list, page, entries, sort) {
-            var opt = list + ':' + page + ':' + entries + ':' + sort;
+        // cursors holds the cursor of every page up to the current one,
+        // an empty one for the first page
+        var getUserList = function (title, list, cursors, entries, sort) {
+            var desc = /-r$/.test(sort);
+            var field = sort.replace(/-r$/, '');
+
+            if (field == 'rdate') {
+                field = 'RegDate';
+            }
+
+            var query = { List: list,
+                Sort: [{ Field: field, Desc: desc }],
+                Limit: parseInt(entries),
+                Cursor: cursors[cursors.length - 1] };
             var param = { Sid: $form.find('#sid').val(),
                 Uid: 0,
                 Cmd: '',
-                Data: opt };
+                Data: JSON.stringify(query) };
 
             $.ajax({
                 type: "POST",
@@ -196,20 +208,22 @@
                                 '<td class="text-center">' + st + '</td></tr>').appendTo($tbl);
                         });
 
-						scrollTable(page, entries, e.Total, $con, function (page) {
-							getUserList(title, list, page, entries, sort)
+						cursorTable(cursors, e.Cursor, e.Total, $con, function (cursors) {
+							getUserList(title, list, cursors, entries, sort)
 						});
                     }
                 }
             });
         };
 
-        var getUserUidList = function (title, list, page, entries, sort) {
-            var opt = list + ':' + page + ':' + entries + ':' + sort;
+        var getUserUidList = function (title, list, cursors, entries) {
+            var query = { List: list,
+                Limit: parseInt(entries),
+                Cursor: cursors[cursors.length - 1] };
 			var	param = { Sid: $form.find('#sid').val(),
                     Uid: parseInt($form.find('#auid').val()),
                     Cmd: '',
-                    Data: opt };
+                    Data: JSON.stringify(query) };
 
             $.ajax({
                 type: "POST",
@@ -251,8 +265,8 @@
                                 '<td>' + v.Time + '</td></tr>').appendTo($tbl);
                         });
 
-						scrollTable(page, entries, e.Total, $con, function (page) {
-							getUserUidList(title, list, page, entries, sort)
+						cursorTable(cursors, e.Cursor, e.Total, $con, function (cursors) {
+							getUserUidList(title, list, cursors, entries)
 						});
                     }
                 }
@@ -883,31 +897,31 @@
         var setMenuList = function (url) {
             // user list
             $('a#all-users', 'li.user-menu').click(function () {
-                url.href = "/list?uid=0&list=all&page=1&cnt=25&order=rdate-r";
+                url.href = "/list?uid=0&list=all&cnt=25&order=rdate-r";
             });
 
             $('a#new-users', 'li.user-menu').click(function () {
-                url.href = "/list?uid=0&list=new&page=1&cnt=25&order=rdate-r";
+                url.href = "/list?uid=0&list=new&cnt=25&order=rdate-r";
             });
 
             $('a#admin-users', 'li.user-menu').click(function () {
-                url.href = "/list?uid=0&list=admin&page=1&cnt=25&order=rdate-r";
+                url.href = "/list?uid=0&list=admin&cnt=25&order=rdate-r";
             });
 
             $('a#enabled-users', 'li.user-menu').click(function () {
-                url.href = "/list?uid=0&list=enabled&page=1&cnt=25&order=rdate-r";
+                url.href = "/list?uid=0&list=enabled&cnt=25&order=rdate-r";
             });
 
             $('a#disabled-users', 'li.user-menu').click(function () {
-                url.href = "/list?uid=0&list=disabled&page=1&cnt=25&order=rdate-r";
+                url.href = "/list?uid=0&list=disabled&cnt=25&order=rdate-r";
             });
 
             $('a#active-users', 'li.user-menu').click(function () {
-                url.href = "/list?uid=0&list=active&page=1&cnt=25&order=rdate-r";
+                url.href = "/list?uid=0&list=active&cnt=25&order=rdate-r";
             });
 
             $('a#inactive-users', 'li.user-menu').click(function () {
-                url.href = "/list?uid=0&list=inactive&page=1&cnt=25&order=rdate-r";
+                url.href = "/list?uid=0&list=inactive&cnt=25&order=rdate-r";
             });
 
             // server list
@@ -945,7 +959,7 @@
 
         case 'home':
             setMenuList(window.location);
-            getUserList('New Users', 'new', '1', '10', 'rdate-r');
+            getUserList('New Users', 'new', [''], '10', 'rdate-r');
             break;
 
         case 'list':
@@ -978,11 +992,11 @@
                     });
 
                     $('a#login-hist', 'li').click(function () {
-                        getUserUidList('Login History', 'login', '1', '10');
+                        getUserUidList('Login History', 'login', [''], '10');
                     });
 
                     $('a#activity-hist', 'li').click(function () {
-                        getUserUidList('Activity History', 'activity', '1', '10');
+                        getUserUidList('Activity History', 'activity', [''], '10');
                     });
 
                     $('a#admin', 'li').click(function () {
@@ -1016,11 +1030,10 @@
                         title = 'Inactive Users'
                     }
 
-                    var page = getParameter('page');
                     var count = getParameter('cnt');
                     var order = getParameter('order');
 
-                    getUserList(title, list, page, count, order);
+                    getUserList(title, list, [''], count, order);
                 }
             }
 
@@ -1159,6 +1172,34 @@
             }
         }
 
+		// cursorTable pages through a cursor paginated list, the previous page
+		// is reloaded from the cursor before the current one
+		var cursorTable = function(cursors, next, count, domScope, callback) {
+			var cpage = cursors.length;
+			$('h3', domScope).append('<span class="label label-info blue"> [page ' + cpage + ', ' + count + ' entries]</span>');
+			if (cpage > 1 || next) {
+				domScope.prepend('<div class="pull-right page-cont"></div>');
+				var container = $('.page-cont', domScope);
+				container.append('<ul class="pagination pagination-sm"><li><a class="prev"><span class="glyphicon glyphicon-chevron-left"></span> Prev</a></li><li><a class="next">Next <span class="glyphicon glyphicon-chevron-right"></span></a></li></ul>');
+				if (cpage > 1) {
+					$('.prev', container).attr('href', '#');
+					$('ul', container).on('click', '.prev', function(e) {
+						e.preventDefault();
+						callback(cursors.slice(0, -1));
+					});
+				} else
+					$('.prev', container).parent().addClass('disabled');
+				if (next) {
+					$('.next', container).attr('href', '#');
+					$('ul', container).on('click', '.next', function(e) {
+						e.preventDefault();
+						callback(cursors.concat([next]));
+					});
+				} else
+					$('.next', container).parent().addClass('disabled');
+			}
+		};
+
 		var scrollTable = function(cpage, npage, TotalRecords, domScope, callback) {
 			var ViewedRecords = cpage * npage,
 				lastPage      = Math.ceil(TotalRecords / npage),
@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// SigningKey is a request signing key of the keyring file, issued with
+// add-signing-key. It is valid from NotBefore until NotAfter, 0 for a key
+// that does not expire.
+type SigningKey struct {
+	Id        string
+	Service   string
+	Secret    string
+	NotBefore int64
+	NotAfter  int64
+}
+
+// keyRing holds the keys of the keyring file, reread whenever it changes so
+// keys can be rotated without a restart
+type keyRing struct {
+	sync.Mutex
+
+	file  string
+	mtime time.Time
+	keys  []SigningKey
+}
+
+var keyring *keyRing
+
+func newKeyRing(f string) *keyRing {
+	return &keyRing{file: f}
+}
+
+// load rereads the keyring file if it changed, the keys already loaded are
+// kept when it cannot be read
+func (kr *keyRing) load() {
+	if kr.file == "" {
+		return
+	}
+
+	fi, err := os.Stat(kr.file)
+
+	if err != nil || fi.ModTime().Equal(kr.mtime) {
+		return
+	}
+
+	var buf []byte
+	var l []SigningKey
+
+	if buf, err = ioutil.ReadFile(kr.file); err == nil {
+		err = json.Unmarshal(buf, &l)
+	}
+
+	if err != nil {
+		event(logwarn, sli, "Unable to load signing keys from %v",
+			kr.file)
+		return
+	}
+
+	kr.keys = l
+	kr.mtime = fi.ModTime()
+
+	event(loginfo, sli, "Loaded %v signing keys from %v", len(l), kr.file)
+}
+
+// getSigningKey picks the most recently valid key for a service, the
+// service secret is used while there is none
+func getSigningKey(svc, secret string) (kid, key string) {
+	keyring.Lock()
+	defer keyring.Unlock()
+
+	keyring.load()
+
+	now := time.Now().Unix()
+
+	var t int64
+
+	for _, k := range keyring.keys {
+		if k.Service != svc || now < k.NotBefore ||
+			(k.NotAfter != 0 && now >= k.NotAfter) ||
+			(kid != "" && k.NotBefore < t) {
+			continue
+		}
+
+		kid, key, t = k.Id, k.Secret, k.NotBefore
+	}
+
+	if kid == "" {
+		return "", secret
+	}
+
+	return
+}
@@ -19,6 +19,8 @@ const (
 	logcrit   string = "critical"
 )
 
+// LogInfo holds the client address of a panel request, mainUrlHandler sets
+// it up and the ghazal and rebana calls log under it
 type LogInfo struct {
 	Src string
 	Uid int64
@@ -38,14 +40,14 @@ type RebungLog struct {
 var (
 	debug bool
 	logfp *os.File
-	li    *LogInfo
 )
 
+// sli is for startup, signals, keyring reloads and Redis reconnects
+var sli = &LogInfo{Src: "::1"}
+
 func setupLog(d bool) (err error) {
 	debug = d
 
-        li = &LogInfo{Src: "::1", Uid: 0}
-
 	if debug {
 		logfp = os.Stderr
 		fmt.Fprintf(logfp, "Debugging enabled - redirect to stderr\n")
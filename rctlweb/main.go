@@ -17,9 +17,20 @@ import (
 	"time"
 )
 
+// BindInfo is a listening address, served over TLS when TLSCert and TLSKey
+// are set. With TLSClientCA only clients holding a certificate issued by
+// that CA are accepted.
 type BindInfo struct {
 	Host string
 	Port string
+
+	TLSCert     string
+	TLSKey      string
+	TLSClientCA string
+
+	// names the client certificates have to be issued to, any client
+	// the CA issued a certificate to may connect when empty
+	TLSClientNames []string
 }
 
 type AppConfig struct {
@@ -37,11 +48,18 @@ type AppConfig struct {
 	GhazalSecret  string
 	RebanaSecret  string
 
+	// JSON list of signing keys, reread whenever it changes
+	KeyFile string
+
 	AppRoot     string
 	TemplateDir string
 
 	TLSCACert []string `json:"TLSCACert"`
 
+	// certificate presented to services that require mutual TLS
+	TLSClientCert string
+	TLSClientKey  string
+
 	RedisUrl string
 	RedisPw  string
 	RedisDb  string
@@ -59,11 +77,17 @@ const (
 	PIDFILE  string = "/var/run/rebung/rctlweb.pid"
 	CONFFILE string = "/usr/local/etc/rebung/rctlweb.json"
 
+	// canonical request signature scheme
+	SIGALG string = "N3-HMAC-SHA256"
+
 	// result codes
-	EOK    int = 0
-	EINVAL int = 1
-	EAGAIN int = 2
-	ENOENT int = 3
+	EOK     int = 0
+	EINVAL  int = 1
+	EAGAIN  int = 2
+	ENOENT  int = 3
+	EPOLICY int = 5
+	EREPLAY int = 6
+	EAUP    int = 7
 
 	// application resources
 	TPLDIR  string = "templates/"
@@ -74,27 +98,30 @@ const (
 
 var app *AppConfig
 
-func urlHome(w http.ResponseWriter, r *http.Request) (err error) {
+func urlHome(w http.ResponseWriter, li *LogInfo, r *http.Request) (err error) {
 	var v *RenderVar
 
-	if _, v, err = urlCheck(w, r, "Rebung.IO Control Panel"); err != nil {
+	if _, v, err = urlCheck(w, li, r,
+		"Rebung.IO Control Panel"); err != nil {
 		return
 	}
 
 	return render(w, v, "home")
 }
 
-func urlProfile(w http.ResponseWriter, r *http.Request) (err error) {
+func urlProfile(w http.ResponseWriter, li *LogInfo,
+	r *http.Request) (err error) {
 	var v *RenderVar
 
-	if _, v, err = urlCheck(w, r, "Rebumg.IO User Settings"); err != nil {
+	if _, v, err = urlCheck(w, li, r,
+		"Rebumg.IO User Settings"); err != nil {
 		return
 	}
 
 	return render(w, v, "profile")
 }
 
-func urlLogin(w http.ResponseWriter, r *http.Request) (err error) {
+func urlLogin(w http.ResponseWriter, li *LogInfo, r *http.Request) (err error) {
 	var s *Session
 
 	if s, err = getSession(r); err != nil {
@@ -127,35 +154,53 @@ func urlLogin(w http.ResponseWriter, r *http.Request) (err error) {
 	return render(w, v, "index")
 }
 
-func urlLogout(w http.ResponseWriter, r *http.Request) (err error) {
+func urlLogout(w http.ResponseWriter, li *LogInfo,
+	r *http.Request) (err error) {
 	var s *Session
 
-	if s, _, err = urlCheck(w, r, ""); err != nil {
+	if s, _, err = urlCheck(w, li, r, ""); err != nil {
 		return
 	}
 
 	var idl *IdList
 
-	if idl, err = userLogout(s.UserId, s.Key, li.Src); err != nil {
-		redirectLogin(w, r, "Error logging out "+s.Username, s.Id, err)
+	if idl, err = userLogout(li, s.UserId, s.Key, li.Src); err != nil {
+		redirectLogin(w, li, r, "Error logging out "+s.Username, s.Id,
+			err)
 		return
 	}
 
 	if idl.Entry[0].ErrNo == EOK {
-		redirectLogin(w, r, "You have been logged out", s.Id, nil)
+		redirectLogin(w, li, r, "You have been logged out", s.Id, nil)
 	} else {
-		redirectLogin(w, r, "You cannot be logged out, forcing", s.Id,
-			errors.New("Error logging out: "+s.Username))
+		redirectLogin(w, li, r, "You cannot be logged out, forcing",
+			s.Id, errors.New("Error logging out: "+s.Username))
 	}
 
 	return
 }
 
-func urlList(w http.ResponseWriter, r *http.Request) (err error) {
+func urlVerify(w http.ResponseWriter, li *LogInfo,
+	r *http.Request) (err error) {
+	var idl *IdList
+
+	if idl, err = verifyEmail(li, r.FormValue("token")); err != nil {
+		redirectLogin(w, li, r, "Invalid or expired verification link",
+			"", err)
+		return
+	}
+
+	redirectLogin(w, li, r, "Email address "+idl.Entry[0].Opt+" verified, "+
+		"you may now login", "", nil)
+	return
+}
+
+func urlList(w http.ResponseWriter, li *LogInfo, r *http.Request) (err error) {
 	var s *Session
 	var v *RenderVar
 
-	if s, v, err = urlCheck(w, r, "Rebung.IO Control Panel"); err != nil {
+	if s, v, err = urlCheck(w, li, r,
+		"Rebung.IO Control Panel"); err != nil {
 		return
 	}
 
@@ -169,14 +214,15 @@ func urlList(w http.ResponseWriter, r *http.Request) (err error) {
 
 	if _, exist = q["uid"]; exist {
 		if id, err = strconv.ParseInt(q["uid"][0], 0, 64); err != nil {
-			redirectUrl(w, r, s, "/home", estr, err)
+			redirectUrl(w, li, r, s, "/home", estr, err)
 		}
 
 		if id == 0 {
 			v.Users = true
 		} else {
-			if uil, err = listUser(s.UserId, []int64{id}, ""); err != nil {
-				redirectUrl(w, r, s, "/home", estr, err)
+			if uil, err = listUser(li, s.UserId, []int64{id},
+				""); err != nil {
+				redirectUrl(w, li, r, s, "/home", estr, err)
 				return
 			}
 
@@ -205,15 +251,15 @@ func urlList(w http.ResponseWriter, r *http.Request) (err error) {
 		}
 	} else if _, exist = q["vid"]; exist {
 		if id, err = strconv.ParseInt(q["vid"][0], 0, 64); err != nil {
-			redirectUrl(w, r, s, "/home", estr, err)
+			redirectUrl(w, li, r, s, "/home", estr, err)
 		}
 
 		if id == 0 {
 			v.Servers = true
 		} else {
-			if vil, err = listServer(s.UserId, []int64{id},
+			if vil, err = listServer(li, s.UserId, []int64{id},
 				""); err != nil {
-				redirectUrl(w, r, s, "/home", estr, err)
+				redirectUrl(w, li, r, s, "/home", estr, err)
 				return
 			} else {
 				e := &vil.Entry[0]
@@ -235,7 +281,7 @@ func urlList(w http.ResponseWriter, r *http.Request) (err error) {
 			}
 		}
 	} else {
-		redirectUrl(w, r, s, "/home", estr, errors.New(estr))
+		redirectUrl(w, li, r, s, "/home", estr, errors.New(estr))
 		return
 	}
 
@@ -245,14 +291,14 @@ func urlList(w http.ResponseWriter, r *http.Request) (err error) {
 func mainUrlHandler(w http.ResponseWriter, r *http.Request) {
 	var err error
 
-	if ip := r.Header.Get("X-Forwarded-For"); ip == "" {
-		li.Src = r.RemoteAddr
-	} else {
+	li := &LogInfo{Src: r.RemoteAddr}
+
+	if ip := r.Header.Get("X-Forwarded-For"); ip != "" {
 		li.Src = ip
 	}
 
 	if err = checkRedis(); err != nil {
-		renderError(w, r, 500, err.Error())
+		renderError(w, li, r, 500, err.Error())
 		return
 	}
 
@@ -260,79 +306,85 @@ func mainUrlHandler(w http.ResponseWriter, r *http.Request) {
 
 	switch r.URL.Path {
 	case "/":
-		err = urlLogin(w, r)
+		err = urlLogin(w, li, r)
 
 	case "/home":
-		err = urlHome(w, r)
+		err = urlHome(w, li, r)
 
 	case "/list":
-		err = urlList(w, r)
+		err = urlList(w, li, r)
 
 	case "/search":
-		err = formSearch(w, r)
+		err = formSearch(w, li, r)
 
 	case "/add-server":
-		err = formAddServer(w, r)
+		err = formAddServer(w, li, r)
 
 	case "/set-server-attr":
-		err = wsSetServerAttr(w, r)
+		err = wsSetServerAttr(w, li, r)
 
 	case "/set-server-status":
-		err = wsSetServerStatus(w, r)
+		err = wsSetServerStatus(w, li, r)
 
 	case "/list-server":
-		err = wsListServer(w, r)
+		err = wsListServer(w, li, r)
 
 	case "/get-server-list":
-		err = wsGetServerList(w, r)
+		err = wsGetServerList(w, li, r)
 
 	case "/add-user":
-		err = formAddUser(w, r)
+		err = formAddUser(w, li, r)
 
 	case "/resolve-user":
-		err = wsResolveUser(w, r)
+		err = wsResolveUser(w, li, r)
 
 	case "/set-user-attr":
-		err = wsSetUserAttr(w, r)
+		err = wsSetUserAttr(w, li, r)
 
 	case "/set-user-status":
-		err = wsSetUserStatus(w, r)
+		err = wsSetUserStatus(w, li, r)
 
 	case "/set-session-owner":
-		err = wsSetSessionOwner(w, r)
+		err = wsSetSessionOwner(w, li, r)
 
 	case "/set-user-session":
-		err = wsSetUserSession(w, r)
+		err = wsSetUserSession(w, li, r)
 
 	case "/reset-user-pw":
-		err = wsResetUserPw(w, r)
+		err = wsResetUserPw(w, li, r)
 
 	case "/list-user":
-		err = wsListUser(w, r)
+		err = wsListUser(w, li, r)
 
 	case "/get-user-sessions":
-		err = wsGetUserSessions(w, r)
+		err = wsGetUserSessions(w, li, r)
 
 	case "/get-user-list":
-		err = wsGetUserList(w, r)
+		err = wsGetUserList(w, li, r)
 
 	case "/logout":
-		err = urlLogout(w, r)
+		err = urlLogout(w, li, r)
 
 	case "/login":
-		err = formLogin(w, r)
+		err = formLogin(w, li, r)
+
+	case "/login-totp":
+		err = formLoginTOTP(w, li, r)
+
+	case "/verify":
+		err = urlVerify(w, li, r)
 
 	case "/profile":
-		err = urlProfile(w, r)
+		err = urlProfile(w, li, r)
 
 	case "/change-name":
-		err = formChangeName(w, r)
+		err = formChangeName(w, li, r)
 
 	case "/change-pw":
-		err = formChangePw(w, r)
+		err = formChangePw(w, li, r)
 
 	default:
-		renderError(w, r, 404, "URL "+r.URL.Path+" does not exist")
+		renderError(w, li, r, 404, "URL "+r.URL.Path+" does not exist")
 
 	}
 
@@ -368,8 +420,8 @@ func main() {
 
 	go sigHandler()
 
-	event(loginfo, li, "%v-%v server started: %v", app.ProgName, app.Version,
-		app.HostName)
+	event(loginfo, sli, "%v-%v server started: %v", app.ProgName,
+		app.Version, app.HostName)
 
 	if err := setupServer(); err != nil {
 		fatal(err.Error())
@@ -389,16 +441,19 @@ func main() {
 func sigHandler() {
 	c := make(chan os.Signal, 1)
 
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-	signal := <-c
-	event(lognotice, li, "Signal received: "+signal.String())
+	for signal := range c {
+		event(lognotice, sli, "Signal received: "+signal.String())
 
-	switch signal {
-	case syscall.SIGINT, syscall.SIGTERM:
-		event(lognotice, li, "Terminating..")
-		os.Remove(PIDFILE)
-		os.Exit(0)
+		switch signal {
+		case syscall.SIGHUP:
+			reloadTLS()
+		case syscall.SIGINT, syscall.SIGTERM:
+			event(lognotice, sli, "Terminating..")
+			os.Remove(PIDFILE)
+			os.Exit(0)
+		}
 	}
 }
 
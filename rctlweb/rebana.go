@@ -17,6 +17,7 @@ type RebanaRequest struct {
 	UserId  int64
 	Command string
 	Data    string
+	Nonce   string
 }
 
 type RebanaMsg struct {
@@ -109,11 +110,12 @@ type SessionActivityL struct {
 	Time   string
 }
 
-func wsSetServerAttr(w http.ResponseWriter, r *http.Request) (err error) {
+func wsSetServerAttr(w http.ResponseWriter, li *LogInfo,
+	r *http.Request) (err error) {
 	var d *WSRequest
 	var s *Session
 
-	if s, d, err = wsCheck(w, r, false); err != nil {
+	if s, d, err = wsCheck(w, li, r, false); err != nil {
 		return
 	}
 
@@ -121,15 +123,15 @@ func wsSetServerAttr(w http.ResponseWriter, r *http.Request) (err error) {
 		d.Cmd == "location" || d.Cmd == "access" || d.Cmd == "tunnel" ||
 		d.Cmd == "tunsrc" || d.Cmd == "ppprefix" || d.Cmd == "rtprefix" {
 	} else {
-		sendWSResponse(w, EINVAL, "Invalid user attribute")
+		sendWSResponse(w, li, EINVAL, "Invalid user attribute")
 		return
 	}
 
 	var nl *NameList
 
-	if nl, err = setServerAttr(s.UserId, d.Uid, []string{d.Cmd},
+	if nl, err = setServerAttr(li, s.UserId, d.Uid, []string{d.Cmd},
 		[]string{d.Data}); err != nil {
-		sendWSResponse(w, EINVAL, err.Error())
+		sendWSResponse(w, li, EINVAL, err.Error())
 		return
 	}
 
@@ -139,29 +141,30 @@ func wsSetServerAttr(w http.ResponseWriter, r *http.Request) (err error) {
 	}{Name: nl.Entry[0].Name, Value: nl.Entry[0].Opt}
 
 	buf, _ := json.Marshal(msg)
-	sendWSResponse(w, EOK, string(buf))
+	sendWSResponse(w, li, EOK, string(buf))
 	return
 }
 
-func wsSetServerStatus(w http.ResponseWriter, r *http.Request) (err error) {
+func wsSetServerStatus(w http.ResponseWriter, li *LogInfo,
+	r *http.Request) (err error) {
 	var d *WSRequest
 	var s *Session
 
-	if s, d, err = wsCheck(w, r, false); err != nil {
+	if s, d, err = wsCheck(w, li, r, false); err != nil {
 		return
 	}
 
 	if d.Cmd == "enable-server" || d.Cmd == "disable-server" ||
 		d.Cmd == "activate-server" || d.Cmd == "deactivate-server" {
 	} else {
-		sendWSResponse(w, EINVAL, "Invalid command")
+		sendWSResponse(w, li, EINVAL, "Invalid command")
 		return
 	}
 
 	var idl *IdList
 
-	if idl, err = setServerStatus(s.UserId, d.Uid, d.Cmd); err != nil {
-		sendWSResponse(w, EINVAL, err.Error())
+	if idl, err = setServerStatus(li, s.UserId, d.Uid, d.Cmd); err != nil {
+		sendWSResponse(w, li, EINVAL, err.Error())
 		return
 	}
 
@@ -170,34 +173,37 @@ func wsSetServerStatus(w http.ResponseWriter, r *http.Request) (err error) {
 	}{Id: idl.Entry[0].Id}
 
 	buf, _ := json.Marshal(msg)
-	sendWSResponse(w, EOK, string(buf))
+	sendWSResponse(w, li, EOK, string(buf))
 	return
 }
 
-func wsSetSessionOwner(w http.ResponseWriter, r *http.Request) (err error) {
+func wsSetSessionOwner(w http.ResponseWriter, li *LogInfo,
+	r *http.Request) (err error) {
+	var s *Session
 	var d *WSRequest
 
-	if _, d, err = wsCheck(w, r, false); err != nil {
+	if s, d, err = wsCheck(w, li, r, false); err != nil {
 		return
 	}
 
 	if d.Cmd == "assign-session" || d.Cmd == "reassign-session" {
 	} else {
-		sendWSResponse(w, EINVAL, "Invalid command")
+		sendWSResponse(w, li, EINVAL, "Invalid command")
 		return
 	}
 
         uid, _ := strconv.ParseInt(d.Data, 0, 64)
 
         if uid == 0 {
-		sendWSResponse(w, EINVAL, "Invalid user ID")
+		sendWSResponse(w, li, EINVAL, "Invalid user ID")
 		return
         }
 
 	var idl *IdList
 
-	if idl, err = setSessionOwner(uid, d.Uid, d.Cmd); err != nil {
-		sendWSResponse(w, EINVAL, err.Error())
+	if idl, err = setSessionOwner(li, s.UserId, uid, d.Uid,
+		d.Cmd); err != nil {
+		sendWSResponse(w, li, EINVAL, err.Error())
 		return
 	}
 
@@ -207,21 +213,22 @@ func wsSetSessionOwner(w http.ResponseWriter, r *http.Request) (err error) {
 	}{Vid: idl.Id, Sid: idl.Entry[0].Id}
 
 	buf, _ := json.Marshal(msg)
-	sendWSResponse(w, EOK, string(buf))
+	sendWSResponse(w, li, EOK, string(buf))
 	return
 }
 
-func wsSetUserSession(w http.ResponseWriter, r *http.Request) (err error) {
+func wsSetUserSession(w http.ResponseWriter, li *LogInfo,
+	r *http.Request) (err error) {
 	var d *WSRequest
 
-	if _, d, err = wsCheck(w, r, false); err != nil {
+	if _, d, err = wsCheck(w, li, r, false); err != nil {
 		return
 	}
 
 	vid := d.Uid
 
 	if vid == 0 {
-		sendWSResponse(w, EINVAL, "Invalid server ID")
+		sendWSResponse(w, li, EINVAL, "Invalid server ID")
 		return
 	}
 
@@ -233,28 +240,29 @@ func wsSetUserSession(w http.ResponseWriter, r *http.Request) (err error) {
 		var args = strings.Split(d.Data, ":")
 
 		if len(args) != 2 {
-			sendWSResponse(w, EINVAL, "Invalid request data")
+			sendWSResponse(w, li, EINVAL, "Invalid request data")
 			return
 		}
 
 		if ip = args[0]; checkIPFamily(ip) != 4 {
-			sendWSResponse(w, EINVAL, "Invalid IP address format")
+			sendWSResponse(w, li, EINVAL,
+				"Invalid IP address format")
 			return
 		}
 
 		if uid, err = strconv.ParseInt(args[1], 0, 64); err != nil {
-			sendWSResponse(w, EINVAL, "Invalid user ID")
+			sendWSResponse(w, li, EINVAL, "Invalid user ID")
 			return
 		}
 	} else {
-		sendWSResponse(w, EINVAL, "Invalid command")
+		sendWSResponse(w, li, EINVAL, "Invalid command")
 		return
 	}
 
 	var idl *IdList
 
-	if idl, err = setUserSession(uid, vid, d.Cmd, ip); err != nil {
-		sendWSResponse(w, EINVAL, err.Error())
+	if idl, err = setUserSession(li, uid, vid, d.Cmd, ip); err != nil {
+		sendWSResponse(w, li, EINVAL, err.Error())
 		return
 	}
 
@@ -265,15 +273,16 @@ func wsSetUserSession(w http.ResponseWriter, r *http.Request) (err error) {
 	}{Vid: idl.Id, Sid: idl.Entry[0].Id, IP: idl.Entry[0].Opt}
 
 	buf, _ := json.Marshal(msg)
-	sendWSResponse(w, EOK, string(buf))
+	sendWSResponse(w, li, EOK, string(buf))
 	return
 }
 
-func wsListServer(w http.ResponseWriter, r *http.Request) (err error) {
+func wsListServer(w http.ResponseWriter, li *LogInfo,
+	r *http.Request) (err error) {
 	var d *WSRequest
 	var s *Session
 
-	if s, d, err = wsCheck(w, r, true); err != nil {
+	if s, d, err = wsCheck(w, li, r, true); err != nil {
 		return
 	}
 
@@ -283,7 +292,7 @@ func wsListServer(w http.ResponseWriter, r *http.Request) (err error) {
 		args := strings.Split(d.Data, ":")
 
 		if c := len(args); c != 4 {
-			sendWSResponse(w, EINVAL, "Invalid list parameter")
+			sendWSResponse(w, li, EINVAL, "Invalid list parameter")
 			return
 		}
 
@@ -292,31 +301,35 @@ func wsListServer(w http.ResponseWriter, r *http.Request) (err error) {
 			list == "disabled" || list == "active" ||
 			list == "inactive" {
 			if page = args[1]; page == "" {
-				sendWSResponse(w, EINVAL, "Invalid list parameter")
+				sendWSResponse(w, li, EINVAL,
+					"Invalid list parameter")
 				return
 			}
 
 			if cnt = args[2]; cnt == "" {
-				sendWSResponse(w, EINVAL, "Invalid list parameter")
+				sendWSResponse(w, li, EINVAL,
+					"Invalid list parameter")
 				return
 			}
 
 			if order = args[3]; order == "" {
-				sendWSResponse(w, EINVAL, "Invalid list parameter")
+				sendWSResponse(w, li, EINVAL,
+					"Invalid list parameter")
 				return
 			}
 
 			data = fmt.Sprintf("%v:%v:%v:%v", list, page, cnt, order)
 		} else {
-			sendWSResponse(w, EINVAL, "Invalid list name")
+			sendWSResponse(w, li, EINVAL, "Invalid list name")
 			return
 		}
 	}
 
 	var vil *ServerInfoList
 
-	if vil, err = listServer(s.UserId, []int64{d.Uid}, data); err != nil {
-		sendWSResponse(w, EINVAL, err.Error())
+	if vil, err = listServer(li, s.UserId, []int64{d.Uid},
+		data); err != nil {
+		sendWSResponse(w, li, EINVAL, err.Error())
 		return
 	}
 
@@ -326,15 +339,16 @@ func wsListServer(w http.ResponseWriter, r *http.Request) (err error) {
 	}{Total: vil.Id, Entry: vil.Entry}
 
 	buf, _ := json.Marshal(msg)
-	sendWSResponse(w, EOK, string(buf))
+	sendWSResponse(w, li, EOK, string(buf))
 	return
 }
 
-func wsGetServerList(w http.ResponseWriter, r *http.Request) (err error) {
+func wsGetServerList(w http.ResponseWriter, li *LogInfo,
+	r *http.Request) (err error) {
 	var d *WSRequest
 	var s *Session
 
-	if s, d, err = wsCheck(w, r, false); err != nil {
+	if s, d, err = wsCheck(w, li, r, false); err != nil {
 		return
 	}
 
@@ -343,7 +357,7 @@ func wsGetServerList(w http.ResponseWriter, r *http.Request) (err error) {
 	args := strings.Split(d.Data, ":")
 
 	if c := len(args); c != 4 {
-		sendWSResponse(w, EINVAL, "Invalid list parameter")
+		sendWSResponse(w, li, EINVAL, "Invalid list parameter")
 		return
 	}
 
@@ -351,18 +365,18 @@ func wsGetServerList(w http.ResponseWriter, r *http.Request) (err error) {
 		list == "active-sessions" || list == "assigned-sessions" ||
 		list == "unassigned-sessions" || list == "session-activity" {
 		if page = args[1]; page == "" {
-			sendWSResponse(w, EINVAL, "Invalid list parameter")
+			sendWSResponse(w, li, EINVAL, "Invalid list parameter")
 			return
 		}
 
 		if cnt = args[2]; cnt == "" {
-			sendWSResponse(w, EINVAL, "Invalid list parameter")
+			sendWSResponse(w, li, EINVAL, "Invalid list parameter")
 			return
 		}
 
 		data = fmt.Sprintf("%v:%v:%v:", list, page, cnt)
 	} else {
-		sendWSResponse(w, EINVAL, "Invalid list name")
+		sendWSResponse(w, li, EINVAL, "Invalid list name")
 		return
 	}
 
@@ -371,8 +385,9 @@ func wsGetServerList(w http.ResponseWriter, r *http.Request) (err error) {
 	if list == "all-users" {
 		var nl *NameList
 
-		if nl, err = getServerNameList(s.UserId, d.Uid, data); err != nil {
-			sendWSResponse(w, EINVAL, "Invalid server response")
+		if nl, err = getServerNameList(li, s.UserId, d.Uid,
+			data); err != nil {
+			sendWSResponse(w, li, EINVAL, "Invalid server response")
 			return
 		}
 
@@ -381,14 +396,15 @@ func wsGetServerList(w http.ResponseWriter, r *http.Request) (err error) {
 		for i := range nl.Entry {
 			if ids[i], err = strconv.ParseInt(nl.Entry[i].Name, 0,
 				64); err != nil {
-				sendWSResponse(w, EINVAL, "Invalid result payload")
+				sendWSResponse(w, li, EINVAL,
+					"Invalid result payload")
 			}
 		}
 
 		var uil *UserInfoList
 
-		if uil, err = listUser(s.UserId, ids, ""); err != nil {
-                        sendWSResponse(w, EINVAL, err.Error())
+		if uil, err = listUser(li, s.UserId, ids, ""); err != nil {
+                        sendWSResponse(w, li, EINVAL, err.Error())
 			return
 		}
 
@@ -401,9 +417,9 @@ func wsGetServerList(w http.ResponseWriter, r *http.Request) (err error) {
 	} else if list == "session-activity" {
 		var nl *NameList
 
-		if nl, err = getServerNameList(s.UserId, d.Uid,
+		if nl, err = getServerNameList(li, s.UserId, d.Uid,
 			d.Data); err != nil {
-                        sendWSResponse(w, EINVAL, err.Error())
+                        sendWSResponse(w, li, EINVAL, err.Error())
 			return
 		}
 
@@ -424,9 +440,9 @@ func wsGetServerList(w http.ResponseWriter, r *http.Request) (err error) {
 	} else {
 		var sil *SessionInfoList
 
-		if sil, err = getServerSessionList(s.UserId, d.Uid,
+		if sil, err = getServerSessionList(li, s.UserId, d.Uid,
 			d.Data); err != nil {
-                        sendWSResponse(w, EINVAL, err.Error())
+                        sendWSResponse(w, li, EINVAL, err.Error())
 			return
 		}
 
@@ -438,11 +454,11 @@ func wsGetServerList(w http.ResponseWriter, r *http.Request) (err error) {
 		buf, _ = json.Marshal(msg)
 	}
 
-	sendWSResponse(w, EOK, string(buf))
+	sendWSResponse(w, li, EOK, string(buf))
 	return
 }
 
-func resolveServerName(uid int64, s string) (id int64, err error) {
+func resolveServerName(li *LogInfo, uid int64, s string) (id int64, err error) {
 	url := app.RebanaUrl + "/v/resolve"
 	cmd := "resolve-server"
 
@@ -454,7 +470,7 @@ func resolveServerName(uid int64, s string) (id int64, err error) {
 
 	var res *RebanaMsg
 
-	if res, err = sendRebanaRequest(req); err != nil {
+	if res, err = sendRebanaRequest(li, req); err != nil {
 		return
 	}
 
@@ -473,7 +489,8 @@ func resolveServerName(uid int64, s string) (id int64, err error) {
 	return
 }
 
-func addServer(uid int64, h, pp, rt string) (idl *IdList, err error) {
+func addServer(li *LogInfo, uid int64, h, pp, rt string) (idl *IdList,
+	err error) {
 	url := app.RebanaUrl + "/v/add"
 	cmd := "add-server"
 
@@ -490,7 +507,7 @@ func addServer(uid int64, h, pp, rt string) (idl *IdList, err error) {
 
 	var res *RebanaMsg
 
-	if res, err = sendRebanaRequest(req); err != nil {
+	if res, err = sendRebanaRequest(li, req); err != nil {
 		return
 	}
 
@@ -501,7 +518,8 @@ func addServer(uid int64, h, pp, rt string) (idl *IdList, err error) {
 	return
 }
 
-func setServerAttr(id, vid int64, k, v []string) (nl *NameList, err error) {
+func setServerAttr(li *LogInfo, id, vid int64, k, v []string) (nl *NameList,
+	err error) {
 	url := app.RebanaUrl + "/v/set"
 	cmd := "set-server-attr"
 
@@ -518,7 +536,7 @@ func setServerAttr(id, vid int64, k, v []string) (nl *NameList, err error) {
 
 	var res *RebanaMsg
 
-	if res, err = sendRebanaRequest(req); err != nil {
+	if res, err = sendRebanaRequest(li, req); err != nil {
 		return
 	}
 
@@ -529,7 +547,8 @@ func setServerAttr(id, vid int64, k, v []string) (nl *NameList, err error) {
 	return
 }
 
-func setServerStatus(uid, vid int64, cmd string) (idl *IdList, err error) {
+func setServerStatus(li *LogInfo, uid, vid int64, cmd string) (idl *IdList,
+	err error) {
 	url := app.RebanaUrl + "/v/set"
 
 	e := []Id{Id{Id: vid}}
@@ -540,7 +559,7 @@ func setServerStatus(uid, vid int64, cmd string) (idl *IdList, err error) {
 
 	var res *RebanaMsg
 
-	if res, err = sendRebanaRequest(req); err != nil {
+	if res, err = sendRebanaRequest(li, req); err != nil {
 		return
 	}
 
@@ -551,18 +570,21 @@ func setServerStatus(uid, vid int64, cmd string) (idl *IdList, err error) {
 	return
 }
 
-func setSessionOwner(uid, vid int64, cmd string) (idl *IdList, err error) {
+// setSessionOwner assigns a tunnel session to uid on behalf of the admin id,
+// rebana checks id holds session.assign
+func setSessionOwner(li *LogInfo, id, uid, vid int64,
+	cmd string) (idl *IdList, err error) {
 	url := app.RebanaUrl + "/s/assign"
 
 	e := []Id{Id{Id: vid}}
-	buf, _ := json.Marshal(&IdList{Entry: e})
+	buf, _ := json.Marshal(&IdList{Id: uid, Entry: e})
 
 	data := string(buf)
-	req := &RequestOpt{Uid: uid, Cmd: cmd, Data: data, Url: url}
+	req := &RequestOpt{Uid: id, Cmd: cmd, Data: data, Url: url}
 
 	var res *RebanaMsg
 
-	if res, err = sendRebanaRequest(req); err != nil {
+	if res, err = sendRebanaRequest(li, req); err != nil {
 		return
 	}
 
@@ -573,7 +595,8 @@ func setSessionOwner(uid, vid int64, cmd string) (idl *IdList, err error) {
 	return
 }
 
-func setUserSession(uid, vid int64, cmd, ip string) (idl *IdList, err error) {
+func setUserSession(li *LogInfo, uid, vid int64, cmd, ip string) (idl *IdList,
+	err error) {
 	url := app.RebanaUrl + "/s/set"
 
 	e := []Id{Id{Id: vid, Opt: ip}}
@@ -584,7 +607,7 @@ func setUserSession(uid, vid int64, cmd, ip string) (idl *IdList, err error) {
 
 	var res *RebanaMsg
 
-	if res, err = sendRebanaRequest(req); err != nil {
+	if res, err = sendRebanaRequest(li, req); err != nil {
 		return
 	}
 
@@ -595,8 +618,8 @@ func setUserSession(uid, vid int64, cmd, ip string) (idl *IdList, err error) {
 	return
 }
 
-func listServer(uid int64, ids []int64, opt string) (uil *ServerInfoList,
-	err error) {
+func listServer(li *LogInfo, uid int64, ids []int64,
+	opt string) (uil *ServerInfoList, err error) {
 	url := app.RebanaUrl + "/v/list"
 	cmd := "list-server"
 
@@ -613,7 +636,7 @@ func listServer(uid int64, ids []int64, opt string) (uil *ServerInfoList,
 
 	var res *RebanaMsg
 
-	if res, err = sendRebanaRequest(req); err != nil {
+	if res, err = sendRebanaRequest(li, req); err != nil {
 		return
 	}
 
@@ -624,8 +647,8 @@ func listServer(uid int64, ids []int64, opt string) (uil *ServerInfoList,
 	return
 }
 
-func getServerSessionList(uid, vid int64, opt string) (sil *SessionInfoList,
-	err error) {
+func getServerSessionList(li *LogInfo, uid, vid int64,
+	opt string) (sil *SessionInfoList, err error) {
 	url := app.RebanaUrl + "/v/list"
 	cmd := "get-server-list"
 
@@ -638,7 +661,7 @@ func getServerSessionList(uid, vid int64, opt string) (sil *SessionInfoList,
 
 	var res *RebanaMsg
 
-	if res, err = sendRebanaRequest(req); err != nil {
+	if res, err = sendRebanaRequest(li, req); err != nil {
 		return
 	}
 
@@ -649,7 +672,8 @@ func getServerSessionList(uid, vid int64, opt string) (sil *SessionInfoList,
 	return
 }
 
-func getServerNameList(uid, vid int64, opt string) (nl *NameList, err error) {
+func getServerNameList(li *LogInfo, uid, vid int64, opt string) (nl *NameList,
+	err error) {
 	url := app.RebanaUrl + "/v/list"
 	cmd := "get-server-list"
 
@@ -662,7 +686,7 @@ func getServerNameList(uid, vid int64, opt string) (nl *NameList, err error) {
 
 	var res *RebanaMsg
 
-	if res, err = sendRebanaRequest(req); err != nil {
+	if res, err = sendRebanaRequest(li, req); err != nil {
 		return
 	}
 
@@ -673,7 +697,8 @@ func getServerNameList(uid, vid int64, opt string) (nl *NameList, err error) {
 	return
 }
 
-func listUserSession(id int64) (sil *UserSessionInfoList, err error) {
+func listUserSession(li *LogInfo, id int64) (sil *UserSessionInfoList,
+	err error) {
 	url := app.RebanaUrl + "/s/list"
 	cmd := "list-user-sessions"
 
@@ -681,7 +706,7 @@ func listUserSession(id int64) (sil *UserSessionInfoList, err error) {
 
 	var res *RebanaMsg
 
-	if res, err = sendRebanaRequest(req); err != nil {
+	if res, err = sendRebanaRequest(li, req); err != nil {
 		return
 	}
 
@@ -192,7 +192,7 @@ func checkRedis() (err error) {
 			return
 		}}
 
-	event(loginfo, li, "Connected to Redis: %v", app.RedisUrl)
+	event(loginfo, sli, "Connected to Redis: %v", app.RedisUrl)
 
 	return
 }
@@ -7,10 +7,12 @@ package main
 import (
 	"bytes"
 	"crypto/hmac"
+	crand "crypto/rand"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
@@ -20,10 +22,26 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 	"time"
 )
 
+// PolicyError lists the password policy rules a new password failed
+type PolicyError struct {
+	Rules []Name
+}
+
+func (e *PolicyError) Error() string {
+	r := make([]string, len(e.Rules))
+
+	for i := range e.Rules {
+		r[i] = e.Rules[i].Opt
+	}
+
+	return strings.Join(r, ", ")
+}
+
 type RequestOpt struct {
 	Uid  int64
 	Cmd  string
@@ -135,6 +153,14 @@ func parseConfig(f string) (err error) {
 		fatal("Rebana secret is empty")
 	}
 
+	if app.KeyFile != "" {
+		if _, err = os.Stat(app.KeyFile); err != nil {
+			fatal("Signing key file not found: %v", app.KeyFile)
+		}
+	}
+
+	keyring = newKeyRing(app.KeyFile)
+
 	if app.AppRoot == "" {
 		fatal("Application directory is empty")
 	} else {
@@ -197,6 +223,16 @@ func getUserInfoList(s string, c string) (d *UserInfoList, err error) {
 	return
 }
 
+func getUserEventList(s string, c string) (d *UserEventList, err error) {
+	d = &UserEventList{}
+
+	if err = json.Unmarshal([]byte(s), d); err != nil {
+		return d, errors.New("Error unmarshaling UserEventList struct")
+	}
+
+	return
+}
+
 func getServerInfoList(s string, c string) (d *ServerInfoList, err error) {
 	d = &ServerInfoList{}
 
@@ -252,6 +288,43 @@ func checkSignature(sig, key string, m []byte) (err error) {
 	return
 }
 
+// signCanonicalRequest signs the method, path, signed headers and body
+// digest of req, every other header has to be set before it is signed
+func signCanonicalRequest(req *http.Request, m []byte, key string) string {
+	l := []string{"content-type", "date"}
+
+	for k := range req.Header {
+		k = strings.ToLower(k)
+
+		if strings.HasPrefix(k, "x-n3-") && k != "x-n3-signature" {
+			l = append(l, k)
+		}
+	}
+
+	sort.Strings(l)
+
+	b := sha256.Sum256(m)
+	c := req.Method + "\n" + req.URL.Path + "\n" + req.URL.RawQuery + "\n"
+
+	for _, k := range l {
+		v := req.Header[http.CanonicalHeaderKey(k)]
+		c += k + ":" + strings.TrimSpace(strings.Join(v, ",")) + "\n"
+	}
+
+	c += "\n" + strings.Join(l, ";") + "\n" + hex.EncodeToString(b[:])
+
+	d := sha256.Sum256([]byte(c))
+	s := SIGALG + "\n" + req.Header.Get("Date") + "\n" +
+		hex.EncodeToString(d[:])
+
+	dgst := hmac.New(sha256.New, []byte(key))
+	dgst.Write([]byte(s))
+
+	return fmt.Sprintf("%v SignedHeaders=%v,Signature=%v", SIGALG,
+		strings.Join(l, ";"),
+		base64.StdEncoding.EncodeToString(dgst.Sum(nil)))
+}
+
 func checkMsgExpiry(t time.Time) (err error) {
 	if time.Now().Sub(t).Seconds() > 10.0 {
 		return errors.New("Message has expired")
@@ -280,10 +353,11 @@ func checkIPFamily(s string) (f int) {
 	return
 }
 
-func urlCheck(w http.ResponseWriter, r *http.Request, t string) (s *Session,
+func urlCheck(w http.ResponseWriter, li *LogInfo,
+	r *http.Request, t string) (s *Session,
 	v *RenderVar, err error) {
 	if s, err = getSession(r); err != nil {
-		redirectLogin(w, r, "URL access restricted", "", err)
+		redirectLogin(w, li, r, "URL access restricted", "", err)
 		return
 	}
 
@@ -309,17 +383,18 @@ func urlCheck(w http.ResponseWriter, r *http.Request, t string) (s *Session,
 	return
 }
 
-func wsCheck(w http.ResponseWriter, r *http.Request, flag bool) (s *Session,
+func wsCheck(w http.ResponseWriter, li *LogInfo,
+	r *http.Request, flag bool) (s *Session,
 	d *WSRequest, err error) {
 	d = &WSRequest{}
 
 	if err = json.NewDecoder(r.Body).Decode(&d); err != nil {
-		sendWSResponse(w, EINVAL, "Invalid JSON payload")
+		sendWSResponse(w, li, EINVAL, "Invalid JSON payload")
 		return
 	}
 
 	if s, err = getWSSession(d.Sid); err != nil {
-		sendWSResponse(w, EINVAL, err.Error())
+		sendWSResponse(w, li, EINVAL, err.Error())
 		return
 	}
 
@@ -328,7 +403,7 @@ func wsCheck(w http.ResponseWriter, r *http.Request, flag bool) (s *Session,
 		return
 	} else {
 		if d.Uid == 0 {
-			sendWSResponse(w, EINVAL, "Invalid ID field")
+			sendWSResponse(w, li, EINVAL, "Invalid ID field")
 			return
 		}
 	}
@@ -342,7 +417,7 @@ func render(w http.ResponseWriter, r *RenderVar, t string) error {
 	return tpl.ExecuteTemplate(w, t+".html", r)
 }
 
-func renderError(w http.ResponseWriter, r *http.Request, errno int,
+func renderError(w http.ResponseWriter, li *LogInfo, r *http.Request, errno int,
         estr string) error {
 	event(logwarn, li, estr)
 
@@ -369,7 +444,8 @@ func renderError(w http.ResponseWriter, r *http.Request, errno int,
 	return tpl.ExecuteTemplate(w, "errors.html", v)
 }
 
-func redirectUrl(w http.ResponseWriter, r *http.Request, s *Session,
+func redirectUrl(w http.ResponseWriter, li *LogInfo,
+	r *http.Request, s *Session,
 	url, fstr string, err error) {
 	c := "success"
 
@@ -385,7 +461,8 @@ func redirectUrl(w http.ResponseWriter, r *http.Request, s *Session,
 	http.Redirect(w, r, url, http.StatusFound)
 }
 
-func redirectLogin(w http.ResponseWriter, r *http.Request, fstr, sid string,
+func redirectLogin(w http.ResponseWriter, li *LogInfo,
+	r *http.Request, fstr, sid string,
 	err error) {
 	if sid != "" {
 		if err := deleteSession(w, sid); err != nil {
@@ -405,7 +482,7 @@ func redirectLogin(w http.ResponseWriter, r *http.Request, fstr, sid string,
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
-func sendWSResponse(w http.ResponseWriter, e int, s string) {
+func sendWSResponse(w http.ResponseWriter, li *LogInfo, e int, s string) {
 	buf, _ := json.Marshal(&WSResponse{Uid: li.Uid, ErrNo: e, Data: s})
 
 	w.Header().Add("Content-Type", "application/json")
@@ -426,10 +503,14 @@ func setupServer() (err error) {
 	http.HandleFunc("/", mainUrlHandler)
 
 	for i := range app.Bind {
-		go http.ListenAndServe(net.JoinHostPort(app.Bind[i].Host,
-			app.Bind[i].Port), nil)
-		event(loginfo, li, "listening on %v:%v", app.Bind[i].Host,
-			app.Bind[i].Port)
+		var ln net.Listener
+
+		if ln, err = getListener(&app.Bind[i]); err != nil {
+			return
+		}
+
+		go http.Serve(ln, nil)
+		event(loginfo, sli, "listening on %v", ln.Addr())
 	}
 
 	if tlsc, err = setTLSConfig(); err != nil {
@@ -469,12 +550,44 @@ func setTLSConfig() (p *tls.Config, err error) {
 	}
 
 	p = &tls.Config{RootCAs: opts.Roots}
+
+	if app.TLSClientCert != "" {
+		var c tls.Certificate
+
+		if c, err = tls.LoadX509KeyPair(app.TLSClientCert,
+			app.TLSClientKey); err != nil {
+			return p, errors.New("Error loading TLS client cert")
+		}
+
+		p.Certificates = []tls.Certificate{c}
+	}
+
 	return
 }
 
-func sendGhazalRequest(r *RequestOpt) (msg *GhazalMsg, err error) {
+// newNonce returns a request nonce for a request dated t, the receiving
+// service rejects a nonce it has already seen
+func newNonce(t time.Time) (n string, err error) {
+	p := make([]byte, 12)
+
+	if _, err = crand.Read(p); err != nil {
+		return
+	}
+
+	return fmt.Sprintf("%v.%v", t.Unix(),
+		base64.URLEncoding.EncodeToString(p)), nil
+}
+
+func sendGhazalRequest(li *LogInfo, r *RequestOpt) (msg *GhazalMsg, err error) {
+	now := time.Now()
+	nonce, err := newNonce(now)
+
+	if err != nil {
+		return
+	}
+
 	m := &GhazalRequest{UserId: r.Uid, Origin: li.Src, Command: r.Cmd,
-		Data: r.Data}
+		Data: r.Data, Nonce: nonce}
 	buf, _ := json.Marshal(m)
 	rd := bytes.NewReader(buf)
 
@@ -484,14 +597,22 @@ func sendGhazalRequest(r *RequestOpt) (msg *GhazalMsg, err error) {
 		return
 	}
 
-	req.Header.Add("Date", time.Now().In(gmt).Format(time.RFC1123))
+	req.Header.Add("Date", now.In(gmt).Format(time.RFC1123))
 	req.Header.Add("Accept", "application/json")
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("X-N3-Service-Name", "ghazal")
-	req.Header.Add("X-N3-Signature", signRequest(buf, app.GhazalSecret))
+	req.Header.Add("X-N3-Caller", "rctlweb")
+
+	kid, secret := getSigningKey("ghazal", app.GhazalSecret)
+
+	if kid != "" {
+		req.Header.Add("X-N3-Key-Id", kid)
+	}
+
+	req.Header.Add("X-N3-Signature", signCanonicalRequest(req, buf, secret))
 
 	con := &http.Client{}
-	con.Transport = &http.Transport{TLSClientConfig: tlsc}
+	con.Transport = &http.Transport{TLSClientConfig: getTLSClientConfig()}
 
 	var res *http.Response
 
@@ -527,7 +648,7 @@ func sendGhazalRequest(r *RequestOpt) (msg *GhazalMsg, err error) {
 
 	sig := res.Header.Get("X-N3-Signature")
 
-	if err = checkSignature(sig, app.GhazalSecret, buf); err != nil {
+	if err = checkSignature(sig, secret, buf); err != nil {
 		return
 	}
 
@@ -539,15 +660,39 @@ func sendGhazalRequest(r *RequestOpt) (msg *GhazalMsg, err error) {
 		"Hostname: %v, User ID: %v, ErrNo: %v]", ts, msg.HostName,
 		msg.UserId, msg.ErrNo)
 
-	if msg.ErrNo != EOK {
+	if msg.ErrNo == EPOLICY {
+		err = getPolicyError(msg.Data)
+	} else if msg.ErrNo == EREPLAY {
+		err = errors.New("Request rejected as a replay, please retry")
+	} else if msg.ErrNo != EOK {
 		err = errors.New(msg.Data)
 	}
 
 	return
 }
 
-func sendRebanaRequest(r *RequestOpt) (msg *RebanaMsg, err error) {
-	m := &RebanaRequest{UserId: r.Uid, Command: r.Cmd, Data: r.Data}
+// getPolicyError decodes the password policy rules ghazal rejected a
+// password for
+func getPolicyError(s string) error {
+	var m *NameList
+
+	if err := json.Unmarshal([]byte(s), &m); err != nil {
+		return errors.New("Invalid password policy response")
+	}
+
+	return &PolicyError{Rules: m.Entry}
+}
+
+func sendRebanaRequest(li *LogInfo, r *RequestOpt) (msg *RebanaMsg, err error) {
+	now := time.Now()
+	nonce, err := newNonce(now)
+
+	if err != nil {
+		return
+	}
+
+	m := &RebanaRequest{UserId: r.Uid, Command: r.Cmd, Data: r.Data,
+		Nonce: nonce}
         buf, _ := json.Marshal(m)
         rd := bytes.NewReader(buf)
 
@@ -557,14 +702,22 @@ func sendRebanaRequest(r *RequestOpt) (msg *RebanaMsg, err error) {
 		return
 	}
 
-	req.Header.Add("Date", time.Now().In(gmt).Format(time.RFC1123))
+	req.Header.Add("Date", now.In(gmt).Format(time.RFC1123))
 	req.Header.Add("Accept", "application/json")
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("X-N3-Service-Name", "rebana")
-	req.Header.Add("X-N3-Signature", signRequest(buf, app.RebanaSecret))
+	req.Header.Add("X-N3-Caller", "rctlweb")
+
+	kid, secret := getSigningKey("rebana", app.RebanaSecret)
+
+	if kid != "" {
+		req.Header.Add("X-N3-Key-Id", kid)
+	}
+
+	req.Header.Add("X-N3-Signature", signCanonicalRequest(req, buf, secret))
 
         con := &http.Client{}
-	con.Transport = &http.Transport{TLSClientConfig: tlsc}
+	con.Transport = &http.Transport{TLSClientConfig: getTLSClientConfig()}
 
 	var res *http.Response
 
@@ -600,7 +753,7 @@ func sendRebanaRequest(r *RequestOpt) (msg *RebanaMsg, err error) {
 
         sig := res.Header.Get("X-N3-Signature")
 
-	if err = checkSignature(sig, app.RebanaSecret, buf); err != nil {
+	if err = checkSignature(sig, secret, buf); err != nil {
 		return
 	}
 
@@ -612,7 +765,12 @@ func sendRebanaRequest(r *RequestOpt) (msg *RebanaMsg, err error) {
 		"Hostname: %v, User ID: %v, ErrNo: %v]", ts, msg.HostName,
 		msg.UserId, msg.ErrNo)
 
-	if msg.ErrNo != EOK {
+	if msg.ErrNo == EREPLAY {
+		err = errors.New("Request rejected as a replay, please retry")
+	} else if msg.ErrNo == EAUP {
+		err = errors.New("Please accept the latest AUP before " +
+			"activating a session")
+	} else if msg.ErrNo != EOK {
 		err = errors.New(msg.Data)
 	}
 
@@ -29,7 +29,7 @@
  *
  * User keys
  * ---------
- * user:admin-list
+ * user:admin-list (migrated to role:superadmin)
  * uid:[uid]:sessions-list
  */
 
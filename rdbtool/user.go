@@ -11,7 +11,7 @@
  * user:disabled-list
  * user:active-list
  * user:inactive-list
- * user:admin-list
+ * user:admin-list (users holding any role)
  * user:new-list
  *
  * uid:next
@@ -21,10 +21,70 @@
  * Messaging keys
  * --------------
  * msgid:next
+ * nonce:[nonce]
  *
  * Session keys
  * ------------
- * uid:[uid]:session
+ * session:[token digest]
+ * uid:[uid]:login-sessions
+ *
+ * Password reset keys
+ * -------------------
+ * reset:[token digest]
+ * uid:[uid]:reset
+ * uid:[uid]:password-history
+ *
+ * Two-factor keys
+ * ---------------
+ * uid:[uid]:totp
+ * uid:[uid]:totp-recovery
+ * login:[challenge digest]
+ *
+ * Role keys
+ * ---------
+ * role:all-list
+ * role:[name]:perms
+ * role:[name]:uids
+ * uid:[uid]:roles
+ *
+ * API keys
+ * --------
+ * apikey:[key id]
+ * uid:[uid]:apikeys
+ *
+ * Search index keys
+ * -----------------
+ * index:login
+ * index:name
+ * index:login:[trigram]
+ * index:name:[trigram]
+ * index:registered
+ * index:id
+ *
+ * Mail queue keys
+ * ---------------
+ * mail:next
+ * mail:[id]
+ * mail:queue
+ * mail:dead-list
+ *
+ * OpenID Connect keys
+ * --------------------
+ * oidc:client-list
+ * oidc:client:[client id]
+ * oidc:code:[code digest]
+ *
+ * Signing keyring keys (also read by rebana)
+ * ------------------------------------------
+ * keyring:key-list
+ * keyring:key:[key id]
+ *
+ * Acceptable use policy keys
+ * --------------------------
+ * aup:next
+ * aup:version-list
+ * aup:[version]
+ * aup:[version]:accepted (hash, [uid]: [time];[ip])
  */
 
 package main
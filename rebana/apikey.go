@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// sessionCommands may be issued with a tunnel-control API key, the first
+// three also with a read-only one
+var sessionCommands = []string{
+	"list-user-sessions",
+	"list-user-servers",
+	"check-session",
+	"activate-session",
+	"deactivate-session",
+	"assign-session",
+	"reassign-session",
+}
+
+func checkApiKeyScope(scope, cmd string) (err error) {
+	var p, ok = serverPermission[cmd]
+
+	if ok && (scope == "admin" ||
+		(scope == "read-only" && strings.HasSuffix(p, ".read"))) {
+		return
+	}
+
+	for i := range sessionCommands {
+		if cmd != sessionCommands[i] {
+			continue
+		}
+
+		if scope == "tunnel-control" || (scope == "read-only" && i < 3) {
+			return
+		}
+	}
+
+	return errors.New(fmt.Sprintf("API key scope %v does not allow %v",
+		scope, cmd))
+}
+
+// getApiKey derives the key of a key ID the way ghazal issues it, from the
+// API key secret both services share
+func getApiKey(kid string) (key string, err error) {
+	if app.ApiKeySecret == "" {
+		return key, errors.New("API keys are not enabled")
+	}
+
+	var dgst = hmac.New(sha256.New, []byte(app.ApiKeySecret))
+	dgst.Write([]byte("apikey:" + kid))
+
+	return base64.URLEncoding.EncodeToString(dgst.Sum(nil)), nil
+}
+
+// checkApiKey verifies a request signed with a ghazal API key instead of the
+// service secret, the key is looked up in the role database and has to
+// match the digest ghazal stored
+func checkApiKey(li *LogInfo, r *http.Request, kid, sig string, m []byte,
+	d *RequestMsg) (err error) {
+	var uid, scope, key, dgst string
+
+	if uid, scope, dgst, err = getRedisApiKey(kid); err != nil {
+		return errors.New("Invalid API key: " + kid)
+	}
+
+	if key, err = getApiKey(kid); err != nil {
+		return
+	}
+
+	var h = sha256.Sum256([]byte(key))
+
+	if !hmac.Equal([]byte(hex.EncodeToString(h[:])), []byte(dgst)) {
+		return errors.New("Invalid API key: " + kid)
+	}
+
+	if err = checkRequestSignature(r, sig, m, key); err != nil {
+		return
+	}
+
+	if uid != fmt.Sprintf("%v", d.UserId) {
+		return errors.New(fmt.Sprintf("API key %v does not belong to "+
+			"user [%v]", kid, d.UserId))
+	}
+
+	if err = checkApiKeyScope(scope, d.Command); err != nil {
+		return
+	}
+
+	if err = setRedisApiKeyUsed(kid); err != nil {
+		event(logwarn, li, err.Error())
+	}
+
+	li.Key = key
+	return nil
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SigningKey is a request signing key of the keyring ghazal keeps in the
+// role database, see ghazal for its validity rules
+type SigningKey struct {
+	Id        string
+	Service   string
+	Callers   []string
+	NotBefore int64
+	NotAfter  int64
+}
+
+// checkSigningKey checks a key may sign a request from caller to the
+// service at this time
+func checkSigningKey(k *SigningKey, svc, caller string) (err error) {
+	var now = time.Now().Unix()
+
+	if k.Service != svc {
+		return errors.New(fmt.Sprintf("Signing key %v is not valid "+
+			"for %v", k.Id, svc))
+	}
+
+	if now < k.NotBefore {
+		return errors.New("Signing key " + k.Id + " is not yet valid")
+	}
+
+	if k.NotAfter != 0 && now >= k.NotAfter {
+		return errors.New("Signing key " + k.Id + " has expired")
+	}
+
+	if len(k.Callers) == 0 {
+		return
+	}
+
+	for i := range k.Callers {
+		if caller == k.Callers[i] {
+			return
+		}
+	}
+
+	return errors.New(fmt.Sprintf("Signing key %v is not valid for "+
+		"caller %v", k.Id, caller))
+}
+
+// checkKeyId verifies a request signed with a keyring key instead of the
+// service secret, the response is signed with the same key
+func checkKeyId(li *LogInfo, r *http.Request, kid, sig string,
+	m []byte) (err error) {
+	var k *SigningKey
+	var secret string
+
+	if k, secret, err = getRedisSigningKey(kid); err != nil {
+		return errors.New("Invalid signing key: " + kid)
+	}
+
+	var caller = r.Header.Get("X-N3-Caller")
+
+	// a mutual TLS client is held to the name on its certificate. Without
+	// one the caller header is only trusted under a canonical signature, a
+	// legacy signature covers the body alone.
+	if cn := getClientName(r); cn != "" {
+		caller = cn
+	} else if len(k.Callers) != 0 && !strings.HasPrefix(sig, SIGALG+" ") {
+		return errors.New("Signing key " + kid + " is restricted to " +
+			"callers and needs a canonical signature")
+	}
+
+	if err = checkSigningKey(k, "rebana", caller); err != nil {
+		return
+	}
+
+	if err = checkRequestSignature(r, sig, m, secret); err != nil {
+		return
+	}
+
+	li.Key = secret
+	return
+}
+
+// getSigningKey picks the most recently valid key rebana may sign requests
+// to a service with, the service secret is used while there is none
+func getSigningKey(svc string) (kid, secret string) {
+	var l, err = getRedisSigningKeyList()
+
+	if err != nil {
+		return "", app.Secret
+	}
+
+	var t int64
+
+	for i := range l {
+		var k, s, err = getRedisSigningKey(l[i])
+
+		if err != nil || checkSigningKey(k, svc, "rebana") != nil ||
+			(kid != "" && k.NotBefore < t) {
+			continue
+		}
+
+		kid, secret, t = k.Id, s, k.NotBefore
+	}
+
+	if kid == "" {
+		return "", app.Secret
+	}
+
+	return
+}
@@ -19,10 +19,19 @@ const (
 	logcrit   string = "critical"
 )
 
+// LogInfo is created by the server and session handlers for every request
+// and passed to the Redis helpers, responses are signed with its Key
 type LogInfo struct {
 	Src   string
 	Uid   int64
 	Msgid int64
+
+	// key the response is signed with, set when the request was signed
+	// with an API or keyring key instead of the service secret
+	Key string
+
+	// name on the certificate of a mutual TLS client
+	Client string
 }
 
 type RebanaLog struct {
@@ -40,14 +49,15 @@ type RebanaLog struct {
 var (
 	debug bool
 	logfp *os.File
-	li    *LogInfo
 )
 
+// sli is used by startup, the signal handler, the message channel and Redis
+// reconnects
+var sli = &LogInfo{Src: "::1"}
+
 func setupLog(d bool) (err error) {
 	debug = d
 
-        li = &LogInfo{"::1", 0, 0}
-
 	if debug {
 		logfp = os.Stderr
 		fmt.Fprintf(logfp, "Debugging enabled - redirect to stderr\n")
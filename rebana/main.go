@@ -12,6 +12,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 )
 
@@ -41,6 +42,7 @@ type RequestMsg struct {
 	UserId  int64
 	Command string
 	Data    string
+	Nonce   string
 }
 
 type Msg struct {
@@ -51,9 +53,20 @@ type Msg struct {
 	Data     string
 }
 
+// BindInfo is a listening address, served over TLS when TLSCert and TLSKey
+// are set. With TLSClientCA only clients holding a certificate issued by
+// that CA are accepted.
 type BindInfo struct {
 	Host string
 	Port string
+
+	TLSCert     string
+	TLSKey      string
+	TLSClientCA string
+
+	// names the client certificates have to be issued to, any client
+	// the CA issued a certificate to may connect when empty
+	TLSClientNames []string
 }
 
 type AppConfig struct {
@@ -73,9 +86,31 @@ type AppConfig struct {
 	Secret    string
 	TLSCACert []string `json:"TLSCACert"`
 
+	// certificate presented to services that require mutual TLS
+	TLSClientCert string
+	TLSClientKey  string
+
+	// seconds a request Date may lie either side of the local clock, also
+	// how long request nonces are remembered for
+	ClockSkew int64
+
+	// canonical only accepts canonical request signatures, transition also
+	// accepts the legacy body signature while clients are upgraded. The
+	// default becomes canonical on 2027-04-01, set transition explicitly
+	// to keep legacy clients working past it.
+	SignatureMode string
+
+	// the API key secret of ghazal, API keys are not accepted without it
+	ApiKeySecret string
+
 	RedisUrl string
 	RedisPw  string
 	RedisDb  string
+
+	RoleRedisDb string
+
+	// refuse tunnel activation until the latest AUP is accepted
+	AUPRequired bool
 }
 
 type AppStat struct {
@@ -106,12 +141,18 @@ type AppStat struct {
 	ReqServerStatus             int64
 	ReqServerInfo               int64
 	ReqStatus                   int64
+	ReqLegacySignature          int64
 	ReqError                    int64
 	ReqErrUrl                   int64
 	ReqErrHeader                int64
 	ReqErrRedis                 int64
 	ReqErrPayload               int64
 	ReqErrSignature             int64
+	ReqErrApiKey                int64
+	ReqErrKeyId                 int64
+	ReqErrReplay                int64
+	ReqErrExpired               int64
+	ReqErrFuture                int64
 	ReqErrUserId                int64
 	ReqErrServerId              int64
 	ReqErrSessionId             int64
@@ -151,64 +192,88 @@ const (
 	PIDFILE  = "/var/run/rebung/rebana.pid"
 	CONFFILE = "/usr/local/etc/rebung/rebana.json"
 
+	// canonical request signature scheme
+	SIGALG = "N3-HMAC-SHA256"
+
 	// result codes
 	EOK    = 0
 	EINVAL = 1
 	EAGAIN = 2
 	ENOENT = 3
 	EPERM  = 4
+
+	// shared with ghazal, which uses 5 for password policy failures
+	EREPLAY = 6
+
+	// the user has yet to accept the latest AUP version
+	EAUP = 7
 )
 
 var (
 	app  *AppConfig
 	stat *AppStat
+
+	// statLock guards the counters of stat, which concurrent handlers
+	// bump through incStat
+	statLock sync.Mutex
 )
 
-func status(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqStatus++
+func incStat(c *int64) {
+	statLock.Lock()
+	*c++
+	statLock.Unlock()
+}
+
+func status(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqStatus)
+
+	// copied under the lock so the counters are from a single moment
+	statLock.Lock()
+	var s = *stat
+	statLock.Unlock()
 
-	var buf, _ = json.Marshal(&stat)
+	var buf, _ = json.Marshal(&s)
 
-	sendResponse(w, &Msg{Data: string(buf)})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
 func defaultHandler(w http.ResponseWriter, r *http.Request) {
-	stat.ReqAll++
-	li.Msgid = 0
+	incStat(&stat.ReqAll)
 
+	var li = &LogInfo{}
 	var err error
 	var str = "Invalid request"
 
-	if err = checkUrl(r); err != nil {
-		stat.ReqErrUrl++
-		sendError(w, EINVAL, str, err)
+	if err = checkUrl(li, r); err != nil {
+		incStat(&stat.ReqErrUrl)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
 	if err = checkHeader(r); err != nil {
-		stat.ReqErrHeader++
-		sendError(w, EINVAL, str, err)
+		incStat(&stat.ReqErrHeader)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
 	if err = checkRedis(); err != nil {
-		stat.ReqErrRedis++
-		sendError(w, EINVAL, str, err)
+		incStat(&stat.ReqErrRedis)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
 	var d *RequestMsg
 
-	if d, err = checkData(r); err != nil {
-		stat.ReqErrPayload++
-		sendError(w, EINVAL, str, err)
+	if d, err = checkData(li, r); err != nil {
+		incStat(&stat.ReqErrPayload)
+		sendError(w, li, getDataErrNo(err), str, err)
 		return
 	}
 
 	if li.Msgid, err = getRedisMsgId(d.Command); err != nil {
-		stat.ReqErrMsgId++
-		sendError(w, EINVAL, str, err)
+		incStat(&stat.ReqErrMsgId)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
@@ -216,12 +281,12 @@ func defaultHandler(w http.ResponseWriter, r *http.Request) {
 
 	switch d.Command {
 	case "server-status":
-		err = status(w, d)
+		err = status(w, li, d)
 	}
 
 	if err != nil {
 		str += ": " + d.Command
-		sendError(w, EINVAL, str, err)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
@@ -257,8 +322,13 @@ func main() {
 
 	var ch = channelHandler()
 
-	event(loginfo, li, "%v-%v server started: %v", app.ProgName, app.Version,
-		app.HostName)
+	event(loginfo, sli, "%v-%v server started: %v", app.ProgName,
+		app.Version, app.HostName)
+
+	// roles are in place before the first server request comes in
+	if err := setupRoles(); err != nil {
+		fatal(err.Error())
+	}
 
 	setupServer(ch)
 
@@ -281,7 +351,7 @@ func channelHandler() chan<- ChMsg {
 				if s.Type == chMsgFatal {
 					fatal(s.Msg)
 				} else {
-					event(loginfo, li, s.Msg)
+					event(loginfo, sli, s.Msg)
 				}
 			}
 		}
@@ -295,23 +365,24 @@ func sigHandler() {
 
 	var c = make(chan os.Signal, 1)
 
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-	var signal = <-c
+	for signal := range c {
+		event(lognotice, sli, "Signal received: "+signal.String())
 
-	event(lognotice, li, "Signal received: "+signal.String())
-
-	switch signal {
-	case syscall.SIGINT, syscall.SIGTERM:
-		quit = true
-	}
+		switch signal {
+		case syscall.SIGHUP:
+			reloadTLS()
+		case syscall.SIGINT, syscall.SIGTERM:
+			quit = true
+		}
 
-	if quit {
-		event(lognotice, li, "Terminating..")
-		os.Remove(PIDFILE)
-		os.Exit(0)
+		if quit {
+			event(lognotice, sli, "Terminating..")
+			os.Remove(PIDFILE)
+			os.Exit(0)
+		}
 	}
-
 }
 
 func usage() {
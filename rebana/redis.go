@@ -26,11 +26,24 @@
  * Messaging keys
  * --------------
  * msgid:next
+ * nonce:[nonce] (expires after twice the clock skew)
  *
  * User keys
  * ---------
- * user:admin-list
+ * user:admin-list (migrated to role:superadmin)
  * uid:[uid]:sessions-list
+ *
+ * Role keys (RoleRedisDb)
+ * -----------------------
+ * role:all-list
+ * role:[name]:perms
+ * role:[name]:uids
+ * uid:[uid]:roles
+ * apikey:[key id]
+ * aup:version-list
+ * aup:[version]:accepted
+ * keyring:key-list
+ * keyring:key:[key id]
  */
 
 package main
@@ -46,7 +59,10 @@ import (
 
 var rdp *redis.Pool
 
-func setRedisServerNew(s *ServerInfo) (vid int64, err error) {
+// rrp reaches the role and API keys, which may live in the ghazal database
+var rrp *redis.Pool
+
+func setRedisServerNew(li *LogInfo, s *ServerInfo) (vid int64, err error) {
 	var rdb = rdp.Get()
 	defer rdb.Close()
 
@@ -113,7 +129,8 @@ func setRedisServerNew(s *ServerInfo) (vid int64, err error) {
 	return
 }
 
-func setRedisServerAttr(vid int64, field, value string) (err error) {
+func setRedisServerAttr(li *LogInfo, vid int64, field,
+	value string) (err error) {
 	var rdb = rdp.Get()
 	defer rdb.Close()
 
@@ -129,7 +146,7 @@ func setRedisServerAttr(vid int64, field, value string) (err error) {
 	return
 }
 
-func setRedisServerAdminStatus(vid int64, f bool) (err error) {
+func setRedisServerAdminStatus(li *LogInfo, vid int64, f bool) (err error) {
 	var rdb = rdp.Get()
 	defer rdb.Close()
 
@@ -168,7 +185,7 @@ func setRedisServerAdminStatus(vid int64, f bool) (err error) {
 	return
 }
 
-func setRedisServerStatus(vid int64, f bool) (err error) {
+func setRedisServerStatus(li *LogInfo, vid int64, f bool) (err error) {
 	var rdb = rdp.Get()
 	defer rdb.Close()
 
@@ -209,7 +226,8 @@ func setRedisServerStatus(vid int64, f bool) (err error) {
 	return
 }
 
-func setRedisSessionOwner(uid, vid int64, f bool) (sid int64, err error) {
+func setRedisSessionOwner(li *LogInfo, uid, vid int64, f bool) (sid int64,
+	err error) {
 	var rdb = rdp.Get()
 	defer rdb.Close()
 
@@ -292,7 +310,8 @@ func setRedisSessionOwner(uid, vid int64, f bool) (sid int64, err error) {
 		rdb.Do("rpush", ril, sid)
 	}
 
-	if err = setRedisSessionActivityList(uid, vid, sid, action); err != nil {
+	if err = setRedisSessionActivityList(li, uid, vid, sid,
+		action); err != nil {
 		event(logwarn, li, err.Error())
 	}
 
@@ -301,7 +320,8 @@ func setRedisSessionOwner(uid, vid int64, f bool) (sid int64, err error) {
 	return
 }
 
-func setRedisSessionStatus(vid, sid, uid int64, dst string, f bool) (err error) {
+func setRedisSessionStatus(li *LogInfo, vid, sid, uid int64, dst string,
+	f bool) (err error) {
 	var rdb = rdp.Get()
 	defer rdb.Close()
 
@@ -330,7 +350,8 @@ func setRedisSessionStatus(vid, sid, uid int64, dst string, f bool) (err error)
 		rdb.Do("lrem", acl, 0, sid)
 	}
 
-	if err = setRedisSessionActivityList(uid, vid, sid, action); err != nil {
+	if err = setRedisSessionActivityList(li, uid, vid, sid,
+		action); err != nil {
 		event(logwarn, li, err.Error())
 	}
 
@@ -338,7 +359,8 @@ func setRedisSessionStatus(vid, sid, uid int64, dst string, f bool) (err error)
 	return
 }
 
-func setRedisSessionActivityList(uid, vid, sid int64, act string) (err error) {
+func setRedisSessionActivityList(li *LogInfo, uid, vid, sid int64,
+	act string) (err error) {
 	var rdb = rdp.Get()
 	defer rdb.Close()
 
@@ -366,6 +388,27 @@ func setRedisSessionActivityList(uid, vid, sid int64, act string) (err error) {
 	return
 }
 
+// setRedisNonce remembers a request nonce for ttl seconds, failing with a
+// ReplayError if it is already known
+func setRedisNonce(n string, ttl int64) (err error) {
+	var rdb = rdp.Get()
+	defer rdb.Close()
+
+	var key = "nonce:" + n
+
+	var r interface{}
+
+	if r, err = rdb.Do("set", key, 1, "ex", ttl, "nx"); err != nil {
+		return errors.New(fmt.Sprintf("Error saving Redis key [%v]", key))
+	}
+
+	if r == nil {
+		return &ReplayError{Nonce: n}
+	}
+
+	return
+}
+
 func getRedisMsgId(c string) (id int64, err error) {
 	var rdb = rdp.Get()
 	defer rdb.Close()
@@ -477,7 +520,7 @@ func getRedisServerInfo(vid int64) (s *ServerInfo, err error) {
 	return
 }
 
-func getRedisServerList(s string) (l []string, err error) {
+func getRedisServerList(li *LogInfo, s string) (l []string, err error) {
 	var rdb = rdp.Get()
 	defer rdb.Close()
 
@@ -501,7 +544,8 @@ func getRedisServerList(s string) (l []string, err error) {
 	return
 }
 
-func getRedisServerSvidList(vid int64, s string) (l []string, err error) {
+func getRedisServerSvidList(li *LogInfo, vid int64, s string) (l []string,
+	err error) {
 	var rdb = rdp.Get()
 	defer rdb.Close()
 
@@ -521,7 +565,8 @@ func getRedisServerSvidList(vid int64, s string) (l []string, err error) {
 	return
 }
 
-func getRedisUserUidList(uid int64, s string) (l []string, err error) {
+func getRedisUserUidList(li *LogInfo, uid int64, s string) (l []string,
+	err error) {
 	var rdb = rdp.Get()
 	defer rdb.Close()
 
@@ -541,6 +586,106 @@ func getRedisUserUidList(uid int64, s string) (l []string, err error) {
 	return
 }
 
+func setRedisRoleNew(name string, perms []string) (err error) {
+	var rdb = rrp.Get()
+	defer rdb.Close()
+
+	var key = fmt.Sprintf("role:%v:perms", name)
+
+	for i := range perms {
+		if _, err = rdb.Do("sadd", key, perms[i]); err != nil {
+			return errors.New(fmt.Sprintf("Error saving Redis key "+
+				"[%v]", key))
+		}
+	}
+
+	rdb.Do("lrem", "role:all-list", 0, name)
+	rdb.Do("rpush", "role:all-list", name)
+	return
+}
+
+func setRedisUserRole(uid int64, role string) (err error) {
+	var rdb = rrp.Get()
+	defer rdb.Close()
+
+	var key = fmt.Sprintf("uid:%v:roles", uid)
+
+	if _, err = rdb.Do("sadd", key, role); err != nil {
+		return errors.New(fmt.Sprintf("Error saving Redis key [%v]", key))
+	}
+
+	rdb.Do("sadd", fmt.Sprintf("role:%v:uids", role), uid)
+	return
+}
+
+func setRedisApiKeyUsed(kid string) (err error) {
+	var rdb = rrp.Get()
+	defer rdb.Close()
+
+	var key = "apikey:" + kid
+
+	if _, err = rdb.Do("hset", key, "last-used",
+		time.Now().Format(time.RFC1123)); err != nil {
+		return errors.New(fmt.Sprintf("Error saving Redis key [%v]", key))
+	}
+
+	return
+}
+
+func getRedisApiKey(kid string) (uid, scope, dgst string, err error) {
+	var rdb = rrp.Get()
+	defer rdb.Close()
+
+	var key = "apikey:" + kid
+
+	var r []string
+
+	if r, err = redis.Strings(rdb.Do("hmget", key, "uid", "scope",
+		"digest")); err != nil || len(r) != 3 || r[0] == "" {
+		return uid, scope, dgst, errors.New(fmt.Sprintf("Error "+
+			"retrieving Redis key [%v]", key))
+	}
+
+	return r[0], r[1], r[2], nil
+}
+
+func getRedisSigningKey(kid string) (k *SigningKey, secret string,
+	err error) {
+	var rdb = rrp.Get()
+	defer rdb.Close()
+
+	var key = "keyring:key:" + kid
+
+	var r []string
+
+	if r, err = redis.Strings(rdb.Do("hmget", key, "service", "callers",
+		"secret", "not-before", "not-after")); err != nil ||
+		len(r) != 5 || r[0] == "" {
+		return k, secret, errors.New(fmt.Sprintf("Error retrieving "+
+			"Redis key [%v]", key))
+	}
+
+	k = &SigningKey{Id: kid, Service: r[0], Callers: strings.Fields(r[1])}
+	k.NotBefore, _ = strconv.ParseInt(r[3], 0, 64)
+	k.NotAfter, _ = strconv.ParseInt(r[4], 0, 64)
+
+	return k, r[2], nil
+}
+
+func getRedisSigningKeyList() (l []string, err error) {
+	var rdb = rrp.Get()
+	defer rdb.Close()
+
+	var key = "keyring:key-list"
+
+	if l, err = redis.Strings(rdb.Do("lrange", key, 0, -1)); err != nil {
+		return l, errors.New(fmt.Sprintf("Error retrieving Redis key "+
+			"[%v]", key))
+	}
+
+	return
+}
+
 func getRedisUserList(s string) (l []string, err error) {
 	var rdb = rdp.Get()
 	defer rdb.Close()
@@ -605,6 +750,95 @@ func getRedisSessionInfo(vid, sid int64) (s *SessionInfo, err error) {
 	return
 }
 
+func deleteRedisUserAdmin(uid int64) {
+	var rdb = rdp.Get()
+	defer rdb.Close()
+
+	rdb.Do("lrem", "user:admin-list", 0, uid)
+}
+
+func checkRedisRoleExist(name string) (err error) {
+	var rdb = rrp.Get()
+	defer rdb.Close()
+
+	var key = fmt.Sprintf("role:%v:perms", name)
+
+	var exist bool
+
+	if exist, err = redis.Bool(rdb.Do("exists", key)); err != nil || !exist {
+		return errors.New(fmt.Sprintf("Error retrieving Redis key [%v]",
+			key))
+	}
+
+	return
+}
+
+// checkRedisUserPermission looks for the permission in any of the user roles
+func checkRedisUserPermission(uid int64, perm string) (ok bool, err error) {
+	var rdb = rrp.Get()
+	defer rdb.Close()
+
+	var key = fmt.Sprintf("uid:%v:roles", uid)
+
+	var l []string
+
+	if l, err = redis.Strings(rdb.Do("smembers", key)); err != nil {
+		return ok, errors.New(fmt.Sprintf("Error retrieving Redis key "+
+			"[%v]", key))
+	}
+
+	for i := range l {
+		key = fmt.Sprintf("role:%v:perms", l[i])
+
+		if ok, err = redis.Bool(rdb.Do("sismember", key, perm)); err != nil {
+			return ok, errors.New(fmt.Sprintf("Error retrieving Redis "+
+				"key [%v]", key))
+		}
+
+		if ok {
+			return
+		}
+	}
+
+	return
+}
+
+// checkRedisUserAUP returns an AUPError unless the user accepted the latest
+// AUP version published in ghazal, nothing is required before the first
+// one. ghazal rpushes each version, so the latest is the last entry.
+func checkRedisUserAUP(uid int64) (err error) {
+	var rdb = rrp.Get()
+	defer rdb.Close()
+
+	var key = "aup:version-list"
+
+	var l []string
+
+	if l, err = redis.Strings(rdb.Do("lrange", key, -1, -1)); err != nil {
+		return errors.New(fmt.Sprintf("Error retrieving Redis key [%v]",
+			key))
+	}
+
+	if len(l) == 0 {
+		return
+	}
+
+	key = fmt.Sprintf("aup:%v:accepted", l[0])
+
+	var ok bool
+
+	if ok, err = redis.Bool(rdb.Do("hexists", key, uid)); err != nil {
+		return errors.New(fmt.Sprintf("Error retrieving Redis key [%v]",
+			key))
+	}
+
+	if !ok {
+		return &AUPError{Uid: uid, Version: l[0]}
+	}
+
+	return
+}
+
 func checkRedisKeyExist(key string) (err error) {
 	var rdb = rdp.Get()
 	defer rdb.Close()
@@ -691,28 +925,33 @@ func checkRedisMsgId(id int64) (err error) {
 
 func checkRedis() (err error) {
 	if rdp == nil {
-		rdp = &redis.Pool{MaxIdle: 5, IdleTimeout: 300 * time.Second,
-			Dial: func() (rdb redis.Conn, err error) {
-				if rdb, err = redis.Dial("tcp",
-					app.RedisUrl); err != nil {
-					return
-				}
+		rdp = newRedisPool(app.RedisDb)
 
-				if _, err = rdb.Do("auth",
-					app.RedisPw); err != nil {
-					return
-				}
+		event(loginfo, sli, "Connected to Redis: %v", app.RedisUrl)
+	}
 
-				if _, err = rdb.Do("select",
-					app.RedisDb); err != nil {
-					return
-				}
+	if rrp == nil {
+		rrp = newRedisPool(app.RoleRedisDb)
+	}
+
+	return
+}
 
+func newRedisPool(db string) *redis.Pool {
+	return &redis.Pool{MaxIdle: 5, IdleTimeout: 300 * time.Second,
+		Dial: func() (rdb redis.Conn, err error) {
+			if rdb, err = redis.Dial("tcp", app.RedisUrl); err != nil {
 				return
-			}}
+			}
 
-		event(loginfo, li, "Connected to Redis: %v", app.RedisUrl)
-	}
+			if _, err = rdb.Do("auth", app.RedisPw); err != nil {
+				return
+			}
 
-	return
+			if _, err = rdb.Do("select", db); err != nil {
+				return
+			}
+
+			return
+		}}
 }
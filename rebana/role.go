@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const superadmin = "superadmin"
+
+// permissions shared with ghazal, superadmin holds all of them
+var permissions = []string{
+	"user.read",
+	"user.write",
+	"user.admin",
+	"role.read",
+	"role.write",
+	"server.read",
+	"server.write",
+	"session.assign",
+}
+
+// serverPermission declares the permission each server command requires
+var serverPermission = map[string]string{
+	"resolve-server":       "server.read",
+	"resolve-server-id":    "server.read",
+	"list-server":          "server.read",
+	"get-server-list":      "server.read",
+	"tunnel-server-status": "server.read",
+	"server-info":          "server.read",
+	"add-server":           "server.write",
+	"set-server-attr":      "server.write",
+	"enable-server":        "server.write",
+	"disable-server":       "server.write",
+	"activate-server":      "server.write",
+	"deactivate-server":    "server.write",
+}
+
+// sessionPermission declares the permission of the session commands that act
+// on the tunnel sessions of another user, the request user ID is the acting
+// user and the session owner is in the payload
+var sessionPermission = map[string]string{
+	"assign-session":   "session.assign",
+	"reassign-session": "session.assign",
+}
+
+// setupRoles makes sure the superadmin role holds every permission, whether
+// or not ghazal created it first, and moves the users of the legacy admin
+// list into it
+func setupRoles() (err error) {
+	if err = checkRedis(); err != nil {
+		return
+	}
+
+	var isnew = checkRedisRoleExist(superadmin) != nil
+
+	if err = setRedisRoleNew(superadmin, permissions); err != nil {
+		return
+	}
+
+	if isnew {
+		event(lognotice, sli, "Role %v created", superadmin)
+	}
+
+	var l []string
+
+	// an empty admin list means there is nothing left to migrate
+	if l, err = getRedisUserList("admin"); err != nil {
+		return nil
+	}
+
+	for i := range l {
+		var uid, _ = strconv.ParseInt(l[i], 0, 64)
+
+		if err = setRedisUserRole(uid, superadmin); err != nil {
+			return
+		}
+
+		deleteRedisUserAdmin(uid)
+
+		event(lognotice, sli, "User [%v] migrated to role %v", uid,
+			superadmin)
+	}
+
+	return
+}
+
+func checkUserPermission(uid int64, perm string) (err error) {
+	var ok bool
+
+	if ok, err = checkRedisUserPermission(uid, perm); err != nil {
+		return
+	}
+
+	if !ok {
+		return errors.New(fmt.Sprintf("User [%v] lacks permission %v",
+			uid, perm))
+	}
+
+	return
+}
@@ -20,6 +20,7 @@ type TSReqMsg struct {
 	MsgId   int64
 	Command string
 	Data    string
+	Nonce   string
 }
 
 type TSMsg struct {
@@ -93,13 +94,14 @@ type UserServerInfoList struct {
 	Entry []UserServerInfo
 }
 
-func resolveServer(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqResolveServer++
+func resolveServer(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqResolveServer)
 
 	var m *NameList
 
 	if m, err = getNameList(d.Data, d.Command); err != nil {
-		stat.ReqErrResolveServer++
+		incStat(&stat.ReqErrResolveServer)
 		return
 	}
 
@@ -118,17 +120,18 @@ func resolveServer(w http.ResponseWriter, d *RequestMsg) (err error) {
 
 	var buf, _ = json.Marshal(&IdList{Id: m.Id, Entry: si})
 
-	sendResponse(w, &Msg{Data: string(buf)})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
-func resolveServerId(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqResolveServerId++
+func resolveServerId(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqResolveServerId)
 
 	var m *IdList
 
 	if m, err = getIdList(d.Data, d.Command); err != nil {
-		stat.ReqErrResolveServerId++
+		incStat(&stat.ReqErrResolveServerId)
 		return
 	}
 
@@ -147,17 +150,17 @@ func resolveServerId(w http.ResponseWriter, d *RequestMsg) (err error) {
 
 	var buf, _ = json.Marshal(&IdList{Id: m.Id, Entry: si})
 
-	sendResponse(w, &Msg{Data: string(buf)})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
-func addServer(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqAddServer++
+func addServer(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqAddServer)
 
 	var m *NameList
 
 	if m, err = getNameList(d.Data, d.Command); err != nil {
-		stat.ReqErrAddServer++
+		incStat(&stat.ReqErrAddServer)
 		return
 	}
 
@@ -207,12 +210,12 @@ func addServer(w http.ResponseWriter, d *RequestMsg) (err error) {
 	}
 
 	if err != nil {
-		stat.ReqErrAddServer++
+		incStat(&stat.ReqErrAddServer)
 		return errors.New("Invalid tunnel server parameter: " + p)
 	}
 
 	if c != 0 {
-		stat.ReqErrAddServer++
+		incStat(&stat.ReqErrAddServer)
 		err = errors.New("Insufficient tunnel server parameters")
 		return
 	}
@@ -230,8 +233,8 @@ func addServer(w http.ResponseWriter, d *RequestMsg) (err error) {
 
 	var vid int64
 
-	if vid, err = setRedisServerNew(s); err != nil {
-		stat.ReqErrAddServer++
+	if vid, err = setRedisServerNew(li, s); err != nil {
+		incStat(&stat.ReqErrAddServer)
 		return
 	} else {
 		si[0] = Id{Id: vid, Opt: s.Name}
@@ -255,17 +258,18 @@ func addServer(w http.ResponseWriter, d *RequestMsg) (err error) {
 
 	var buf, _ = json.Marshal(&IdList{Id: m.Id, Entry: si})
 
-	sendResponse(w, &Msg{Data: string(buf)})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
-func setServerAttr(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqSetServerAttr++
+func setServerAttr(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqSetServerAttr)
 
 	var m *NameList
 
 	if m, err = getNameList(d.Data, d.Command); err != nil {
-		stat.ReqErrSetServerAttr++
+		incStat(&stat.ReqErrSetServerAttr)
 		return
 	}
 
@@ -280,7 +284,7 @@ func setServerAttr(w http.ResponseWriter, d *RequestMsg) (err error) {
 			e.Name == "tunsrc" || e.Name == "ppprefix" ||
                         e.Name == "rtprefix" {
 
-			if err = setRedisServerAttr(m.Id, e.Name,
+			if err = setRedisServerAttr(li, m.Id, e.Name,
 				e.Opt); err != nil {
 				si[i] = Name{Name: e.Name, ErrNo: ENOENT}
 				event(logwarn, li, err.Error())
@@ -288,24 +292,25 @@ func setServerAttr(w http.ResponseWriter, d *RequestMsg) (err error) {
 				si[i] = Name{Name: e.Name, Opt: e.Opt}
 			}
 		} else {
-			stat.ReqErrSetServerAttr++
+			incStat(&stat.ReqErrSetServerAttr)
 			return errors.New("Attribute not permitted: " + e.Name)
 		}
 	}
 
 	var buf, _ = json.Marshal(&NameList{Id: m.Id, Entry: si})
 
-	sendResponse(w, &Msg{Data: string(buf)})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
-func enableServer(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqEnableServer++
+func enableServer(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqEnableServer)
 
 	var m *IdList
 
 	if m, err = getIdList(d.Data, d.Command); err != nil {
-		stat.ReqErrEnableServer++
+		incStat(&stat.ReqErrEnableServer)
 		return
 	}
 
@@ -314,7 +319,7 @@ func enableServer(w http.ResponseWriter, d *RequestMsg) (err error) {
 	for i := range m.Entry {
 		var e = m.Entry[i]
 
-		if err = setRedisServerAdminStatus(e.Id, true); err != nil {
+		if err = setRedisServerAdminStatus(li, e.Id, true); err != nil {
 			si[i] = Id{Id: e.Id, ErrNo: ENOENT}
 			event(logwarn, li, err.Error())
 		} else {
@@ -324,17 +329,18 @@ func enableServer(w http.ResponseWriter, d *RequestMsg) (err error) {
 
 	var buf, _ = json.Marshal(&IdList{Id: m.Id, Entry: si})
 
-	sendResponse(w, &Msg{Data: string(buf)})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
-func disableServer(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqDisableServer++
+func disableServer(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqDisableServer)
 
 	var m *IdList
 
 	if m, err = getIdList(d.Data, d.Command); err != nil {
-		stat.ReqErrDisableServer++
+		incStat(&stat.ReqErrDisableServer)
 		return
 	}
 
@@ -343,7 +349,8 @@ func disableServer(w http.ResponseWriter, d *RequestMsg) (err error) {
 	for i := range m.Entry {
 		var e = m.Entry[i]
 
-		if err = setRedisServerAdminStatus(e.Id, false); err != nil {
+		if err = setRedisServerAdminStatus(li, e.Id,
+			false); err != nil {
 			si[i] = Id{Id: e.Id, ErrNo: ENOENT}
 			event(logwarn, li, err.Error())
 		} else {
@@ -353,17 +360,18 @@ func disableServer(w http.ResponseWriter, d *RequestMsg) (err error) {
 
 	var buf, _ = json.Marshal(&IdList{Id: m.Id, Entry: si})
 
-	sendResponse(w, &Msg{Data: string(buf)})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
-func activateServer(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqActivateServer++
+func activateServer(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqActivateServer)
 
 	var m *IdList
 
 	if m, err = getIdList(d.Data, d.Command); err != nil {
-		stat.ReqErrActivateServer++
+		incStat(&stat.ReqErrActivateServer)
 		return
 	}
 
@@ -372,7 +380,7 @@ func activateServer(w http.ResponseWriter, d *RequestMsg) (err error) {
 	for i := range m.Entry {
 		var e = m.Entry[i]
 
-		if err = setRedisServerStatus(e.Id, true); err != nil {
+		if err = setRedisServerStatus(li, e.Id, true); err != nil {
 			si[i] = Id{Id: e.Id, ErrNo: ENOENT}
 			event(logwarn, li, err.Error())
 		} else {
@@ -382,17 +390,18 @@ func activateServer(w http.ResponseWriter, d *RequestMsg) (err error) {
 
 	var buf, _ = json.Marshal(&IdList{Id: m.Id, Entry: si})
 
-	sendResponse(w, &Msg{Data: string(buf)})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
-func deactivateServer(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqDeactivateServer++
+func deactivateServer(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqDeactivateServer)
 
 	var m *IdList
 
 	if m, err = getIdList(d.Data, d.Command); err != nil {
-		stat.ReqErrDeactivateServer++
+		incStat(&stat.ReqErrDeactivateServer)
 		return
 	}
 
@@ -401,7 +410,7 @@ func deactivateServer(w http.ResponseWriter, d *RequestMsg) (err error) {
 	for i := range m.Entry {
 		var e = m.Entry[i]
 
-		if err = setRedisServerStatus(e.Id, false); err != nil {
+		if err = setRedisServerStatus(li, e.Id, false); err != nil {
 			si[i] = Id{Id: e.Id, ErrNo: ENOENT}
 			event(logwarn, li, err.Error())
 		} else {
@@ -411,17 +420,17 @@ func deactivateServer(w http.ResponseWriter, d *RequestMsg) (err error) {
 
 	var buf, _ = json.Marshal(&IdList{Id: m.Id, Entry: si})
 
-	sendResponse(w, &Msg{Data: string(buf)})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
-func listServer(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqListServer++
+func listServer(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqListServer)
 
 	var m *IdList
 
 	if m, err = getIdList(d.Data, d.Command); err != nil {
-		stat.ReqErrListServer++
+		incStat(&stat.ReqErrListServer)
 		return
 	}
 
@@ -432,7 +441,7 @@ func listServer(w http.ResponseWriter, d *RequestMsg) (err error) {
 		var args = strings.Split(m.Entry[0].Opt, ":")
 
 		if c := len(args); c != 4 {
-			stat.ReqErrListServer++
+			incStat(&stat.ReqErrListServer)
 			return errors.New("Invalid server list parameter count")
 		}
 
@@ -441,7 +450,7 @@ func listServer(w http.ResponseWriter, d *RequestMsg) (err error) {
 		if list == "all" || list == "enabled" || list == "disabled" ||
 			list == "active" || list == "inactive" {
 		} else {
-			stat.ReqErrListServer++
+			incStat(&stat.ReqErrListServer)
 			return errors.New("Invalid server list: " + list)
 		}
 
@@ -449,7 +458,7 @@ func listServer(w http.ResponseWriter, d *RequestMsg) (err error) {
 		var npage, _ = strconv.ParseInt(args[2], 0, 32)
 
 		if page == 0 || npage < 10 {
-			stat.ReqErrListServer++
+			incStat(&stat.ReqErrListServer)
 			return errors.New("Invalid list page count")
 		}
 
@@ -482,14 +491,14 @@ func listServer(w http.ResponseWriter, d *RequestMsg) (err error) {
 				return s1.RegDate > s2.RegDate
 			}
 		} else {
-			stat.ReqErrListServer++
+			incStat(&stat.ReqErrListServer)
 			return errors.New("Invalid sort field: " + sby)
 		}
 
 		var v []string
 
-		if v, err = getRedisServerList(list); err != nil {
-			stat.ReqErrListServer++
+		if v, err = getRedisServerList(li, list); err != nil {
+			incStat(&stat.ReqErrListServer)
 			return
 		}
 
@@ -521,7 +530,7 @@ func listServer(w http.ResponseWriter, d *RequestMsg) (err error) {
 			var eofs = int(pofs*int(npage) + (int(npage) - 1))
 
 			if sofs >= c {
-				stat.ReqErrListServer++
+				incStat(&stat.ReqErrListServer)
 				return errors.New("Invalid page offset")
 			}
 
@@ -557,24 +566,25 @@ func listServer(w http.ResponseWriter, d *RequestMsg) (err error) {
 
 	var buf, _ = json.Marshal(sil)
 
-	sendResponse(w, &Msg{Data: string(buf)})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
-func getServerList(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqGetServerList++
+func getServerList(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqGetServerList)
 
 	var m *IdList
 
 	if m, err = getIdList(d.Data, d.Command); err != nil {
-		stat.ReqErrGetServerList++
+		incStat(&stat.ReqErrGetServerList)
 		return
 	}
 
 	var args = strings.Split(m.Entry[0].Opt, ":")
 
 	if c := len(args); c != 4 {
-		stat.ReqErrGetServerList++
+		incStat(&stat.ReqErrGetServerList)
 		return errors.New("Invalid server list parameter count")
 	}
 
@@ -584,7 +594,7 @@ func getServerList(w http.ResponseWriter, d *RequestMsg) (err error) {
 		list == "active-sessions" || list == "assigned-sessions" ||
 		list == "unassigned-sessions" || list == "session-activity" {
 	} else {
-		stat.ReqErrGetServerList++
+		incStat(&stat.ReqErrGetServerList)
 		return errors.New("Invalid server list: " + list)
 	}
 
@@ -592,14 +602,15 @@ func getServerList(w http.ResponseWriter, d *RequestMsg) (err error) {
 	var npage, _ = strconv.ParseInt(args[2], 0, 32)
 
 	if page == 0 || npage < 10 {
-		stat.ReqErrGetServerList++
+		incStat(&stat.ReqErrGetServerList)
 		return errors.New("Invalid list page count")
 	}
 
 	var v []string
 
-	if v, err = getRedisServerSvidList(m.Entry[0].Id, list); err != nil {
-		stat.ReqErrGetServerList++
+	if v, err = getRedisServerSvidList(li, m.Entry[0].Id,
+		list); err != nil {
+		incStat(&stat.ReqErrGetServerList)
 		return
 	}
 
@@ -624,7 +635,7 @@ func getServerList(w http.ResponseWriter, d *RequestMsg) (err error) {
 			var eofs = int(pofs*int(npage) + (int(npage) - 1))
 
 			if sofs >= c {
-				stat.ReqErrGetServerList++
+				incStat(&stat.ReqErrGetServerList)
 				return errors.New("Invalid page offset")
 			}
 
@@ -649,7 +660,7 @@ func getServerList(w http.ResponseWriter, d *RequestMsg) (err error) {
 		var sil *SessionInfoList
 
 		if sv, err = getRedisServerInfo(e.Id); err != nil {
-			stat.ReqErrGetServerList++
+			incStat(&stat.ReqErrGetServerList)
 			return
 		}
 
@@ -688,7 +699,7 @@ func getServerList(w http.ResponseWriter, d *RequestMsg) (err error) {
 			var eofs = int(pofs*int(npage) + (int(npage) - 1))
 
 			if sofs >= c {
-				stat.ReqErrGetServerList++
+				incStat(&stat.ReqErrGetServerList)
 				return errors.New("Invalid page offset")
 			}
 
@@ -709,17 +720,18 @@ func getServerList(w http.ResponseWriter, d *RequestMsg) (err error) {
 		buf, _ = json.Marshal(sil)
 	}
 
-	sendResponse(w, &Msg{Data: string(buf)})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
-func serverStatus(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqServerStatus++
+func serverStatus(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqServerStatus)
 
 	var m *IdList
 
 	if m, err = getIdList(d.Data, d.Command); err != nil {
-		stat.ReqErrServerStatus++
+		incStat(&stat.ReqErrServerStatus)
 		return
 	}
 
@@ -728,7 +740,7 @@ func serverStatus(w http.ResponseWriter, d *RequestMsg) (err error) {
 	var url string
 
 	if url, err = getRedisServerUrl(e.Id); err != nil {
-		stat.ReqErrServerStatus++
+		incStat(&stat.ReqErrServerStatus)
 		return
 	}
 
@@ -739,36 +751,44 @@ func serverStatus(w http.ResponseWriter, d *RequestMsg) (err error) {
 
 	var res *TSMsg
 
-	if res, err = sendTSRequest(url, req); err != nil {
-		stat.ReqErrServerStatus++
+	if res, err = sendTSRequest(li, url, req); err != nil {
+		incStat(&stat.ReqErrServerStatus)
 		return
 	}
 
-	sendResponse(w, &Msg{Data: res.Data})
+	sendResponse(w, li, &Msg{Data: res.Data})
 	return
 }
 
-func serverInfo(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqServerInfo++
+func serverInfo(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqServerInfo)
+
+	// a tunnel server with a client certificate only gets its own info
+	if li.Client != "" && li.Client != d.Data {
+		incStat(&stat.ReqErrServerInfo)
+		return errors.New("Client certificate " + li.Client +
+			" does not match server " + d.Data)
+	}
 
 	var vid int64
 
 	if vid, err = getRedisServerIdFromName(d.Data); err != nil {
-		stat.ReqErrServerInfo++
+		incStat(&stat.ReqErrServerInfo)
 		return
 	}
 
 	var si = &ServerInfo{}
 
 	if si, err = getRedisServerInfo(vid); err != nil {
-		stat.ReqErrServerInfo++
+		incStat(&stat.ReqErrServerInfo)
 		return
 	}
 
 	var list []string
 	var sa []TSInfoSession
 
-	if list, err = getRedisServerSvidList(vid, "active-sessions"); err != nil {
+	if list, err = getRedisServerSvidList(li, vid,
+		"active-sessions"); err != nil {
 		err = nil
 		event(lognotice, li, "No active sessions for server [%v]", vid)
 	} else {
@@ -792,52 +812,53 @@ func serverInfo(w http.ResponseWriter, d *RequestMsg) (err error) {
 	var buf, _ = json.Marshal(&TSInfo{Id: vid, TunSrc: si.TunnelSrc,
 		PpPrefix: si.PpPrefix, RtPrefix: si.RtPrefix, Session: sa})
 
-	sendResponse(w, &Msg{Data: string(buf)})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
 func defaultServerHandler(w http.ResponseWriter, r *http.Request) {
-	stat.ReqAll++
-	li.Msgid = 0
+	incStat(&stat.ReqAll)
 
+	var li = &LogInfo{}
 	var err error
 	var str = "Invalid request"
 
-	if err = checkUrl(r); err != nil {
-		stat.ReqErrUrl++
-		sendError(w, EINVAL, str, err)
+	if err = checkUrl(li, r); err != nil {
+		incStat(&stat.ReqErrUrl)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
 	if err = checkHeader(r); err != nil {
-		stat.ReqErrHeader++
-		sendError(w, EINVAL, str, err)
+		incStat(&stat.ReqErrHeader)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
 	if err = checkRedis(); err != nil {
-		stat.ReqErrRedis++
-		sendError(w, EINVAL, str, err)
+		incStat(&stat.ReqErrRedis)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
 	var d *RequestMsg
 
-	if d, err = checkData(r); err != nil {
-		stat.ReqErrPayload++
-		sendError(w, EINVAL, str, err)
+	if d, err = checkData(li, r); err != nil {
+		incStat(&stat.ReqErrPayload)
+		sendError(w, li, getDataErrNo(err), str, err)
 		return
 	}
 
 	if li.Msgid, err = getRedisMsgId(d.Command); err != nil {
-		stat.ReqErrMsgId++
-		sendError(w, EINVAL, str, err)
+		incStat(&stat.ReqErrMsgId)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
-	if err = checkUserAdmin(d.UserId); err != nil {
-		stat.ReqErrUserId++
-		sendError(w, EPERM, str, err)
+	if err = checkUserPermission(d.UserId,
+		serverPermission[d.Command]); err != nil {
+		incStat(&stat.ReqErrUserId)
+		sendError(w, li, EPERM, str, err)
 		return
 	}
 
@@ -845,45 +866,45 @@ func defaultServerHandler(w http.ResponseWriter, r *http.Request) {
 
 	switch d.Command {
 	case "resolve-server":
-		err = resolveServer(w, d)
+		err = resolveServer(w, li, d)
 
 	case "resolve-server-id":
-		err = resolveServerId(w, d)
+		err = resolveServerId(w, li, d)
 
 	case "add-server":
-		err = addServer(w, d)
+		err = addServer(w, li, d)
 
 	case "set-server-attr":
-		err = setServerAttr(w, d)
+		err = setServerAttr(w, li, d)
 
 	case "enable-server":
-		err = enableServer(w, d)
+		err = enableServer(w, li, d)
 
 	case "disable-server":
-		err = disableServer(w, d)
+		err = disableServer(w, li, d)
 
 	case "activate-server":
-		err = activateServer(w, d)
+		err = activateServer(w, li, d)
 
 	case "deactivate-server":
-		err = deactivateServer(w, d)
+		err = deactivateServer(w, li, d)
 
 	case "list-server":
-		err = listServer(w, d)
+		err = listServer(w, li, d)
 
 	case "get-server-list":
-		err = getServerList(w, d)
+		err = getServerList(w, li, d)
 
 	case "tunnel-server-status":
-		err = serverStatus(w, d)
+		err = serverStatus(w, li, d)
 
 	case "server-info":
-		err = serverInfo(w, d)
+		err = serverInfo(w, li, d)
 	}
 
 	if err != nil {
 		str += ": " + d.Command
-		sendError(w, EINVAL, str, err)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
@@ -6,6 +6,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 	"strings"
@@ -55,13 +56,14 @@ type UserSessionInfoList struct {
 	Entry []UserSessionInfo
 }
 
-func activateSession(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqActivateSession++
+func activateSession(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqActivateSession)
 
 	var m *IdList
 
 	if m, err = getIdList(d.Data, d.Command); err != nil {
-		stat.ReqErrActivateSession++
+		incStat(&stat.ReqErrActivateSession)
 		return
 	}
 
@@ -70,32 +72,40 @@ func activateSession(w http.ResponseWriter, d *RequestMsg) (err error) {
 	var e = m.Entry[0]
 
         if ipf, err = checkIPFamily(e.Opt); ipf != 4 {
-		stat.ReqErrActivateSession++
+		incStat(&stat.ReqErrActivateSession)
 		return
         }
 
 	if err = checkRedisServerStatus(e.Id); err != nil {
-		stat.ReqErrActivateSession++
+		incStat(&stat.ReqErrActivateSession)
 		return
 	}
 
-	if sid, err = getUserSession(d.UserId, e.Id); err != nil {
-		stat.ReqErrActivateSession++
+	if sid, err = getUserSession(li, d.UserId, e.Id); err != nil {
+		incStat(&stat.ReqErrActivateSession)
 		return
 	}
 
 	var s *SessionInfo
 
 	if s, err = getRedisSessionInfo(e.Id, sid); err != nil {
-		stat.ReqErrActivateSession++
+		incStat(&stat.ReqErrActivateSession)
 		return
 	}
 
 	var idx, _ = strconv.ParseInt(s.Idx, 16, 64)
 	var uid, _ = strconv.ParseInt(s.Uid, 0, 64)
 
-	if err = setRedisSessionStatus(e.Id, sid, uid, e.Opt, true); err != nil {
-		stat.ReqErrActivateSession++
+	if app.AUPRequired {
+		if err = checkRedisUserAUP(uid); err != nil {
+			incStat(&stat.ReqErrActivateSession)
+			return
+		}
+	}
+
+	if err = setRedisSessionStatus(li, e.Id, sid, uid, e.Opt,
+		true); err != nil {
+		incStat(&stat.ReqErrActivateSession)
 		return
 	}
 
@@ -108,31 +118,32 @@ func activateSession(w http.ResponseWriter, d *RequestMsg) (err error) {
 	var url string
 
 	if url, err = getRedisServerUrl(e.Id); err != nil {
-		stat.ReqErrActivateSession++
+		incStat(&stat.ReqErrActivateSession)
 		return
 	}
 
 	url += "/activate"
 
-	if _, err = sendTSRequest(url, req); err != nil {
-		stat.ReqErrActivateSession++
+	if _, err = sendTSRequest(li, url, req); err != nil {
+		incStat(&stat.ReqErrActivateSession)
 		return
 	}
 
 	buf, _ = json.Marshal(&IdList{Id: e.Id, Entry: []Id{Id{Id: sid,
                 Opt: e.Opt}}})
 
-        sendResponse(w, &Msg{Data: string(buf)})
+        sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
-func deactivateSession(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqDeactivateSession++
+func deactivateSession(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqDeactivateSession)
 
 	var m *IdList
 
 	if m, err = getIdList(d.Data, d.Command); err != nil {
-		stat.ReqErrDeactivateSession++
+		incStat(&stat.ReqErrDeactivateSession)
 		return
 	}
 
@@ -141,32 +152,33 @@ func deactivateSession(w http.ResponseWriter, d *RequestMsg) (err error) {
 	var e = m.Entry[0]
 
         if ipf, err = checkIPFamily(e.Opt); ipf != 4 {
-		stat.ReqErrActivateSession++
+		incStat(&stat.ReqErrActivateSession)
 		return
         }
 
 	if err = checkRedisServerStatus(e.Id); err != nil {
-		stat.ReqErrDeactivateSession++
+		incStat(&stat.ReqErrDeactivateSession)
 		return
 	}
 
-	if sid, err = getUserSession(d.UserId, e.Id); err != nil {
-		stat.ReqErrDeactivateSession++
+	if sid, err = getUserSession(li, d.UserId, e.Id); err != nil {
+		incStat(&stat.ReqErrDeactivateSession)
 		return
 	}
 
 	var s *SessionInfo
 
 	if s, err = getRedisSessionInfo(e.Id, sid); err != nil {
-		stat.ReqErrDeactivateSession++
+		incStat(&stat.ReqErrDeactivateSession)
 		return
 	}
 
 	var idx, _ = strconv.ParseInt(s.Idx, 16, 64)
 	var uid, _ = strconv.ParseInt(s.Uid, 0, 64)
 
-	if err = setRedisSessionStatus(e.Id, sid, uid, e.Opt, false); err != nil {
-		stat.ReqErrDeactivateSession++
+	if err = setRedisSessionStatus(li, e.Id, sid, uid, e.Opt,
+		false); err != nil {
+		incStat(&stat.ReqErrDeactivateSession)
 		return
 	}
 
@@ -179,31 +191,32 @@ func deactivateSession(w http.ResponseWriter, d *RequestMsg) (err error) {
 	var url string
 
 	if url, err = getRedisServerUrl(e.Id); err != nil {
-		stat.ReqErrDeactivateSession++
+		incStat(&stat.ReqErrDeactivateSession)
 		return
 	}
 
 	url += "/deactivate"
 
-	if _, err = sendTSRequest(url, req); err != nil {
-		stat.ReqErrDeactivateSession++
+	if _, err = sendTSRequest(li, url, req); err != nil {
+		incStat(&stat.ReqErrDeactivateSession)
 		return
 	}
 
 	buf, _ = json.Marshal(&IdList{Id: e.Id, Entry: []Id{Id{Id: sid,
                 Opt: e.Opt}}})
 
-        sendResponse(w, &Msg{Data: string(buf)})
+        sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
-func checkSession(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqCheckSession++
+func checkSession(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqCheckSession)
 
 	var m *IdList
 
 	if m, err = getIdList(d.Data, d.Command); err != nil {
-		stat.ReqErrCheckSession++
+		incStat(&stat.ReqErrCheckSession)
 		return
 	}
 
@@ -212,24 +225,24 @@ func checkSession(w http.ResponseWriter, d *RequestMsg) (err error) {
 	var e = m.Entry[0]
 
         if ipf, err = checkIPFamily(e.Opt); ipf != 4 {
-		stat.ReqErrActivateSession++
+		incStat(&stat.ReqErrActivateSession)
 		return
         }
 
 	if err = checkRedisServerStatus(e.Id); err != nil {
-		stat.ReqErrCheckSession++
+		incStat(&stat.ReqErrCheckSession)
 		return
 	}
 
-	if sid, err = getUserSession(d.UserId, e.Id); err != nil {
-		stat.ReqErrDeactivateSession++
+	if sid, err = getUserSession(li, d.UserId, e.Id); err != nil {
+		incStat(&stat.ReqErrDeactivateSession)
 		return
 	}
 
 	var s *SessionInfo
 
 	if s, err = getRedisSessionInfo(e.Id, sid); err != nil {
-		stat.ReqErrDeactivateSession++
+		incStat(&stat.ReqErrDeactivateSession)
 		return
 	}
 
@@ -244,7 +257,7 @@ func checkSession(w http.ResponseWriter, d *RequestMsg) (err error) {
 	var url string
 
 	if url, err = getRedisServerUrl(e.Id); err != nil {
-		stat.ReqErrCheckSession++
+		incStat(&stat.ReqErrCheckSession)
 		return
 	}
 
@@ -252,15 +265,15 @@ func checkSession(w http.ResponseWriter, d *RequestMsg) (err error) {
 
 	var res *TSMsg
 
-	if res, err = sendTSRequest(url, req); err != nil {
-		stat.ReqErrCheckSession++
+	if res, err = sendTSRequest(li, url, req); err != nil {
+		incStat(&stat.ReqErrCheckSession)
 		return
 	}
 
 	var idl *IdList
 
 	if idl, err = getIdList(res.Data, "ts-check-session"); err != nil {
-		stat.ReqErrCheckSession++
+		incStat(&stat.ReqErrCheckSession)
 		return
 	}
 
@@ -276,63 +289,78 @@ func checkSession(w http.ResponseWriter, d *RequestMsg) (err error) {
 
 	buf, _ = json.Marshal(&IdList{Id: e.Id, Entry: si})
 
-        sendResponse(w, &Msg{Data: string(buf)})
+        sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
-func assignSession(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqAssignSession++
+func assignSession(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqAssignSession)
 
 	var m *IdList
 
 	if m, err = getIdList(d.Data, d.Command); err != nil {
-		stat.ReqErrAssignSession++
+		incStat(&stat.ReqErrAssignSession)
 		return
 	}
 
+	if m.Id == 0 {
+		incStat(&stat.ReqErrAssignSession)
+		return errors.New("Invalid session owner")
+	}
+
 	var sid int64
 	var e = m.Entry[0]
 
-	if sid, err = setRedisSessionOwner(d.UserId, e.Id, true); err != nil {
+	if sid, err = setRedisSessionOwner(li, m.Id, e.Id,
+		true); err != nil {
 		return
 	}
 
 	var buf, _ = json.Marshal(&IdList{Id: e.Id, Entry: []Id{Id{Id: sid}}})
 
-        sendResponse(w, &Msg{Data: string(buf)})
+        sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
-func reassignSession(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqReassignSession++
+func reassignSession(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqReassignSession)
 
 	var m *IdList
 
 	if m, err = getIdList(d.Data, d.Command); err != nil {
-		stat.ReqErrReassignSession++
+		incStat(&stat.ReqErrReassignSession)
 		return
 	}
 
+	if m.Id == 0 {
+		incStat(&stat.ReqErrReassignSession)
+		return errors.New("Invalid session owner")
+	}
+
 	var sid int64
 	var e = m.Entry[0]
 
-	if sid, err = setRedisSessionOwner(d.UserId, e.Id, false); err != nil {
+	if sid, err = setRedisSessionOwner(li, m.Id, e.Id,
+		false); err != nil {
 		return
 	}
 
 	var buf, _ = json.Marshal(&IdList{Id: e.Id, Entry: []Id{Id{Id: sid}}})
 
-        sendResponse(w, &Msg{Data: string(buf)})
+        sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
-func listUserSessions(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqListUserSession++
+func listUserSessions(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqListUserSession)
 
 	var m []string
 
-	if m, err = getRedisUserUidList(d.UserId, "sessions"); err != nil {
-		stat.ReqErrListUserSession++
+	if m, err = getRedisUserUidList(li, d.UserId, "sessions"); err != nil {
+		incStat(&stat.ReqErrListUserSession)
 		return
 	}
 
@@ -377,23 +405,24 @@ func listUserSessions(w http.ResponseWriter, d *RequestMsg) (err error) {
 	var buf, _ = json.Marshal(&UserSessionInfoList{Id: int64(len(si)),
                 Entry: si})
 
-        sendResponse(w, &Msg{Data: string(buf)})
+        sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
-func listUserServers(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqListUserServer++
+func listUserServers(w http.ResponseWriter, li *LogInfo,
+	d *RequestMsg) (err error) {
+	incStat(&stat.ReqListUserServer)
 
 	var m []string
 
-	if m, err = getRedisUserUidList(d.UserId, "sessions"); err != nil {
+	if m, err = getRedisUserUidList(li, d.UserId, "sessions"); err != nil {
 		event(lognotice, li, err.Error())
 	}
 
 	var v []string
 
-	if v, err = getRedisServerList("all"); err != nil {
-		stat.ReqErrListUserServer++
+	if v, err = getRedisServerList(li, "all"); err != nil {
+		incStat(&stat.ReqErrListUserServer)
 		return
 	}
 
@@ -435,77 +464,92 @@ func listUserServers(w http.ResponseWriter, d *RequestMsg) (err error) {
 	var buf, _ = json.Marshal(&UserServerInfoList{Id: int64(len(si)),
                 Entry: si})
 
-        sendResponse(w, &Msg{Data: string(buf)})
+        sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
 func defaultSessionHandler(w http.ResponseWriter, r *http.Request) {
-	stat.ReqAll++
-        li.Msgid = 0
+	incStat(&stat.ReqAll)
 
+	var li = &LogInfo{}
 	var err error
 	var str = "Invalid request"
 
-	if err = checkUrl(r); err != nil {
-		stat.ReqErrUrl++
-		sendError(w, EINVAL, str, err)
+	if err = checkUrl(li, r); err != nil {
+		incStat(&stat.ReqErrUrl)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
 	if err = checkHeader(r); err != nil {
-		stat.ReqErrHeader++
-		sendError(w, EINVAL, str, err)
+		incStat(&stat.ReqErrHeader)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
 	if err = checkRedis(); err != nil {
-		stat.ReqErrRedis++
-		sendError(w, EINVAL, str, err)
+		incStat(&stat.ReqErrRedis)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
 	var d *RequestMsg
 
-	if d, err = checkData(r); err != nil {
-		stat.ReqErrPayload++
-		sendError(w, EINVAL, str, err)
+	if d, err = checkData(li, r); err != nil {
+		incStat(&stat.ReqErrPayload)
+		sendError(w, li, getDataErrNo(err), str, err)
 		return
 	}
 
 	if li.Msgid, err = getRedisMsgId(d.Command); err != nil {
-		stat.ReqErrMsgId++
-		sendError(w, EINVAL, str, err)
+		incStat(&stat.ReqErrMsgId)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
+	if p, ok := sessionPermission[d.Command]; ok {
+		if err = checkUserPermission(d.UserId, p); err != nil {
+			incStat(&stat.ReqErrUserId)
+			sendError(w, li, EPERM, str, err)
+			return
+		}
+	}
+
         event(logdebug, li, "Processing request [%v:%v]", d.Command, li.Msgid)
 
 	switch d.Command {
 	case "activate-session":
-		err = activateSession(w, d)
+		err = activateSession(w, li, d)
 
 	case "deactivate-session":
-		err = deactivateSession(w, d)
+		err = deactivateSession(w, li, d)
 
 	case "check-session":
-		err = checkSession(w, d)
+		err = checkSession(w, li, d)
 
 	case "assign-session":
-		err = assignSession(w, d)
+		err = assignSession(w, li, d)
 
 	case "reassign-session":
-		err = reassignSession(w, d)
+		err = reassignSession(w, li, d)
 
 	case "list-user-sessions":
-		err = listUserSessions(w, d)
+		err = listUserSessions(w, li, d)
 
 	case "list-user-servers":
-		err = listUserServers(w, d)
+		err = listUserServers(w, li, d)
 	}
 
 	if err != nil {
 		str += ": " + d.Command
-		sendError(w, EINVAL, str, err)
+
+		// told apart so clients can ask the user to accept the AUP
+		if _, ok := err.(*AUPError); ok {
+			sendError(w, li, EAUP, str, err)
+			return
+		}
+
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// tlsListener holds the server config of a TLS bind, it is replaced in place
+// when the certificates are reloaded so open listeners pick it up
+type tlsListener struct {
+	sync.Mutex
+
+	bind *BindInfo
+	conf *tls.Config
+}
+
+var tlsListeners []*tlsListener
+
+// tlscLock guards tlsc, which reloadTLS replaces while requests and mail
+// are sent with it
+var tlscLock sync.Mutex
+
+// load reads the certificate, key and client CA of the bind, a bind with a
+// client CA only accepts clients holding a certificate it issued
+func (l *tlsListener) load() (err error) {
+	var cert tls.Certificate
+
+	if cert, err = tls.LoadX509KeyPair(l.bind.TLSCert,
+		l.bind.TLSKey); err != nil {
+		return errors.New("Error loading TLS cert " + l.bind.TLSCert)
+	}
+
+	var c = &tls.Config{Certificates: []tls.Certificate{cert},
+		MinVersion: tls.VersionTLS12}
+
+	if l.bind.TLSClientCA != "" {
+		var data []byte
+
+		if data, err = ioutil.ReadFile(l.bind.TLSClientCA); err != nil {
+			return errors.New("Error reading TLS client CA cert " +
+				l.bind.TLSClientCA)
+		}
+
+		var p = x509.NewCertPool()
+
+		if !p.AppendCertsFromPEM(data) {
+			return errors.New("Error parsing TLS client CA cert " +
+				l.bind.TLSClientCA)
+		}
+
+		c.ClientCAs = p
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+		c.VerifyPeerCertificate = l.checkClientName
+	}
+
+	l.Lock()
+	l.conf = c
+	l.Unlock()
+
+	return
+}
+
+// checkClientName refuses a client whose certificate is not issued to one
+// of the TLSClientNames of the bind, without them any certificate of the
+// client CA is accepted. Which tunnel server a client may speak for is
+// checked per request by checkClientCert.
+func (l *tlsListener) checkClientName(raw [][]byte,
+	chains [][]*x509.Certificate) error {
+	if len(l.bind.TLSClientNames) == 0 {
+		return nil
+	}
+
+	var cn = chains[0][0].Subject.CommonName
+
+	for i := range l.bind.TLSClientNames {
+		if cn == l.bind.TLSClientNames[i] {
+			return nil
+		}
+	}
+
+	return errors.New("Client certificate " + cn + " is not allowed")
+}
+
+func (l *tlsListener) getConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.conf, nil
+}
+
+// getListener opens a bind, serving TLS when it has a certificate
+func getListener(b *BindInfo) (ln net.Listener, err error) {
+	var addr = net.JoinHostPort(b.Host, b.Port)
+
+	if b.TLSCert == "" {
+		return net.Listen("tcp", addr)
+	}
+
+	var l = &tlsListener{bind: b}
+
+	if err = l.load(); err != nil {
+		return
+	}
+
+	if ln, err = tls.Listen("tcp", addr,
+		&tls.Config{GetConfigForClient: l.getConfig}); err != nil {
+		return
+	}
+
+	tlsListeners = append(tlsListeners, l)
+	return
+}
+
+// reloadTLS rereads the certificates of every TLS bind and the client
+// config, whatever fails to load keeps its current certificates
+func reloadTLS() {
+	for _, l := range tlsListeners {
+		if err := l.load(); err != nil {
+			event(logwarn, sli, err.Error())
+		}
+	}
+
+	if c, err := setTLSConfig(); err != nil {
+		event(logwarn, sli, err.Error())
+	} else {
+		tlscLock.Lock()
+		tlsc = c
+		tlscLock.Unlock()
+	}
+
+	event(lognotice, sli, "TLS certificates reloaded")
+}
+
+// getClientName returns the name on the certificate of a mutual TLS
+// client, empty without one. Unlike the caller header it cannot be chosen by
+// the client, keys restricted to callers are checked against it.
+func getClientName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+
+	return r.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+// checkClientCert holds a mutual TLS client to the tunnel server it names,
+// any other certificate of the client CA could otherwise speak for it
+func checkClientCert(r *http.Request) (err error) {
+	var cn = getClientName(r)
+	var ts = r.Header.Get("X-N3-Tunnel-Server")
+
+	if cn != "" && ts != "" && cn != ts {
+		return errors.New("Client certificate " + cn +
+			" does not match tunnel server " + ts)
+	}
+
+	return
+}
+
+// getTLSClientConfig returns the TLS config for connections to other
+// services and mail servers
+func getTLSClientConfig() *tls.Config {
+	tlscLock.Lock()
+	defer tlscLock.Unlock()
+
+	return tlsc
+}
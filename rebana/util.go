@@ -7,10 +7,12 @@ package main
 import (
 	"bytes"
 	"crypto/hmac"
+	crand "crypto/rand"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
@@ -21,6 +23,7 @@ import (
 	"net/mail"
 	"net/smtp"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -98,6 +101,20 @@ func parseConfig(f string) (err error) {
 		}
 	}
 
+	if app.ClockSkew == 0 {
+		app.ClockSkew = 10
+	}
+
+	// legacy clients have until 2027-04-01, the default is canonical after
+	if app.SignatureMode == "" {
+		app.SignatureMode = "transition"
+	}
+
+	if app.SignatureMode != "transition" &&
+		app.SignatureMode != "canonical" {
+		fatal("Invalid signature mode: %v", app.SignatureMode)
+	}
+
 	if app.RedisUrl == "" {
 		fatal("Redis URL is empty")
 	}
@@ -110,6 +127,10 @@ func parseConfig(f string) (err error) {
 		fatal("Redis database index is empty")
 	}
 
+	if app.RoleRedisDb == "" {
+		app.RoleRedisDb = app.RedisDb
+	}
+
 	return
 }
 
@@ -117,24 +138,24 @@ func getNameList(s string, c string) (d *NameList, err error) {
 	d = &NameList{}
 
 	if err = json.Unmarshal([]byte(s), d); err != nil {
-		stat.ReqErrData++
+		incStat(&stat.ReqErrData)
 		return nil, errors.New("Error unmarshaling NameList struct")
 	}
 
 	if d.Id != 0 {
 		if c == "set-server-attr" {
 			if err = checkRedisServerId(d.Id); err != nil {
-				stat.ReqErrServerId++
+				incStat(&stat.ReqErrServerId)
 				return
 			}
 		} else {
-			stat.ReqErrServerId++
+			incStat(&stat.ReqErrServerId)
 			return nil, errors.New("Invalid tunnel server ID")
 		}
 	}
 
 	if len(d.Entry) == 0 {
-		stat.ReqErrData++
+		incStat(&stat.ReqErrData)
 		return nil, errors.New("Invalid arg list")
 	}
 
@@ -145,7 +166,7 @@ func getIdList(s string, c string) (d *IdList, err error) {
 	d = &IdList{}
 
 	if err = json.Unmarshal([]byte(s), d); err != nil {
-		stat.ReqErrData++
+		incStat(&stat.ReqErrData)
 		return nil, errors.New("Error unmarshaling IdList struct")
 	}
 
@@ -153,27 +174,27 @@ func getIdList(s string, c string) (d *IdList, err error) {
 		if c == "get-server-list" || c == "activate-session" ||
 			c == "deactivate-session" || c == "check-session" {
 			if err = checkRedisServerId(d.Id); err != nil {
-				stat.ReqErrServerId++
+				incStat(&stat.ReqErrServerId)
 				return
 			}
 		} else {
-			stat.ReqErrServerId++
+			incStat(&stat.ReqErrServerId)
 			return nil, errors.New("Invalid tunnel server ID")
 		}
 	}
 
 	if len(d.Entry) == 0 {
-		stat.ReqErrData++
+		incStat(&stat.ReqErrData)
 		return nil, errors.New("Invalid arg list")
 	}
 
 	return
 }
 
-func getUserSession(uid, vid int64) (sid int64, err error) {
+func getUserSession(li *LogInfo, uid, vid int64) (sid int64, err error) {
 	var list []string
 
-	if list, err = getRedisUserUidList(uid, "sessions"); err != nil {
+	if list, err = getRedisUserUidList(li, uid, "sessions"); err != nil {
 		return
 	}
 
@@ -197,16 +218,131 @@ func getUserSession(uid, vid int64) (sid int64, err error) {
 	return
 }
 
-func signRequest(m []byte, id int64) string {
-	var dgst = hmac.New(sha256.New, []byte(app.Secret))
+// signResponse signs with the API key digest of a key-signed request
+func signResponse(li *LogInfo, m []byte) string {
+	if li.Key != "" {
+		return signKeyRequest(m, li.Key)
+	}
+
+	return signKeyRequest(m, app.Secret)
+}
+
+func signKeyRequest(m []byte, key string) string {
+	var dgst = hmac.New(sha256.New, []byte(key))
 
 	dgst.Write(m)
 
 	return base64.StdEncoding.EncodeToString(dgst.Sum(nil))
 }
 
-func checkSignature(sig string, m []byte) (err error) {
-	var dgst = hmac.New(sha256.New, []byte(app.Secret))
+// getSignedHeaders lists the headers a canonical signature has to cover,
+// Content-Type, Date and every X-N3 header save the signature itself
+func getSignedHeaders(h http.Header) []string {
+	var l = []string{"content-type", "date"}
+
+	for k := range h {
+		k = strings.ToLower(k)
+
+		if strings.HasPrefix(k, "x-n3-") && k != "x-n3-signature" {
+			l = append(l, k)
+		}
+	}
+
+	sort.Strings(l)
+	return l
+}
+
+// getCanonicalSignature signs the method, path, signed headers and body
+// digest of a request, hashed into a string to sign alongside its Date
+func getCanonicalSignature(r *http.Request, signed []string, body []byte,
+	key string) []byte {
+	var b = sha256.Sum256(body)
+	var c = r.Method + "\n" + r.URL.Path + "\n" + r.URL.RawQuery + "\n"
+
+	for _, k := range signed {
+		var v = r.Header[http.CanonicalHeaderKey(k)]
+
+		c += k + ":" + strings.TrimSpace(strings.Join(v, ",")) + "\n"
+	}
+
+	c += "\n" + strings.Join(signed, ";") + "\n" + hex.EncodeToString(b[:])
+
+	var d = sha256.Sum256([]byte(c))
+	var s = SIGALG + "\n" + r.Header.Get("Date") + "\n" +
+		hex.EncodeToString(d[:])
+	var dgst = hmac.New(sha256.New, []byte(key))
+
+	dgst.Write([]byte(s))
+
+	return dgst.Sum(nil)
+}
+
+// signCanonicalRequest returns the X-N3-Signature header of req, every
+// other header has to be set before it is signed
+func signCanonicalRequest(req *http.Request, body []byte, key string) string {
+	var l = getSignedHeaders(req.Header)
+	var s = getCanonicalSignature(req, l, body, key)
+
+	return fmt.Sprintf("%v SignedHeaders=%v,Signature=%v", SIGALG,
+		strings.Join(l, ";"), base64.StdEncoding.EncodeToString(s))
+}
+
+// checkRequestSignature verifies the canonical signature of a request, the
+// legacy signature of the body alone is accepted in transition mode
+func checkRequestSignature(r *http.Request, sig string, body []byte,
+	key string) (err error) {
+	if !strings.HasPrefix(sig, SIGALG+" ") {
+		if app.SignatureMode != "transition" {
+			return errors.New("Legacy signature not accepted")
+		}
+
+		if err = checkKeySignature(sig, body, key); err == nil {
+			incStat(&stat.ReqLegacySignature)
+		}
+
+		return
+	}
+
+	var signed []string
+	var str string
+
+	for _, v := range strings.Split(sig[len(SIGALG)+1:], ",") {
+		v = strings.TrimSpace(v)
+
+		if strings.HasPrefix(v, "SignedHeaders=") {
+			signed = strings.Split(v[len("SignedHeaders="):], ";")
+		} else if strings.HasPrefix(v, "Signature=") {
+			str = v[len("Signature="):]
+		}
+	}
+
+	var m = make(map[string]bool)
+
+	for _, v := range signed {
+		m[v] = true
+	}
+
+	for _, v := range getSignedHeaders(r.Header) {
+		if !m[v] {
+			return errors.New("Header not signed: " + v)
+		}
+	}
+
+	var s []byte
+
+	if s, err = base64.StdEncoding.DecodeString(str); err != nil {
+		return errors.New("Error decoding signature string")
+	}
+
+	if !hmac.Equal(s, getCanonicalSignature(r, signed, body, key)) {
+		return errors.New("Message signature does not match")
+	}
+
+	return
+}
+
+func checkKeySignature(sig string, m []byte, key string) (err error) {
+	var dgst = hmac.New(sha256.New, []byte(key))
 
 	dgst.Write(m)
 
@@ -223,39 +359,82 @@ func checkSignature(sig string, m []byte) (err error) {
 	return
 }
 
+// checkMsgExpiry rejects a request dated outside the allowed clock skew, a
+// date ahead of the local clock is reported apart from an expired one
 func checkMsgExpiry(t time.Time) (err error) {
-	if time.Now().Sub(t).Seconds() > 10.0 {
+	var d = time.Now().Sub(t).Seconds()
+
+	if d > float64(app.ClockSkew) {
+		incStat(&stat.ReqErrExpired)
 		return errors.New("Message has expired")
 	}
 
+	if -d > float64(app.ClockSkew) {
+		incStat(&stat.ReqErrFuture)
+		return errors.New("Message is dated in the future")
+	}
+
 	return
 }
 
-func checkUserAdmin(id int64) (err error) {
-	var list []string
-	var m bool
+// ReplayError reports a request nonce seen before within the clock skew
+// window
+type ReplayError struct {
+	Nonce string
+}
 
-	if list, err = getRedisUserList("admin"); err != nil {
-		return
+func (e *ReplayError) Error() string {
+	return "Message nonce has been used: " + e.Nonce
+}
+
+// AUPError reports a user who has yet to accept the latest AUP version
+type AUPError struct {
+	Uid     int64
+	Version string
+}
+
+func (e *AUPError) Error() string {
+	return fmt.Sprintf("User [%v] has not accepted AUP version %v", e.Uid,
+		e.Version)
+}
+
+// checkNonce rejects a request whose nonce is malformed or already used.
+// Nonces are [unix time].[random], the time has to match the Date header so
+// a captured request cannot be replayed later under a fresh date.
+func checkNonce(n string, t time.Time) (err error) {
+	if n == "" {
+		return errors.New("Missing message nonce")
 	}
 
-	var uid = fmt.Sprintf("%v", id)
+	var p = strings.Split(n, ".")
 
-	for i := range list {
-		if uid == list[i] {
-			m = true
-			break
-		}
+	if len(p) != 2 || p[1] == "" {
+		return errors.New("Invalid message nonce: " + n)
 	}
 
-	if !m {
-		return errors.New(fmt.Sprintf("User [%v] is not an admin", uid))
+	if ts, _ := strconv.ParseInt(p[0], 0, 64); ts != t.Unix() {
+		return errors.New("Message nonce does not match Date header")
+	}
+
+	// a nonce is kept for both sides of the window it can be accepted in
+	if err = setRedisNonce(n, 2*app.ClockSkew); err != nil {
+		incStat(&stat.ReqErrReplay)
+		return
 	}
 
 	return
 }
 
-func checkUrl(r *http.Request) (err error) {
+// getDataErrNo returns the result code for a checkData failure
+func getDataErrNo(err error) int {
+	if _, ok := err.(*ReplayError); ok {
+		return EREPLAY
+	}
+
+	return EINVAL
+}
+
+func checkUrl(li *LogInfo, r *http.Request) (err error) {
 	switch r.URL.Path {
 	case "/v/resolve":
 	case "/v/add":
@@ -280,6 +459,8 @@ func checkUrl(r *http.Request) (err error) {
 		li.Src = ip
 	}
 
+	li.Client = getClientName(r)
+
 	event(logdebug, li, "New connection from %v to %v", li.Src, r.URL.Path)
 	return
 }
@@ -297,36 +478,74 @@ func checkHeader(r *http.Request) (err error) {
 		return errors.New("Invalid Service-Name header: " + s)
 	}
 
+	if err = checkClientCert(r); err != nil {
+		return
+	}
+
 	return
 }
 
-func checkData(r *http.Request) (d *RequestMsg, err error) {
-	if err = json.NewDecoder(r.Body).Decode(&d); err != nil {
+func checkData(li *LogInfo, r *http.Request) (d *RequestMsg, err error) {
+	var body []byte
+
+	if body, err = ioutil.ReadAll(r.Body); err != nil {
+		return d, errors.New("Error reading request body")
+	}
+
+	if err = json.Unmarshal(body, &d); err != nil {
 		return d, errors.New("Invalid JSON payload")
 	}
 
-        t, _ := time.Parse(time.RFC1123, r.Header.Get("Date"))
+	var h = r.Header.Get("Date")
+
+	if h == "" {
+		return d, errors.New("Missing Date header")
+	}
+
+	var t time.Time
+
+	if t, err = time.Parse(time.RFC1123, h); err != nil {
+		return d, errors.New("Invalid Date header: " + h)
+	}
 
-        /*
 	if err = checkMsgExpiry(t); err != nil {
 		return
-	}*/
+	}
 
 	var sig = r.Header.Get("X-N3-Signature")
-	var buf, _ = json.Marshal(d)
 
-	if err = checkSignature(sig, buf); err != nil {
-		stat.ReqErrSignature++
+	if kid := r.Header.Get("X-N3-Api-Key"); kid != "" {
+		if err = checkApiKey(li, r, kid, sig, body, d); err != nil {
+			incStat(&stat.ReqErrApiKey)
+			return
+		}
+	} else if kid := r.Header.Get("X-N3-Key-Id"); kid != "" {
+		if err = checkKeyId(li, r, kid, sig, body); err != nil {
+			incStat(&stat.ReqErrKeyId)
+			return
+		}
+	} else if err = checkRequestSignature(r, sig, body,
+		app.Secret); err != nil {
+		incStat(&stat.ReqErrSignature)
 		return
 	}
 
+	// only a signed nonce is remembered, so forged requests cannot use
+	// up a legitimate one. Legacy clients send none, their requests are
+	// only bounded by the Date window until transition mode is retired.
+	if strings.HasPrefix(sig, SIGALG+" ") {
+		if err = checkNonce(d.Nonce, t); err != nil {
+			return
+		}
+	}
+
 	if err = checkCommand(d.Command); err != nil {
-		stat.ReqErrCommand++
+		incStat(&stat.ReqErrCommand)
 		return
 	}
 
 	if d.UserId == 0 {
-		stat.ReqErrUserId++
+		incStat(&stat.ReqErrUserId)
 		return d, errors.New("Invalid user ID")
 	}
 
@@ -400,14 +619,14 @@ func checkIPFamily(s string) (f int, err error) {
 	return f, errors.New("Invalid IP address: " + s)
 }
 
-func sendResponse(w http.ResponseWriter, m *Msg) {
+func sendResponse(w http.ResponseWriter, li *LogInfo, m *Msg) {
 	var data = &Msg{HostName: app.HostName, UserId: li.Uid, MsgId: li.Msgid,
 		Data: m.Data}
 	var buf, _ = json.Marshal(data)
 
 	w.Header().Add("Content-Type", "application/json")
 	w.Header().Add("X-N3-Service-Name", "rebana")
-	w.Header().Add("X-N3-Signature", signRequest(buf, data.MsgId))
+	w.Header().Add("X-N3-Signature", signResponse(li, buf))
 
 	fmt.Fprintf(w, "%s", buf)
 
@@ -416,9 +635,10 @@ func sendResponse(w http.ResponseWriter, m *Msg) {
 		data.UserId, data.MsgId, data.ErrNo)
 }
 
-func sendError(w http.ResponseWriter, errno int, estr string, err error) {
+func sendError(w http.ResponseWriter, li *LogInfo, errno int, estr string,
+	err error) {
 	event(logwarn, li, err.Error())
-	stat.ReqError++
+	incStat(&stat.ReqError)
 
 	var data = &Msg{HostName: app.HostName, UserId: li.Uid, MsgId: li.Msgid,
 		ErrNo: errno, Data: estr}
@@ -426,7 +646,7 @@ func sendError(w http.ResponseWriter, errno int, estr string, err error) {
 
 	w.Header().Add("Content-Type", "application/json")
 	w.Header().Add("X-N3-Service-Name", "rebana")
-	w.Header().Add("X-N3-Signature", signRequest(buf, data.MsgId))
+	w.Header().Add("X-N3-Signature", signResponse(li, buf))
 
 	fmt.Fprintf(w, "%s", buf)
 
@@ -435,7 +655,26 @@ func sendError(w http.ResponseWriter, errno int, estr string, err error) {
 		data.UserId, data.MsgId, data.ErrNo)
 }
 
-func sendTSRequest(url string, m *TSReqMsg) (d *TSMsg, err error) {
+// newNonce returns a request nonce for a request dated t, the receiving
+// service rejects a nonce it has already seen
+func newNonce(t time.Time) (n string, err error) {
+	var p = make([]byte, 12)
+
+	if _, err = crand.Read(p); err != nil {
+		return
+	}
+
+	return fmt.Sprintf("%v.%v", t.Unix(),
+		base64.URLEncoding.EncodeToString(p)), nil
+}
+
+func sendTSRequest(li *LogInfo, url string, m *TSReqMsg) (d *TSMsg, err error) {
+	var now = time.Now()
+
+	if m.Nonce, err = newNonce(now); err != nil {
+		return d, errors.New("Unable to craft request nonce")
+	}
+
 	var buf, _ = json.Marshal(m)
 	var rd = bytes.NewReader(buf)
 
@@ -455,15 +694,23 @@ func sendTSRequest(url string, m *TSReqMsg) (d *TSMsg, err error) {
 		return
 	}
 
-	req.Header.Add("Date", time.Now().In(loc).Format(time.RFC1123))
+	req.Header.Add("Date", now.In(loc).Format(time.RFC1123))
 	req.Header.Add("Accept", "application/json")
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("X-N3-Service-Name", "rebana")
-	req.Header.Add("X-N3-Signature", signRequest(buf, m.MsgId))
+	req.Header.Add("X-N3-Caller", "rebana")
+
+	var kid, secret = getSigningKey("rebanats")
+
+	if kid != "" {
+		req.Header.Add("X-N3-Key-Id", kid)
+	}
+
+	req.Header.Add("X-N3-Signature", signCanonicalRequest(req, buf, secret))
 
 	var con = &http.Client{}
 
-	con.Transport = &http.Transport{TLSClientConfig: tlsc}
+	con.Transport = &http.Transport{TLSClientConfig: getTLSClientConfig()}
 
 	var res *http.Response
 
@@ -483,8 +730,8 @@ func sendTSRequest(url string, m *TSReqMsg) (d *TSMsg, err error) {
 
 	buf, _ = json.Marshal(d)
 
-	if err = checkSignature(sig, buf); err != nil {
-		stat.ReqErrSignature++
+	if err = checkKeySignature(sig, buf, secret); err != nil {
+		incStat(&stat.ReqErrSignature)
 		return
 	}
 
@@ -512,7 +759,7 @@ func sendMail(r []string, s, b string) (err error) {
 		return
 	}
 
-	if err = con.StartTLS(tlsc); err != nil {
+	if err = con.StartTLS(getTLSClientConfig()); err != nil {
 		return errors.New("StartTLS negotiation failed")
 	}
 
@@ -563,15 +810,20 @@ func setupServer(ch chan<- ChMsg) {
 	http.HandleFunc("/v/", defaultServerHandler)
 
 	for i := range app.Bind {
-		var b = net.JoinHostPort(app.Bind[i].Host, app.Bind[i].Port)
+		var ln, err = getListener(&app.Bind[i])
 
-		go func() {
-			if err := http.ListenAndServe(b, nil); err != nil {
+		if err != nil {
+			ch <- ChMsg{Type: chMsgFatal, Msg: err.Error()}
+			return
+		}
+
+		go func(ln net.Listener) {
+			if err := http.Serve(ln, nil); err != nil {
 				ch <- ChMsg{Type: chMsgFatal, Msg: err.Error()}
 			}
-		}()
+		}(ln)
 
-                msg := fmt.Sprintf("Listening on %v", b)
+		var msg = fmt.Sprintf("Listening on %v", ln.Addr())
 		ch <- ChMsg{Type: chMsgNotice, Msg: msg}
 	}
 
@@ -612,5 +864,16 @@ func setTLSConfig() (p *tls.Config, err error) {
 
 	p = &tls.Config{RootCAs: opts.Roots}
 
+	if app.TLSClientCert != "" {
+		var c tls.Certificate
+
+		if c, err = tls.LoadX509KeyPair(app.TLSClientCert,
+			app.TLSClientKey); err != nil {
+			return p, errors.New("Error loading TLS client cert")
+		}
+
+		p.Certificates = []tls.Certificate{c}
+	}
+
 	return
 }
@@ -0,0 +1,183 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SigningKey is a request signing key of the keyring file. It is valid from
+// NotBefore until NotAfter, 0 for a key that does not expire, and only for
+// the listed callers, or any caller when none are listed.
+type SigningKey struct {
+	Id        string
+	Service   string
+	Secret    string
+	Callers   []string
+	NotBefore int64
+	NotAfter  int64
+}
+
+// keyRing holds the keys of the keyring file. The tunnel server has no
+// Redis to read the ghazal keyring from, the file is reread whenever it
+// changes so keys can be rolled out without a restart.
+type keyRing struct {
+	sync.Mutex
+
+	file  string
+	mtime time.Time
+	keys  []SigningKey
+}
+
+var keyring *keyRing
+
+func newKeyRing(f string) *keyRing {
+	return &keyRing{file: f}
+}
+
+// load rereads the keyring file if it changed, the keys already loaded are
+// kept when it cannot be read
+func (kr *keyRing) load() {
+	if kr.file == "" {
+		return
+	}
+
+	var fi, err = os.Stat(kr.file)
+
+	if err != nil || fi.ModTime().Equal(kr.mtime) {
+		return
+	}
+
+	var buf []byte
+	var l []SigningKey
+
+	if buf, err = ioutil.ReadFile(kr.file); err == nil {
+		err = json.Unmarshal(buf, &l)
+	}
+
+	if err != nil {
+		event(logwarn, sli, "Unable to load signing keys from %v",
+			kr.file)
+		return
+	}
+
+	kr.keys = l
+	kr.mtime = fi.ModTime()
+
+	event(loginfo, sli, "Loaded %v signing keys from %v", len(l), kr.file)
+}
+
+// get returns a copy of a key by its ID
+func (kr *keyRing) get(kid string) (k *SigningKey, err error) {
+	kr.Lock()
+	defer kr.Unlock()
+
+	kr.load()
+
+	for i := range kr.keys {
+		if kr.keys[i].Id == kid {
+			var c = kr.keys[i]
+			return &c, nil
+		}
+	}
+
+	return k, errors.New("Invalid signing key: " + kid)
+}
+
+// pick returns the most recently valid key caller may sign requests to a
+// service with, nil while there is none
+func (kr *keyRing) pick(svc, caller string) (k *SigningKey) {
+	kr.Lock()
+	defer kr.Unlock()
+
+	kr.load()
+
+	for i := range kr.keys {
+		var c = kr.keys[i]
+
+		if checkSigningKey(&c, svc, caller) != nil ||
+			(k != nil && c.NotBefore < k.NotBefore) {
+			continue
+		}
+
+		k = &c
+	}
+
+	return
+}
+
+// checkSigningKey checks a key may sign a request from caller to the
+// service at this time
+func checkSigningKey(k *SigningKey, svc, caller string) (err error) {
+	var now = time.Now().Unix()
+
+	if k.Service != svc {
+		return errors.New(fmt.Sprintf("Signing key %v is not valid "+
+			"for %v", k.Id, svc))
+	}
+
+	if now < k.NotBefore {
+		return errors.New("Signing key " + k.Id + " is not yet valid")
+	}
+
+	if k.NotAfter != 0 && now >= k.NotAfter {
+		return errors.New("Signing key " + k.Id + " has expired")
+	}
+
+	if len(k.Callers) == 0 {
+		return
+	}
+
+	for i := range k.Callers {
+		if caller == k.Callers[i] {
+			return
+		}
+	}
+
+	return errors.New(fmt.Sprintf("Signing key %v is not valid for "+
+		"caller %v", k.Id, caller))
+}
+
+// checkKeyId verifies a request signed with a keyring key instead of the
+// service secret, the response is signed with the same key
+func checkKeyId(li *LogInfo, r *http.Request, kid, sig string,
+	m []byte) (err error) {
+	var k *SigningKey
+
+	if k, err = keyring.get(kid); err != nil {
+		return
+	}
+
+	var caller = r.Header.Get("X-N3-Caller")
+
+	// a mutual TLS client is held to the name on its certificate. Without
+	// one the caller header is only trusted under a canonical signature, a
+	// legacy signature covers the body alone.
+	if cn := getClientName(r); cn != "" {
+		caller = cn
+	} else if len(k.Callers) != 0 && !strings.HasPrefix(sig, SIGALG+" ") {
+		return errors.New("Signing key " + kid + " is restricted to " +
+			"callers and needs a canonical signature")
+	}
+
+	if err = checkSigningKey(k, "rebanats", caller); err != nil {
+		return
+	}
+
+	if err = checkRequestSignature(r, sig, m, k.Secret); err != nil {
+		return
+	}
+
+	li.Key = k.Secret
+	return
+}
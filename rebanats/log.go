@@ -19,10 +19,16 @@ const (
 	logcrit   string = "critical"
 )
 
+// LogInfo is created for every request rebana sends, a session is
+// activated or deactivated under it
 type LogInfo struct {
 	Src   string
 	Uid   int64
 	Msgid int64
+
+	// key the response is signed with, set when the request was signed
+	// with a keyring key instead of the service secret
+	Key string
 }
 
 type RebanaTSLog struct {
@@ -40,14 +46,15 @@ type RebanaTSLog struct {
 var (
 	debug bool
 	logfp *os.File
-	li    *LogInfo
 )
 
+// sli covers startup, signals, keyring reloads and the server info reported
+// to rebana
+var sli = &LogInfo{Src: "::1"}
+
 func setupLog(d bool) (err error) {
 	debug = d
 
-	li = &LogInfo{"::1", 0, 0}
-
 	if debug {
 		logfp = os.Stderr
 		fmt.Fprintf(logfp, "Debugging enabled - redirect to stderr\n")
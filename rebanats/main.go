@@ -16,6 +16,7 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -26,6 +27,7 @@ type RequestMsg struct {
 	MsgId   int64
 	Command string
 	Data    string
+	Nonce   string
 }
 
 type Msg struct {
@@ -39,6 +41,7 @@ type RebanaRequestMsg struct {
 	UserId  int64
 	Command string
 	Data    string
+	Nonce   string
 }
 
 type RebanaMsg struct {
@@ -74,9 +77,20 @@ type Session struct {
 	Idx int64
 }
 
+// BindInfo is a listening address, served over TLS when TLSCert and TLSKey
+// are set. With TLSClientCA only clients holding a certificate issued by
+// that CA are accepted.
 type BindInfo struct {
 	Host string
 	Port string
+
+	TLSCert     string
+	TLSKey      string
+	TLSClientCA string
+
+	// names the client certificates have to be issued to, any client
+	// the CA issued a certificate to may connect when empty
+	TLSClientNames []string
 }
 
 type AppConfig struct {
@@ -92,30 +106,55 @@ type AppConfig struct {
 	Secret    string
 	TLSCACert []string `json:"TLSCACert"`
 
+	// certificate presented to services that require mutual TLS
+	TLSClientCert string
+	TLSClientKey  string
+
+	// seconds a request Date may lie either side of the local clock, also
+	// how long request nonces are remembered for
+	ClockSkew int64
+
+	// most live nonces kept, requests are refused with EAGAIN beyond it
+	NonceCacheSize int
+
+	// canonical only accepts canonical request signatures, transition also
+	// accepts the legacy body signature while clients are upgraded. The
+	// default becomes canonical on 2027-04-01, set transition explicitly
+	// to keep legacy clients working past it.
+	SignatureMode string
+
+	// JSON list of signing keys, reread whenever it changes
+	KeyFile string
+
 	SvInfo *ServerInfo
 }
 
 type AppStat struct {
-	HostName         string
-	ReqAll           int64
-	ReqActivate      int64
-	ReqDeactivate    int64
-	ReqCheck         int64
-	ReqStatus        int64
-	ReqError         int64
-	ReqErrUrl        int64
-	ReqErrHeader     int64
-	ReqErrPayload    int64
-	ReqErrSignature  int64
-	ReqErrServerId   int64
-	ReqErrUserId     int64
-	ReqErrMsgId      int64
-	ReqErrCommand    int64
-	ReqErrData       int64
-	ReqErrActivate   int64
-	ReqErrDeactivate int64
-	ReqErrCheck      int64
-	ReqErrStatus     int64
+	HostName           string
+	ReqAll             int64
+	ReqActivate        int64
+	ReqDeactivate      int64
+	ReqCheck           int64
+	ReqStatus          int64
+	ReqLegacySignature int64
+	ReqError           int64
+	ReqErrUrl          int64
+	ReqErrHeader       int64
+	ReqErrPayload      int64
+	ReqErrSignature    int64
+	ReqErrKeyId        int64
+	ReqErrReplay       int64
+	ReqErrExpired      int64
+	ReqErrFuture       int64
+	ReqErrServerId     int64
+	ReqErrUserId       int64
+	ReqErrMsgId        int64
+	ReqErrCommand      int64
+	ReqErrData         int64
+	ReqErrActivate     int64
+	ReqErrDeactivate   int64
+	ReqErrCheck        int64
+	ReqErrStatus       int64
 }
 
 const (
@@ -124,40 +163,56 @@ const (
 	PIDFILE  = "/var/run/rebanats.pid"
 	CONFFILE = "/usr/local/etc/rebanats.json"
 
+	// canonical request signature scheme
+	SIGALG = "N3-HMAC-SHA256"
+
 	// error codes
 	EOK    = 0
 	EINVAL = 1
 	EAGAIN = 2
 	ENOENT = 3
+
+	// shared with ghazal, which uses 5 for password policy failures
+	EREPLAY = 6
 )
 
 var (
 	app  *AppConfig
 	stat *AppStat
 	tlsc *tls.Config
+
+	// statLock guards the counters of stat, which concurrent handlers
+	// bump through incStat
+	statLock sync.Mutex
 )
 
-func activate(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqActivate++
+func incStat(c *int64) {
+	statLock.Lock()
+	*c++
+	statLock.Unlock()
+}
+
+func activate(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqActivate)
 
 	var m *IdList
 
 	if m, err = getIdList(d.Data, d.Command); err != nil {
-		stat.ReqErrActivate++
+		incStat(&stat.ReqErrActivate)
 		return
 	}
 
 	var e = m.Entry[0]
 
 	if e.Id == 0 {
-		stat.ReqErrActivate++
+		incStat(&stat.ReqErrActivate)
 		return
 	}
 
 	var ipf int
 
 	if ipf, err = checkIPFamily(e.Opt); ipf != 4 {
-		stat.ReqErrActivate++
+		incStat(&stat.ReqErrActivate)
 		return
 	}
 
@@ -181,7 +236,7 @@ func activate(w http.ResponseWriter, d *RequestMsg) (err error) {
 
 	var si []Id
 
-	if err = activateSession(s); err != nil {
+	if err = activateSession(li, s); err != nil {
 		si = []Id{Id{ErrNo: EINVAL}}
 		event(logwarn, li, err.Error())
 	} else {
@@ -190,31 +245,31 @@ func activate(w http.ResponseWriter, d *RequestMsg) (err error) {
 
 	var buf, _ = json.Marshal(&IdList{Entry: si})
 
-	sendResponse(w, &Msg{Data: string(buf)})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return nil
 }
 
-func deactivate(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqDeactivate++
+func deactivate(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqDeactivate)
 
 	var m *IdList
 
 	if m, err = getIdList(d.Data, d.Command); err != nil {
-		stat.ReqErrDeactivate++
+		incStat(&stat.ReqErrDeactivate)
 		return
 	}
 
 	var e = m.Entry[0]
 
 	if e.Id == 0 {
-		stat.ReqErrDeactivate++
+		incStat(&stat.ReqErrDeactivate)
 		return
 	}
 
 	var ipf int
 
 	if ipf, err = checkIPFamily(e.Opt); ipf != 4 {
-		stat.ReqErrDeactivate++
+		incStat(&stat.ReqErrDeactivate)
 		return
 	}
 
@@ -238,7 +293,7 @@ func deactivate(w http.ResponseWriter, d *RequestMsg) (err error) {
 
 	var si []Id
 
-	if err = deactivateSession(s); err != nil {
+	if err = deactivateSession(li, s); err != nil {
 		si = []Id{Id{ErrNo: EINVAL}}
 		event(logwarn, li, err.Error())
 	} else {
@@ -247,31 +302,31 @@ func deactivate(w http.ResponseWriter, d *RequestMsg) (err error) {
 
 	var buf, _ = json.Marshal(&IdList{Entry: si})
 
-	sendResponse(w, &Msg{Data: string(buf)})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return nil
 }
 
-func check(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqCheck++
+func check(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqCheck)
 
 	var m *IdList
 
 	if m, err = getIdList(d.Data, d.Command); err != nil {
-		stat.ReqErrCheck++
+		incStat(&stat.ReqErrCheck)
 		return
 	}
 
 	var e = m.Entry[0]
 
 	if e.Id == 0 {
-		stat.ReqErrCheck++
+		incStat(&stat.ReqErrCheck)
 		return
 	}
 
 	var ipf int
 
 	if ipf, err = checkIPFamily(e.Opt); ipf != 4 {
-		stat.ReqErrCheck++
+		incStat(&stat.ReqErrCheck)
 		return
 	}
 
@@ -300,22 +355,34 @@ func check(w http.ResponseWriter, d *RequestMsg) (err error) {
 
 	var buf, _ = json.Marshal(&IdList{Entry: si})
 
-	sendResponse(w, &Msg{Data: string(buf)})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return nil
 }
 
-func status(w http.ResponseWriter, d *RequestMsg) (err error) {
-	stat.ReqStatus++
+func status(w http.ResponseWriter, li *LogInfo, d *RequestMsg) (err error) {
+	incStat(&stat.ReqStatus)
+
+	// copied under the lock so the counters are from a single moment
+	statLock.Lock()
+	var s = *stat
+	statLock.Unlock()
 
-	var buf, _ = json.Marshal(&stat)
+	var buf, _ = json.Marshal(&s)
 
-	sendResponse(w, &Msg{Data: string(buf)})
+	sendResponse(w, li, &Msg{Data: string(buf)})
 	return
 }
 
 func serverInfo() (err error) {
+	var now = time.Now()
+	var nonce string
+
+	if nonce, err = newNonce(now); err != nil {
+		return
+	}
+
 	var data = &RebanaRequestMsg{UserId: 102, Command: "server-info",
-		Data: app.HostName}
+		Data: app.HostName, Nonce: nonce}
 	var buf, _ = json.Marshal(data)
 
 	var url = app.RebanaUrl + "/v/info"
@@ -333,16 +400,25 @@ func serverInfo() (err error) {
 		return
 	}
 
-	req.Header.Add("Date", time.Now().In(loc).Format(time.RFC1123))
+	req.Header.Add("Date", now.In(loc).Format(time.RFC1123))
 	req.Header.Add("Accept", "application/json")
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("X-N3-Service-Name", "rebana")
 	req.Header.Add("X-N3-Tunnel-Server", app.HostName)
-	req.Header.Add("X-N3-Signature", signRequest(buf, 0))
+	req.Header.Add("X-N3-Caller", app.HostName)
+
+	var secret = app.Secret
+
+	if k := keyring.pick("rebana", app.HostName); k != nil {
+		secret = k.Secret
+		req.Header.Add("X-N3-Key-Id", k.Id)
+	}
+
+	req.Header.Add("X-N3-Signature", signCanonicalRequest(req, buf, secret))
 
 	var c = &http.Client{}
 
-	c.Transport = &http.Transport{TLSClientConfig: tlsc}
+	c.Transport = &http.Transport{TLSClientConfig: getTLSClientConfig()}
 
 	var res *http.Response
 
@@ -367,8 +443,8 @@ func serverInfo() (err error) {
 
 	buf, _ = json.Marshal(msg)
 
-	if err = checkSignature(sig, buf); err != nil {
-		stat.ReqErrSignature++
+	if err = checkKeySignature(sig, buf, secret); err != nil {
+		incStat(&stat.ReqErrSignature)
 		return
 	}
 
@@ -416,7 +492,7 @@ func serverInfo() (err error) {
 
 	var ts = t.In(time.Local).Format(time.RFC1123)
 
-	event(logdebug, li, "Server information retrieved: "+
+	event(logdebug, sli, "Server information retrieved: "+
 		"[Timestamp: %v, Server name: %v[%v], "+
 		"Tunnel source address: %v, "+
 		"Tunnel point-to-point prefix: %v, "+
@@ -427,28 +503,29 @@ func serverInfo() (err error) {
 }
 
 func defaultHandler(w http.ResponseWriter, r *http.Request) {
-	stat.ReqAll++
+	incStat(&stat.ReqAll)
 
+	var li = &LogInfo{}
 	var err error
 	var str = "Invalid request"
 
-	if err = checkUrl(r); err != nil {
-		stat.ReqErrHeader++
-		sendError(w, EINVAL, str, err)
+	if err = checkUrl(li, r); err != nil {
+		incStat(&stat.ReqErrHeader)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
 	if err = checkHeader(r); err != nil {
-		stat.ReqErrHeader++
-		sendError(w, EINVAL, str, err)
+		incStat(&stat.ReqErrHeader)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
 	var d *RequestMsg
 
-	if d, err = checkData(r); err != nil {
-		stat.ReqErrPayload++
-		sendError(w, EINVAL, str, err)
+	if d, err = checkData(li, r); err != nil {
+		incStat(&stat.ReqErrPayload)
+		sendError(w, li, getDataErrNo(err), str, err)
 		return
 	}
 
@@ -456,21 +533,21 @@ func defaultHandler(w http.ResponseWriter, r *http.Request) {
 
 	switch d.Command {
 	case "activate":
-		err = activate(w, d)
+		err = activate(w, li, d)
 
 	case "deactivate":
-		err = deactivate(w, d)
+		err = deactivate(w, li, d)
 
 	case "check":
-		err = check(w, d)
+		err = check(w, li, d)
 
 	case "status":
-		err = status(w, d)
+		err = status(w, li, d)
 	}
 
 	if err != nil {
 		str += ": " + d.Command
-		sendError(w, EINVAL, str, err)
+		sendError(w, li, EINVAL, str, err)
 		return
 	}
 
@@ -506,8 +583,8 @@ func main() {
 
 	go sigHandler()
 
-	event(loginfo, li, "%v-%v server started: %v", app.ProgName, app.Version,
-		app.HostName)
+	event(loginfo, sli, "%v-%v server started: %v", app.ProgName,
+		app.Version, app.HostName)
 
 	if err = setupServer(); err != nil {
 		fatal(err.Error())
@@ -531,24 +608,25 @@ func sigHandler() {
 
 	var c = make(chan os.Signal, 1)
 
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-
-	var signal = <-c
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-	event(lognotice, li, "Signal received: "+signal.String())
+	for signal := range c {
+		event(lognotice, sli, "Signal received: "+signal.String())
 
-	switch signal {
-	case syscall.SIGINT, syscall.SIGTERM:
-		quit = true
-	}
+		switch signal {
+		case syscall.SIGHUP:
+			reloadTLS()
+		case syscall.SIGINT, syscall.SIGTERM:
+			quit = true
+		}
 
-	if quit {
-		event(lognotice, li, "Terminating..")
+		if quit {
+			event(lognotice, sli, "Terminating..")
 
-		os.Remove(PIDFILE)
-		os.Exit(0)
+			os.Remove(PIDFILE)
+			os.Exit(0)
+		}
 	}
-
 }
 
 func usage() {
@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// nonceCache remembers request nonces until they expire. A nonce is only
+// dropped once expired, when the cache is full of live ones new requests are
+// refused. The tunnel server has no Redis to share them with, each instance
+// keeps its own.
+type nonceCache struct {
+	sync.Mutex
+
+	max   int
+	order *list.List
+	seen  map[string]*list.Element
+}
+
+type nonceEntry struct {
+	nonce  string
+	expire time.Time
+}
+
+var nonces *nonceCache
+
+func newNonceCache(max int) *nonceCache {
+	return &nonceCache{max: max, order: list.New(),
+		seen: make(map[string]*list.Element)}
+}
+
+// add records a nonce for ttl, it returns a ReplayError if the nonce is
+// already known and has not expired and a NonceFullError if there is no
+// room for it
+func (c *nonceCache) add(n string, ttl time.Duration) (err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	var now = time.Now()
+
+	// entries are kept in the order they were added, with a single ttl
+	// the expired ones gather at the back
+	for e := c.order.Back(); e != nil; e = c.order.Back() {
+		var v = e.Value.(*nonceEntry)
+
+		if now.Before(v.expire) {
+			break
+		}
+
+		c.order.Remove(e)
+		delete(c.seen, v.nonce)
+	}
+
+	if e, ok := c.seen[n]; ok {
+		if now.Before(e.Value.(*nonceEntry).expire) {
+			return &ReplayError{Nonce: n}
+		}
+
+		c.order.Remove(e)
+		delete(c.seen, n)
+	}
+
+	// evicting a live nonce would let its request be replayed
+	if c.order.Len() >= c.max {
+		return &NonceFullError{}
+	}
+
+	c.seen[n] = c.order.PushFront(&nonceEntry{nonce: n,
+		expire: now.Add(ttl)})
+	return
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2013 Ihsan Junaidi Ibrahim <ihsan.junaidi@gmail.com>
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNonceCache(t *testing.T) {
+	var c = newNonceCache(3)
+	var live = time.Minute
+	var short = 50 * time.Millisecond
+
+	// each step adds a nonce, after a pause when wait is set
+	var tests = []struct {
+		nonce string
+		ttl   time.Duration
+		wait  bool
+		err   error
+	}{
+		{"a", short, false, nil},
+		{"a", short, false, &ReplayError{}},
+		{"b", live, false, nil},
+		{"c", live, false, nil},
+		{"d", live, false, &NonceFullError{}},
+		{"b", live, false, &ReplayError{}},
+		// a has expired, its place is free and it may be used again
+		{"a", live, true, nil},
+		{"d", live, false, &NonceFullError{}},
+		{"b", live, false, &ReplayError{}},
+		{"c", live, false, &ReplayError{}},
+		{"a", live, false, &ReplayError{}},
+	}
+
+	for i, v := range tests {
+		if v.wait {
+			time.Sleep(2 * short)
+		}
+
+		var err = c.add(v.nonce, v.ttl)
+
+		switch v.err.(type) {
+		case nil:
+			if err != nil {
+				t.Errorf("step %v: %v: %v", i, v.nonce, err)
+			}
+
+		case *ReplayError:
+			if _, ok := err.(*ReplayError); !ok {
+				t.Errorf("step %v: %v: got %v, want a replay",
+					i, v.nonce, err)
+			}
+
+		case *NonceFullError:
+			if _, ok := err.(*NonceFullError); !ok {
+				t.Errorf("step %v: %v: got %v, want a full "+
+					"cache", i, v.nonce, err)
+			}
+		}
+	}
+
+	if c.order.Len() != len(c.seen) {
+		t.Errorf("%v nonces listed, %v known", c.order.Len(),
+			len(c.seen))
+	}
+}
+
+func TestNonceCacheExpiry(t *testing.T) {
+	var c = newNonceCache(2)
+
+	c.add("a", 50*time.Millisecond)
+	c.add("b", 50*time.Millisecond)
+
+	time.Sleep(100 * time.Millisecond)
+
+	// expired nonces make room however many there are
+	for _, n := range []string{"c", "d"} {
+		if err := c.add(n, time.Minute); err != nil {
+			t.Errorf("%v: %v", n, err)
+		}
+	}
+
+	if _, ok := c.seen["a"]; ok {
+		t.Errorf("expired nonce kept")
+	}
+}
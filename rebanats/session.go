@@ -41,7 +41,7 @@ type PingReq struct {
 	Dst6 *net.UDPAddr
 }
 
-func activateSession(s *CSession) (err error) {
+func activateSession(li *LogInfo, s *CSession) (err error) {
 	var cs = C.struct_session{
 		ifname:  C.CString(s.Ifname),
 		tunaddr: C.CString(s.TunAddr),
@@ -79,7 +79,7 @@ func activateSession(s *CSession) (err error) {
 	return
 }
 
-func deactivateSession(s *CSession) (err error) {
+func deactivateSession(li *LogInfo, s *CSession) (err error) {
 	var cs = C.struct_session{
 		ifname:  C.CString(s.Ifname),
 		tunaddr: C.CString(s.TunAddr),
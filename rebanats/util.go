@@ -6,10 +6,12 @@ package main
 
 import (
 	"crypto/hmac"
+	crand "crypto/rand"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
@@ -18,6 +20,8 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -57,6 +61,34 @@ func parseConfig(f string) (err error) {
 		fatal("Secret is empty")
 	}
 
+	if app.ClockSkew == 0 {
+		app.ClockSkew = 10
+	}
+
+	if app.NonceCacheSize == 0 {
+		app.NonceCacheSize = 10000
+	}
+
+	nonces = newNonceCache(app.NonceCacheSize)
+
+	if app.KeyFile != "" {
+		if _, err = os.Stat(app.KeyFile); err != nil {
+			fatal("Signing key file not found: %v", app.KeyFile)
+		}
+	}
+
+	keyring = newKeyRing(app.KeyFile)
+
+	// legacy clients have until 2027-04-01, the default is canonical after
+	if app.SignatureMode == "" {
+		app.SignatureMode = "transition"
+	}
+
+	if app.SignatureMode != "transition" &&
+		app.SignatureMode != "canonical" {
+		fatal("Invalid signature mode: %v", app.SignatureMode)
+	}
+
 	if len(app.TLSCACert) == 0 {
 		fatal("Invalid TLS CA cert parameters")
 	} else {
@@ -75,18 +107,18 @@ func getIdList(s string, c string) (d *IdList, err error) {
 	d = &IdList{}
 
 	if err = json.Unmarshal([]byte(s), d); err != nil {
-		stat.ReqErrData++
+		incStat(&stat.ReqErrData)
 		return nil, errors.New("Error unmarshaling IdList struct")
 	}
 
 	if d.Id != 0 {
 		if c == "activate" || c == "deactivate" || c == "check" {
 			if err = checkServerId(d.Id); err != nil {
-				stat.ReqErrServerId++
+				incStat(&stat.ReqErrServerId)
 				return
 			}
 		} else {
-			stat.ReqErrServerId++
+			incStat(&stat.ReqErrServerId)
 			return d, errors.New("Invalid tunnel server ID for " + c)
 		}
 	}
@@ -94,8 +126,12 @@ func getIdList(s string, c string) (d *IdList, err error) {
 	return
 }
 
-func signRequest(m []byte, id int64) string {
-	var dgst = hmac.New(sha256.New, []byte(app.Secret))
+func signRequest(m []byte, key string) string {
+	if key == "" {
+		key = app.Secret
+	}
+
+	var dgst = hmac.New(sha256.New, []byte(key))
 
 	dgst.Write(m)
 
@@ -103,7 +139,11 @@ func signRequest(m []byte, id int64) string {
 }
 
 func checkSignature(sig string, m []byte) (err error) {
-	var dgst = hmac.New(sha256.New, []byte(app.Secret))
+	return checkKeySignature(sig, m, app.Secret)
+}
+
+func checkKeySignature(sig string, m []byte, key string) (err error) {
+	var dgst = hmac.New(sha256.New, []byte(key))
 
 	dgst.Write(m)
 
@@ -120,15 +160,207 @@ func checkSignature(sig string, m []byte) (err error) {
 	return
 }
 
+// getSignedHeaders lists the headers a canonical signature has to cover,
+// Content-Type, Date and every X-N3 header save the signature itself
+func getSignedHeaders(h http.Header) []string {
+	var l = []string{"content-type", "date"}
+
+	for k := range h {
+		k = strings.ToLower(k)
+
+		if strings.HasPrefix(k, "x-n3-") && k != "x-n3-signature" {
+			l = append(l, k)
+		}
+	}
+
+	sort.Strings(l)
+	return l
+}
+
+// getCanonicalSignature signs the method, path, signed headers and body
+// digest of a request, hashed into a string to sign alongside its Date
+func getCanonicalSignature(r *http.Request, signed []string, body []byte,
+	key string) []byte {
+	var b = sha256.Sum256(body)
+	var c = r.Method + "\n" + r.URL.Path + "\n" + r.URL.RawQuery + "\n"
+
+	for _, k := range signed {
+		var v = r.Header[http.CanonicalHeaderKey(k)]
+
+		c += k + ":" + strings.TrimSpace(strings.Join(v, ",")) + "\n"
+	}
+
+	c += "\n" + strings.Join(signed, ";") + "\n" + hex.EncodeToString(b[:])
+
+	var d = sha256.Sum256([]byte(c))
+	var s = SIGALG + "\n" + r.Header.Get("Date") + "\n" +
+		hex.EncodeToString(d[:])
+	var dgst = hmac.New(sha256.New, []byte(key))
+
+	dgst.Write([]byte(s))
+
+	return dgst.Sum(nil)
+}
+
+// signCanonicalRequest returns the X-N3-Signature header of req, every
+// other header has to be set before it is signed
+func signCanonicalRequest(req *http.Request, body []byte, key string) string {
+	var l = getSignedHeaders(req.Header)
+	var s = getCanonicalSignature(req, l, body, key)
+
+	return fmt.Sprintf("%v SignedHeaders=%v,Signature=%v", SIGALG,
+		strings.Join(l, ";"), base64.StdEncoding.EncodeToString(s))
+}
+
+// checkRequestSignature verifies the canonical signature of a request, the
+// legacy signature of the body alone is accepted in transition mode
+func checkRequestSignature(r *http.Request, sig string, body []byte,
+	key string) (err error) {
+	if !strings.HasPrefix(sig, SIGALG+" ") {
+		if app.SignatureMode != "transition" {
+			return errors.New("Legacy signature not accepted")
+		}
+
+		if err = checkKeySignature(sig, body, key); err == nil {
+			incStat(&stat.ReqLegacySignature)
+		}
+
+		return
+	}
+
+	var signed []string
+	var str string
+
+	for _, v := range strings.Split(sig[len(SIGALG)+1:], ",") {
+		v = strings.TrimSpace(v)
+
+		if strings.HasPrefix(v, "SignedHeaders=") {
+			signed = strings.Split(v[len("SignedHeaders="):], ";")
+		} else if strings.HasPrefix(v, "Signature=") {
+			str = v[len("Signature="):]
+		}
+	}
+
+	var m = make(map[string]bool)
+
+	for _, v := range signed {
+		m[v] = true
+	}
+
+	for _, v := range getSignedHeaders(r.Header) {
+		if !m[v] {
+			return errors.New("Header not signed: " + v)
+		}
+	}
+
+	var s []byte
+
+	if s, err = base64.StdEncoding.DecodeString(str); err != nil {
+		return errors.New("Error decoding signature string")
+	}
+
+	if !hmac.Equal(s, getCanonicalSignature(r, signed, body, key)) {
+		return errors.New("Message signature does not match")
+	}
+
+	return
+}
+
+// checkMsgExpiry rejects a message dated outside the allowed clock skew, a
+// date ahead of the local clock is reported apart from an expired one
 func checkMsgExpiry(t time.Time) (err error) {
-	if time.Now().Sub(t).Seconds() > 10.0 {
+	var d = time.Now().Sub(t).Seconds()
+
+	if d > float64(app.ClockSkew) {
+		incStat(&stat.ReqErrExpired)
 		return errors.New("Message has expired")
 	}
 
+	if -d > float64(app.ClockSkew) {
+		incStat(&stat.ReqErrFuture)
+		return errors.New("Message is dated in the future")
+	}
+
 	return
 }
 
-func checkUrl(r *http.Request) (err error) {
+// ReplayError reports a request nonce seen before within the clock skew
+// window
+type ReplayError struct {
+	Nonce string
+}
+
+func (e *ReplayError) Error() string {
+	return "Message nonce has been used: " + e.Nonce
+}
+
+// NonceFullError reports a nonce cache full of nonces that have yet to
+// expire, the request can be retried once some do
+type NonceFullError struct{}
+
+func (e *NonceFullError) Error() string {
+	return "Nonce cache is full"
+}
+
+// newNonce returns a request nonce for a request dated t, the receiving
+// service rejects a nonce it has already seen
+func newNonce(t time.Time) (n string, err error) {
+	var p = make([]byte, 12)
+
+	if _, err = crand.Read(p); err != nil {
+		return
+	}
+
+	return fmt.Sprintf("%v.%v", t.Unix(),
+		base64.URLEncoding.EncodeToString(p)), nil
+}
+
+// checkNonce rejects a request whose nonce is malformed or already used.
+// Nonces are [unix time].[random], the time has to match the Date header so
+// a captured request cannot be replayed later under a fresh date.
+func checkNonce(n string, t time.Time) (err error) {
+	if n == "" {
+		return errors.New("Missing message nonce")
+	}
+
+	var p = strings.Split(n, ".")
+
+	if len(p) != 2 || p[1] == "" {
+		return errors.New("Invalid message nonce: " + n)
+	}
+
+	if ts, _ := strconv.ParseInt(p[0], 0, 64); ts != t.Unix() {
+		return errors.New("Message nonce does not match Date header")
+	}
+
+	// a nonce is kept for both sides of the window it can be accepted in
+	var ttl = time.Duration(2*app.ClockSkew) * time.Second
+
+	if err = nonces.add(n, ttl); err != nil {
+		if _, ok := err.(*ReplayError); ok {
+			incStat(&stat.ReqErrReplay)
+		}
+
+		return
+	}
+
+	return
+}
+
+// getDataErrNo returns the result code for a checkData failure
+func getDataErrNo(err error) int {
+	if _, ok := err.(*ReplayError); ok {
+		return EREPLAY
+	}
+
+	if _, ok := err.(*NonceFullError); ok {
+		return EAGAIN
+	}
+
+	return EINVAL
+}
+
+func checkUrl(li *LogInfo, r *http.Request) (err error) {
 	var p = r.URL.Path[1:]
 
 	switch p {
@@ -168,37 +400,67 @@ func checkHeader(r *http.Request) (err error) {
 	return
 }
 
-func checkData(r *http.Request) (d *RequestMsg, err error) {
-	if err = json.NewDecoder(r.Body).Decode(&d); err != nil {
+func checkData(li *LogInfo, r *http.Request) (d *RequestMsg, err error) {
+	var body []byte
+
+	if body, err = ioutil.ReadAll(r.Body); err != nil {
+		return d, errors.New("Error reading request body")
+	}
+
+	if err = json.Unmarshal(body, &d); err != nil {
 		return d, errors.New("Invalid JSON payload")
 	}
 
-	var t, _ = time.Parse(time.RFC1123, r.Header.Get("Date"))
+	var h = r.Header.Get("Date")
+
+	if h == "" {
+		return d, errors.New("Missing Date header")
+	}
+
+	var t time.Time
+
+	if t, err = time.Parse(time.RFC1123, h); err != nil {
+		return d, errors.New("Invalid Date header: " + h)
+	}
 
 	if err = checkMsgExpiry(t); err != nil {
 		return
 	}
 
 	var sig = r.Header.Get("X-N3-Signature")
-	var buf, _ = json.Marshal(d)
 
-	if err = checkSignature(sig, buf); err != nil {
-		stat.ReqErrSignature++
+	if kid := r.Header.Get("X-N3-Key-Id"); kid != "" {
+		if err = checkKeyId(li, r, kid, sig, body); err != nil {
+			incStat(&stat.ReqErrKeyId)
+			return
+		}
+	} else if err = checkRequestSignature(r, sig, body,
+		app.Secret); err != nil {
+		incStat(&stat.ReqErrSignature)
 		return
 	}
 
+	// only a signed nonce is remembered, so forged requests cannot use
+	// up a legitimate one. Legacy clients send none, their requests are
+	// only bounded by the Date window until transition mode is retired.
+	if strings.HasPrefix(sig, SIGALG+" ") {
+		if err = checkNonce(d.Nonce, t); err != nil {
+			return
+		}
+	}
+
 	if err = checkServerId(d.Id); err != nil {
-		stat.ReqErrServerId++
+		incStat(&stat.ReqErrServerId)
 		return
 	}
 
 	if err = checkCommand(d.Command, r.RemoteAddr); err != nil {
-		stat.ReqErrCommand++
+		incStat(&stat.ReqErrCommand)
 		return
 	}
 
 	if d.UserId == 0 {
-		stat.ReqErrUserId++
+		incStat(&stat.ReqErrUserId)
 		return d, errors.New("Invalid user ID")
 	}
 
@@ -274,13 +536,13 @@ func checkIPFamily(s string) (f int, err error) {
 	return f, errors.New("Invalid IP address: " + s)
 }
 
-func sendResponse(w http.ResponseWriter, m *Msg) {
+func sendResponse(w http.ResponseWriter, li *LogInfo, m *Msg) {
 	var data = &Msg{Id: app.SvInfo.Id, MsgId: li.Msgid, Data: m.Data}
 	var buf, _ = json.Marshal(data)
 
 	w.Header().Add("Content-Type", "application/json")
 	w.Header().Add("X-N3-Service-Name", "rebana")
-	w.Header().Add("X-N3-Signature", signRequest(buf, data.MsgId))
+	w.Header().Add("X-N3-Signature", signRequest(buf, li.Key))
 
 	fmt.Fprintf(w, "%s", buf)
 
@@ -289,9 +551,10 @@ func sendResponse(w http.ResponseWriter, m *Msg) {
 		li.Msgid, m.ErrNo)
 }
 
-func sendError(w http.ResponseWriter, errno int, estr string, err error) {
+func sendError(w http.ResponseWriter, li *LogInfo, errno int, estr string,
+	err error) {
 	event(logwarn, li, err.Error())
-	stat.ReqError++
+	incStat(&stat.ReqError)
 
 	var data = &Msg{Id: app.SvInfo.Id, MsgId: li.Msgid, ErrNo: errno,
 		Data: estr}
@@ -299,7 +562,7 @@ func sendError(w http.ResponseWriter, errno int, estr string, err error) {
 
 	w.Header().Add("Content-Type", "application/json")
 	w.Header().Add("X-N3-Service-Name", "rebana")
-	w.Header().Add("X-N3-Signature", signRequest(buf, data.MsgId))
+	w.Header().Add("X-N3-Signature", signRequest(buf, li.Key))
 
 	fmt.Fprintf(w, "%s", buf)
 
@@ -312,10 +575,14 @@ func setupServer() (err error) {
 	http.HandleFunc("/", defaultHandler)
 
 	for i := range app.Bind {
-		var b = net.JoinHostPort(app.Bind[i].Host, app.Bind[i].Port)
+		var ln net.Listener
 
-		go http.ListenAndServe(b, nil)
-		event(loginfo, li, "Listening on %v", b)
+		if ln, err = getListener(&app.Bind[i]); err != nil {
+			return
+		}
+
+		go http.Serve(ln, nil)
+		event(loginfo, sli, "Listening on %v", ln.Addr())
 	}
 
 	if tlsc, err = setTLSConfig(); err != nil {
@@ -353,5 +620,17 @@ func setTLSConfig() (p *tls.Config, err error) {
 	}
 
 	p = &tls.Config{RootCAs: opts.Roots}
+
+	if app.TLSClientCert != "" {
+		var c tls.Certificate
+
+		if c, err = tls.LoadX509KeyPair(app.TLSClientCert,
+			app.TLSClientKey); err != nil {
+			return p, errors.New("Error loading TLS client cert")
+		}
+
+		p.Certificates = []tls.Certificate{c}
+	}
+
 	return
 }